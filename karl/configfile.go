@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kong"
+)
+
+// configFile holds the values of a config file (--config) by the names of
+// their flags in snake case (e.g. out_dir). Values are scalars, or maps
+// of scalars (e.g. cookies per host).
+type configFile map[string]any
+
+var _ kong.Resolver = configFile(nil)
+
+// loadConfigFile loads a YAML config file, of the subset needed for
+// flags: top-level scalars, and maps of scalars indented beneath keys.
+func loadConfigFile(r io.Reader) (kong.Resolver, error) {
+	var (
+		cf      = make(configFile)
+		current map[string]any
+		scanner = bufio.NewScanner(r)
+	)
+	for n := 1; scanner.Scan(); n++ {
+		line := stripComment(scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		indented := line[0] == ' ' || line[0] == '\t'
+		key, value, err := parseConfigLine(strings.TrimSpace(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		switch {
+		case indented && current == nil:
+			return nil, fmt.Errorf("line %d: unexpected indentation", n)
+		case indented:
+			if value == nil {
+				return nil, fmt.Errorf("line %d: nested too deep or missing value of %q", n, key)
+			}
+			current[key] = value
+		case value == nil:
+			current = make(map[string]any)
+			cf[key] = current
+		default:
+			current = nil
+			cf[key] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return cf, nil
+}
+
+// parseConfigLine parses a "key: value" line, of a map if no (nil)
+// value. Keys and values may be quoted. Unquoted values are typed as
+// by YAML: integers, floats, true and false, or else strings.
+func parseConfigLine(line string) (key string, value any, err error) {
+	key, rest, err := cutConfigScalar(line, ':')
+	if err != nil {
+		return "", nil, err
+	}
+	if rest == "" || rest[0] != ':' {
+		return "", nil, fmt.Errorf("missing colon after %q", key)
+	}
+	rest = strings.TrimSpace(rest[1:])
+	if rest == "" {
+		return key, nil, nil
+	}
+
+	quoted := rest[0] == '"' || rest[0] == '\''
+	s, rest, err := cutConfigScalar(rest, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	if rest != "" {
+		return "", nil, fmt.Errorf("unexpected %q after value of %q", rest, key)
+	}
+	if quoted {
+		return key, s, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return key, i, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return key, f, nil
+	}
+	if s == "true" || s == "false" {
+		return key, s == "true", nil
+	}
+	return key, s, nil
+}
+
+// cutConfigScalar cuts a (possibly quoted) scalar from the start of s,
+// ending at sep followed by a space or the end if unquoted, returning it
+// and the rest of s.
+func cutConfigScalar(s string, sep byte) (scalar, rest string, err error) {
+	switch s[0] {
+	case '"':
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return "", "", fmt.Errorf("unterminated quote in %q", s)
+		}
+		scalar, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return "", "", fmt.Errorf("invalid quoted %s: %w", s[:end+1], err)
+		}
+		return scalar, strings.TrimSpace(s[end+1:]), nil
+	case '\'':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				b.WriteByte(s[i])
+				continue
+			}
+			// A quote is escaped by doubling it.
+			if i+1 < len(s) && s[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+				continue
+			}
+			return b.String(), strings.TrimSpace(s[i+1:]), nil
+		}
+		return "", "", fmt.Errorf("unterminated quote in %q", s)
+	}
+
+	if sep == 0 {
+		return strings.TrimSpace(s), "", nil
+	}
+	// As by YAML, sep ends the scalar only if followed by a space or the
+	// end, e.g. not the colon of a host and port.
+	for i := 0; i < len(s); i++ {
+		if s[i] == sep && (i+1 == len(s) || s[i+1] == ' ' || s[i+1] == '\t') {
+			return strings.TrimSpace(s[:i]), s[i:], nil
+		}
+	}
+	return strings.TrimSpace(s), "", nil
+}
+
+// stripComment strips a comment (from # at the start or after a space,
+// outside quotes) from line.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Validate fails on keys of no flag, e.g. misspelled.
+func (cf configFile) Validate(app *kong.Application) error {
+	names := make(map[string]bool)
+	for _, node := range append(app.Leaves(false), app.Node) {
+		for _, group := range node.AllFlags(false) {
+			for _, flag := range group {
+				names[strings.ReplaceAll(flag.Name, "-", "_")] = true
+			}
+		}
+	}
+	for key := range cf {
+		if !names[key] || key == "config" {
+			return fmt.Errorf("config file: unknown key %q", key)
+		}
+	}
+	return nil
+}
+
+// Resolve returns the value of flag in the config file, unless set by
+// an environment variable, which takes precedence (as do flags, not
+// resolved).
+func (cf configFile) Resolve(_ *kong.Context, _ *kong.Path, flag *kong.Flag) (any, error) {
+	for _, env := range flag.Envs {
+		if _, ok := os.LookupEnv(env); ok {
+			return nil, nil
+		}
+	}
+	return cf[strings.ReplaceAll(flag.Name, "-", "_")], nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kong"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	const file = `# Flags of a crawl.
+out_dir: ./out   # relative to the working directory
+country_code: 'SE'
+verbose: true
+retries: 3
+note: "a # not a comment: \"quoted\""
+title: 'it''s'
+cookies:
+  www.example.com: "session=1; token=xyz123"
+  cdn.example.com:8443: 'a=b'
+  "api.example.com": auth=abc
+
+rate_limit:
+  api.example.com: 5
+`
+	r, err := loadConfigFile(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := configFile{
+		"out_dir":      "./out",
+		"country_code": "SE",
+		"verbose":      true,
+		"retries":      int64(3),
+		"note":         `a # not a comment: "quoted"`,
+		"title":        "it's",
+		"cookies": map[string]any{
+			"www.example.com":      "session=1; token=xyz123",
+			"cdn.example.com:8443": "a=b",
+			"api.example.com":      "auth=abc",
+		},
+		"rate_limit": map[string]any{"api.example.com": int64(5)},
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("loaded %#v, want %#v", r, want)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		file string
+		want string
+	}{
+		{"  out_dir: ./out\n", "line 1: unexpected indentation"},
+		{"cookies:\n  www.example.com:\n", `line 2: nested too deep or missing value of "www.example.com"`},
+		{"out_dir ./out\n", `line 1: missing colon after "out_dir ./out"`},
+		{"out_dir: \"./out\n", "line 1: unterminated quote"},
+		{"out_dir: './out' x\n", `line 1: unexpected "x" after value of "out_dir"`},
+	} {
+		_, err := loadConfigFile(strings.NewReader(tt.file))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: error %v, want %q", tt.file, err, tt.want)
+		}
+	}
+}
+
+// testCLI is of flags of the kinds loaded from config files.
+type testCLI struct {
+	Config      kong.ConfigFlag   `placeholder:"FILE"`
+	OutDir      string            `env:"TEST_OUT_DIR" default:"."`
+	CountryCode string            `env:"TEST_COUNTRY_CODE"`
+	Retries     int               `env:"TEST_RETRIES"`
+	Cookies     map[string]string `env:"TEST_COOKIES" mapsep:","`
+	RateLimit   map[string]int    `env:"TEST_RATE_LIMIT" mapsep:","`
+}
+
+func parseTestCLI(t *testing.T, file string, args ...string) (testCLI, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var cli testCLI
+	parser, err := kong.New(&cli, kong.Configuration(loadConfigFile, path))
+	if err != nil {
+		return cli, err
+	}
+	_, err = parser.Parse(args)
+	return cli, err
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	const file = "out_dir: ./file\ncountry_code: SE\nretries: 3\ncookies:\n  cdn.example.com:8443: a=b\nrate_limit:\n  api.example.com: 5\n"
+	t.Setenv("TEST_COUNTRY_CODE", "NO")
+	t.Setenv("TEST_RETRIES", "4")
+
+	cli, err := parseTestCLI(t, file, "--retries", "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flags over environment variables over the file.
+	if cli.OutDir != "./file" || cli.CountryCode != "NO" || cli.Retries != 5 {
+		t.Errorf("out dir %q, country %q, retries %d, want of the file, environment and flag", cli.OutDir, cli.CountryCode, cli.Retries)
+	}
+	if want := map[string]string{"cdn.example.com:8443": "a=b"}; !reflect.DeepEqual(cli.Cookies, want) {
+		t.Errorf("cookies %v, want %v", cli.Cookies, want)
+	}
+	if want := map[string]int{"api.example.com": 5}; !reflect.DeepEqual(cli.RateLimit, want) {
+		t.Errorf("rate limit %v, want %v", cli.RateLimit, want)
+	}
+}
+
+func TestConfigFileUnknownKey(t *testing.T) {
+	for _, file := range []string{"out_dri: ./out\n", "config: other.yaml\n"} {
+		_, err := parseTestCLI(t, file)
+		if err == nil || !strings.Contains(err.Error(), "config file: unknown key") {
+			t.Errorf("%q: error %v, want unknown key", file, err)
+		}
+	}
+}
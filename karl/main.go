@@ -2,17 +2,23 @@ package main
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/net/publicsuffix"
 	"golang.org/x/time/rate"
 	"karl/pkg/app"
 	"karl/pkg/config"
 	"karl/pkg/geolocate"
+	"karl/pkg/service"
 
 	"github.com/alecthomas/kong"
 	"github.com/joho/godotenv"
@@ -20,35 +26,150 @@ import (
 
 var CLI struct {
 	ExtractURLs struct {
-		Service string `arg:"" name:"service" help:"Service to extract URLs from"`
+		Service     string `arg:"" name:"service" help:"Service to extract URLs from"`
+		SVTCategory string `name:"svt-category" placeholder:"CATEGORY" help:"Extract only the URLs of titles in an SVT Play category (e.g. \"nyheter\"), rather than of all episodes"`
 	} `cmd:"" name:"extract-urls" help:"Extract all available URLs from service that may link to videos, shows or movies"`
 
 	Extract struct {
-		URLs   []string `arg:"" name:"url" help:"URLs to extract. URLs don't have to be from the same service."`
-		Format string   `enum:"dash,hls,both" default:"dash" placeholder:"FORMAT" help:"Limit fingerprinting to specific ABR format: \"dash\", \"hls\" or \"both\". Default is \"dash\""`
+		URLs             []string          `arg:"" name:"url" help:"URLs to extract. URLs don't have to be from the same service. IMDb (imdb:tt1234567) or TMDB (tmdb:movie/123, tmdb:tv/123) IDs are resolved to a service URL via JustWatch"`
+		Format           string            `enum:"dash,hls,both" default:"dash" placeholder:"FORMAT" help:"Limit fingerprinting to specific ABR format: \"dash\", \"hls\" or \"both\". Default is \"dash\""`
+		StreamThreshold  int               `env:"STREAM_THRESHOLD" placeholder:"NUM" help:"Write videos to output as they are fingerprinted, rather than all at once, for URLs with more than NUM videos. Reduces memory use for large series. Disabled if 0 (default)"`
+		TimeoutPerURL    time.Duration     `name:"timeout-per-url" env:"TIMEOUT_PER_URL" placeholder:"DURATION" help:"Abandon URLs not extracted within DURATION (e.g. 2m), reporting them as failed, so others proceed. Disabled if 0 (default)"`
+		Kinds            []string          `name:"kind" env:"KIND" placeholder:"KIND" help:"Limit fingerprinting to manifests of specific kinds, where provided by the service: \"main\", \"audio-desc\" or \"trailer\". Default is all"`
+		OutputFormat     string            `enum:"files,ndjson,single" default:"files" env:"OUTPUT_FORMAT" placeholder:"FORMAT" help:"Write results to a file per URL (\"files\"), or all to one file: one JSON result per line (\"ndjson\") or a JSON array of results (\"single\"). Videos are not streamed unless \"files\". Default is \"files\""`
+		Append           string            `placeholder:"FILE" env:"APPEND" help:"Add results to the existing FILE of --output-format \"ndjson\" or \"single\", rather than a new file of the run, leaving out videos (by service, ID and edit) already in it, to grow one output over runs. Created if it doesn't exist"`
+		NameBy           string            `enum:"index,id" default:"index" env:"NAME_BY" placeholder:"NAMING" help:"Name output files by \"index\" of the URL or stable \"id\" of the service and video or show, to keep names across runs with different URLs (those of the same ID in a run suffixed _2, _3, ...). Default is \"index\""`
+		Sort             string            `enum:"episode,none" default:"episode" env:"SORT" placeholder:"ORDER" help:"Order videos of a URL by season and episode (parsed from titles) and then ID, and their variants by bandwidth, for deterministic output (\"episode\"), or as completed (\"none\"). Streamed videos are written as completed. Default is \"episode\""`
+		AllEdits         bool              `name:"all-edits" env:"ALL_EDITS" help:"Max: extract every edit of videos (e.g. theatrical and extended cuts), each with its own manifest, as a video each labeled with its edit, rather than the one played by default"`
+		AmazonUnentitled bool              `name:"amazon-include-unentitled" env:"AMAZON_INCLUDE_UNENTITLED" help:"Amazon: extract titles not included with Prime (to rent or buy, or of channels), rather than failing them. They play if the account of --cookies is entitled, else fail per video as not entitled. The availability of videos is recorded either way"`
+		AmazonCodec      string            `name:"amazon-codec" enum:"H264,H265" default:"H264" env:"AMAZON_CODEC" placeholder:"CODEC" help:"Amazon: video codec to request playback of, \"H264\" or \"H265\" (HEVC). Default is \"H264\""`
+		AmazonQuality    string            `name:"amazon-quality" enum:"SD,HD,UHD" default:"HD" env:"AMAZON_QUALITY" placeholder:"QUALITY" help:"Amazon: video quality to request playback of, \"SD\", \"HD\" or \"UHD\", the latter usually with H265 and an entitled account. Default is \"HD\""`
+		AmazonDRM        string            `name:"amazon-drm" default:"CENC" env:"AMAZON_DRM" placeholder:"DRM" help:"Amazon: DRM scheme to request playback with, e.g. \"CENC\", \"Widevine\" or \"PlayReady\". Default is \"CENC\""`
+		AmazonDisplay    string            `name:"amazon-display" default:"3840x2160" env:"AMAZON_DISPLAY" placeholder:"WxH" help:"Amazon: display dimensions to request playback for, capping the resolutions of manifests. Default is 3840x2160"`
+		AmazonQuery      map[string]string `name:"amazon-query" mapsep:"," env:"AMAZON_QUERY" placeholder:"KEY=VALUE,..." help:"Amazon: parameters to add to playback requests, replacing those of the same name, e.g. deviceHdrFormatsOverride=Hdr10"`
+		AmazonUHDDevice  string            `name:"amazon-uhd-device-id" env:"AMAZON_UHD_DEVICE_ID" placeholder:"ID" help:"Amazon: device ID of the living room client UHD playback is requested as (--include-uhd), e.g. of a Fire TV registered to the account. Random per run if unset, as of a client newly installed"`
+		AmazonAllCDNs    bool              `name:"amazon-all-cdns" env:"AMAZON_ALL_CDNS" help:"Amazon: extract the manifest of every CDN offered (e.g. CloudFront and Akamai) rather than the default one, their variants labeled with the CDN, e.g. to compare CDNs. Multiplies the variants fingerprinted"`
+		AmazonEncodings  bool              `name:"amazon-both-encodings" env:"AMAZON_BOTH_ENCODINGS" help:"Amazon: extract the manifests of both the CVBR and CBR encodes, as of separate playback requests, their variants labeled with the encoding, or with both if the manifests are the same. Doubles the playback requests"`
+		AmazonEpisodes   bool              `name:"amazon-expand-episodes" env:"AMAZON_EXPAND_EPISODES" help:"Amazon: extract the whole season of episode URLs, rather than the episode only"`
 	} `cmd:"" help:"Extract and fingerprint service specific URLs to videos, shows or movies. Authentication cookies may be required (set via --cookies)"`
 
 	Fingerprint struct {
-		FileOrURL  string `arg:"" name:"file|url" help:"File or URL to fingerprint"`
+		FileOrURL  string `arg:"" name:"file|url" help:"File, directory or URL to fingerprint"`
 		BaseURL    string `help:"Base URL for manifest files, required if not contained within manifest"`
-		IndexRange string `help:"Byte-range of the index segment in the fragmented MP4 file. If not supplied will read first 64KB"`
-	} `cmd:"" help:"Fingerprint file or resource on the web. Must be MPD, M3U8 or fragmented MP4 file. If manifest file, base URL is required if not contained within the file. If MP4 file or URL, index range may be optionally supplied otherwise first 64KB will be read."`
-
-	OutDir      string            `env:"OUT_DIR" default:"." placeholder:"DIRECTORY" help:"Output directory for extracted data. Created if it doesn't exist. Default is current directory"`
-	NoIndent    bool              `env:"NO_INDENT" help:"Don't indent (beautify) JSON output"`
-	CountryCode string            `env:"COUNTRY_CODE" help:"Two-letter (alpha-2) country code. Recommended to set in alignment with IP location due to potential geo-blocking. If not provided, a geolocation lookup will be done"`
-	Cookies     map[string]string `env:"COOKIES" mapsep:"," placeholder:"HOST=COOKIES,..." help:"Cookies to send with each request to host. For example --cookies www.example.com=\"session=1; token=xyz123\",api.io=\"auth=abc\""`
-	RateLimit   map[string]int    `env:"RATE_LIMIT" mapsep:"," placeholder:"HOST=LIMIT,..." help:"Rate limit outbound requests per second for provided hosts. Restrictive defaults are set for known services, to disable (not recommended) set to a negative value"`
-	Verbose     bool              `env:"VERBOSE" help:"Enable verbose logging (additional error details)"`
+		IndexRange string `help:"Byte-range of the index segment in the fragmented MP4 file. If not supplied it is searched for from the start of the file, reading up to 4MB"`
+		Width      uint32 `help:"Width to label the variant of an HLS media playlist with"`
+		Height     uint32 `help:"Height to label the variant of an HLS media playlist with"`
+		Bandwidth  uint32 `help:"Bandwidth to label the variant of an HLS media playlist with"`
+	} `cmd:"" help:"Fingerprint file or resource on the web. Must be MPD, M3U8, fragmented MP4 or WebM file, detected by extension or else content. If manifest file, base URL is required if not contained within the file, unless an HLS media playlist with its segments on disk. If MP4 or WebM file or URL, index range may be optionally supplied otherwise the start of the file will be read. If directory, each file of it (and its subdirectories) with a supported extension is fingerprinted, to a result each."`
+
+	SelfTest struct {
+		Service string            `arg:"" name:"service" help:"Service to test"`
+		URLs    map[string]string `name:"url" env:"SELFTEST_URL" mapsep:"," placeholder:"SERVICE=URL,..." help:"Known-good URL per service to extract, e.g. a movie. Required for the service tested"`
+	} `cmd:"" name:"selftest" help:"Check that a service works, to tell breakage of its API from that of authentication or geo-blocking: runs the service's own checks (e.g. obtaining a token) and extracts and fingerprints a known-good URL, printing pass or fail with timing. Nothing is written to output. Exits with status 1 if failed"`
+
+	Config             kong.ConfigFlag   `placeholder:"FILE" help:"Load flags from a YAML file, keyed by their names in snake case, e.g. \"country_code: SE\", or for maps (e.g. cookies) a key per line indented beneath. Environment variables take precedence over the file, and flags over both"`
+	OutDir             string            `env:"OUT_DIR" default:"." placeholder:"DIRECTORY" help:"Output directory for extracted data. Created if it doesn't exist. Default is current directory"`
+	NoIndent           bool              `env:"NO_INDENT" help:"Don't indent (beautify) JSON output"`
+	URLNormalize       string            `name:"url-normalize" enum:"none,sort,strip" default:"none" env:"URL_NORMALIZE" placeholder:"MODE" help:"Normalize query parameters of URLs in output, not those requested, to make output reproducible: \"none\", \"sort\" or \"strip\". Default is \"none\""`
+	CountryCode        string            `env:"COUNTRY_CODE" help:"Two-letter (alpha-2) country code. Recommended to set in alignment with IP location due to potential geo-blocking. If not provided, a geolocation lookup will be done, unless --no-geolocate"`
+	NoGeolocate        bool              `env:"NO_GEOLOCATE" help:"Don't look up the country code by IP location (an external request) if --country-code isn't set, e.g. to run offline. Services requiring a country code fail with an error, fingerprinting works without"`
+	Cookies            map[string]string `env:"COOKIES" mapsep:"," placeholder:"HOST=COOKIES,..." help:"Cookies to send with each request to host. For example --cookies www.example.com=\"session=1; token=xyz123\",api.io=\"auth=abc\""`
+	CacheDir           string            `env:"CACHE_DIR" placeholder:"DIRECTORY" help:"Directory to keep state of services in across runs, e.g. the anonymous token of Max, not to obtain one each run. Default is karl in the user cache directory (e.g. ~/.cache/karl). Nothing is kept if \"none\""`
+	RateLimit          map[string]int    `env:"RATE_LIMIT" mapsep:"," placeholder:"HOST=LIMIT,..." help:"Rate limit outbound requests per second for provided hosts. Restrictive defaults are set for known services, to disable (not recommended) set to a negative value, also exempting the host from --rate-limit-default"`
+	RateLimitDefault   int               `env:"RATE_LIMIT_DEFAULT" placeholder:"LIMIT" help:"Rate limit outbound requests per second for each host without a limit of --rate-limit or the defaults, e.g. CDNs of segments. Unlimited if 0 (default)"`
+	Resolve            []string          `env:"RESOLVE" placeholder:"HOST:IP" help:"Resolve host to IP rather than through DNS, like curl. For example --resolve www.example.com:203.0.113.7"`
+	Proxy              string            `env:"PROXY" placeholder:"URL" help:"Send requests through the proxy at URL (e.g. http://proxy.example.com:3128 or socks5://127.0.0.1:1080), for example to request from the country of --country-code. Unless set, requests go through the proxies of the HTTPS_PROXY and HTTP_PROXY environment variables, if any, hosts of NO_PROXY excepted"`
+	Verbose            bool              `env:"VERBOSE" help:"Enable verbose logging (additional error details)"`
+	IncludeTrickplay   bool              `env:"INCLUDE_TRICKPLAY" help:"Include HLS I-frame (trick play) streams as variants of type \"iframe\""`
+	IncludeBonus       bool              `name:"include-bonus" env:"INCLUDE_BONUS" help:"Extract the bonus content of titles (featurettes, trailers) as well, as videos of media type \"bonus\", where listed by the service (Amazon). May double the number of videos of a title"`
+	Thumbnails         bool              `env:"THUMBNAILS" help:"Add the thumbnail (storyboard) tracks of videos, DASH image adaptation sets and HLS image streams, with their URLs and tile geometry, not fingerprinted"`
+	IncludeUHD         bool              `name:"include-uhd" env:"INCLUDE_UHD" help:"Request UHD (H.265, HDR) playback as well, where a service offers it to other clients than the default (Amazon), fingerprinting its manifest as an additional reference. Left out if not allowed for the account or territory"`
+	IncludeAddressing  bool              `env:"INCLUDE_ADDRESSING" help:"Add how segments of variants are addressed to output: the file and index range, or the segment URLs (possibly many) and template"`
+	CodecsRequired     bool              `env:"CODECS_REQUIRED" help:"Fail HLS variants without codecs, rather than fingerprinting them with empty codecs"`
+	ProbeInit          bool              `env:"PROBE_INIT" help:"Derive codecs, width and height of DASH representations missing them from their initialization segments (moov), rather than leaving them empty. Makes a request per such representation"`
+	HLSParts           bool              `name:"hls-parts" env:"HLS_PARTS" help:"Fingerprint low-latency HLS partial segments where present, rather than their parent segments. Such fingerprints have granularity \"part\""`
+	WalkFragments      bool              `env:"WALK_FRAGMENTS" help:"Fingerprint fragmented MP4 URLs without sidx by their fragments (moof boxes), as done for files. Makes a request per box"`
+	Summary            bool              `env:"SUMMARY" help:"Add a summary of segment sizes and durations to each fingerprint"`
+	VideoConcurrency   int               `default:"8" env:"VIDEO_CONCURRENCY" placeholder:"NUM" help:"Maximum number of videos (e.g. episodes) of a URL to extract concurrently, for services that fetch each separately. Unlimited if 0. Default is 8"`
+	VariantConcurrency int               `default:"4" env:"VARIANT_CONCURRENCY" placeholder:"NUM" help:"Maximum number of variants of a video to extract and fingerprint concurrently. Unlimited if 0. Default is 4"`
+	SegmentConcurrency int               `default:"16" env:"SEGMENT_CONCURRENCY" placeholder:"NUM" help:"Maximum number of segments of a variant to fetch sizes of concurrently, where not indexed. Beyond twice the connections per host (${max_conns_per_host}) requests mostly queue. Unlimited if 0. Default is 16"`
+	Stealth            bool              `env:"STEALTH" help:"Fetch the segments of a variant in random order, each after a random delay of up to 500ms, rather than in order, as some CDNs throttle sequential access. Rate limits and retries apply as otherwise"`
+	LiveWindow         bool              `env:"LIVE_WINDOW" help:"Fingerprint live (or event) HLS playlists as the window currently published, rather than failing. Such variants are marked live with the snapshot time and media sequence range"`
+	LiveDuration       time.Duration     `env:"LIVE_DURATION" placeholder:"DURATION" help:"Poll live HLS playlists until the window covers at least DURATION (e.g. 10m). Requires --live-window"`
+	ValidateLadder     bool              `env:"VALIDATE_LADDER" help:"Warn of variants with bandwidth per pixel inconsistent with the rest of the ladder (e.g. packager bugs). Warnings are added to videos and logged if verbose"`
+	DurationTolerance  float64           `default:"2" env:"DURATION_TOLERANCE" placeholder:"PERCENT" help:"Warn of variants whose fingerprint duration differs by more than PERCENT from the video duration or the median of the other variants (e.g. truncated playlists). Warnings are added to videos, counted per URL and logged if verbose. Disabled if 0. Default is 2"`
+	AllowPartial       bool              `name:"allow-partial-fingerprints" env:"ALLOW_PARTIAL_FINGERPRINTS" help:"Keep fingerprints of segmented variants with segments that couldn't be sized (after retrying), listing their indices as missing, rather than failing them"`
+	HashSegments       string            `env:"HASH_SEGMENTS" placeholder:"all|first:N" help:"Download segments (all or the first N) and add truncated SHA-256 hashes of them to fingerprints, for stronger matching. Expensive"`
+	HashMaxMB          int64             `name:"hash-max-mb" default:"1024" env:"HASH_MAX_MB" placeholder:"MB" help:"Maximum megabytes to download per variant for --hash-segments, after which segments aren't hashed. Unlimited if 0. Default is 1024"`
+	HashMaxRate        float64           `name:"hash-max-rate" env:"HASH_MAX_RATE" placeholder:"MB" help:"Maximum megabytes per second to download segments at for --hash-segments, across variants. Unlimited if 0"`
+	MaxManifestSize    int64             `name:"max-manifest-size" default:"16" env:"MAX_MANIFEST_SIZE" placeholder:"MB" help:"Maximum megabytes of a manifest (MPD or M3U8) to read, failing larger ones, as of misbehaving servers. Unlimited if 0. Default is 16"`
+	Retries            int               `default:"5" env:"RETRIES" placeholder:"NUM" help:"Maximum number of times to retry playlist, segment and Max API requests failing transiently (timeouts, throttling, server and connection errors), and Amazon playback requests throttled. Segments gone or forbidden aren't retried. Default is 5"`
+	RetryBackoff       time.Duration     `default:"250ms" env:"RETRY_BACKOFF" placeholder:"DURATION" help:"Base of the exponential backoff between retries, doubled for each and randomized (jitter), up to 10s. Default is 250ms"`
+	PermanentFailures  int               `name:"max-permanent-failures" default:"10" env:"MAX_PERMANENT_FAILURES" placeholder:"PERCENT" help:"Fail a segmented variant early once more than PERCENT of its segments are gone or forbidden (403, 404 or 410), usually as the manifest token expired, rather than fetching the rest. Disabled if 100. Default is 10"`
+	StallWarning       time.Duration     `default:"5m" env:"STALL_WARNING" placeholder:"DURATION" help:"Warn of variants whose segments haven't progressed for DURATION, with the host, e.g. when rate limited. Progress is also logged every 10% if verbose. Disabled if 0. Default is 5m"`
+	ContentLengthGET   bool              `name:"content-length-get" env:"CONTENT_LENGTH_GET" help:"Count segment sizes by downloading them where neither HEAD nor range requests return sizes. Expensive. Requests used per host are logged if verbose"`
+	MetricsAddr        string            `name:"metrics-addr" env:"METRICS_ADDR" placeholder:"ADDRESS" help:"Serve metrics of the run in the Prometheus format at http://ADDRESS/metrics (e.g. :9090), to monitor long crawls: requests by host and status with their latency, extractions and videos by service and outcome, fingerprint durations and segments in flight. Not served if unset"`
 }
 
 func main() {
 	godotenv.Load()
-	kongCtx := kong.Parse(&CLI)
+	kongCtx := kong.Parse(&CLI, kong.Configuration(loadConfigFile), kong.Vars{
+		"max_conns_per_host": strconv.Itoa(app.MaxConnsPerHost),
+	})
 	config := &config.AppConfig{
-		OutDir:   CLI.OutDir,
-		NoIndent: CLI.NoIndent,
-		Verbose:  CLI.Verbose,
+		OutDir:             CLI.OutDir,
+		NoIndent:           CLI.NoIndent,
+		URLNormalize:       CLI.URLNormalize,
+		SVTCategory:        CLI.ExtractURLs.SVTCategory,
+		Verbose:            CLI.Verbose,
+		StreamThreshold:    CLI.Extract.StreamThreshold,
+		TimeoutPerURL:      CLI.Extract.TimeoutPerURL,
+		NameBy:             CLI.Extract.NameBy,
+		OutputFormat:       CLI.Extract.OutputFormat,
+		AppendTo:           CLI.Extract.Append,
+		Format:             CLI.Extract.Format,
+		Sort:               CLI.Extract.Sort,
+		AllEdits:           CLI.Extract.AllEdits,
+		IncludeUnentitled:  CLI.Extract.AmazonUnentitled,
+		ExpandEpisodes:     CLI.Extract.AmazonEpisodes,
+		AllCDNs:            CLI.Extract.AmazonAllCDNs,
+		BothEncodings:      CLI.Extract.AmazonEncodings,
+		Kinds:              CLI.Extract.Kinds,
+		IncludeTrickplay:   CLI.IncludeTrickplay,
+		Thumbnails:         CLI.Thumbnails,
+		IncludeUHD:         CLI.IncludeUHD,
+		IncludeBonus:       CLI.IncludeBonus,
+		IncludeAddressing:  CLI.IncludeAddressing,
+		CodecsRequired:     CLI.CodecsRequired,
+		ProbeInit:          CLI.ProbeInit,
+		HLSParts:           CLI.HLSParts,
+		WalkFragments:      CLI.WalkFragments,
+		Summary:            CLI.Summary,
+		VideoConcurrency:   CLI.VideoConcurrency,
+		VariantConcurrency: CLI.VariantConcurrency,
+		SegmentConcurrency: CLI.SegmentConcurrency,
+		Stealth:            CLI.Stealth,
+		LiveWindow:         CLI.LiveWindow,
+		LiveDuration:       CLI.LiveDuration,
+		ValidateLadder:     CLI.ValidateLadder,
+		DurationTolerance:  CLI.DurationTolerance,
+		ContentLengthGET:   CLI.ContentLengthGET,
+		HashMaxBytes:       CLI.HashMaxMB << 20,
+		MaxManifestBytes:   CLI.MaxManifestSize << 20,
+		AllowPartial:       CLI.AllowPartial,
+		Retries:            CLI.Retries,
+		RetryBackoff:       CLI.RetryBackoff,
+		PermanentFailures:  CLI.PermanentFailures,
+		StallWarning:       CLI.StallWarning,
+		MetricsAddr:        CLI.MetricsAddr,
+		Proxy:              CLI.Proxy,
+		AmazonUHDDeviceID:  CLI.Extract.AmazonUHDDevice,
+		AmazonProfile: config.DeviceProfile{
+			Codec:   CLI.Extract.AmazonCodec,
+			Quality: CLI.Extract.AmazonQuality,
+			DRM:     CLI.Extract.AmazonDRM,
+			Query:   CLI.Extract.AmazonQuery,
+		},
 	}
 
 	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
@@ -61,20 +182,90 @@ func main() {
 	}
 	config.CookieJar = jar
 
+	switch CLI.CacheDir {
+	case "":
+		if dir, err := os.UserCacheDir(); err == nil {
+			config.CacheDir = filepath.Join(dir, "karl")
+		}
+	case "none":
+	default:
+		config.CacheDir = CLI.CacheDir
+	}
+
+	if s := CLI.Extract.AmazonDisplay; s != "" {
+		w, h, ok := strings.Cut(s, "x")
+		width, werr := strconv.Atoi(w)
+		height, herr := strconv.Atoi(h)
+		if !ok || werr != nil || herr != nil || width <= 0 || height <= 0 {
+			kongCtx.Fatalf("invalid --amazon-display %q, expected WxH", s)
+		}
+		config.AmazonProfile.DisplayWidth, config.AmazonProfile.DisplayHeight = width, height
+	}
+
+	if CLI.Extract.Append != "" && CLI.Extract.OutputFormat == "files" {
+		kongCtx.Fatalf("--append requires --output-format ndjson or single")
+	}
+
+	resolve := make(map[string]string)
+	for _, s := range CLI.Resolve {
+		host, ip, ok := strings.Cut(s, ":")
+		if !ok || host == "" || net.ParseIP(ip) == nil {
+			kongCtx.Fatalf("invalid --resolve %q, expected HOST:IP", s)
+		}
+		resolve[strings.ToLower(host)] = ip
+	}
+	config.Resolve = resolve
+
+	switch s := CLI.HashSegments; {
+	case s == "":
+	case s == "all":
+		config.HashSegments = -1
+	case strings.HasPrefix(s, "first:"):
+		n, err := strconv.Atoi(strings.TrimPrefix(s, "first:"))
+		if err != nil || n <= 0 {
+			kongCtx.Fatalf("invalid --hash-segments %q, expected all or first:N", s)
+		}
+		config.HashSegments = n
+	default:
+		kongCtx.Fatalf("invalid --hash-segments %q, expected all or first:N", s)
+	}
+
+	if CLI.HashMaxRate > 0 {
+		const burst = 256 << 10
+		config.BandwidthLimiter = rate.NewLimiter(rate.Limit(CLI.HashMaxRate*(1<<20)), burst)
+	}
+
 	requestLimiter := map[string]*rate.Limiter{
 		"www.amazon.com":                  rate.NewLimiter(rate.Limit(2), 2),
+		"www.amazon.co.uk":                rate.NewLimiter(rate.Limit(2), 2),
+		"www.amazon.de":                   rate.NewLimiter(rate.Limit(2), 2),
+		"www.amazon.co.jp":                rate.NewLimiter(rate.Limit(2), 2),
 		"www.primevideo.com":              rate.NewLimiter(rate.Limit(2), 2),
+		"atv-ps.amazon.com":               rate.NewLimiter(rate.Limit(5), 5),
+		"atv-ps.primevideo.com":           rate.NewLimiter(rate.Limit(5), 5),
+		"atv-ps-eu.amazon.co.uk":          rate.NewLimiter(rate.Limit(5), 5),
+		"atv-ps-eu.amazon.de":             rate.NewLimiter(rate.Limit(5), 5),
+		"atv-ps-eu.primevideo.com":        rate.NewLimiter(rate.Limit(5), 5),
+		"atv-ps-fe.amazon.co.jp":          rate.NewLimiter(rate.Limit(5), 5),
+		"atv-ps-fe.primevideo.com":        rate.NewLimiter(rate.Limit(5), 5),
+		"api.channel4.com":                rate.NewLimiter(rate.Limit(5), 5),
+		"api.hotstar.com":                 rate.NewLimiter(rate.Limit(5), 5),
 		"default.any-any.prd.api.max.com": rate.NewLimiter(rate.Limit(10), 10),
+		"edge.api.brightcove.com":         rate.NewLimiter(rate.Limit(5), 5),
+		"services.radio-canada.ca":        rate.NewLimiter(rate.Limit(5), 5),
+		"www.sbs.com.au":                  rate.NewLimiter(rate.Limit(5), 5),
 		"video.svt.se":                    rate.NewLimiter(rate.Limit(10), 10),
 	}
 	for host, rateLimit := range CLI.RateLimit {
+		// Kept unlimited, not to be limited by default.
 		if rateLimit < 0 {
-			delete(requestLimiter, host)
+			requestLimiter[host] = nil
 			continue
 		}
 		requestLimiter[host] = rate.NewLimiter(rate.Limit(rateLimit), rateLimit)
 	}
 	config.RequestLimiter = requestLimiter
+	config.RateLimitDefault = CLI.RateLimitDefault
 
 	app, err := app.New(config)
 	if err != nil {
@@ -93,6 +284,13 @@ func main() {
 		defer wg.Done()
 		app.ShutdownHandler(ctx, cancel)
 	}()
+	// Exits once output is done.
+	var exitCode int
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
 	defer func() {
 		app.Close()
 		wg.Wait()
@@ -103,7 +301,7 @@ func main() {
 		kongCtx.Errorf("invalid two-letter country code: %q", countryCode)
 		return
 	}
-	if countryCode == "" {
+	if countryCode == "" && !CLI.NoGeolocate {
 		countryCode, err = geolocate.CountryCode(ctx)
 		if err != nil {
 			kongCtx.Errorf("no country code set and geolocate failed: %v", err)
@@ -114,11 +312,24 @@ func main() {
 
 	switch kongCtx.Command() {
 	case "extract-urls <service>":
+		if CLI.ExtractURLs.SVTCategory != "" && CLI.ExtractURLs.Service != "svt" {
+			kongCtx.Errorf("--svt-category requires service svt")
+			return
+		}
 		app.URLExtract(ctx, CLI.ExtractURLs.Service)
 	case "extract <url>":
 		app.Extract(ctx, CLI.Extract.URLs, CLI.Extract.Format)
+	case "selftest <service>":
+		if !app.SelfTest(ctx, CLI.SelfTest.Service, CLI.SelfTest.URLs[CLI.SelfTest.Service]) {
+			exitCode = 1
+		}
 	case "fingerprint <file|url>":
-		app.Fingerprint(ctx, CLI.Fingerprint.FileOrURL, CLI.Fingerprint.BaseURL, CLI.Fingerprint.IndexRange)
+		hints := service.VariantHints{
+			Width:     CLI.Fingerprint.Width,
+			Height:    CLI.Fingerprint.Height,
+			Bandwidth: CLI.Fingerprint.Bandwidth,
+		}
+		app.Fingerprint(ctx, CLI.Fingerprint.FileOrURL, CLI.Fingerprint.BaseURL, CLI.Fingerprint.IndexRange, hints)
 	default:
 		kongCtx.Errorf("unknown command")
 	}
@@ -2,22 +2,31 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"maps"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 	"karl/pkg/config"
+	"karl/pkg/metrics"
 	"karl/pkg/model"
 	"karl/pkg/service"
-	"karl/pkg/service/amazon"
-	"karl/pkg/service/max"
-	"karl/pkg/service/svt"
 )
 
 type App struct {
@@ -25,33 +34,66 @@ type App struct {
 	httpClient     *http.Client
 	serviceManager *service.Manager
 	jsonWriter     *jsonWriter
+	progress       *progressTracker
+	metricsServer  *http.Server
 	outputChan     chan output
 	signalChan     chan os.Signal
 }
 
+// MaxConnsPerHost limits the connections per host, beyond which requests
+// queue.
+const MaxConnsPerHost = 8
+
 func New(config *config.AppConfig) (*App, error) {
 	app := &App{config: config}
 
+	proxy, err := proxyFunc(config.Proxy)
+	if err != nil {
+		return nil, err
+	}
 	rt := &http.Transport{
 		ForceAttemptHTTP2:     true,
 		MaxIdleConns:          400,
-		MaxIdleConnsPerHost:   8,
-		MaxConnsPerHost:       8,
+		MaxIdleConnsPerHost:   MaxConnsPerHost,
+		MaxConnsPerHost:       MaxConnsPerHost,
 		IdleConnTimeout:       30 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
+		DialContext:           dialContext(config.Resolve),
+		Proxy:                 proxy,
 	}
 	hc := &http.Client{
-		Transport: wrapRoundTripper(rt, config),
-		Jar:       config.CookieJar,
-		Timeout:   3 * time.Minute,
+		Transport:     wrapRoundTripper(rt, config),
+		Jar:           config.CookieJar,
+		Timeout:       3 * time.Minute,
+		CheckRedirect: checkRedirect,
 	}
 	app.httpClient = hc
 
+	if config.Verbose || config.StallWarning > 0 {
+		app.progress = newProgressTracker(config)
+		config.Progress = app.progress.update
+	}
+
+	if config.MetricsAddr != "" {
+		ln, err := net.Listen("tcp", config.MetricsAddr)
+		if err != nil {
+			return nil, fmt.Errorf("listen metrics: %w", err)
+		}
+		config.Metrics = metrics.New()
+		config.Metrics.Gauge("karl_segments_in_flight", "Segments of variants being sized (or hashed).", func() float64 {
+			return float64(service.InFlightContentLengths())
+		})
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", config.Metrics)
+		app.metricsServer = &http.Server{Handler: mux}
+		go app.metricsServer.Serve(ln)
+	}
+
 	m := service.NewManager(hc, config)
-	m.Register(amazon.New)
-	m.Register(max.New)
-	m.Register(svt.New)
+	for _, constructor := range service.Registered() {
+		m.Register(constructor)
+	}
 	app.serviceManager = m
 
 	jw, err := newJSONWriter(config)
@@ -69,10 +111,7 @@ func New(config *config.AppConfig) (*App, error) {
 
 func (a *App) OutputHandler(ctx context.Context) {
 	for output := range a.outputChan {
-		if output.Error != nil {
-			if ctx.Err() == nil {
-				log.Println(output.Error)
-			}
+		if output.Error != nil && ctx.Err() != nil {
 			continue
 		}
 		if a.config.Verbose {
@@ -80,14 +119,50 @@ func (a *App) OutputHandler(ctx context.Context) {
 				for _, e := range r.FailedErrors {
 					log.Println(e)
 				}
+				for _, w := range r.Warnings {
+					log.Printf("warning: %v\n", w)
+				}
 			}
 		}
-		a.jsonWriter.write(output)
+		if output.Error != nil {
+			if r, ok := output.Result.(model.ExtractResult); ok && r.Service != "" {
+				log.Printf("%s: %v\n", r.Service, output.Error)
+				continue
+			}
+			log.Println(output.Error)
+			continue
+		}
+		if output.Stream != nil {
+			r, _ := output.Result.(model.ExtractResult)
+			path := a.jsonWriter.path(output.Prefix, output.Suffix)
+			if err := output.Stream.close(r, path); err != nil {
+				log.Printf("%s: write %s: %v\n", r.Service, path, err)
+			}
+			continue
+		}
+		if _, ok := output.Result.(model.ExtractResult); ok && a.config.OutputFormat != "files" {
+			if err := a.jsonWriter.add(output); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		if err := a.jsonWriter.write(output); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := a.jsonWriter.flush(); err != nil {
+		log.Println(err)
 	}
 }
 
 func (a *App) Close() {
 	close(a.outputChan)
+	if a.progress != nil {
+		a.progress.close()
+	}
+	if a.metricsServer != nil {
+		a.metricsServer.Close()
+	}
 }
 
 func (a *App) ShutdownHandler(ctx context.Context, cancel context.CancelFunc) {
@@ -107,24 +182,192 @@ func (a *App) URLExtract(ctx context.Context, service string) {
 }
 
 func (a *App) Extract(ctx context.Context, urls []string, format string) {
+	ids := newResultIDs()
 	g, ctx := errgroup.WithContext(ctx)
 	g.SetLimit(runtime.NumCPU())
 	for i, url := range urls {
 		g.Go(func() error {
-			result, err := a.serviceManager.Extract(ctx, g, url, format)
+			var (
+				prefix = "extract_"
+				suffix = fmt.Sprintf("_%05d", i)
+				js     *jsonStream
+			)
+			var stream service.StreamFunc
+			if a.config.OutputFormat == "files" {
+				stream = func(id service.ID, url string) (service.VideoWriter, error) {
+					var err error
+					js, err = a.jsonWriter.stream(prefix, suffix, id, url)
+					return js, err
+				}
+			}
+			// A stuck URL is abandoned, freeing its worker.
+			urlCtx, cancel := ctx, context.CancelFunc(func() {})
+			if t := a.config.TimeoutPerURL; t > 0 {
+				urlCtx, cancel = context.WithTimeout(ctx, t)
+			}
+			result, err := a.serviceManager.Extract(urlCtx, g, url, format, stream)
+			if err != nil && errors.Is(urlCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+				err = fmt.Errorf("%q timed out after %s", url, a.config.TimeoutPerURL)
+			}
+			cancel()
+			if err != nil && js != nil {
+				js.discard()
+				js = nil
+			}
+			if err == nil && a.config.NameBy == "id" {
+				suffix = "_" + ids.unique(resultID(result), url)
+			}
 			a.outputChan <- output{
 				Result: result,
-				Prefix: "extract_",
-				Suffix: fmt.Sprintf("_%05d", i),
+				Prefix: prefix,
+				Suffix: suffix,
 				Error:  err,
+				Stream: js,
 			}
 			return nil
 		})
 	}
 	g.Wait()
+
+	throttled := a.serviceManager.Throttled()
+	for _, id := range slices.Sorted(maps.Keys(throttled)) {
+		log.Printf("%s: %d request(s) throttled, retried at a reduced rate\n", id, throttled[id])
+	}
+	logEncoded(service.EncodedHosts())
+}
+
+// logEncoded logs the segments per host responded to with a content
+// encoding although identity was requested, measured decoded.
+func logEncoded(encoded map[string]int) {
+	for _, host := range slices.Sorted(maps.Keys(encoded)) {
+		log.Printf("%s: %d segment(s) responded encoded, measured decoded\n", host, encoded[host])
+	}
+}
+
+// SelfTest checks that service works by extracting url, printing pass
+// or fail with timing rather than writing output. Returns whether passed.
+func (a *App) SelfTest(ctx context.Context, service, url string) bool {
+	r := a.serviceManager.SelfTest(ctx, service, url, a.config.Format)
+	tested := r.Service
+	if r.URL != "" {
+		tested += " " + r.URL
+	}
+	if r.Err != nil {
+		fmt.Printf("FAIL %s in %s: %v\n", tested, r.Duration.Round(time.Millisecond), r.Err)
+		return false
+	}
+	fmt.Printf("PASS %s in %s: %d video(s), %d variant(s), %d failed\n", tested, r.Duration.Round(time.Millisecond), r.NumVideos, r.NumVariants, r.NumFailed)
+	return true
+}
+
+var unsafeFilenameRegex = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// resultID returns a stable ID of an extract result for naming its
+// output: the service and the ID of its only video, or else the last
+// element of its URL path (typically the show ID).
+func resultID(result model.ExtractResult) string {
+	id := result.URL
+	if len(result.Videos) == 1 {
+		id = result.Videos[0].ID
+	} else if u, err := url.Parse(result.URL); err == nil {
+		if base := path.Base(strings.TrimSuffix(u.Path, "/")); base != "." && base != "/" {
+			id = base
+		}
+	}
+
+	return unsafeFilenameRegex.ReplaceAllString(result.Service+"_"+id, "_")
+}
+
+// resultIDs are the IDs of the results of a run named by ID, to tell
+// apart those of URLs of the same ID (e.g. of a show and one of its
+// episodes, or of the same video by different URLs), rather than
+// overwrite one's output with another's.
+type resultIDs struct {
+	mu   sync.Mutex
+	seen map[string]int
+}
+
+func newResultIDs() *resultIDs {
+	return &resultIDs{seen: make(map[string]int)}
 }
 
-func (a *App) Fingerprint(ctx context.Context, fileOrURL, baseURL, indexRange string) {
-	result, err := a.serviceManager.Fingerprint(ctx, fileOrURL, baseURL, indexRange)
+// unique returns id, suffixed with the first number free ("_2", "_3",
+// ...) if already used by another URL of the run, warning of it.
+func (ids *resultIDs) unique(id, url string) string {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+
+	unique := id
+	for n := 2; ids.seen[unique] > 0; n++ {
+		unique = fmt.Sprintf("%s_%d", id, n)
+	}
+	ids.seen[unique]++
+	if unique == id {
+		return id
+	}
+	log.Printf("warning: %q of ID %s already extracted, named %s\n", url, id, unique)
+	return unique
+}
+
+func (a *App) Fingerprint(ctx context.Context, fileOrURL, baseURL, indexRange string, hints service.VariantHints) {
+	defer func() { logEncoded(service.EncodedHosts()) }()
+
+	if fi, err := os.Stat(fileOrURL); err == nil && fi.IsDir() {
+		a.fingerprintDir(ctx, fileOrURL, baseURL, indexRange, hints)
+		return
+	}
+
+	result, err := a.serviceManager.Fingerprint(ctx, fileOrURL, baseURL, indexRange, hints)
 	a.outputChan <- output{Result: result, Prefix: "fingerprint_", Error: err}
 }
+
+// fingerprintExtensions are those of the files of a directory that are
+// fingerprinted.
+var fingerprintExtensions = []string{".mpd", ".m3u8", ".mp4", ".webm"}
+
+// fingerprintDir fingerprints the files of dir (and its subdirectories)
+// with supported extensions, a result each.
+func (a *App) fingerprintDir(ctx context.Context, dir, baseURL, indexRange string, hints service.VariantHints) {
+	if indexRange != "" {
+		a.outputChan <- output{Error: errors.New("index range not supported for directory")}
+		return
+	}
+
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && slices.Contains(fingerprintExtensions, strings.ToLower(filepath.Ext(path))) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		a.outputChan <- output{Error: fmt.Errorf("walk %q: %w", dir, err)}
+		return
+	}
+	if len(files) == 0 {
+		a.outputChan <- output{Error: fmt.Errorf("no files to fingerprint in %q", dir)}
+		return
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(runtime.NumCPU())
+	for i, file := range files {
+		g.Go(func() error {
+			result, err := a.serviceManager.Fingerprint(ctx, file, baseURL, "", hints)
+			if err != nil {
+				err = fmt.Errorf("%q: %w", file, err)
+			}
+			a.outputChan <- output{
+				Result: result,
+				Prefix: "fingerprint_",
+				Suffix: fmt.Sprintf("_%05d", i),
+				Error:  err,
+			}
+			return nil
+		})
+	}
+	g.Wait()
+}
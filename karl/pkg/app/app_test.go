@@ -0,0 +1,91 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+)
+
+func TestResultIDsUnique(t *testing.T) {
+	ids := newResultIDs()
+	for _, tt := range []struct{ id, want string }{
+		{"max_show", "max_show"},
+		{"max_show", "max_show_2"},
+		{"max_show_3", "max_show_3"},
+		{"max_show", "max_show_4"},
+		{"amazon_show", "amazon_show"},
+	} {
+		if got := ids.unique(tt.id, "https://example.com"); got != tt.want {
+			t.Errorf("unique(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestResultID(t *testing.T) {
+	for _, tt := range []struct {
+		result model.ExtractResult
+		want   string
+	}{
+		{model.ExtractResult{Service: "max", URL: "https://play.max.com/show/abc-123", Videos: []model.Video{{ID: "v1"}, {ID: "v2"}}}, "max_abc-123"},
+		{model.ExtractResult{Service: "max", URL: "https://play.max.com/video/watch/x/y", Videos: []model.Video{{ID: "v:1"}}}, "max_v_1"},
+	} {
+		if got := resultID(tt.result); got != tt.want {
+			t.Errorf("resultID(%s) = %q, want %q", tt.result.URL, got, tt.want)
+		}
+	}
+}
+
+func TestLogEncoded(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	logEncoded(map[string]int{"b.example.com": 1, "a.example.com": 12})
+	want := "a.example.com: 12 segment(s) responded encoded, measured decoded\n" +
+		"b.example.com: 1 segment(s) responded encoded, measured decoded\n"
+	if got := buf.String(); got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+func TestOutputHandlerStreamError(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	config := &config.AppConfig{OutDir: t.TempDir(), OutputFormat: "files"}
+	jw := &jsonWriter{config: config, fileFormatStr: "%s%s.json"}
+	js, err := jw.stream("extract_", "", "max", "https://example.com/show")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Named after extraction as a directory in the way, failing to move.
+	path := jw.path("extract_", "_00000")
+	if err := os.MkdirAll(filepath.Join(path, "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &App{config: config, jsonWriter: jw, outputChan: make(chan output, 1)}
+	a.outputChan <- output{Result: model.ExtractResult{Service: "max"}, Prefix: "extract_", Suffix: "_00000", Stream: js}
+	close(a.outputChan)
+	a.OutputHandler(context.Background())
+
+	if got, want := buf.String(), "max: write "+path+": rename:"; !strings.HasPrefix(got, want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
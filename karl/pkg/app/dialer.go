@@ -0,0 +1,44 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dialContext returns a dial function that connects to the IP of a host
+// in resolve, if any, rather than resolving the host through DNS.
+func dialContext(resolve map[string]string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip, ok := resolve[strings.ToLower(host)]; ok {
+			addr = net.JoinHostPort(ip, port)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// proxyFunc returns the proxy of requests: that of proxyURL if set, or
+// else those of the environment (HTTPS_PROXY, HTTP_PROXY and NO_PROXY).
+func proxyFunc(proxyURL string) (func(*http.Request) (*url.URL, error), error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q, expected a URL such as http://host:port", proxyURL)
+	}
+	return http.ProxyURL(u), nil
+}
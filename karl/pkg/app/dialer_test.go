@@ -0,0 +1,37 @@
+package app
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProxyFunc(t *testing.T) {
+	// Those of the environment are read once per process, so not tested.
+	if proxy, err := proxyFunc(""); proxy == nil || err != nil {
+		t.Errorf("proxy of the environment %v, want it", err)
+	}
+
+	for _, tt := range []struct {
+		proxy, want string
+	}{
+		{"socks5://127.0.0.1:1080", "socks5://127.0.0.1:1080"},
+		{"http://proxy.example.com:3128", "http://proxy.example.com:3128"},
+	} {
+		proxy, err := proxyFunc(tt.proxy)
+		if err != nil {
+			t.Errorf("%q: %v", tt.proxy, err)
+			continue
+		}
+		req, _ := http.NewRequest(http.MethodGet, "https://www.example.com/", nil)
+		u, err := proxy(req)
+		if err != nil || u == nil || u.String() != tt.want {
+			t.Errorf("%q: proxy %v, %v, want %s", tt.proxy, u, err, tt.want)
+		}
+	}
+
+	for _, proxy := range []string{"proxy.example.com:3128", "://x", "http://"} {
+		if _, err := proxyFunc(proxy); err == nil {
+			t.Errorf("%q: want invalid", proxy)
+		}
+	}
+}
@@ -1,14 +1,23 @@
 package app
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"karl/pkg/config"
+	"karl/pkg/model"
 )
 
 type output struct {
@@ -16,11 +25,26 @@ type output struct {
 	Prefix string
 	Suffix string
 	Error  error
+	Stream *jsonStream
 }
 
 type jsonWriter struct {
 	config        *config.AppConfig
 	fileFormatStr string
+
+	// Aggregated results, unless written to a file each.
+	results []output
+	ndjson  *os.File
+
+	// Results of the file appended to, if any, and the keys of their
+	// URLs and videos.
+	existing []json.RawMessage
+	seen     map[appendKey]bool
+}
+
+// appendKey is of a URL (without id) or a video of an extract result.
+type appendKey struct {
+	service, url, id, edit string
 }
 
 func newJSONWriter(config *config.AppConfig) (*jsonWriter, error) {
@@ -33,17 +57,110 @@ func newJSONWriter(config *config.AppConfig) (*jsonWriter, error) {
 		fileFormatStr = "%s" + now.Format("20060102_150405") + "%s.json"
 	)
 
-	return &jsonWriter{
+	jw := &jsonWriter{
 		config:        config,
 		fileFormatStr: fileFormatStr,
-	}, nil
+	}
+	if config.AppendTo != "" {
+		if err := jw.loadAppend(); err != nil {
+			return nil, fmt.Errorf("load %s: %w", config.AppendTo, err)
+		}
+	}
+
+	return jw, nil
+}
+
+// loadAppend reads the results of the file appended to, if it exists, to
+// leave out what is already in it.
+func (jw *jsonWriter) loadAppend() error {
+	jw.seen = make(map[appendKey]bool)
+
+	b, err := os.ReadFile(jw.config.AppendTo)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	var raws []json.RawMessage
+	if jw.config.OutputFormat == "single" {
+		if len(bytes.TrimSpace(b)) > 0 {
+			if err := json.Unmarshal(b, &raws); err != nil {
+				return fmt.Errorf("decode JSON: %w", err)
+			}
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		for {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("decode JSON line %d: %w", len(raws)+1, err)
+			}
+			raws = append(raws, raw)
+		}
+	}
+
+	for i, raw := range raws {
+		var r struct {
+			Service string `json:"service"`
+			URL     string `json:"url"`
+			Videos  []struct {
+				ID   string `json:"id"`
+				Edit string `json:"edit"`
+			} `json:"videos"`
+		}
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return fmt.Errorf("decode result %d: %w", i+1, err)
+		}
+		jw.seen[appendKey{service: r.Service, url: r.URL}] = true
+		for _, v := range r.Videos {
+			jw.seen[appendKey{service: r.Service, id: v.ID, edit: v.Edit}] = true
+		}
+	}
+	if jw.config.OutputFormat == "single" {
+		jw.existing = raws
+	}
+
+	return nil
+}
+
+// dedupe returns result without the videos already in the file appended
+// to, or false if nothing of it is new: its URL is in the file and it has
+// no other videos.
+func (jw *jsonWriter) dedupe(result model.ExtractResult) (model.ExtractResult, bool) {
+	urlKey := appendKey{service: result.Service, url: result.URL}
+	result.Videos = slices.DeleteFunc(slices.Clone(result.Videos), func(v model.Video) bool {
+		return jw.seen[appendKey{service: result.Service, id: v.ID, edit: v.Edit}]
+	})
+	if jw.seen[urlKey] && len(result.Videos) == 0 {
+		return result, false
+	}
+
+	jw.seen[urlKey] = true
+	for _, v := range result.Videos {
+		jw.seen[appendKey{service: result.Service, id: v.ID, edit: v.Edit}] = true
+	}
+	return result, true
+}
+
+func (jw *jsonWriter) path(prefix, suffix string) string {
+	return filepath.Join(jw.config.OutDir, fmt.Sprintf(jw.fileFormatStr, prefix, suffix))
 }
 
 func (jw *jsonWriter) write(output output) error {
-	var (
-		filename = fmt.Sprintf(jw.fileFormatStr, output.Prefix, output.Suffix)
-		path     = filepath.Join(jw.config.OutDir, filename)
-	)
+	path := jw.path(output.Prefix, output.Suffix)
+	if err := jw.writeFile(path, output.Result); err != nil {
+		return err
+	}
+
+	log.Printf("Saved %s\n", path)
+	return nil
+}
+
+func (jw *jsonWriter) writeFile(path string, result any) error {
 	file, err := os.Create(path)
 	if err != nil {
 		return fmt.Errorf("create file: %w", err)
@@ -54,10 +171,310 @@ func (jw *jsonWriter) write(output output) error {
 	if !jw.config.NoIndent {
 		encoder.SetIndent("", "  ")
 	}
-	if err := encoder.Encode(output.Result); err != nil {
+	if err := encoder.Encode(jw.normalizeURLs(result)); err != nil {
 		return fmt.Errorf("encode JSON: %w", err)
 	}
+	return nil
+}
 
-	log.Printf("Saved %s\n", path)
+// add aggregates output with the others of the run, as a line of the
+// NDJSON file or an element of the array written on flush. When appending,
+// what is already in the file is left out.
+func (jw *jsonWriter) add(output output) error {
+	output.Result = jw.normalizeURLs(output.Result)
+	if r, ok := output.Result.(model.ExtractResult); ok && jw.seen != nil {
+		if r, ok = jw.dedupe(r); !ok {
+			return nil
+		}
+		output.Result = r
+	}
+	if jw.config.OutputFormat != "ndjson" {
+		jw.results = append(jw.results, output)
+		return nil
+	}
+
+	if jw.ndjson == nil {
+		var (
+			file *os.File
+			err  error
+		)
+		if path := jw.config.AppendTo; path != "" {
+			file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		} else {
+			file, err = os.Create(strings.TrimSuffix(jw.path(output.Prefix, ""), ".json") + ".ndjson")
+		}
+		if err != nil {
+			return fmt.Errorf("open file: %w", err)
+		}
+		jw.ndjson = file
+	}
+
+	if err := json.NewEncoder(jw.ndjson).Encode(output.Result); err != nil {
+		return fmt.Errorf("encode JSON: %w", err)
+	}
 	return nil
 }
+
+// flush writes the aggregated outputs, if any.
+func (jw *jsonWriter) flush() error {
+	if jw.ndjson != nil {
+		defer jw.ndjson.Close()
+		if err := jw.ndjson.Sync(); err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+		log.Printf("Saved %s\n", jw.ndjson.Name())
+		return nil
+	}
+	if len(jw.results) == 0 {
+		return nil
+	}
+
+	results := make([]any, 0, len(jw.existing)+len(jw.results))
+	for _, r := range jw.existing {
+		results = append(results, r)
+	}
+	for _, o := range jw.results {
+		results = append(results, o.Result)
+	}
+	if path := jw.config.AppendTo; path != "" {
+		// Replace the file only once written in full, not to lose the
+		// results of earlier runs.
+		if err := jw.writeFile(path+".tmp", results); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return fmt.Errorf("rename: %w", err)
+		}
+		log.Printf("Saved %s\n", path)
+		return nil
+	}
+	return jw.write(output{Result: results, Prefix: jw.results[0].Prefix})
+}
+
+// normalizeURLs returns result with its URLs normalized for output, as
+// configured: query parameters (e.g. volatile auth tokens) sorted or
+// stripped, to make output reproducible.
+func (jw *jsonWriter) normalizeURLs(result any) any {
+	if jw.config.URLNormalize == "" || jw.config.URLNormalize == "none" {
+		return result
+	}
+
+	switch r := result.(type) {
+	case model.URLExtractResult:
+		r.URLs = slices.Clone(r.URLs)
+		for i, u := range r.URLs {
+			r.URLs[i] = jw.normalizeURL(u)
+		}
+		return r
+	case model.ExtractResult:
+		r.URL = jw.normalizeURL(r.URL)
+		r.Videos = slices.Clone(r.Videos)
+		for i := range r.Videos {
+			r.Videos[i] = normalizeVideo(r.Videos[i], jw.normalizeURL)
+		}
+		return r
+	case model.FingerprintResult:
+		r.URL = jw.normalizeURL(r.URL)
+		if r.Variants != nil {
+			variants := normalizeVariants(*r.Variants, jw.normalizeURL)
+			r.Variants = &variants
+		}
+		return r
+	default:
+		return result
+	}
+}
+
+// normalizeVideo returns video with its URLs normalized by normalize,
+// those of its thumbnails and variants cloned rather than changed.
+func normalizeVideo(video model.Video, normalize func(string) string) model.Video {
+	video.PlaybackURL = normalize(video.PlaybackURL)
+	if video.Thumbnails != nil {
+		video.Thumbnails = slices.Clone(video.Thumbnails)
+		for i := range video.Thumbnails {
+			video.Thumbnails[i].URL = normalize(video.Thumbnails[i].URL)
+		}
+	}
+	video.Variants = normalizeVariants(video.Variants, normalize)
+	return video
+}
+
+// normalizeVariants returns variants with the URLs of their addressing,
+// if output, normalized by normalize, cloned rather than changed.
+func normalizeVariants(variants []model.Variant, normalize func(string) string) []model.Variant {
+	if !slices.ContainsFunc(variants, func(v model.Variant) bool { return v.Addressing != nil }) {
+		return variants
+	}
+
+	variants = slices.Clone(variants)
+	for i, v := range variants {
+		if v.Addressing == nil {
+			continue
+		}
+		a := *v.Addressing
+		if a.Indexed != nil {
+			indexed := *a.Indexed
+			indexed.URL = normalize(indexed.URL)
+			a.Indexed = &indexed
+		}
+		if a.Explicit != nil {
+			explicit := *a.Explicit
+			explicit.TemplateURL = normalize(explicit.TemplateURL)
+			explicit.InitURL = normalize(explicit.InitURL)
+			explicit.URLs = slices.Clone(explicit.URLs)
+			for j, u := range explicit.URLs {
+				explicit.URLs[j] = normalize(u)
+			}
+			a.Explicit = &explicit
+		}
+		variants[i].Addressing = &a
+	}
+	return variants
+}
+
+func (jw *jsonWriter) normalizeURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return rawURL
+	}
+
+	switch jw.config.URLNormalize {
+	case "sort":
+		u.RawQuery = u.Query().Encode()
+	case "strip":
+		u.RawQuery = ""
+	}
+
+	return u.String()
+}
+
+// jsonStream writes an extract result incrementally, one video at a time.
+// The trailing fields are written on close. Not safe for concurrent use.
+type jsonStream struct {
+	file      *os.File
+	w         *bufio.Writer
+	path      string
+	indent    bool
+	normalize func(string) string
+	numVideos int
+}
+
+func (jw *jsonWriter) stream(prefix, suffix, service, url string) (*jsonStream, error) {
+	path := jw.path(prefix, suffix)
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create file: %w", err)
+	}
+
+	js := &jsonStream{
+		file:      file,
+		w:         bufio.NewWriter(file),
+		path:      path,
+		indent:    !jw.config.NoIndent,
+		normalize: jw.normalizeURL,
+	}
+
+	s, _ := json.Marshal(service)
+	u, _ := json.Marshal(jw.normalizeURL(url))
+	if js.indent {
+		fmt.Fprintf(js.w, "{\n  \"service\": %s,\n  \"url\": %s,\n  \"videos\": [", s, u)
+	} else {
+		fmt.Fprintf(js.w, `{"service":%s,"url":%s,"videos":[`, s, u)
+	}
+
+	return js, nil
+}
+
+func (js *jsonStream) WriteVideo(video model.Video) error {
+	video = normalizeVideo(video, js.normalize)
+
+	var (
+		b   []byte
+		err error
+	)
+	if js.indent {
+		b, err = json.MarshalIndent(video, "    ", "  ")
+	} else {
+		b, err = json.Marshal(video)
+	}
+	if err != nil {
+		return fmt.Errorf("encode JSON: %w", err)
+	}
+
+	if js.numVideos > 0 {
+		js.w.WriteString(",")
+	}
+	if js.indent {
+		js.w.WriteString("\n    ")
+	}
+	if _, err := js.w.Write(b); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	js.numVideos++
+
+	return nil
+}
+
+// close writes the trailing fields of result and moves the file to path,
+// if named differently after extraction.
+func (js *jsonStream) close(result model.ExtractResult, path string) error {
+	defer js.file.Close()
+
+	if js.indent {
+		if js.numVideos > 0 {
+			js.w.WriteString("\n  ")
+		}
+		fmt.Fprintf(js.w, "],\n  \"num_failed\": %d", result.NumFailed)
+		if n := result.NumDurationWarnings; n > 0 {
+			fmt.Fprintf(js.w, ",\n  \"num_duration_warnings\": %d", n)
+		}
+		if len(result.Seasons) > 0 {
+			b, _ := json.Marshal(result.Seasons)
+			fmt.Fprintf(js.w, ",\n  \"seasons\": %s", b)
+		}
+		if len(result.FailedSeasons) > 0 {
+			b, _ := json.Marshal(result.FailedSeasons)
+			fmt.Fprintf(js.w, ",\n  \"failed_seasons\": %s", b)
+		}
+		if len(result.Failures) > 0 {
+			b, _ := json.MarshalIndent(result.Failures, "  ", "  ")
+			fmt.Fprintf(js.w, ",\n  \"failures\": %s", b)
+		}
+		js.w.WriteString("\n}\n")
+	} else {
+		fmt.Fprintf(js.w, "],\"num_failed\":%d", result.NumFailed)
+		if n := result.NumDurationWarnings; n > 0 {
+			fmt.Fprintf(js.w, ",\"num_duration_warnings\":%d", n)
+		}
+		if len(result.Seasons) > 0 {
+			b, _ := json.Marshal(result.Seasons)
+			fmt.Fprintf(js.w, ",\"seasons\":%s", b)
+		}
+		if len(result.FailedSeasons) > 0 {
+			b, _ := json.Marshal(result.FailedSeasons)
+			fmt.Fprintf(js.w, ",\"failed_seasons\":%s", b)
+		}
+		if len(result.Failures) > 0 {
+			b, _ := json.Marshal(result.Failures)
+			fmt.Fprintf(js.w, ",\"failures\":%s", b)
+		}
+		js.w.WriteString("}\n")
+	}
+	if err := js.w.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	if path != js.path {
+		if err := os.Rename(js.path, path); err != nil {
+			return fmt.Errorf("rename: %w", err)
+		}
+		js.path = path
+	}
+
+	log.Printf("Saved %s\n", js.path)
+	return nil
+}
+
+func (js *jsonStream) discard() {
+	js.file.Close()
+	os.Remove(js.path)
+}
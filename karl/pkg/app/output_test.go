@@ -0,0 +1,95 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+)
+
+func testVideo() model.Video {
+	return model.Video{
+		ID:          "v1",
+		PlaybackURL: "https://example.com/watch/v1?token=abc&b=2",
+		Thumbnails: []model.Thumbnail{
+			{URL: "https://cdn.example.com/thumbs/$Number$.jpg?hdnts=exp~1700000000&a=1"},
+		},
+	}
+}
+
+func TestNormalizeURLsThumbnails(t *testing.T) {
+	jw := &jsonWriter{config: &config.AppConfig{URLNormalize: "strip"}}
+	video := testVideo()
+
+	r := jw.normalizeURLs(model.ExtractResult{Videos: []model.Video{video}}).(model.ExtractResult)
+	if u := r.Videos[0].Thumbnails[0].URL; u != "https://cdn.example.com/thumbs/$Number$.jpg" {
+		t.Errorf("thumbnail %s, want stripped", u)
+	}
+	// Of the result, unchanged.
+	if video.Thumbnails[0].URL != testVideo().Thumbnails[0].URL {
+		t.Errorf("result changed: %s", video.Thumbnails[0].URL)
+	}
+}
+
+func TestStreamNormalizesThumbnails(t *testing.T) {
+	jw := &jsonWriter{
+		config:        &config.AppConfig{URLNormalize: "sort", OutDir: t.TempDir(), NoIndent: true},
+		fileFormatStr: "%s%s.json",
+	}
+	js, err := jw.stream("extract_", "", "max", "https://example.com/show")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := js.WriteVideo(testVideo()); err != nil {
+		t.Fatal(err)
+	}
+	if err := js.close(model.ExtractResult{}, js.path); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(jw.config.OutDir, "extract_.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"url":"https://cdn.example.com/thumbs/$Number$.jpg?a=1\u0026hdnts=exp~1700000000"`; !strings.Contains(string(b), want) {
+		t.Errorf("wrote %s, want thumbnail %s", b, want)
+	}
+}
+
+func TestNormalizeURLsAddressing(t *testing.T) {
+	jw := &jsonWriter{config: &config.AppConfig{URLNormalize: "strip"}}
+	explicit := &model.ExplicitAddressingInfo{
+		TemplateURL: "https://cdn.example.com/v1/$Number$.m4s?token=abc",
+		InitURL:     "https://cdn.example.com/v1/init.mp4?token=abc",
+		URLs:        []string{"https://cdn.example.com/v1/1.m4s?token=abc", "https://cdn.example.com/v1/2.m4s?token=abc"},
+	}
+	indexed := &model.IndexedAddressingInfo{URL: "https://cdn.example.com/v2.mp4?token=abc"}
+	variants := []model.Variant{
+		{Addressing: &model.Addressing{Mode: "explicit", Explicit: explicit}},
+		{Addressing: &model.Addressing{Mode: "indexed", Indexed: indexed}},
+		{},
+	}
+
+	r := jw.normalizeURLs(model.ExtractResult{Videos: []model.Video{{Variants: variants}}}).(model.ExtractResult)
+	got := r.Videos[0].Variants
+	e := got[0].Addressing.Explicit
+	if e.TemplateURL != "https://cdn.example.com/v1/$Number$.m4s" || e.InitURL != "https://cdn.example.com/v1/init.mp4" ||
+		e.URLs[0] != "https://cdn.example.com/v1/1.m4s" || e.URLs[1] != "https://cdn.example.com/v1/2.m4s" {
+		t.Errorf("explicit addressing %+v, want stripped", e)
+	}
+	if u := got[1].Addressing.Indexed.URL; u != "https://cdn.example.com/v2.mp4" {
+		t.Errorf("indexed addressing %s, want stripped", u)
+	}
+	// Of the result, unchanged.
+	if explicit.URLs[0] != "https://cdn.example.com/v1/1.m4s?token=abc" || indexed.URL != "https://cdn.example.com/v2.mp4?token=abc" {
+		t.Errorf("result changed: %+v, %+v", explicit, indexed)
+	}
+
+	f := jw.normalizeURLs(model.FingerprintResult{Variants: &variants}).(model.FingerprintResult)
+	if u := (*f.Variants)[1].Addressing.Indexed.URL; u != "https://cdn.example.com/v2.mp4" {
+		t.Errorf("fingerprint indexed addressing %s, want stripped", u)
+	}
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service"
+)
+
+// progressTracker follows the fingerprinting of variants segment by
+// segment, logging every 10% if verbose and warning of variants stalled
+// (without progress) for longer than configured.
+type progressTracker struct {
+	config *config.AppConfig
+
+	mu       sync.Mutex
+	variants map[string]*variantProgress
+	stop     chan struct{}
+}
+
+type variantProgress struct {
+	model.FingerprintProgress
+	decile  int
+	updated time.Time
+	warned  bool
+}
+
+func newProgressTracker(config *config.AppConfig) *progressTracker {
+	pt := &progressTracker{
+		config:   config,
+		variants: make(map[string]*variantProgress),
+		stop:     make(chan struct{}),
+	}
+	if config.StallWarning > 0 {
+		go pt.watch()
+	}
+	return pt
+}
+
+func (pt *progressTracker) update(p model.FingerprintProgress) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if p.Finished {
+		delete(pt.variants, p.URL)
+		return
+	}
+	vp, ok := pt.variants[p.URL]
+	if !ok {
+		vp = &variantProgress{}
+		pt.variants[p.URL] = vp
+	}
+	vp.FingerprintProgress = p
+	vp.updated = time.Now()
+	vp.warned = false
+
+	if decile := p.Done * 10 / max(p.Total, 1); pt.config.Verbose && decile > vp.decile {
+		vp.decile = decile
+		log.Printf("fingerprint %s at %s: %d%% (%d of %d segments, %d failed, %d in flight overall)\n", p.VariantID, host(p.URL), decile*10, p.Done, p.Total, p.Failed, service.InFlightContentLengths())
+	}
+}
+
+// watch warns of stalled variants, once each until they progress.
+func (pt *progressTracker) watch() {
+	ticker := time.NewTicker(max(pt.config.StallWarning/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pt.stop:
+			return
+		case now := <-ticker.C:
+			pt.mu.Lock()
+			for _, vp := range pt.variants {
+				if vp.warned || now.Sub(vp.updated) < pt.config.StallWarning {
+					continue
+				}
+				vp.warned = true
+				log.Printf("warning: fingerprint %s at %s stalled, no progress for %s (%d of %d segments, %d failed)\n", vp.VariantID, host(vp.URL), now.Sub(vp.updated).Round(time.Second), vp.Done, vp.Total, vp.Failed)
+			}
+			pt.mu.Unlock()
+		}
+	}
+}
+
+func (pt *progressTracker) close() {
+	close(pt.stop)
+}
+
+func host(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return rawURL
+}
@@ -0,0 +1,19 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// maxRedirects is the most redirects followed per request, fewer than
+// the default of net/http, as chains of services are short and loops
+// would otherwise be followed until then.
+const maxRedirects = 5
+
+// checkRedirect stops following redirects after maxRedirects.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	return nil
+}
@@ -3,8 +3,11 @@ package app
 import (
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
 	"golang.org/x/net/publicsuffix"
+	"golang.org/x/time/rate"
 	"karl/pkg/config"
 )
 
@@ -19,6 +22,9 @@ type customRoundTripper struct {
 	http.RoundTripper
 
 	config *config.AppConfig
+
+	mu              sync.Mutex
+	defaultLimiters map[string]*rate.Limiter
 }
 
 func (rt *customRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -40,11 +46,47 @@ func (rt *customRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 		setHeaderIfEmpty(req.Header, k, v)
 	}
 
-	if limiter := rt.config.RequestLimiter[req.URL.Hostname()]; limiter != nil {
+	host := req.URL.Hostname()
+	limiter, ok := rt.config.RequestLimiter[host]
+	if !ok {
+		limiter = rt.defaultLimiter(host)
+	}
+	if limiter != nil {
 		limiter.Wait(req.Context())
 	}
 
-	return rt.RoundTripper.RoundTrip(req)
+	start := time.Now()
+	res, err := rt.RoundTripper.RoundTrip(req)
+	if m := rt.config.Metrics; m != nil {
+		var status int
+		if err == nil {
+			status = res.StatusCode
+		}
+		m.ObserveRequest(host, status, time.Since(start))
+	}
+	return res, err
+}
+
+// defaultLimiter returns the limiter of host without a limit of its own,
+// created on first use, or nil if unlimited by default.
+func (rt *customRoundTripper) defaultLimiter(host string) *rate.Limiter {
+	n := rt.config.RateLimitDefault
+	if n <= 0 {
+		return nil
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.defaultLimiters == nil {
+		rt.defaultLimiters = make(map[string]*rate.Limiter)
+	}
+	limiter, ok := rt.defaultLimiters[host]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(n), n)
+		rt.defaultLimiters[host] = limiter
+	}
+	return limiter
 }
 
 // Some "best effort" browser-like headers to mitigate bot detection.
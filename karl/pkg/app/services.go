@@ -0,0 +1,14 @@
+package app
+
+// Services register themselves on import. Others (e.g. private ones of a
+// fork) can be added by importing them in a file of their own, optionally
+// behind a build tag.
+import (
+	_ "karl/pkg/service/amazon"
+	_ "karl/pkg/service/cbcgem"
+	_ "karl/pkg/service/channel4"
+	_ "karl/pkg/service/hotstar"
+	_ "karl/pkg/service/max"
+	_ "karl/pkg/service/sbs"
+	_ "karl/pkg/service/svt"
+)
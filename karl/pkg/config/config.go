@@ -2,15 +2,90 @@ package config
 
 import (
 	"net/http/cookiejar"
+	"time"
 
 	"golang.org/x/time/rate"
+	"karl/pkg/metrics"
+	"karl/pkg/model"
 )
 
 type AppConfig struct {
-	CountryCode    string
-	OutDir         string
-	NoIndent       bool
-	CookieJar      *cookiejar.Jar
-	RequestLimiter map[string]*rate.Limiter
-	Verbose        bool
+	CountryCode        string
+	OutDir             string
+	NoIndent           bool
+	URLNormalize       string
+	SVTCategory        string
+	CookieJar          *cookiejar.Jar
+	CacheDir           string
+	RequestLimiter     map[string]*rate.Limiter
+	RateLimitDefault   int
+	Resolve            map[string]string
+	Proxy              string
+	Verbose            bool
+	StreamThreshold    int
+	TimeoutPerURL      time.Duration
+	NameBy             string
+	OutputFormat       string
+	AppendTo           string
+	Format             string
+	Sort               string
+	AllEdits           bool
+	IncludeUnentitled  bool
+	ExpandEpisodes     bool
+	AmazonProfile      DeviceProfile
+	AmazonUHDDeviceID  string
+	AllCDNs            bool
+	BothEncodings      bool
+	Kinds              []string
+	IncludeTrickplay   bool
+	Thumbnails         bool
+	IncludeUHD         bool
+	IncludeBonus       bool
+	IncludeAddressing  bool
+	CodecsRequired     bool
+	ProbeInit          bool
+	HLSParts           bool
+	WalkFragments      bool
+	Summary            bool
+	VideoConcurrency   int
+	VariantConcurrency int
+	SegmentConcurrency int
+	Stealth            bool
+	LiveWindow         bool
+	LiveDuration       time.Duration
+	ValidateLadder     bool
+	DurationTolerance  float64
+	ContentLengthGET   bool
+	AllowPartial       bool
+	Retries            int
+	RetryBackoff       time.Duration
+	PermanentFailures  int
+	HashSegments       int
+	HashMaxBytes       int64
+	MaxManifestBytes   int64
+	StallWarning       time.Duration
+	// BandwidthLimiter, if set, limits the bytes per second of segments
+	// downloaded to be hashed, across variants.
+	BandwidthLimiter *rate.Limiter
+	// Progress, if set, is called as segments of explicitly addressed
+	// variants are fetched.
+	Progress func(model.FingerprintProgress)
+	// MetricsAddr is the address metrics are served at, if any.
+	MetricsAddr string
+	// Metrics, set if served, are of the requests, extractions and
+	// fingerprints of the run.
+	Metrics *metrics.Metrics
+}
+
+// DeviceProfile is of the device playback is requested as, where
+// configurable by service. Zero fields are of the default device.
+type DeviceProfile struct {
+	Codec         string
+	Quality       string
+	DRM           string
+	DisplayWidth  int
+	DisplayHeight int
+	// Query are parameters added to playback requests, replacing those
+	// of the same name.
+	Query map[string]string
 }
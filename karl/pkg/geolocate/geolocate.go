@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -32,9 +33,15 @@ func CountryCode(ctx context.Context) (string, error) {
 		return "", fmt.Errorf("decode body: %w", err)
 	}
 
-	if r.Location.CountryCode == "" {
+	// Normalized like the one set, as an uppercase two-letter (alpha-2)
+	// code.
+	countryCode := strings.ToUpper(strings.TrimSpace(r.Location.CountryCode))
+	if countryCode == "" {
 		return "", fmt.Errorf("no country code")
 	}
+	if len(countryCode) != 2 || strings.Trim(countryCode, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return "", fmt.Errorf("invalid two-letter country code: %q", r.Location.CountryCode)
+	}
 
-	return r.Location.CountryCode, nil
+	return countryCode, nil
 }
@@ -0,0 +1,207 @@
+// Package metrics keeps the counters and histograms of a run, of requests
+// by host and status, extractions and fingerprint durations, served in
+// the Prometheus text format for monitoring long crawls. A nil *Metrics
+// keeps none.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// requestBuckets are the upper bounds of request durations, in
+	// seconds.
+	requestBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	// fingerprintBuckets are the upper bounds of fingerprint durations,
+	// in seconds.
+	fingerprintBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+)
+
+type Metrics struct {
+	mu sync.Mutex
+
+	requests         map[[2]string]uint64
+	requestDurations map[string]*histogram
+
+	extractions          map[[2]string]uint64
+	videos               map[[2]string]uint64
+	fingerprintDurations map[string]*histogram
+
+	gauges []gauge
+}
+
+// gauge is a value read as written, e.g. of requests in flight.
+type gauge struct {
+	name, help string
+	value      func() float64
+}
+
+func New() *Metrics {
+	return &Metrics{
+		requests:             make(map[[2]string]uint64),
+		requestDurations:     make(map[string]*histogram),
+		extractions:          make(map[[2]string]uint64),
+		videos:               make(map[[2]string]uint64),
+		fingerprintDurations: make(map[string]*histogram),
+	}
+}
+
+// ObserveRequest counts a request to host, of its response status, or
+// "error" if none (0), and its duration.
+func (m *Metrics) ObserveRequest(host string, status int, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	code := "error"
+	if status > 0 {
+		code = strconv.Itoa(status)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[[2]string{host, code}]++
+	observe(m.requestDurations, host, requestBuckets, d)
+}
+
+// ObserveExtract counts an extraction of a URL of service, succeeded or
+// failed, and its videos fingerprinted and failed.
+func (m *Metrics) ObserveExtract(service string, ok bool, numVideos, numFailed int) {
+	if m == nil {
+		return
+	}
+
+	outcome := "success"
+	if !ok {
+		outcome = "failure"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.extractions[[2]string{service, outcome}]++
+	m.videos[[2]string{service, "fingerprinted"}] += uint64(numVideos)
+	m.videos[[2]string{service, "failed"}] += uint64(numFailed)
+}
+
+// ObserveFingerprint records the duration of fingerprinting a variant of
+// service.
+func (m *Metrics) ObserveFingerprint(service string, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	observe(m.fingerprintDurations, service, fingerprintBuckets, d)
+}
+
+// Gauge adds a gauge of name, whose value is read as written.
+func (m *Metrics) Gauge(name, help string, value func() float64) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.gauges = append(m.gauges, gauge{name: name, help: help, value: value})
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	writeCounter(&b, "karl_http_requests_total", "Requests by host and response status.", []string{"host", "code"}, m.requests)
+	writeHistogram(&b, "karl_http_request_duration_seconds", "Durations of requests by host, rate limiting excluded.", "host", m.requestDurations)
+	writeCounter(&b, "karl_extractions_total", "Extractions of URLs by service and outcome.", []string{"service", "outcome"}, m.extractions)
+	writeCounter(&b, "karl_videos_total", "Videos of URLs extracted by service and outcome.", []string{"service", "outcome"}, m.videos)
+	writeHistogram(&b, "karl_fingerprint_duration_seconds", "Durations of fingerprinting variants by service.", "service", m.fingerprintDurations)
+	for _, g := range m.gauges {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, strconv.FormatFloat(g.value(), 'g', -1, 64))
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+type histogram struct {
+	bounds []float64
+	// counts are of observations of each bucket, not cumulative.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func observe(hs map[string]*histogram, key string, bounds []float64, d time.Duration) {
+	h, ok := hs[key]
+	if !ok {
+		h = &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+		hs[key] = h
+	}
+
+	s := d.Seconds()
+	if i, _ := slices.BinarySearch(h.bounds, s); i < len(h.bounds) {
+		h.counts[i]++
+	}
+	h.sum += s
+	h.count++
+}
+
+func writeCounter(b *strings.Builder, name, help string, labels []string, values map[[2]string]uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, k := range slices.SortedFunc(maps.Keys(values), compareKeys) {
+		fmt.Fprintf(b, "%s{%s=%s,%s=%s} %d\n", name, labels[0], quote(k[0]), labels[1], quote(k[1]), values[k])
+	}
+}
+
+func writeHistogram(b *strings.Builder, name, help, label string, hs map[string]*histogram) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, k := range slices.Sorted(maps.Keys(hs)) {
+		var (
+			h   = hs[k]
+			l   = label + "=" + quote(k)
+			cum uint64
+		)
+		for i, bound := range h.bounds {
+			cum += h.counts[i]
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%s\"} %d\n", name, l, strconv.FormatFloat(bound, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, l, h.count)
+		fmt.Fprintf(b, "%s_sum{%s} %s\n", name, l, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(b, "%s_count{%s} %d\n", name, l, h.count)
+	}
+}
+
+func compareKeys(a, b [2]string) int {
+	if c := strings.Compare(a[0], b[0]); c != 0 {
+		return c
+	}
+	return strings.Compare(a[1], b[1])
+}
+
+// labelQuoter escapes label values as of the text format.
+var labelQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quote returns a label value escaped and quoted.
+func quote(s string) string {
+	return `"` + labelQuoter.Replace(s) + `"`
+}
@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGauge(t *testing.T) {
+	var (
+		m = New()
+		n float64
+	)
+	m.Gauge("karl_segments_in_flight", "Segments of variants being sized (or hashed).", func() float64 { return n })
+
+	for _, n = range []float64{0, 12} {
+		var b strings.Builder
+		if _, err := m.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		want := "# TYPE karl_segments_in_flight gauge\nkarl_segments_in_flight " + map[float64]string{0: "0", 12: "12"}[n] + "\n"
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("metrics %q, want containing %q", b.String(), want)
+		}
+	}
+
+	var nilMetrics *Metrics
+	nilMetrics.Gauge("karl_segments_in_flight", "", func() float64 { return 0 })
+}
@@ -2,6 +2,8 @@ package model
 
 import (
 	"fmt"
+	"math"
+	"slices"
 	"time"
 )
 
@@ -12,11 +14,34 @@ type (
 	}
 
 	ExtractResult struct {
-		Service      string  `json:"service"`
-		URL          string  `json:"url"`
-		Videos       []Video `json:"videos"`
-		NumFailed    int     `json:"num_failed"`
-		FailedErrors []error `json:"-"`
+		Service             string  `json:"service"`
+		URL                 string  `json:"url"`
+		Videos              []Video `json:"videos"`
+		NumFailed           int     `json:"num_failed"`
+		NumDurationWarnings int     `json:"num_duration_warnings,omitempty"`
+		FailedErrors        []error `json:"-"`
+		// Warnings are of videos extracted nonetheless (e.g. of
+		// validation), not counted as failed.
+		Warnings []error `json:"-"`
+
+		// Seasons are of the series extracted, where told by the
+		// service, FailedSeasons those of which a season or episode
+		// failed.
+		Seasons       []int32 `json:"seasons,omitempty"`
+		FailedSeasons []int32 `json:"failed_seasons,omitempty"`
+
+		// Failures are of the videos failed, as counted by NumFailed.
+		Failures []Failure `json:"failures,omitempty"`
+	}
+
+	// Failure is of a video failed, of its season and episode where
+	// told, classed by Reason: "not_entitled", "session_required",
+	// "geo_blocked", "live_event" or "error".
+	Failure struct {
+		Season  int32  `json:"season,omitempty"`
+		Episode int32  `json:"episode,omitempty"`
+		Reason  string `json:"reason"`
+		Error   string `json:"error"`
 	}
 
 	FingerprintResult struct {
@@ -31,57 +56,306 @@ type (
 		PlaybackURL string     `json:"playback_url"`
 		Duration    int32      `json:"duration"`
 		ExpiresAt   *time.Time `json:"expires_at"`
+		Description string     `json:"description,omitempty"`
+		AirDate     *time.Time `json:"air_date,omitempty"`
+		Genres      []string   `json:"genres,omitempty"`
 		Variants    []Variant  `json:"variants"`
+
+		// Availability is how the video is offered, where told by the
+		// service, e.g. "PRIME", "FVOD" (free with ads), "TVOD" (to
+		// rent or buy) or the channel subscribed to.
+		Availability string `json:"availability,omitempty"`
+
+		// Edit is the ID of the edit (e.g. theatrical or extended cut)
+		// of the video fingerprinted, set where several are extracted.
+		Edit string `json:"edit,omitempty"`
+
+		// MediaType is set for videos other than the title itself, e.g.
+		// "bonus" for its extras (featurettes, trailers).
+		MediaType string `json:"media_type,omitempty"`
+
+		// Thumbnails are the thumbnail (storyboard) tracks of the
+		// video, not fingerprinted, if asked for.
+		Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+
+		LadderWarnings   []string          `json:"ladder_warnings,omitempty"`
+		DurationWarnings []DurationWarning `json:"duration_warnings,omitempty"`
+	}
+
+	// Thumbnail is a track of images each tiled with Columns by Rows
+	// thumbnails of Width by Height, of Duration seconds each. URL is of
+	// the media playlist (HLS) or the template of the images (DASH, e.g.
+	// with $Number$). The geometry is zero where not told.
+	Thumbnail struct {
+		URL       string  `json:"url"`
+		MimeType  string  `json:"mime_type,omitempty"`
+		Codecs    string  `json:"codecs,omitempty"`
+		Bandwidth uint32  `json:"bandwidth,omitempty"`
+		Width     uint32  `json:"width,omitempty"`
+		Height    uint32  `json:"height,omitempty"`
+		Columns   uint32  `json:"columns,omitempty"`
+		Rows      uint32  `json:"rows,omitempty"`
+		Duration  float64 `json:"duration,omitempty"`
+	}
+
+	// DurationWarning is of a variant whose fingerprint is shorter or
+	// longer than expected, by the video metadata or the median of the
+	// other variants of its kind ("metadata" or "variants"). Durations
+	// are in seconds.
+	DurationWarning struct {
+		Width     uint32  `json:"width"`
+		Height    uint32  `json:"height"`
+		Bandwidth uint32  `json:"bandwidth"`
+		Language  string  `json:"language,omitempty"`
+		Kind      string  `json:"kind,omitempty"`
+		Duration  float64 `json:"duration"`
+		Expected  float64 `json:"expected"`
+		Source    string  `json:"source"`
 	}
 
 	VideoResult struct {
 		Video      Video
 		References []Reference
 		Err        error
+
+		// Season and Episode are the numbers of the video (or failure)
+		// in its series, where known.
+		Season  int32
+		Episode int32
+
+		// Seasons, sent in a result of its own, without video nor
+		// error, are the season numbers of the series extracted.
+		Seasons []int32
 	}
 
+	// Reference is a manifest of a video. Language and Kind are empty
+	// if not provided by the service, an empty Kind meaning main. CDN is
+	// set where manifests of several CDNs are extracted, and Encoding,
+	// the bitrate adaptation (e.g. CVBR or CBR), where of several
+	// encodes, or of both if one manifest is of either.
 	Reference struct {
-		ID      string
-		Format  string
-		URL     string
-		Servers []string
+		ID       string
+		Format   string
+		URL      string
+		Servers  []string
+		Language string
+		Kind     string
+		CDN      string
+		Encoding string
 	}
 
 	Variant struct {
-		ID        string `json:"-"`
-		MimeType  string `json:"mime_type"`
-		Codecs    string `json:"codecs"`
-		Width     uint32 `json:"width"`
-		Height    uint32 `json:"height"`
-		Bandwidth uint32 `json:"bandwidth"`
+		ID          string `json:"-"`
+		Type        string `json:"type,omitempty"`
+		MimeType    string `json:"mime_type"`
+		Codecs      string `json:"codecs"`
+		AudioCodecs string `json:"audio_codecs,omitempty"`
+		Width       uint32 `json:"width"`
+		Height      uint32 `json:"height"`
+		Bandwidth   uint32 `json:"bandwidth"`
+
+		FrameRate        float64 `json:"frame_rate,omitempty"`
+		AverageBandwidth uint32  `json:"average_bandwidth,omitempty"`
+		DynamicRange     string  `json:"dynamic_range,omitempty"`
+		Score            float64 `json:"score,omitempty"`
+
+		Protection []Protection `json:"protection,omitempty"`
+		Language   string       `json:"language,omitempty"`
+		Kind       string       `json:"kind,omitempty"`
+		CDN        string       `json:"cdn,omitempty"`
+		Encoding   string       `json:"encoding,omitempty"`
+
+		// Set for a live (or event) HLS playlist, fingerprinted as the
+		// window of media sequence numbers published at SnapshotTime.
+		Live               bool       `json:"live,omitempty"`
+		SnapshotTime       *time.Time `json:"snapshot_time,omitempty"`
+		MediaSequenceStart int        `json:"media_sequence_start,omitempty"`
+		MediaSequenceEnd   int        `json:"media_sequence_end,omitempty"`
+
+		// Thumbnail is set for a thumbnail track (of type "image"),
+		// moved to the video rather than fingerprinted.
+		Thumbnail *Thumbnail `json:"-"`
 
 		AddressingMode         string                  `json:"-"`
 		IndexedAddressingInfo  *IndexedAddressingInfo  `json:"-"`
 		ExplicitAddressingInfo *ExplicitAddressingInfo `json:"-"`
 
+		// Addressing is set to output the above, if opted in, as the
+		// segment URLs may be many.
+		Addressing *Addressing `json:"addressing,omitempty"`
+
 		Fingerprint *Fingerprint `json:"fingerprint"`
 	}
 
+	// Addressing is how the segments of a variant are addressed: by an
+	// index in the file ("indexed") or one by one ("explicit").
+	Addressing struct {
+		Mode     string                  `json:"mode"`
+		Indexed  *IndexedAddressingInfo  `json:"indexed,omitempty"`
+		Explicit *ExplicitAddressingInfo `json:"explicit,omitempty"`
+	}
+
+	// Protection describes the encryption of segments from FirstSegment
+	// up to the next protection entry of the variant. Session entries
+	// are advertised in the multivariant playlist only.
+	Protection struct {
+		Method       string `json:"method"`
+		KeyFormat    string `json:"key_format,omitempty"`
+		IV           bool   `json:"iv,omitempty"`
+		FirstSegment int    `json:"first_segment"`
+		Session      bool   `json:"session,omitempty"`
+	}
+
 	IndexedAddressingInfo struct {
-		URL        string
-		IndexRange string
+		URL        string `json:"url"`
+		IndexRange string `json:"index_range,omitempty"`
+		InitRange  string `json:"init_range,omitempty"`
 	}
 
 	ExplicitAddressingInfo struct {
-		TemplateURL      string
-		URLs             []string
-		Servers          []string
-		SegmentDurations []uint32
-		Timescale        uint32
+		TemplateURL      string   `json:"template_url,omitempty"`
+		Granularity      string   `json:"granularity,omitempty"`
+		InitURL          string   `json:"init_url,omitempty"`
+		InitSize         uint32   `json:"init_size,omitempty"`
+		URLs             []string `json:"urls"`
+		Servers          []string `json:"servers,omitempty"`
+		SegmentSizes     []uint32 `json:"segment_sizes,omitempty"`
+		SegmentDurations []uint32 `json:"segment_durations"`
+		Timescale        uint32   `json:"timescale"`
+		Gaps             []Gap    `json:"gaps,omitempty"`
+		Discontinuities  []int    `json:"discontinuities,omitempty"`
 	}
 
 	Fingerprint struct {
+		Granularity      string   `json:"granularity,omitempty"`
+		InitSegmentSize  uint32   `json:"init_segment_size,omitempty"`
 		SegmentSizes     []uint32 `json:"segment_sizes"`
 		SegmentDurations []uint32 `json:"segment_durations"`
 		Timescale        uint32   `json:"timescale"`
+		Gaps             []Gap    `json:"gaps,omitempty"`
+		Discontinuities  []int    `json:"discontinuities,omitempty"`
+		Summary          *Summary `json:"summary,omitempty"`
+
+		// Set for indexed MP4 from the (first top-level) sidx: its byte
+		// range in the file, the distance from its end to the first
+		// segment and the presentation time of that, as in the box.
+		SIDXRange                string `json:"sidx_range,omitempty"`
+		FirstOffset              uint64 `json:"first_offset,omitempty"`
+		EarliestPresentationTime uint64 `json:"earliest_presentation_time,omitempty"`
+
+		// Set for indexed variants: the byte range ("start-end") of each
+		// segment in the file, to request exactly.
+		SegmentRanges []string `json:"segment_ranges,omitempty"`
+
+		// Indices of segments that couldn't be measured, with sizes 0.
+		// Only set if partial fingerprints are allowed.
+		MissingSegments []uint32 `json:"missing_segments,omitempty"`
+
+		// Set if segments were downloaded and hashed (opt-in), up to a
+		// cap. Segments not hashed within it have empty hashes.
+		HashAlgorithm string   `json:"hash_algorithm,omitempty"`
+		SegmentHashes []string `json:"segment_hashes,omitempty"`
+	}
+
+	// Summary is computed from the segment sizes and durations of a
+	// fingerprint, to ease judging its plausibility. Sizes are in bytes
+	// and durations in seconds.
+	Summary struct {
+		NumSegments   int     `json:"num_segments"`
+		TotalSize     uint64  `json:"total_size"`
+		MeanSize      float64 `json:"mean_size"`
+		MedianSize    float64 `json:"median_size"`
+		StddevSize    float64 `json:"stddev_size"`
+		TotalDuration float64 `json:"total_duration"`
+	}
+
+	// FingerprintProgress reports the segments of a variant measured so
+	// far, of Total, while they're fetched. URL is that of the first
+	// segment, identifying the variant. Finished is set on the last.
+	FingerprintProgress struct {
+		VariantID string
+		URL       string
+		Done      int
+		Failed    int
+		Total     int
+		Finished  bool
+	}
+
+	// Gap is a segment marked as missing (e.g. EXT-X-GAP) preceding the
+	// segment at Index. It is not part of the segment sizes or durations.
+	Gap struct {
+		Index    int    `json:"index"`
+		Duration uint32 `json:"duration"`
 	}
 )
 
+// Summarize computes the summary of fp.
+func Summarize(fp Fingerprint) *Summary {
+	n := len(fp.SegmentSizes)
+	s := Summary{NumSegments: n}
+	if n == 0 {
+		return &s
+	}
+
+	for _, size := range fp.SegmentSizes {
+		s.TotalSize += uint64(size)
+	}
+	s.MeanSize = float64(s.TotalSize) / float64(n)
+
+	var variance float64
+	for _, size := range fp.SegmentSizes {
+		d := float64(size) - s.MeanSize
+		variance += d * d
+	}
+	s.StddevSize = math.Sqrt(variance / float64(n))
+
+	sorted := slices.Clone(fp.SegmentSizes)
+	slices.Sort(sorted)
+	if n%2 == 1 {
+		s.MedianSize = float64(sorted[n/2])
+	} else {
+		s.MedianSize = (float64(sorted[n/2-1]) + float64(sorted[n/2])) / 2
+	}
+
+	s.TotalDuration = fp.SegmentsDuration()
+
+	return &s
+}
+
+// SegmentsDuration returns the duration of the segments of fp in seconds,
+// or 0 if it has no timescale.
+func (fp Fingerprint) SegmentsDuration() float64 {
+	if fp.Timescale == 0 {
+		return 0
+	}
+	var total uint64
+	for _, d := range fp.SegmentDurations {
+		total += uint64(d)
+	}
+	return float64(total) / float64(fp.Timescale)
+}
+
+// Duration returns the duration of the content of fp in seconds, that of
+// the segments and of the gaps between them, or 0 if it has no timescale.
+func (fp Fingerprint) Duration() float64 {
+	if fp.Timescale == 0 {
+		return 0
+	}
+	var gaps uint64
+	for _, g := range fp.Gaps {
+		gaps += uint64(g.Duration)
+	}
+	return fp.SegmentsDuration() + float64(gaps)/float64(fp.Timescale)
+}
+
+const (
+	KindMain             = "main"
+	KindAudioDescription = "audio-desc"
+	KindTrailer          = "trailer"
+)
+
+const MediaTypeBonus = "bonus"
+
 func OneTitle(main, secondary string, season, episode int32) string {
 	title := main
 	if season > 0 || episode > 0 {
@@ -0,0 +1,110 @@
+package model
+
+import "math"
+
+// minSimilarityBins is the fewest bins of bitrate correlated, as a
+// correlation of fewer is as likely by chance (e.g. of any 2, ±1).
+const minSimilarityBins = 8
+
+// Similarity returns how similar fp and other are, from 0 (unrelated) to
+// 1 (same content). The segment sizes are spread over their durations
+// into a bitrate over time, at the resolution of the longer mean segment
+// duration of both, which is correlated between both at the offset that
+// matches best. That way fingerprints of the same content are similar
+// regardless of variant, timescale or segmentation, and even with content
+// (e.g. ads) before or after that of the other. Fingerprints shorter
+// than minSimilarityBins bins are taken as unrelated.
+func (fp Fingerprint) Similarity(other Fingerprint) float64 {
+	bin := max(fp.meanDuration(), other.meanDuration())
+	if bin == 0 {
+		return 0
+	}
+	a, b := fp.bitrate(bin), other.bitrate(bin)
+	shortest := min(len(a), len(b))
+	if shortest < minSimilarityBins {
+		return 0
+	}
+
+	// At least half of the shorter one has to overlap.
+	minOverlap := max(shortest/2, minSimilarityBins)
+
+	best := 0.0
+	for offset := minOverlap - len(b); offset <= len(a)-minOverlap; offset++ {
+		start, end := max(0, offset), min(len(a), len(b)+offset)
+		if r := correlate(a[start:end], b[start-offset:end-offset]); r > best {
+			best = r
+		}
+	}
+
+	return best
+}
+
+// meanDuration returns the mean segment duration of fp in seconds, or 0
+// if it has no timescale or segments.
+func (fp Fingerprint) meanDuration() float64 {
+	if len(fp.SegmentDurations) == 0 {
+		return 0
+	}
+	return fp.SegmentsDuration() / float64(len(fp.SegmentDurations))
+}
+
+// bitrate returns the bytes per second of fp in bins of bin seconds, or
+// nil if it has no timescale.
+func (fp Fingerprint) bitrate(bin float64) []float64 {
+	if fp.Timescale == 0 || len(fp.SegmentSizes) != len(fp.SegmentDurations) {
+		return nil
+	}
+
+	var total uint64
+	for _, d := range fp.SegmentDurations {
+		total += uint64(d)
+	}
+	timescale := float64(fp.Timescale)
+	bins := make([]float64, int(math.Ceil(float64(total)/timescale/bin)))
+
+	var t uint64
+	for i, size := range fp.SegmentSizes {
+		d := fp.SegmentDurations[i]
+		if d == 0 {
+			continue
+		}
+		var (
+			start = float64(t) / timescale
+			end   = float64(t+uint64(d)) / timescale
+			rate  = float64(size) / (end - start)
+		)
+		for j := int(start / bin); j < len(bins) && float64(j)*bin < end; j++ {
+			overlap := min(end, float64(j+1)*bin) - max(start, float64(j)*bin)
+			bins[j] += rate * overlap / bin
+		}
+		t += uint64(d)
+	}
+
+	return bins
+}
+
+// correlate returns the Pearson correlation of a and b, of equal length,
+// or 0 if either is constant.
+func correlate(a, b []float64) float64 {
+	n := float64(len(a))
+	var meanA, meanB float64
+	for i := range a {
+		meanA += a[i]
+		meanB += b[i]
+	}
+	meanA /= n
+	meanB /= n
+
+	var cov, varA, varB float64
+	for i := range a {
+		da, db := a[i]-meanA, b[i]-meanB
+		cov += da * db
+		varA += da * da
+		varB += db * db
+	}
+	if varA == 0 || varB == 0 {
+		return 0
+	}
+
+	return cov / math.Sqrt(varA*varB)
+}
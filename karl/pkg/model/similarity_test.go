@@ -0,0 +1,53 @@
+package model
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// testFingerprint returns a fingerprint of segments of sizes, of 2s each.
+func testFingerprint(sizes []uint32) Fingerprint {
+	fp := Fingerprint{Timescale: 1000, SegmentSizes: sizes}
+	for range sizes {
+		fp.SegmentDurations = append(fp.SegmentDurations, 2000)
+	}
+	return fp
+}
+
+func randomSizes(r *rand.Rand, n int) []uint32 {
+	sizes := make([]uint32, n)
+	for i := range sizes {
+		sizes[i] = 500_000 + uint32(r.Intn(1_000_000))
+	}
+	return sizes
+}
+
+func TestSimilarity(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	content := randomSizes(r, 60)
+
+	// Of another variant: the same shape at half the bitrate, with an ad
+	// of 10 segments before.
+	shifted := randomSizes(r, 10)
+	for _, size := range content {
+		shifted = append(shifted, size/2)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		a, b     []uint32
+		min, max float64
+	}{
+		{"identical", content, content, 0.999, 1},
+		{"shifted", content, shifted, 0.99, 1},
+		{"unrelated", content, randomSizes(r, 60), 0, 0.6},
+		{"too short", content[:minSimilarityBins-1], content[:minSimilarityBins-1], 0, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testFingerprint(tt.a).Similarity(testFingerprint(tt.b))
+			if s < tt.min || s > tt.max {
+				t.Errorf("similarity = %f, want in [%f, %f]", s, tt.min, tt.max)
+			}
+		})
+	}
+}
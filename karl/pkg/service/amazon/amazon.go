@@ -1,10 +1,14 @@
 package amazon
 
 import (
+	"cmp"
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"maps"
 	"net/http"
 	urlpkg "net/url"
 	"regexp"
@@ -19,31 +23,62 @@ import (
 )
 
 var (
-	_ service.Client           = (*amazon)(nil)
-	_ service.URLExtractor     = (*amazon)(nil)
-	_ service.VideoExtractor   = (*amazon)(nil)
-	_ service.VariantExtractor = (*amazon)(nil)
-	_ service.Fingerprinter    = (*amazon)(nil)
+	_ service.Client            = (*amazon)(nil)
+	_ service.URLExtractor      = (*amazon)(nil)
+	_ service.JustWatchProvider = (*amazon)(nil)
+	_ service.VideoExtractor    = (*amazon)(nil)
+	_ service.VariantExtractor  = (*amazon)(nil)
+	_ service.Fingerprinter     = (*amazon)(nil)
+	_ service.ThrottleReporter  = (*amazon)(nil)
 )
 
 type amazon struct {
 	config            *config.AppConfig
 	httpClient        *http.Client
+	index             *service.IndexCache
 	regex             *regexp.Regexp
 	origin            string
 	justWatchPackages []string
+	throttler         *service.Throttler
+	// uhdDeviceID is the ID of the living room client UHD playback is
+	// requested as.
+	uhdDeviceID string
+
+	mu sync.Mutex
+	// sessions are whether the jar has a session, by marketplace, and
+	// warned whether its absence was logged.
+	sessions map[string]bool
+	warned   map[string]bool
+}
+
+func init() {
+	service.Register(New)
 }
 
 func New(config *config.AppConfig, httpClient *http.Client) service.Client {
-	return &amazon{
+	c := &amazon{
 		config:     config,
 		httpClient: httpClient,
+		index:      service.NewIndexCache(),
 		regex: regexp.MustCompile(
 			`((?:amazon|primevideo)\.[^/]+).*(?:(?:(?:gti|asin|creativeASIN)=|(?:detail|dp)/)([\w\.\-]+))`,
 		),
 		origin:            "https://www.primevideo.com",
 		justWatchPackages: []string{"amp", "prv"},
+		throttler:         service.NewThrottler(config),
+		uhdDeviceID:       cmp.Or(config.AmazonUHDDeviceID, newDeviceID()),
+		sessions:          make(map[string]bool),
+		warned:            make(map[string]bool),
+	}
+	for _, domain := range marketplaces {
+		c.sessions[domain] = c.findSession(domain)
 	}
+
+	return c
+}
+
+func (c *amazon) NumThrottled() int64 {
+	return c.throttler.Count()
 }
 
 func (c *amazon) ID() service.ID {
@@ -54,6 +89,10 @@ func (c *amazon) ExtractURLs(ctx context.Context) ([]string, error) {
 	return service.NewJustWatchURLExtractor(c.config, c.httpClient, c.justWatchPackages).ExtractURLs(ctx)
 }
 
+func (c *amazon) JustWatchPackages() []string {
+	return c.justWatchPackages
+}
+
 func (c *amazon) Matches(url string) bool {
 	return c.regex.MatchString(url)
 }
@@ -73,7 +112,7 @@ func (c *amazon) ExtractVariants(ctx context.Context, reference model.Reference)
 }
 
 func (c *amazon) Fingerprint(ctx context.Context, variant model.Variant) (model.Fingerprint, error) {
-	return service.NewDefaultFingerprinter(c.config, c.httpClient, c.origin).Fingerprint(ctx, variant)
+	return service.NewDefaultFingerprinter(c.config, c.httpClient, c.origin, c.index).Fingerprint(ctx, variant)
 }
 
 func (c *amazon) extract(ctx context.Context, url string) <-chan model.VideoResult {
@@ -88,17 +127,26 @@ func (c *amazon) extract(ctx context.Context, url string) <-chan model.VideoResu
 	go func() {
 		defer close(results)
 
+		c.hasSession(domain)
+
 		w, err := c.extractDetailPageWidgets(ctx, domain, id)
 		if err != nil {
 			results <- model.VideoResult{Err: err}
 			return
 		}
 
+		if w.isEvent() {
+			c.sendEvent(ctx, domain, id, w.event(), results)
+			return
+		}
+
 		switch t := w.PageContext.SubPageType; t {
 		case "Movie":
 			c.sendMovie(ctx, domain, id, w.movie(), results)
 		case "Season":
 			c.sendSeries(ctx, domain, id, w.season(), results)
+		case "Episode":
+			c.sendEpisode(ctx, domain, id, w, results)
 		default:
 			results <- model.VideoResult{Err: fmt.Errorf("page type %q", t)}
 		}
@@ -121,10 +169,13 @@ type (
 
 		Header struct {
 			Detail detailPageDetail `json:"detail"`
+			Event  detailPageEvent  `json:"event"`
 		} `json:"header"`
 
 		BuyBox struct {
 			Action detailPageAction `json:"action"`
+			// Badges are of the title, e.g. "LIVE" of live events.
+			Badges []string `json:"badges"`
 		} `json:"buybox"`
 
 		SeasonSelector []struct {
@@ -132,30 +183,25 @@ type (
 			IsSelected bool   `json:"isSelected"`
 		} `json:"seasonSelector"`
 
-		EpisodeList struct {
-			Actions struct {
-				Pagination []detailPagePagination `json:"pagination"`
-			} `json:"actions"`
+		EpisodeList detailPageEpisodeList `json:"episodeList"`
 
-			Episodes []struct {
+		// BonusList is of the Bonus widget, the extras of the title.
+		BonusList struct {
+			Items []struct {
 				Self   detailPageSelf   `json:"self"`
 				Detail detailPageDetail `json:"detail"`
-			} `json:"episodes"`
-		} `json:"episodeList"`
+			} `json:"items"`
+		} `json:"bonusList"`
 	}
 
 	detailPageAction struct {
 		AcquisitionActions struct {
 			PrimaryWaysToWatch []struct {
-				Children []struct {
-					SType string `json:"sType"`
-				} `json:"children"`
+				Children []detailPageWayToWatch `json:"children"`
 			} `json:"primaryWaysToWatch"`
 
 			MoreWaysToWatch struct {
-				Children []struct {
-					SType string `json:"sType"`
-				} `json:"children"`
+				Children []detailPageWayToWatch `json:"children"`
 			} `json:"moreWaysToWatch"`
 		} `json:"acquisitionActions"`
 
@@ -168,6 +214,11 @@ type (
 		} `json:"playbackActions"`
 	}
 
+	detailPageWayToWatch struct {
+		SType     string `json:"sType"`
+		BenefitID string `json:"benefitId"`
+	}
+
 	detailPagePagination struct {
 		Token     string `json:"token"`
 		TokenType string `json:"tokenType"`
@@ -187,28 +238,37 @@ type (
 	}
 )
 
-func (a *detailPageAction) availableWithPrime() bool {
+// availability returns how the title is offered: with Prime ("PRIME"),
+// free with ads ("FVOD"), by subscription to a channel (its benefit) or
+// to rent or buy ("TVOD"), in that order of preference. Empty if none.
+func (a *detailPageAction) availability() string {
+	var ways []detailPageWayToWatch
 	for _, p := range a.AcquisitionActions.PrimaryWaysToWatch {
-		for _, c := range p.Children {
-			if c.SType == "PRIME" {
-				return true
-			}
-		}
+		ways = append(ways, p.Children...)
 	}
+	ways = append(ways, a.AcquisitionActions.MoreWaysToWatch.Children...)
 
-	for _, c := range a.AcquisitionActions.MoreWaysToWatch.Children {
-		if c.SType == "PRIME" {
-			return true
-		}
+	if slices.ContainsFunc(ways, func(w detailPageWayToWatch) bool { return w.SType == "PRIME" }) {
+		return "PRIME"
 	}
 
 	for _, c := range a.PlaybackActions.Main.Children {
 		if c.BenefitID == "freewithads" || c.BenefitID == "FVOD" {
-			return true
+			return "FVOD"
+		}
+	}
+
+	for _, w := range ways {
+		if (w.SType == "CHANNELS" || w.SType == "SVOD") && w.BenefitID != "" {
+			return w.BenefitID
 		}
 	}
 
-	return false
+	if slices.ContainsFunc(ways, func(w detailPageWayToWatch) bool { return w.SType == "TVOD" }) {
+		return "TVOD"
+	}
+
+	return ""
 }
 
 func (c *amazon) extractDetailPageWidgets(ctx context.Context, domain, id string) (*detailPageWidgets, error) {
@@ -217,36 +277,21 @@ func (c *amazon) extractDetailPageWidgets(ctx context.Context, domain, id string
 		return nil, fmt.Errorf("fetch detail page %q: %w", id, err)
 	}
 
-	if !res.Widgets.BuyBox.Action.availableWithPrime() {
-		return nil, fmt.Errorf("unavailable with prime %q", id)
-	}
-
-	var (
-		agg      = res
-		page     = res.Widgets.EpisodeList.Actions.Pagination
-		nextPage = func(p detailPagePagination) bool { return p.TokenType == "NextPage" }
-	)
-
-	for {
-		i := slices.IndexFunc(page, nextPage)
-		if i == -1 {
-			break
-		}
-
-		res, err = c.fetchDetailPage(ctx, domain, id, page[i].Token)
-		if err != nil {
-			return nil, fmt.Errorf("fetch detail page paginated %q: %w", id, err)
+	// Titles not included with Prime (or free) fail to play unless
+	// entitled otherwise, which is only tried if asked for.
+	switch res.Widgets.BuyBox.Action.availability() {
+	case "PRIME", "FVOD":
+	default:
+		if !c.config.IncludeUnentitled {
+			return nil, fmt.Errorf("unavailable with prime %q", id)
 		}
+	}
 
-		agg.Widgets.EpisodeList.Episodes = append(
-			agg.Widgets.EpisodeList.Episodes,
-			res.Widgets.EpisodeList.Episodes...,
-		)
-
-		page = res.Widgets.EpisodeList.Actions.Pagination
+	if err := c.fetchEpisodePages(ctx, domain, id, &res.Widgets.EpisodeList); err != nil {
+		return nil, err
 	}
 
-	return &agg.Widgets, nil
+	return &res.Widgets, nil
 }
 
 func (c *amazon) fetchDetailPage(ctx context.Context, domain, id, token string) (*detailPageResponse, error) {
@@ -258,6 +303,7 @@ func (c *amazon) fetchDetailPage(ctx context.Context, domain, id, token string)
 
 	req.Header.Set("Referer", refURL)
 	req.Header["x-requested-with"] = []string{"XMLHttpRequest"}
+	c.addCookies(req, domain)
 
 	res, err := c.httpClient.Do(req)
 	if err != nil {
@@ -312,37 +358,112 @@ func createURLs(domain, id, token string) (string, string) {
 	return url, refURL
 }
 
-type movie struct {
-	gti      string
-	link     string
-	title    string
-	duration int32
-}
+type (
+	movie struct {
+		gti          string
+		link         string
+		title        string
+		duration     int32
+		availability string
+		bonus        []bonus
+	}
+
+	bonus struct {
+		gti      string
+		link     string
+		title    string
+		duration int32
+	}
+)
 
 func (w *detailPageWidgets) movie() movie {
 	return movie{
-		gti:      w.Self.GTI,
-		link:     w.Self.Link,
-		title:    w.Header.Detail.Title,
-		duration: w.Header.Detail.Duration,
+		gti:          w.Self.GTI,
+		link:         w.Self.Link,
+		title:        w.Header.Detail.Title,
+		duration:     w.Header.Detail.Duration,
+		availability: w.BuyBox.Action.availability(),
+		bonus:        w.bonus(),
+	}
+}
+
+func (w *detailPageWidgets) bonus() []bonus {
+	var bs []bonus
+	for _, b := range w.BonusList.Items {
+		if b.Self.GTI == "" {
+			continue
+		}
+		bs = append(bs, bonus{
+			gti:      b.Self.GTI,
+			link:     b.Self.Link,
+			title:    b.Detail.Title,
+			duration: b.Detail.Duration,
+		})
 	}
+	return bs
 }
 
 func (c *amazon) sendMovie(ctx context.Context, domain, id string, m movie, results chan<- model.VideoResult) {
-	refs, err := c.extractVideoReferences(ctx, domain, m.gti)
-	if err != nil {
+	fail := func(err error) {
 		results <- model.VideoResult{Err: fmt.Errorf("extract movie reference %q: %w", id, err)}
-		return
 	}
 
-	results <- model.VideoResult{
-		Video: model.Video{
-			ID:          m.gti,
-			Title:       m.title,
-			PlaybackURL: "https://www." + domain + m.link,
-			Duration:    m.duration,
-		},
-		References: refs,
+	l := service.NewVideoLimiter(c.config)
+	l.Go(ctx, func() {
+		refs, err := c.extractVideoReferences(ctx, domain, m.gti)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		results <- model.VideoResult{
+			Video: model.Video{
+				ID:           m.gti,
+				Title:        m.title,
+				PlaybackURL:  "https://www." + domain + m.link,
+				Duration:     m.duration,
+				Availability: m.availability,
+			},
+			References: refs,
+		}
+	}, fail)
+	// Bonus content plays on its own, whether the movie does or not.
+	if c.config.IncludeBonus {
+		c.sendBonus(ctx, l, domain, m.title, 0, m.availability, m.bonus, results)
+	}
+	l.Wait()
+}
+
+// sendBonus adds the sending of the videos of the bonus content of a
+// title (of season number, if of a series) titled title to l.
+func (c *amazon) sendBonus(ctx context.Context, l *service.VideoLimiter, domain, title string, number int32, availability string, bs []bonus, results chan<- model.VideoResult) {
+	for _, b := range bs {
+		fail := func(err error) {
+			results <- model.VideoResult{
+				Err:    fmt.Errorf("extract bonus reference %q: %w", b.gti, err),
+				Season: number,
+			}
+		}
+		l.Go(ctx, func() {
+			refs, err := c.extractVideoReferences(ctx, domain, b.gti)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			results <- model.VideoResult{
+				Video: model.Video{
+					ID:           b.gti,
+					Title:        model.OneTitle(title, b.title, 0, 0),
+					PlaybackURL:  "https://www." + domain + b.link,
+					Duration:     b.duration,
+					Availability: availability,
+					MediaType:    model.MediaTypeBonus,
+				},
+				References: refs,
+				Season:     number,
+			}
+		}, fail)
 	}
 }
 
@@ -350,8 +471,10 @@ type (
 	season struct {
 		seriesTitle         string
 		number              int32
+		availability        string
 		additionalSeasonIDs []string
 		episodes            []episode
+		bonus               []bonus
 	}
 
 	episode struct {
@@ -365,8 +488,10 @@ type (
 
 func (w *detailPageWidgets) season() season {
 	s := season{
-		seriesTitle: w.Header.Detail.ParentTitle,
-		number:      w.Header.Detail.SeasonNumber,
+		seriesTitle:  w.Header.Detail.ParentTitle,
+		number:       w.Header.Detail.SeasonNumber,
+		availability: w.BuyBox.Action.availability(),
+		bonus:        w.bonus(),
 	}
 
 	for _, ss := range w.SeasonSelector {
@@ -389,114 +514,270 @@ func (w *detailPageWidgets) season() season {
 	return s
 }
 
+// sendEpisode sends the video of the episode of an episode page, or of
+// its whole season if asked for and the season is selected on the page.
+func (c *amazon) sendEpisode(ctx context.Context, domain, id string, w *detailPageWidgets, results chan<- model.VideoResult) {
+	l := service.NewVideoLimiter(c.config)
+	defer l.Wait()
+
+	if c.config.ExpandEpisodes {
+		if sid := w.selectedSeasonID(); sid != "" {
+			sw, err := c.extractDetailPageWidgets(ctx, domain, sid)
+			if err != nil {
+				results <- model.VideoResult{Err: err}
+				return
+			}
+			c.sendSeason(ctx, l, domain, sid, sw.season(), results)
+			return
+		}
+		if c.config.Verbose {
+			log.Printf("amazon: episode %q: no season selected, extracting the episode only\n", id)
+		}
+	}
+
+	c.sendSeason(ctx, l, domain, id, w.episode(), results)
+}
+
+// sendSeries sends the videos of the seasons of a series, of s and those
+// additional, their episodes and bonus content too, a limited number of
+// them fetched at a time.
 func (c *amazon) sendSeries(ctx context.Context, domain, id string, s season, results chan<- model.VideoResult) {
-	var wg sync.WaitGroup
+	l := service.NewVideoLimiter(c.config)
 	for _, id := range s.additionalSeasonIDs {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
+		fail := func(err error) {
+			results <- model.VideoResult{Err: err}
+		}
+		l.Go(ctx, func() {
 			w, err := c.extractDetailPageWidgets(ctx, domain, id)
 			if err != nil {
-				results <- model.VideoResult{Err: err}
+				fail(err)
 				return
 			}
 
-			c.sendSeason(ctx, domain, id, w.season(), results)
-		}()
+			c.sendSeason(ctx, l, domain, id, w.season(), results)
+		}, fail)
 	}
-	c.sendSeason(ctx, domain, id, s, results)
-	wg.Wait()
+	c.sendSeason(ctx, l, domain, id, s, results)
+	l.Wait()
 }
 
-func (c *amazon) sendSeason(ctx context.Context, domain, id string, s season, results chan<- model.VideoResult) {
-	var wg sync.WaitGroup
+// sendSeason adds the sending of the videos of the episodes of s, and
+// bonus content if asked for, to l.
+func (c *amazon) sendSeason(ctx context.Context, l *service.VideoLimiter, domain, id string, s season, results chan<- model.VideoResult) {
 	for _, e := range s.episodes {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
+		fail := func(err error) {
+			results <- model.VideoResult{
+				Err:     fmt.Errorf("extract season reference %q: %w", id, err),
+				Season:  s.number,
+				Episode: e.number,
+			}
+		}
+		l.Go(ctx, func() {
 			refs, err := c.extractVideoReferences(ctx, domain, e.gti)
 			if err != nil {
-				results <- model.VideoResult{
-					Err: fmt.Errorf("extract season reference %q: %w", id, err),
-				}
+				fail(err)
 				return
 			}
 
 			results <- model.VideoResult{
 				Video: model.Video{
-					ID:          e.gti,
-					Title:       model.OneTitle(s.seriesTitle, e.title, s.number, e.number),
-					PlaybackURL: "https://www." + domain + e.link,
-					Duration:    e.duration,
+					ID:           e.gti,
+					Title:        model.OneTitle(s.seriesTitle, e.title, s.number, e.number),
+					PlaybackURL:  "https://www." + domain + e.link,
+					Duration:     e.duration,
+					Availability: s.availability,
 				},
 				References: refs,
+				Season:     s.number,
+				Episode:    e.number,
 			}
-		}()
+		}, fail)
+	}
+	if c.config.IncludeBonus {
+		c.sendBonus(ctx, l, domain, s.seriesTitle, s.number, s.availability, s.bonus, results)
 	}
-	wg.Wait()
 }
 
+// episode returns the season of the episode of an episode page, of the
+// episode only, as of its header.
+func (w *detailPageWidgets) episode() season {
+	d := w.Header.Detail
+	return season{
+		seriesTitle:  d.ParentTitle,
+		number:       d.SeasonNumber,
+		availability: w.BuyBox.Action.availability(),
+		episodes: []episode{{
+			gti:      w.Self.GTI,
+			link:     w.Self.Link,
+			title:    d.Title,
+			duration: d.Duration,
+			number:   d.EpisodeNumber,
+		}},
+	}
+}
+
+// selectedSeasonID returns the ID of the season selected on the page, if
+// any.
+func (w *detailPageWidgets) selectedSeasonID() string {
+	for _, ss := range w.SeasonSelector {
+		if ss.IsSelected {
+			return ss.TitleID
+		}
+	}
+	return ""
+}
+
+// bitrateAdaptations are those requested of playback, both by default, or
+// each of its own if both encodes are asked for.
+const bitrateAdaptations = "CVBR,CBR"
+
 func (c *amazon) extractVideoReferences(ctx context.Context, domain, gti string) ([]model.Reference, error) {
 	if gti == "" {
 		return nil, errors.New("empty GTI")
 	}
 
-	refs := make([]model.Reference, 2)
+	qualities := []string{"sd", "hd"}
+	// UHD isn't allowed for all accounts and territories, so failing it
+	// only leaves its reference out.
+	if c.config.IncludeUHD {
+		qualities = append(qualities, "uhd")
+	}
+	encodings := []string{bitrateAdaptations}
+	if c.config.BothEncodings {
+		encodings = strings.Split(bitrateAdaptations, ",")
+	}
+
+	// refs are of each quality by encoding.
+	refs := make([][][]model.Reference, len(qualities))
 	g, ctx := errgroup.WithContext(ctx)
-	for i, quality := range []string{"sd", "hd"} {
-		g.Go(func() error {
-			ref, err := c.extractVideoReference(ctx, domain, gti, quality)
-			if err != nil {
-				return fmt.Errorf("extract video reference %q: %w", gti, err)
-			}
-			refs[i] = ref
-			return nil
-		})
+	for i, quality := range qualities {
+		refs[i] = make([][]model.Reference, len(encodings))
+		for j, encoding := range encodings {
+			g.Go(func() error {
+				qrefs, err := c.extractQualityReferences(ctx, domain, gti, quality, encoding)
+				if err != nil && quality == "uhd" {
+					if c.config.Verbose && ctx.Err() == nil {
+						log.Printf("amazon: %q: no UHD (%s): %v\n", gti, encoding, err)
+					}
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("extract video reference %q: %w", gti, err)
+				}
+				refs[i][j] = qrefs
+				return nil
+			})
+		}
 	}
 	err := g.Wait()
 
-	return refs, err
+	var all []model.Reference
+	for _, qrefs := range refs {
+		all = append(all, mergeEncodings(qrefs)...)
+	}
+	return all, err
+}
+
+// mergeEncodings returns the references of a quality of each encoding,
+// labeled with it if several, those of a manifest of several encodings
+// once, labeled with them all.
+func mergeEncodings(refs [][]model.Reference) []model.Reference {
+	if len(refs) == 1 {
+		return refs[0]
+	}
+
+	var merged []model.Reference
+	for _, erefs := range refs {
+		for _, ref := range erefs {
+			i := slices.IndexFunc(merged, func(o model.Reference) bool { return o.URL == ref.URL })
+			if i >= 0 {
+				merged[i].Encoding += "," + ref.Encoding
+				continue
+			}
+			merged = append(merged, ref)
+		}
+	}
+	return merged
 }
 
-func (c *amazon) extractVideoReference(ctx context.Context, domain, gti, quality string) (model.Reference, error) {
-	res, err := c.fetchPlaybackResources(ctx, domain, gti, quality)
+// extractQualityReferences returns the reference of the manifest of gti
+// of quality and encoding (bitrate adaptations) of the default URL set,
+// or, if all CDNs are asked for, of each distinct manifest of the URL
+// sets, the default first, labeled with their CDN. They're labeled with
+// the encoding unless of both.
+func (c *amazon) extractQualityReferences(ctx context.Context, domain, gti, quality, encoding string) ([]model.Reference, error) {
+	res, err := c.fetchPlaybackResourcesRetrying(ctx, domain, gti, quality, encoding)
 	if err != nil {
-		return model.Reference{}, fmt.Errorf("fetch playback resources %q: %w", gti, err)
+		return nil, fmt.Errorf("fetch playback resources %q: %w", gti, err)
 	}
 	if res.Error != nil {
-		return model.Reference{}, fmt.Errorf("playback resources %q: %w", gti, res.Error)
+		return nil, fmt.Errorf("playback resources %q: %w", gti, c.playbackError(domain, res.Error))
 	}
 	if res.ErrorsByResource.PlaybackURLs != nil {
-		return model.Reference{}, fmt.Errorf("playback urls %q: %w", gti, res.ErrorsByResource.PlaybackURLs)
+		return nil, fmt.Errorf("playback urls %q: %w", gti, c.playbackError(domain, res.ErrorsByResource.PlaybackURLs))
 	}
 
 	var (
-		urlSetID = res.PlaybackURLs.DefaultURLSetID
-		manifest = res.PlaybackURLs.URLSets[urlSetID].URLs.Manifest
+		defaultID = res.PlaybackURLs.DefaultURLSetID
+		ids       = []string{defaultID}
 	)
+	if c.config.AllCDNs {
+		for _, id := range slices.Sorted(maps.Keys(res.PlaybackURLs.URLSets)) {
+			if id != defaultID {
+				ids = append(ids, id)
+			}
+		}
+	}
 
-	url := manifest.URL
-	if !strings.Contains(manifest.URL, "encoding=segmentBase") {
-		u, err := urlpkg.Parse(manifest.URL)
-		if err != nil {
-			return model.Reference{}, fmt.Errorf("parse manifest URL: %w", err)
+	var (
+		refs []model.Reference
+		seen []string
+	)
+	for _, id := range ids {
+		set := res.PlaybackURLs.URLSets[id]
+		manifest := set.URLs.Manifest
+		if manifest.URL == "" || slices.Contains(seen, manifest.URL) {
+			continue
 		}
+		seen = append(seen, manifest.URL)
+
+		url := manifest.URL
+		if !strings.Contains(manifest.URL, "encoding=segmentBase") {
+			u, err := urlpkg.Parse(manifest.URL)
+			if err != nil {
+				return nil, fmt.Errorf("parse manifest URL: %w", err)
+			}
+
+			if u.RawQuery != "" {
+				u.RawQuery += "&"
+			}
+			u.RawQuery += "encoding=segmentBase"
 
-		if u.RawQuery != "" {
-			u.RawQuery += "&"
+			url = u.String()
 		}
-		u.RawQuery += "encoding=segmentBase"
 
-		url = u.String()
+		ref := model.Reference{
+			ID:     id,
+			Format: strings.ToLower(manifest.StreamingTechnology),
+			URL:    url,
+		}
+		if c.config.AllCDNs {
+			// The ID is of the CDN too, telling references apart by it.
+			ref.CDN = cmp.Or(manifest.CDN, set.CDN, id)
+			if ref.CDN != id {
+				ref.ID = id + ":" + ref.CDN
+			}
+		}
+		if encoding != bitrateAdaptations {
+			ref.Encoding = encoding
+		}
+		refs = append(refs, ref)
+	}
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("playback urls %q: no manifest", gti)
 	}
 
-	return model.Reference{
-		ID:     urlSetID,
-		Format: strings.ToLower(manifest.StreamingTechnology),
-		URL:    url,
-	}, nil
+	return refs, nil
 }
 
 type (
@@ -514,8 +795,10 @@ type (
 		DefaultURLSetID string `json:"defaultUrlSetId"`
 
 		URLSets map[string]struct {
+			CDN  string `json:"cdn"`
 			URLs struct {
 				Manifest struct {
+					CDN                 string `json:"cdn"`
 					StreamingTechnology string `json:"streamingTechnology"`
 					URL                 string `json:"url"`
 				} `json:"manifest"`
@@ -533,9 +816,67 @@ func (e playbackResourcesError) Error() string {
 	return e.ErrorCode + ": " + e.Message
 }
 
-func (c *amazon) fetchPlaybackResources(ctx context.Context, domain, gti, quality string) (*playbackResourcesResponse, error) {
+// playbackError returns e, as geo-blocked if its code is of the location
+// of the request (e.g. PRS.NoRights.AnonymizerIP for a known VPN, or of
+// geo-restrictions and territories), as requiring a session if of
+// authentication (e.g. CDP.Authentication) or of rights without one, or
+// else as not entitled if of other rights (e.g. PRS.NoRights.NotOwned for
+// rentals not paid for).
+func (c *amazon) playbackError(domain string, e *playbackResourcesError) error {
+	code := strings.ToLower(e.ErrorCode)
+	for _, s := range []string{"geo", "anonymizer", "territor"} {
+		if strings.Contains(code, s) {
+			return &service.GeoBlockedError{Country: c.config.CountryCode, Reason: e.Error()}
+		}
+	}
+	sessionRequired := &service.SessionRequiredError{Service: "amazon", Host: "www." + domain, Reason: e.Error()}
+	if strings.Contains(code, "authentication") || strings.Contains(code, "authoriz") {
+		return sessionRequired
+	}
+	if strings.Contains(code, "norights") {
+		if !c.hasSession(domain) {
+			return sessionRequired
+		}
+		return &service.NotEntitledError{Reason: e.Error()}
+	}
+	return e
+}
+
+// errThrottled is of playback resources refused for the rate of requests,
+// by status (429, 503) or error code (PRSThrottled).
+var errThrottled = errors.New("throttled")
+
+// fetchPlaybackResourcesRetrying fetches the playback resources of gti,
+// retrying requests throttled with backoff, up to the configured retries,
+// at a reduced rate.
+func (c *amazon) fetchPlaybackResourcesRetrying(ctx context.Context, domain, gti, quality, encoding string) (*playbackResourcesResponse, error) {
+	for try := 0; ; try++ {
+		res, err := c.fetchPlaybackResources(ctx, domain, gti, quality, encoding)
+		if err == nil && res.Error != nil && strings.EqualFold(res.Error.ErrorCode, "PRSThrottled") {
+			err = fmt.Errorf("%w: %w", errThrottled, res.Error)
+		}
+		if !errors.Is(err, errThrottled) {
+			return res, err
+		}
+
+		// Requested, so of a known marketplace.
+		host, _, _ := c.playbackEndpoint(domain)
+		c.throttler.Throttled(host)
+		if try >= c.config.Retries {
+			return nil, err
+		}
+		if c.config.Verbose {
+			log.Printf("amazon: playback resources %q throttled, retrying\n", gti)
+		}
+		if err := service.SleepRetry(ctx, c.config, try); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *amazon) fetchPlaybackResources(ctx context.Context, domain, gti, quality, encoding string) (*playbackResourcesResponse, error) {
 	const fmtQuery = "?deviceID=%s" +
-		"&deviceTypeID=AOAGZA014O5RE" +
+		"&deviceTypeID=%s" +
 		"&firmware=1" +
 		"&operatingSystemName=%s" +
 		"&asin=%s" +
@@ -543,39 +884,49 @@ func (c *amazon) fetchPlaybackResources(ctx context.Context, domain, gti, qualit
 		"&desiredResources=PlaybackUrls,CuepointPlaylist" +
 		"&resourceUsage=CacheResources" +
 		"&videoMaterialType=Feature" +
-		"&displayWidth=3840" +
-		"&displayHeight=2160" +
+		"&displayWidth=%d" +
+		"&displayHeight=%d" +
 		"&vodStreamSupportOverride=Auxiliary" +
 		"&deviceStreamingTechnologyOverride=DASH" +
-		"&deviceDrmOverride=CENC" +
+		"&deviceDrmOverride=%s" +
 		"&deviceAdInsertionTypeOverride=SSAI" +
-		"&deviceVideoCodecOverride=H264" +
-		"&deviceVideoQualityOverride=HD" +
-		"&deviceBitrateAdaptationsOverride=CVBR,CBR" +
+		"&deviceVideoCodecOverride=%s" +
+		"&deviceVideoQualityOverride=%s" +
+		"&deviceBitrateAdaptationsOverride=%s" +
 		"&supportedDRMKeyScheme=DUAL_KEY" +
 		"&ssaiSegmentInfoSupport=Base" +
 		"&ssaiStitchType=MultiPeriod"
 
-	query := ""
-	switch quality {
-	case "sd":
-		query = fmt.Sprintf(fmtQuery, "479f9d33-f548-4567-89b5-4a36e898b576", "Linux", gti)
-	case "hd":
-		query = fmt.Sprintf(fmtQuery, "49e8621c-a610-4ba6-9e3a-786b3a2f35cc", "Mac%20OS%20X", gti)
+	d := c.device(quality)
+	query := fmt.Sprintf(fmtQuery, d.id, d.typeID, d.os, gti, d.DisplayWidth, d.DisplayHeight, d.DRM, d.Codec, d.Quality, encoding)
+	if quality == "uhd" {
+		query += "&deviceHdrFormatsOverride=Hdr10,DolbyVision"
+	}
+	if len(d.Query) > 0 {
+		q, err := urlpkg.ParseQuery(strings.TrimPrefix(query, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("parse query: %w", err)
+		}
+		for k, v := range d.Query {
+			q.Set(k, v)
+		}
+		query = "?" + q.Encode()
 	}
 
-	var (
-		switched = switchDomain(domain)
-		url      = "https://atv-ps." + switched + ".com/cdp/catalog/GetPlaybackResources" + query
-	)
+	host, site, err := c.playbackEndpoint(domain)
+	if err != nil {
+		return nil, err
+	}
+	url := "https://" + host + "/cdp/catalog/GetPlaybackResources" + query
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("new: %w", err)
 	}
 
-	req.Header.Set("Origin", "https://www."+switched+".com")
-	req.Header.Set("Referer", "https://www."+switched+".com/")
+	req.Header.Set("Origin", "https://www."+site)
+	req.Header.Set("Referer", "https://www."+site+"/")
+	c.addCookies(req, domain)
 
 	res, err := c.httpClient.Do(req)
 	if err != nil {
@@ -583,7 +934,11 @@ func (c *amazon) fetchPlaybackResources(ctx context.Context, domain, gti, qualit
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return nil, fmt.Errorf("status %s: %w", res.Status, errThrottled)
+	default:
 		return nil, fmt.Errorf("status %s", res.Status)
 	}
 
@@ -595,6 +950,124 @@ func (c *amazon) fetchPlaybackResources(ctx context.Context, domain, gti, qualit
 	return &r, nil
 }
 
+// device is of playback requests, as a client and profile of it.
+type device struct {
+	id, typeID, os string
+	config.DeviceProfile
+}
+
+// newDeviceID returns a random device ID (a version 4 UUID), as the
+// clients of Amazon make one when installed. The IDs of the web clients
+// are of browsers, that of the living room client is made per run,
+// unless configured (e.g. of a Fire TV of the account).
+func newDeviceID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// defaultProfile is of playback requests unless configured otherwise.
+var defaultProfile = config.DeviceProfile{
+	Codec:         "H264",
+	Quality:       "HD",
+	DRM:           "CENC",
+	DisplayWidth:  3840,
+	DisplayHeight: 2160,
+}
+
+// device returns the device to request playback of quality as: "sd" and
+// "hd" of web clients (capped at SD and HD of the profile respectively),
+// of the configured profile, or "uhd" of a living room client (Fire TV),
+// web ones being capped at HD, of H265 and UHD whatever configured.
+func (c *amazon) device(quality string) device {
+	p := c.config.AmazonProfile
+	p.Codec = cmp.Or(p.Codec, defaultProfile.Codec)
+	p.Quality = cmp.Or(p.Quality, defaultProfile.Quality)
+	p.DRM = cmp.Or(p.DRM, defaultProfile.DRM)
+	p.DisplayWidth = cmp.Or(p.DisplayWidth, defaultProfile.DisplayWidth)
+	p.DisplayHeight = cmp.Or(p.DisplayHeight, defaultProfile.DisplayHeight)
+
+	switch quality {
+	case "sd":
+		return device{"479f9d33-f548-4567-89b5-4a36e898b576", "AOAGZA014O5RE", "Linux", p}
+	case "uhd":
+		p.Codec, p.Quality = "H265", "UHD"
+		return device{c.uhdDeviceID, "A43PXU4ZN2AL1", "Android", p}
+	default:
+		return device{"49e8621c-a610-4ba6-9e3a-786b3a2f35cc", "AOAGZA014O5RE", "Mac%20OS%20X", p}
+	}
+}
+
+// Marketplaces are served playback resources by the ATV endpoint of
+// their region: North America (atv-ps), Europe (atv-ps-eu) or the Far
+// East (atv-ps-fe), grouped as by the APIs of Amazon.
+var (
+	// marketplaceRegions are the regions of the marketplaces of Amazon,
+	// by their domain's TLD, "" of North America.
+	marketplaceRegions = map[string]string{
+		"com": "", "ca": "", "com.mx": "", "com.br": "",
+		"co.uk": "eu", "de": "eu", "fr": "eu", "it": "eu", "es": "eu",
+		"nl": "eu", "se": "eu", "pl": "eu", "com.be": "eu", "com.tr": "eu",
+		"ae": "eu", "sa": "eu", "eg": "eu", "in": "eu",
+		"co.jp": "fe", "com.au": "fe", "sg": "fe",
+	}
+	// regionalSites are the marketplaces with ATV endpoints of their
+	// own domain. Those of others of a region are of primevideo.com.
+	regionalSites = map[string]bool{
+		"amazon.co.uk": true,
+		"amazon.de":    true,
+		"amazon.co.jp": true,
+	}
+	// countryRegions are the regions of the countries served by
+	// primevideo.com. Countries not listed are of North America.
+	countryRegions = map[string]string{
+		"GB": "eu", "IE": "eu", "DE": "eu", "AT": "eu", "FR": "eu", "IT": "eu",
+		"ES": "eu", "NL": "eu", "BE": "eu", "SE": "eu", "PL": "eu", "TR": "eu",
+		"EG": "eu", "SA": "eu", "AE": "eu", "IN": "eu",
+		"JP": "fe", "AU": "fe", "SG": "fe",
+	}
+)
+
+// playbackEndpoint returns the host of the ATV endpoint of the region of
+// the marketplace of domain (e.g. amazon.de), and the site to send
+// requests as from. primevideo.com serves all countries, its region
+// being that of the country of the requests. Fails for domains not of
+// a known marketplace.
+func (c *amazon) playbackEndpoint(domain string) (string, string, error) {
+	var (
+		site, tld, _ = strings.Cut(domain, ".")
+		region       string
+		ok           bool
+	)
+	switch site {
+	case "primevideo":
+		if tld != "com" {
+			return "", "", fmt.Errorf("unknown marketplace %s", domain)
+		}
+		region = countryRegions[strings.ToUpper(c.config.CountryCode)]
+	case "amazon":
+		if region, ok = marketplaceRegions[tld]; !ok {
+			return "", "", fmt.Errorf("unknown marketplace %s", domain)
+		}
+	default:
+		return "", "", fmt.Errorf("unknown marketplace %s", domain)
+	}
+
+	switch {
+	case region == "":
+		// Requests to North America are sent to the endpoint of the
+		// other site, as to avoid 421s.
+		site = switchDomain(domain) + ".com"
+		return "atv-ps." + site, site, nil
+	case site == "primevideo" || regionalSites[domain]:
+		return "atv-ps-" + region + "." + domain, domain, nil
+	default:
+		return "atv-ps-" + region + ".primevideo.com", "primevideo.com", nil
+	}
+}
+
 // Send requests to atv-ps host on alt. domain.
 // Hack to avoid 421s.
 func switchDomain(domain string) string {
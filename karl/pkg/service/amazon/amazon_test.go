@@ -0,0 +1,379 @@
+package amazon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service"
+	"karl/pkg/service/internal/servicetest"
+)
+
+func newTestClient(t *testing.T, config *config.AppConfig, rt http.RoundTripper) *amazon {
+	t.Helper()
+	return New(config, servicetest.NewClient(t, rt)).(*amazon)
+}
+
+func testSeason(n int) season {
+	s := season{seriesTitle: "Series", number: 1}
+	for i := range n {
+		s.episodes = append(s.episodes, episode{gti: "amzn1.dv.gti." + strconv.Itoa(i), number: int32(i + 1)})
+	}
+	return s
+}
+
+func TestSendSeriesBounded(t *testing.T) {
+	var inFlight servicetest.InFlight
+	c := newTestClient(t, &config.AppConfig{VideoConcurrency: 2, IncludeBonus: true}, servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		defer inFlight.Enter()()
+		time.Sleep(5 * time.Millisecond)
+		return nil, errors.New("offline")
+	}))
+
+	s := testSeason(10)
+	s.additionalSeasonIDs = []string{"amzn1.dv.gti.s2", "amzn1.dv.gti.s3", "amzn1.dv.gti.s4"}
+	s.bonus = []bonus{{gti: "amzn1.dv.gti.b1"}, {gti: "amzn1.dv.gti.b2"}}
+	rs := servicetest.Collect(func(results chan<- model.VideoResult) {
+		c.sendSeries(context.Background(), "amazon.com", "series", s, results)
+	})
+	if want := 10 + 3 + 2; len(rs) != want {
+		t.Fatalf("results = %d, want one per episode, season and bonus item (%d)", len(rs), want)
+	}
+	// Of 2 videos at a time, each of sd and hd, season pages, episodes
+	// and bonus content alike.
+	if m := inFlight.Most(); m > 4 {
+		t.Errorf("requests in flight = %d, want at most 4", m)
+	}
+}
+
+func TestSendSeasonCancelled(t *testing.T) {
+	c := newTestClient(t, &config.AppConfig{VideoConcurrency: 1}, servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+	}()
+	rs := servicetest.Collect(func(results chan<- model.VideoResult) {
+		c.sendSeries(ctx, "amazon.com", "series", testSeason(5), results)
+	})
+	if len(rs) != 5 {
+		t.Fatalf("results = %d, want one per episode", len(rs))
+	}
+	for _, r := range rs {
+		if !errors.Is(r.Err, context.Canceled) || r.Episode == 0 {
+			t.Errorf("result %+v, want episode cancelled", r)
+		}
+	}
+}
+
+func TestPlaybackEndpoint(t *testing.T) {
+	for _, tt := range []struct {
+		domain, country string
+		host, site      string
+	}{
+		{"amazon.com", "", "atv-ps.primevideo.com", "primevideo.com"},
+		{"amazon.ca", "", "atv-ps.primevideo.com", "primevideo.com"},
+		{"amazon.co.uk", "", "atv-ps-eu.amazon.co.uk", "amazon.co.uk"},
+		{"amazon.de", "", "atv-ps-eu.amazon.de", "amazon.de"},
+		{"amazon.fr", "", "atv-ps-eu.primevideo.com", "primevideo.com"},
+		{"amazon.it", "", "atv-ps-eu.primevideo.com", "primevideo.com"},
+		{"amazon.es", "", "atv-ps-eu.primevideo.com", "primevideo.com"},
+		{"amazon.in", "", "atv-ps-eu.primevideo.com", "primevideo.com"},
+		{"amazon.co.jp", "", "atv-ps-fe.amazon.co.jp", "amazon.co.jp"},
+		{"amazon.com.au", "", "atv-ps-fe.primevideo.com", "primevideo.com"},
+		{"primevideo.com", "", "atv-ps.amazon.com", "amazon.com"},
+		{"primevideo.com", "de", "atv-ps-eu.primevideo.com", "primevideo.com"},
+		{"primevideo.com", "JP", "atv-ps-fe.primevideo.com", "primevideo.com"},
+	} {
+		c := newTestClient(t, &config.AppConfig{CountryCode: tt.country}, nil)
+		host, site, err := c.playbackEndpoint(tt.domain)
+		if err != nil || host != tt.host || site != tt.site {
+			t.Errorf("%s (%s): %s, %s, %v, want %s, %s", tt.domain, tt.country, host, site, err, tt.host, tt.site)
+		}
+	}
+
+	c := newTestClient(t, &config.AppConfig{}, nil)
+	for _, domain := range []string{"amazon.xyz", "primevideo.de", "example.com"} {
+		if host, _, err := c.playbackEndpoint(domain); err == nil {
+			t.Errorf("%s: %s, want unknown marketplace", domain, host)
+		}
+	}
+}
+
+func TestUHDDeviceID(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef"
+	c := newTestClient(t, &config.AppConfig{AmazonUHDDeviceID: id}, nil)
+	if d := c.device("uhd"); d.id != id || d.Codec != "H265" || d.Quality != "UHD" {
+		t.Errorf("device %+v, want of ID %s, H265 and UHD", d, id)
+	}
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	a := newTestClient(t, &config.AppConfig{}, nil).device("uhd").id
+	b := newTestClient(t, &config.AppConfig{}, nil).device("uhd").id
+	if !uuid.MatchString(a) || !uuid.MatchString(b) || a == b {
+		t.Errorf("device IDs %s and %s, want random UUIDs", a, b)
+	}
+}
+
+func TestExtractQualityReferencesAllCDNs(t *testing.T) {
+	rt := servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		f, err := os.Open("../../../testdata/amazon/playbackresources_allcdns.json")
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: f}, nil
+	})
+
+	for _, tt := range []struct {
+		allCDNs bool
+		want    []model.Reference
+	}{
+		{false, []model.Reference{
+			{ID: "7a1f0c2e", Format: "dash", URL: "https://cf.example.com/d/1$abc/manifest.mpd?encoding=segmentBase"},
+		}},
+		// The default first, that of the same manifest once.
+		{true, []model.Reference{
+			{ID: "7a1f0c2e:Cloudfront", Format: "dash", URL: "https://cf.example.com/d/1$abc/manifest.mpd?encoding=segmentBase", CDN: "Cloudfront"},
+			{ID: "3b9d4e71:Akamai", Format: "dash", URL: "https://ak.example.com/d/1$abc/manifest.mpd?encoding=segmentBase", CDN: "Akamai"},
+		}},
+	} {
+		c := newTestClient(t, &config.AppConfig{AllCDNs: tt.allCDNs}, rt)
+		refs, err := c.extractQualityReferences(context.Background(), "amazon.com", "amzn1.dv.gti.1", "hd", bitrateAdaptations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(refs, tt.want) {
+			t.Errorf("all CDNs %t: references %+v, want %+v", tt.allCDNs, refs, tt.want)
+		}
+	}
+}
+
+// detailPageTransport responds to detail page requests with the fixtures
+// of their titles, by ID, and to playback requests with the resources of
+// all CDNs.
+func detailPageTransport(pages map[string]string) servicetest.RoundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		path := "../../../testdata/amazon/playbackresources_allcdns.json"
+		if strings.HasSuffix(r.URL.Path, "/getDetailPage") {
+			id := r.URL.Query().Get("titleID")
+			page, ok := pages[id]
+			if !ok {
+				return nil, fmt.Errorf("unexpected title %q", id)
+			}
+			path = "../../../testdata/amazon/" + page
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: f}, nil
+	}
+}
+
+func TestExtractEpisodePage(t *testing.T) {
+	rt := detailPageTransport(map[string]string{
+		"amzn1.dv.gti.ep3": "detail_episode.json",
+		"amzn1.dv.gti.s2":  "detail_season.json",
+	})
+
+	for _, tt := range []struct {
+		expand   bool
+		episodes []int32
+	}{
+		{false, []int32{3}},
+		// The season selected on the page.
+		{true, []int32{1, 2, 3}},
+	} {
+		c := newTestClient(t, &config.AppConfig{ExpandEpisodes: tt.expand}, rt)
+		rs := servicetest.Collect(func(results chan<- model.VideoResult) {
+			for r := range c.extract(context.Background(), "https://www.amazon.com/gp/video/detail/amzn1.dv.gti.ep3/") {
+				results <- r
+			}
+		})
+
+		var episodes []int32
+		for _, r := range rs {
+			if r.Err != nil {
+				t.Fatalf("expand %t: %v", tt.expand, r.Err)
+			}
+			if r.Season != 2 || len(r.References) == 0 {
+				t.Errorf("expand %t: result %+v, want references of season 2", tt.expand, r)
+			}
+			episodes = append(episodes, r.Episode)
+		}
+		slices.Sort(episodes)
+		if !slices.Equal(episodes, tt.episodes) {
+			t.Errorf("expand %t: episodes %v, want %v", tt.expand, episodes, tt.episodes)
+		}
+	}
+}
+
+func TestExtractBonus(t *testing.T) {
+	rt := detailPageTransport(map[string]string{"amzn1.dv.gti.movie": "detail_movie_bonus.json"})
+
+	for _, tt := range []struct {
+		includeBonus bool
+		want         []string
+	}{
+		{false, []string{"amzn1.dv.gti.movie"}},
+		// Bonus items without GTI don't play.
+		{true, []string{"amzn1.dv.gti.featurette", "amzn1.dv.gti.movie", "amzn1.dv.gti.trailer"}},
+	} {
+		c := newTestClient(t, &config.AppConfig{IncludeBonus: tt.includeBonus}, rt)
+		rs := servicetest.Collect(func(results chan<- model.VideoResult) {
+			for r := range c.extract(context.Background(), "https://www.amazon.com/gp/video/detail/amzn1.dv.gti.movie/") {
+				results <- r
+			}
+		})
+
+		var ids []string
+		for _, r := range rs {
+			if r.Err != nil {
+				t.Fatalf("include bonus %t: %v", tt.includeBonus, r.Err)
+			}
+			bonus := r.Video.ID != "amzn1.dv.gti.movie"
+			if bonus != (r.Video.MediaType == model.MediaTypeBonus) || len(r.References) == 0 {
+				t.Errorf("include bonus %t: video %+v, want references, of bonus media type if bonus", tt.includeBonus, r.Video)
+			}
+			ids = append(ids, r.Video.ID)
+		}
+		slices.Sort(ids)
+		if !slices.Equal(ids, tt.want) {
+			t.Errorf("include bonus %t: videos %v, want %v", tt.includeBonus, ids, tt.want)
+		}
+	}
+}
+
+func TestExtractEventPage(t *testing.T) {
+	rt := detailPageTransport(map[string]string{
+		"amzn1.dv.gti.upcoming": "detail_event_upcoming.json",
+		"amzn1.dv.gti.live":     "detail_event_live.json",
+		"amzn1.dv.gti.ended":    "detail_event_replay.json",
+	})
+	c := newTestClient(t, &config.AppConfig{}, rt)
+	date := func(ms int64) *time.Time {
+		t := time.UnixMilli(ms).UTC()
+		return &t
+	}
+
+	for _, tt := range []struct {
+		id      string
+		wantErr *service.LiveEventError
+	}{
+		{"amzn1.dv.gti.upcoming", &service.LiveEventError{Title: "The Final", Status: "upcoming", StartsAt: date(1800000000000)}},
+		// Typed a movie, told live by the badge of its buybox only.
+		{"amzn1.dv.gti.live", &service.LiveEventError{Title: "The Semi-Final", Status: "live"}},
+		{"amzn1.dv.gti.ended", nil},
+	} {
+		rs := servicetest.Collect(func(results chan<- model.VideoResult) {
+			for r := range c.extract(context.Background(), "https://www.amazon.com/gp/video/detail/"+tt.id+"/") {
+				results <- r
+			}
+		})
+		if len(rs) != 1 {
+			t.Fatalf("%s: %d results, want 1", tt.id, len(rs))
+		}
+		r := rs[0]
+
+		if tt.wantErr != nil {
+			var le *service.LiveEventError
+			if !errors.As(r.Err, &le) || !reflect.DeepEqual(le, tt.wantErr) {
+				t.Errorf("%s: error %v, want %v", tt.id, r.Err, tt.wantErr)
+			}
+			continue
+		}
+		if r.Err != nil {
+			t.Fatalf("%s: %v", tt.id, r.Err)
+		}
+		want := model.Video{
+			ID:           "amzn1.dv.gti.replay",
+			Title:        "The Quarter-Final",
+			PlaybackURL:  "https://www.amazon.com/gp/video/detail/amzn1.dv.gti.replay/",
+			Duration:     6300,
+			AirDate:      date(1790000000000),
+			Availability: "PRIME",
+		}
+		if !reflect.DeepEqual(r.Video, want) || len(r.References) == 0 {
+			t.Errorf("%s: video %+v with %d references, want %+v with references", tt.id, r.Video, len(r.References), want)
+		}
+	}
+}
+
+func TestFetchPlaybackResourcesThrottled(t *testing.T) {
+	file := func(name string) func() (*http.Response, error) {
+		return func() (*http.Response, error) {
+			f, err := os.Open("../../../testdata/amazon/" + name)
+			if err != nil {
+				return nil, err
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: f}, nil
+		}
+	}
+	status := func(code int) func() (*http.Response, error) {
+		return func() (*http.Response, error) {
+			return &http.Response{StatusCode: code, Status: http.StatusText(code), Body: http.NoBody}, nil
+		}
+	}
+	throttled := file("playbackresources_throttled.json")
+	ok := file("playbackresources_allcdns.json")
+
+	for _, tt := range []struct {
+		name      string
+		responses []func() (*http.Response, error)
+		throttled int64
+		limit     rate.Limit
+		wantErr   bool
+	}{
+		{"then success", []func() (*http.Response, error){status(http.StatusServiceUnavailable), throttled, ok}, 2, 2, false},
+		{"retries exhausted", []func() (*http.Response, error){status(http.StatusTooManyRequests), throttled, throttled, ok}, 3, 1, true},
+	} {
+		var n atomic.Int32
+		rt := servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+			return tt.responses[n.Add(1)-1]()
+		})
+		limiters := make(map[string]*rate.Limiter)
+		c := newTestClient(t, &config.AppConfig{Retries: 2, RequestLimiter: limiters}, rt)
+		host, _, err := c.playbackEndpoint("amazon.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		limiters[host] = rate.NewLimiter(8, 1)
+
+		res, err := c.fetchPlaybackResourcesRetrying(context.Background(), "amazon.com", "amzn1.dv.gti.1", "hd", "CVBR")
+		if tt.wantErr {
+			if !errors.Is(err, errThrottled) {
+				t.Errorf("%s: error %v, want throttled", tt.name, err)
+			}
+		} else if err != nil || res == nil || res.Error != nil {
+			t.Errorf("%s: %+v, %v, want the resources", tt.name, res, err)
+		}
+		if got := c.NumThrottled(); got != tt.throttled {
+			t.Errorf("%s: %d throttled, want %d", tt.name, got, tt.throttled)
+		}
+		// Halved for each throttled response, for a while.
+		if l := limiters[host].Limit(); l != tt.limit {
+			t.Errorf("%s: rate %v, want %v", tt.name, l, tt.limit)
+		}
+		// One initial try and config.Retries retries.
+		if got := n.Load(); got != 3 {
+			t.Errorf("%s: %d requests, want 3", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package amazon
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// maxEpisodePages is the most pages of an episode list followed, beyond
+// which it's taken as looping.
+const maxEpisodePages = 100
+
+// episodePageConcurrency is the limit of pages of an episode list fetched
+// concurrently.
+const episodePageConcurrency = 4
+
+type (
+	detailPageEpisodeList struct {
+		Actions struct {
+			Pagination []detailPagePagination `json:"pagination"`
+		} `json:"actions"`
+
+		// TotalCardSize is the number of episodes of the list, of all
+		// pages. 0 if not told.
+		TotalCardSize int `json:"totalCardSize"`
+
+		Episodes []detailPageEpisode `json:"episodes"`
+	}
+
+	detailPageEpisode struct {
+		Self   detailPageSelf   `json:"self"`
+		Detail detailPageDetail `json:"detail"`
+	}
+)
+
+func (l *detailPageEpisodeList) nextPage() (string, bool) {
+	i := slices.IndexFunc(l.Actions.Pagination, func(p detailPagePagination) bool { return p.TokenType == "NextPage" })
+	if i == -1 {
+		return "", false
+	}
+	return l.Actions.Pagination[i].Token, true
+}
+
+// pageToken is a token of a page of an episode list of an offset, base64
+// encoded JSON with its startIndex, of which the tokens of the pages to
+// follow are made. Only the value of startIndex is replaced, the rest of
+// the JSON kept byte for byte (order, spacing and number formats).
+type pageToken struct {
+	raw []byte
+	// valueStart and valueEnd are where in raw the value of startIndex
+	// is.
+	valueStart, valueEnd int
+	start                int
+	encoding             *base64.Encoding
+}
+
+func parsePageToken(token string) (*pageToken, bool) {
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		b, err := enc.DecodeString(token)
+		if err != nil {
+			continue
+		}
+		valueStart, valueEnd, ok := findStartIndex(b)
+		if !ok {
+			return nil, false
+		}
+		start, err := strconv.Atoi(string(b[valueStart:valueEnd]))
+		if err != nil || start <= 0 {
+			return nil, false
+		}
+		return &pageToken{raw: b, valueStart: valueStart, valueEnd: valueEnd, start: start, encoding: enc}, true
+	}
+	return nil, false
+}
+
+// findStartIndex returns where in the JSON object raw the value of its
+// startIndex is.
+func findStartIndex(raw []byte) (int, int, bool) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return 0, 0, false
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return 0, 0, false
+		}
+		// The value follows the colon, of any spacing.
+		valueStart := int(dec.InputOffset())
+		for valueStart < len(raw) && strings.ContainsRune(" \t\r\n:", rune(raw[valueStart])) {
+			valueStart++
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return 0, 0, false
+		}
+		if key == "startIndex" {
+			return valueStart, int(dec.InputOffset()), true
+		}
+	}
+	return 0, 0, false
+}
+
+// at returns the token of the page starting at start.
+func (t *pageToken) at(start int) string {
+	b := slices.Concat(t.raw[:t.valueStart], []byte(strconv.Itoa(start)), t.raw[t.valueEnd:])
+	return t.encoding.EncodeToString(b)
+}
+
+// fetchEpisodePages appends the episodes of the pages of list to follow
+// to it, in order and once each (by GTI). If its token is of an offset and
+// it tells its total, the pages are fetched concurrently, or else (or if
+// that fails) one by one, as long as their tokens don't repeat, up to
+// maxEpisodePages. Lists left short of their total are logged.
+func (c *amazon) fetchEpisodePages(ctx context.Context, domain, id string, list *detailPageEpisodeList) error {
+	token, ok := list.nextPage()
+	if !ok {
+		return nil
+	}
+
+	var (
+		pages      = [][]detailPageEpisode{list.Episodes}
+		pt, offset = parsePageToken(token)
+		err        error
+	)
+	if offset && pt.start == len(list.Episodes) && list.TotalCardSize > pt.start {
+		concurrent, last, err := c.fetchEpisodePagesConcurrently(ctx, domain, id, pages, pt, list.TotalCardSize)
+		switch {
+		case err == nil:
+			pages = concurrent
+			token, ok = last.nextPage()
+		case ctx.Err() != nil:
+			return err
+		default:
+			// E.g. of tokens made not accepted, the pages are followed
+			// by their tokens instead.
+			if c.config.Verbose {
+				log.Printf("amazon: %q: fetch episode list pages concurrently: %v, following them one by one\n", id, err)
+			}
+		}
+	}
+	if ok {
+		pages, err = c.fetchEpisodePagesSerially(ctx, domain, id, pages, token)
+		if err != nil {
+			return err
+		}
+	}
+
+	var (
+		episodes []detailPageEpisode
+		seen     = make(map[string]bool)
+	)
+	for _, e := range slices.Concat(pages...) {
+		if gti := e.Self.GTI; gti != "" {
+			if seen[gti] {
+				continue
+			}
+			seen[gti] = true
+		}
+		episodes = append(episodes, e)
+	}
+	list.Episodes = episodes
+
+	if total := list.TotalCardSize; len(episodes) < total && c.config.Verbose {
+		log.Printf("amazon: %q: %d of %d episode(s) listed\n", id, len(episodes), total)
+	}
+
+	return nil
+}
+
+// fetchEpisodePagesConcurrently fetches the pages of the episode list to
+// follow the first, pages[0], whose size they're taken to be of, from the
+// offset of pt to total, returning them and the last.
+func (c *amazon) fetchEpisodePagesConcurrently(
+	ctx context.Context,
+	domain, id string,
+	pages [][]detailPageEpisode,
+	pt *pageToken,
+	total int,
+) ([][]detailPageEpisode, *detailPageEpisodeList, error) {
+	size := pt.start
+	n := min((total-pt.start+size-1)/size, maxEpisodePages-1)
+
+	var (
+		lists = make([]*detailPageEpisodeList, n)
+		g     errgroup.Group
+	)
+	g.SetLimit(episodePageConcurrency)
+	for i := range n {
+		token := pt.at(pt.start + i*size)
+		g.Go(func() error {
+			res, err := c.fetchDetailPage(ctx, domain, id, token)
+			if err != nil {
+				return fmt.Errorf("fetch detail page paginated %q: %w", id, err)
+			}
+			lists[i] = &res.Widgets.EpisodeList
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
+
+	for _, l := range lists {
+		pages = append(pages, l.Episodes)
+	}
+	return pages, lists[n-1], nil
+}
+
+// fetchEpisodePagesSerially fetches the pages of the episode list from
+// that of token on, following their tokens until none, one repeats or
+// maxEpisodePages are, as such lists loop.
+func (c *amazon) fetchEpisodePagesSerially(ctx context.Context, domain, id string, pages [][]detailPageEpisode, token string) ([][]detailPageEpisode, error) {
+	seen := make(map[string]bool)
+	for ok := true; ok; {
+		if seen[token] {
+			if c.config.Verbose {
+				log.Printf("amazon: %q: episode list page token repeated, stopping after %d page(s)\n", id, len(pages))
+			}
+			break
+		}
+		if len(pages) >= maxEpisodePages {
+			if c.config.Verbose {
+				log.Printf("amazon: %q: episode list longer than %d pages, stopping\n", id, maxEpisodePages)
+			}
+			break
+		}
+		seen[token] = true
+
+		res, err := c.fetchDetailPage(ctx, domain, id, token)
+		if err != nil {
+			return nil, fmt.Errorf("fetch detail page paginated %q: %w", id, err)
+		}
+
+		list := &res.Widgets.EpisodeList
+		pages = append(pages, list.Episodes)
+		token, ok = list.nextPage()
+	}
+	return pages, nil
+}
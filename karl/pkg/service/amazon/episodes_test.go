@@ -0,0 +1,185 @@
+package amazon
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"karl/pkg/config"
+	"karl/pkg/service/internal/servicetest"
+)
+
+const episodesTestdata = "../../../testdata/amazon/episodes/"
+
+func readDetailPage(t *testing.T, name string) *detailPageResponse {
+	t.Helper()
+	b, err := os.ReadFile(episodesTestdata + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r detailPageResponse
+	if err := json.Unmarshal(b, &r); err != nil {
+		t.Fatal(err)
+	}
+	return &r
+}
+
+// pageServer serves the fixture pages of their tokens, only those exactly,
+// failing tokens by fail if set.
+func pageServer(t *testing.T, pages map[string]string, fail func(token string) bool) (http.RoundTripper, func() []string) {
+	t.Helper()
+	var (
+		mu     sync.Mutex
+		tokens []string
+	)
+	rt := servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var widgets []struct {
+			WidgetToken string `json:"widgetToken"`
+		}
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("widgets")), &widgets); err != nil || len(widgets) != 1 {
+			t.Errorf("widgets %q", r.URL.Query().Get("widgets"))
+			return &http.Response{StatusCode: http.StatusBadRequest, Body: http.NoBody}, nil
+		}
+		token := widgets[0].WidgetToken
+
+		mu.Lock()
+		tokens = append(tokens, token)
+		mu.Unlock()
+
+		name, ok := pages[token]
+		if !ok || (fail != nil && fail(token)) {
+			return &http.Response{StatusCode: http.StatusBadRequest, Status: "400 Bad Request", Body: http.NoBody}, nil
+		}
+		f, err := os.Open(episodesTestdata + name)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(f)}, nil
+	})
+	return rt, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(tokens)
+	}
+}
+
+func episodeNumbers(l *detailPageEpisodeList) []int32 {
+	var ns []int32
+	for _, e := range l.Episodes {
+		ns = append(ns, e.Detail.EpisodeNumber)
+	}
+	return ns
+}
+
+// offsetPages are the fixture pages of the offset tokens, as sent.
+func offsetPages(t *testing.T) map[string]string {
+	t.Helper()
+	pages := make(map[string]string)
+	for name, next := range map[string]string{"page1.json": "page2.json", "page2.json": "page3.json"} {
+		token, ok := readDetailPage(t, name).Widgets.EpisodeList.nextPage()
+		if !ok {
+			t.Fatalf("%s: no next page", name)
+		}
+		pages[token] = next
+	}
+	return pages
+}
+
+func TestPageTokenAt(t *testing.T) {
+	raw := `{"titleID":"amzn1.dv.gti.series", "startIndex": 2,"pageSize":2.0,"filter":{"startIndex":7}}`
+	pt, ok := parsePageToken(base64.RawURLEncoding.EncodeToString([]byte(raw)))
+	if !ok {
+		t.Fatal("token not of an offset")
+	}
+	if pt.start != 2 {
+		t.Errorf("start %d, want 2", pt.start)
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(pt.at(40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Replace(raw, `"startIndex": 2`, `"startIndex": 40`, 1); string(b) != want {
+		t.Errorf("token %s, want %s", b, want)
+	}
+
+	for _, raw := range []string{`{"cursor":"x"}`, `{"startIndex":"2"}`, `{"startIndex":0}`, `[2]`} {
+		if _, ok := parsePageToken(base64.StdEncoding.EncodeToString([]byte(raw))); ok {
+			t.Errorf("%s of an offset, want not", raw)
+		}
+	}
+}
+
+func TestFetchEpisodePagesConcurrently(t *testing.T) {
+	rt, tokens := pageServer(t, offsetPages(t), nil)
+	c := newTestClient(t, &config.AppConfig{}, rt)
+
+	list := &readDetailPage(t, "page1.json").Widgets.EpisodeList
+	if err := c.fetchEpisodePages(context.Background(), "amazon.com", "series", list); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := episodeNumbers(list), []int32{1, 2, 3, 4, 5}; !slices.Equal(got, want) {
+		t.Errorf("episodes %v, want %v", got, want)
+	}
+	// Tokens made of the first are those sent, so accepted.
+	if n := len(tokens()); n != 2 {
+		t.Errorf("%d pages fetched, want 2", n)
+	}
+}
+
+func TestFetchEpisodePagesConcurrentlyFailing(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		failed bool
+	)
+	pages := offsetPages(t)
+	last, _ := readDetailPage(t, "page2.json").Widgets.EpisodeList.nextPage()
+	// The last page fails once, failing the pages fetched concurrently.
+	rt, tokens := pageServer(t, pages, func(token string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if token == last && !failed {
+			failed = true
+			return true
+		}
+		return false
+	})
+	c := newTestClient(t, &config.AppConfig{}, rt)
+
+	list := &readDetailPage(t, "page1.json").Widgets.EpisodeList
+	if err := c.fetchEpisodePages(context.Background(), "amazon.com", "series", list); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := episodeNumbers(list), []int32{1, 2, 3, 4, 5}; !slices.Equal(got, want) {
+		t.Errorf("episodes %v, want %v", got, want)
+	}
+	// 2 concurrently, then 2 one by one.
+	if n := len(tokens()); n != 4 {
+		t.Errorf("%d pages fetched, want 4", n)
+	}
+}
+
+func TestFetchEpisodePagesRepeatingToken(t *testing.T) {
+	r := readDetailPage(t, "repeating.json")
+	token, _ := r.Widgets.EpisodeList.nextPage()
+	rt, tokens := pageServer(t, map[string]string{token: "repeating.json"}, nil)
+	c := newTestClient(t, &config.AppConfig{}, rt)
+
+	list := &r.Widgets.EpisodeList
+	if err := c.fetchEpisodePages(context.Background(), "amazon.com", "series", list); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := episodeNumbers(list), []int32{1, 2}; !slices.Equal(got, want) {
+		t.Errorf("episodes %v, want %v", got, want)
+	}
+	if n := len(tokens()); n != 1 {
+		t.Errorf("%d pages fetched, want 1", n)
+	}
+}
@@ -0,0 +1,106 @@
+package amazon
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"karl/pkg/model"
+	"karl/pkg/service"
+)
+
+type (
+	// detailPageEvent is of the header of a live event (e.g. sports), its
+	// schedule and state, and the replay once concluded, if any.
+	detailPageEvent struct {
+		// State is "UPCOMING", "LIVE" or "ENDED".
+		State string `json:"state"`
+		// StartTime is the scheduled start, in milliseconds since the
+		// epoch. 0 if not told.
+		StartTime int64          `json:"startTime"`
+		Replay    detailPageSelf `json:"replay"`
+	}
+
+	event struct {
+		title        string
+		state        string
+		startsAt     *time.Time
+		replay       detailPageSelf
+		link         string
+		duration     int32
+		availability string
+	}
+)
+
+// isEvent returns whether the page is of a live event, by its type or by
+// a live badge of its buybox, as live titles may be typed otherwise.
+func (w *detailPageWidgets) isEvent() bool {
+	return w.PageContext.SubPageType == "Event" ||
+		w.Header.Event.State != "" ||
+		slices.ContainsFunc(w.BuyBox.Badges, isLiveBadge)
+}
+
+func isLiveBadge(b string) bool {
+	b = strings.ToUpper(b)
+	return b == "LIVE" || b == "UPCOMING"
+}
+
+func (w *detailPageWidgets) event() event {
+	e := event{
+		title:        w.Header.Detail.Title,
+		state:        strings.ToUpper(w.Header.Event.State),
+		replay:       w.Header.Event.Replay,
+		link:         cmp.Or(w.Header.Event.Replay.Link, w.Self.Link),
+		duration:     w.Header.Detail.Duration,
+		availability: w.BuyBox.Action.availability(),
+	}
+	if e.state == "" {
+		if i := slices.IndexFunc(w.BuyBox.Badges, isLiveBadge); i >= 0 {
+			e.state = strings.ToUpper(w.BuyBox.Badges[i])
+		}
+	}
+	if ms := w.Header.Event.StartTime; ms > 0 {
+		t := time.UnixMilli(ms).UTC()
+		e.startsAt = &t
+	}
+	return e
+}
+
+// sendEvent sends the video of the replay of a concluded live event, or
+// a LiveEventError if upcoming or on air.
+func (c *amazon) sendEvent(ctx context.Context, domain, id string, e event, results chan<- model.VideoResult) {
+	switch e.state {
+	case "UPCOMING", "LIVE":
+		results <- model.VideoResult{Err: &service.LiveEventError{
+			Title:    e.title,
+			Status:   strings.ToLower(e.state),
+			StartsAt: e.startsAt,
+		}}
+		return
+	}
+	if e.replay.GTI == "" {
+		results <- model.VideoResult{Err: fmt.Errorf("event %q: no replay", id)}
+		return
+	}
+
+	refs, err := c.extractVideoReferences(ctx, domain, e.replay.GTI)
+	if err != nil {
+		results <- model.VideoResult{Err: fmt.Errorf("extract event replay reference %q: %w", id, err)}
+		return
+	}
+
+	results <- model.VideoResult{
+		Video: model.Video{
+			ID:           e.replay.GTI,
+			Title:        e.title,
+			PlaybackURL:  "https://www." + domain + e.link,
+			Duration:     e.duration,
+			AirDate:      e.startsAt,
+			Availability: e.availability,
+		},
+		References: refs,
+	}
+}
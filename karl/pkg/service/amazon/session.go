@@ -0,0 +1,78 @@
+package amazon
+
+import (
+	"log"
+	"net/http"
+	urlpkg "net/url"
+	"slices"
+	"strings"
+)
+
+// marketplaces are the domains of which sessions are checked for on
+// construction. Those of other domains are on first use.
+var marketplaces = []string{"amazon.com", "amazon.co.uk", "amazon.de", "amazon.co.jp", "primevideo.com"}
+
+// sessionCookiePrefixes are of the names of the cookies of a signed in
+// session, e.g. at-main (amazon.com) or at-acbuk (amazon.co.uk).
+var sessionCookiePrefixes = []string{"at-", "sess-at-"}
+
+// marketplaceCookies returns the cookies of the jar for the marketplace
+// of domain (e.g. amazon.com), whether set for its www host or the domain
+// itself.
+func (c *amazon) marketplaceCookies(domain string) []*http.Cookie {
+	jar := c.config.CookieJar
+	if jar == nil {
+		return nil
+	}
+
+	var cookies []*http.Cookie
+	for _, host := range []string{"www." + domain, domain} {
+		for _, ck := range jar.Cookies(&urlpkg.URL{Scheme: "https", Host: host}) {
+			if !slices.ContainsFunc(cookies, func(o *http.Cookie) bool { return o.Name == ck.Name }) {
+				cookies = append(cookies, ck)
+			}
+		}
+	}
+	return cookies
+}
+
+func (c *amazon) findSession(domain string) bool {
+	return slices.ContainsFunc(c.marketplaceCookies(domain), func(ck *http.Cookie) bool {
+		return slices.ContainsFunc(sessionCookiePrefixes, func(p string) bool {
+			return strings.HasPrefix(ck.Name, p)
+		})
+	})
+}
+
+// hasSession returns whether the jar has the cookies of a signed in
+// session for the marketplace of domain, logging their absence once.
+func (c *amazon) hasSession(domain string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ok, checked := c.sessions[domain]
+	if !checked {
+		ok = c.findSession(domain)
+		c.sessions[domain] = ok
+	}
+	if !ok && !c.warned[domain] {
+		c.warned[domain] = true
+		log.Printf("amazon: no session cookie for %s, titles requiring one will fail; pass --cookies www.%s=\"...\" of a signed in browser\n", domain, domain)
+	}
+	return ok
+}
+
+// addCookies adds the cookies of the marketplace of domain to req, unless
+// sent by the jar anyway. Playback resources of a marketplace are requested
+// from hosts of others (see playbackEndpoint), which the jar has none of.
+func (c *amazon) addCookies(req *http.Request, domain string) {
+	var sent []*http.Cookie
+	if jar := c.config.CookieJar; jar != nil {
+		sent = jar.Cookies(req.URL)
+	}
+	for _, ck := range c.marketplaceCookies(domain) {
+		if !slices.ContainsFunc(sent, func(o *http.Cookie) bool { return o.Name == ck.Name }) {
+			req.AddCookie(ck)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package cbcgem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	urlpkg "net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service"
+)
+
+var (
+	_ service.Client            = (*cbcgem)(nil)
+	_ service.URLExtractor      = (*cbcgem)(nil)
+	_ service.JustWatchProvider = (*cbcgem)(nil)
+	_ service.VideoExtractor    = (*cbcgem)(nil)
+	_ service.VariantExtractor  = (*cbcgem)(nil)
+	_ service.Fingerprinter     = (*cbcgem)(nil)
+)
+
+const apiBase = "https://services.radio-canada.ca"
+
+type cbcgem struct {
+	config            *config.AppConfig
+	httpClient        *http.Client
+	index             *service.IndexCache
+	regex             *regexp.Regexp
+	origin            string
+	justWatchPackages []string
+}
+
+func init() {
+	service.Register(New)
+}
+
+func New(config *config.AppConfig, httpClient *http.Client) service.Client {
+	return &cbcgem{
+		config:     config,
+		httpClient: httpClient,
+		index:      service.NewIndexCache(),
+		// Shows and films are at gem.cbc.ca/<show>, their episodes at
+		// gem.cbc.ca/<show>/s01e02, formerly under /media/.
+		regex: regexp.MustCompile(
+			`^https?://gem\.cbc\.ca/(?:media/)?([a-z0-9-]+)(?:/(s\d+e\d+))?/?(?:[?#]|$)`,
+		),
+		origin:            "https://gem.cbc.ca",
+		justWatchPackages: []string{"cbc"},
+	}
+}
+
+func (c *cbcgem) ID() service.ID {
+	return "cbcgem"
+}
+
+func (c *cbcgem) ExtractURLs(ctx context.Context) ([]string, error) {
+	return service.NewJustWatchURLExtractor(c.config, c.httpClient, c.justWatchPackages).ExtractURLs(ctx)
+}
+
+func (c *cbcgem) JustWatchPackages() []string {
+	return c.justWatchPackages
+}
+
+func (c *cbcgem) Matches(url string) bool {
+	return c.regex.MatchString(url)
+}
+
+func (c *cbcgem) VideoExtract(ctx context.Context, url string) []model.VideoResult {
+	var results []model.VideoResult
+
+	for r := range c.extract(ctx, url) {
+		results = append(results, r)
+	}
+
+	return results
+}
+
+func (c *cbcgem) ExtractVariants(ctx context.Context, reference model.Reference) ([]model.Variant, error) {
+	return service.NewDefaultVariantExtractor(c.config, c.httpClient, c.origin).ExtractVariants(ctx, reference)
+}
+
+func (c *cbcgem) Fingerprint(ctx context.Context, variant model.Variant) (model.Fingerprint, error) {
+	return service.NewDefaultFingerprinter(c.config, c.httpClient, c.origin, c.index).Fingerprint(ctx, variant)
+}
+
+func (c *cbcgem) extract(ctx context.Context, url string) <-chan model.VideoResult {
+	results := make(chan model.VideoResult)
+
+	m := c.regex.FindStringSubmatch(url)
+
+	go func() {
+		defer close(results)
+
+		if m == nil {
+			results <- model.VideoResult{Err: fmt.Errorf("unsupported url %q", url)}
+			return
+		}
+		c.sendShow(ctx, m[1], m[2], results)
+	}()
+
+	return results
+}
+
+// sendShow sends the videos of the episodes of show, or only that of
+// episode (e.g. "s01e02") if set. Films are shows of one episode.
+func (c *cbcgem) sendShow(ctx context.Context, show, episode string, results chan<- model.VideoResult) {
+	res, err := c.fetchShow(ctx, show)
+	if err != nil {
+		results <- model.VideoResult{Err: fmt.Errorf("fetch show %q: %w", show, err)}
+		return
+	}
+
+	eps := res.episodes()
+	if episode != "" {
+		i := slices.IndexFunc(eps, func(e episodeItem) bool { return e.URL == show+"/"+episode })
+		if i < 0 {
+			results <- model.VideoResult{Err: fmt.Errorf("show %q: episode %q not found", show, episode)}
+			return
+		}
+		c.sendEpisode(ctx, res.Title, eps[i], results)
+		return
+	}
+	if len(eps) == 0 {
+		results <- model.VideoResult{Err: fmt.Errorf("show %q: no episodes", show)}
+		return
+	}
+	if seasons := res.seasons(); len(seasons) > 0 {
+		results <- model.VideoResult{Seasons: seasons}
+	}
+
+	g := service.NewVideoGroup(c.config)
+	for _, e := range eps {
+		g.Go(func() error {
+			c.sendEpisode(ctx, res.Title, e, results)
+			return nil
+		})
+	}
+	g.Wait()
+}
+
+func (c *cbcgem) sendEpisode(ctx context.Context, showTitle string, e episodeItem, results chan<- model.VideoResult) {
+	id := strconv.FormatInt(e.IDMedia, 10)
+
+	ref, err := c.extractVideoReference(ctx, id)
+	if err != nil {
+		results <- model.VideoResult{
+			Err:     fmt.Errorf("extract reference %q (%s): %w", e.URL, id, err),
+			Season:  e.SeasonNumber,
+			Episode: e.EpisodeNumber,
+		}
+		return
+	}
+
+	v := model.Video{
+		ID:          id,
+		Title:       model.OneTitle(showTitle, e.Title, e.SeasonNumber, e.EpisodeNumber),
+		PlaybackURL: c.origin + "/" + e.URL,
+		Duration:    e.Metadata.Duration,
+		Description: e.Description,
+	}
+	if t, err := time.Parse(time.RFC3339, e.Metadata.AirDate); err == nil {
+		v.AirDate = &t
+	}
+
+	results <- model.VideoResult{
+		Video:      v,
+		References: []model.Reference{*ref},
+		Season:     e.SeasonNumber,
+		Episode:    e.EpisodeNumber,
+	}
+}
+
+type (
+	// showResponse is of the catalog, listing the episodes of a show
+	// by season (lineup).
+	showResponse struct {
+		Title   string `json:"title"`
+		Content []struct {
+			Lineups []struct {
+				SeasonNumber int32         `json:"seasonNumber"`
+				Items        []episodeItem `json:"items"`
+			} `json:"lineups"`
+		} `json:"content"`
+	}
+
+	episodeItem struct {
+		IDMedia       int64  `json:"idMedia"`
+		Title         string `json:"title"`
+		Description   string `json:"description"`
+		EpisodeNumber int32  `json:"episodeNumber"`
+		// URL is the path of the episode, e.g. "show/s01e02".
+		URL string `json:"url"`
+
+		Metadata struct {
+			Duration int32  `json:"duration"`
+			AirDate  string `json:"airDate"`
+		} `json:"metadata"`
+
+		// SeasonNumber is of the lineup of the episode.
+		SeasonNumber int32 `json:"-"`
+	}
+)
+
+// episodes returns the playable episodes of all seasons, in order.
+func (r *showResponse) episodes() []episodeItem {
+	var eps []episodeItem
+	for _, c := range r.Content {
+		for _, l := range c.Lineups {
+			for _, e := range l.Items {
+				if e.IDMedia == 0 {
+					continue
+				}
+				e.SeasonNumber = l.SeasonNumber
+				eps = append(eps, e)
+			}
+		}
+	}
+	return eps
+}
+
+// seasons returns the numbers of the seasons of the show, if numbered.
+func (r *showResponse) seasons() []int32 {
+	var nums []int32
+	for _, c := range r.Content {
+		for _, l := range c.Lineups {
+			if n := l.SeasonNumber; n > 0 && !slices.Contains(nums, n) {
+				nums = append(nums, n)
+			}
+		}
+	}
+	return nums
+}
+
+func (c *cbcgem) fetchShow(ctx context.Context, show string) (*showResponse, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		apiBase+"/ott/catalog/v2/gem/show/"+urlpkg.PathEscape(show)+"?device=web",
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new: %w", err)
+	}
+
+	c.setHeaders(req)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", res.Status)
+	}
+
+	var r showResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
+	}
+
+	return &r, nil
+}
+
+// validationResponse is of the media validation API, the URL of the
+// manifest of a media, or why not (errorCode other than 0).
+type validationResponse struct {
+	URL       string `json:"url"`
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+}
+
+func (c *cbcgem) extractVideoReference(ctx context.Context, id string) (*model.Reference, error) {
+	query := urlpkg.Values{
+		"appCode":         {"gem"},
+		"connectionType":  {"hd"},
+		"deviceType":      {"ipad"},
+		"multibitrate":    {"true"},
+		"output":          {"json"},
+		"tech":            {"hls"},
+		"manifestVersion": {"2"},
+		"manifestType":    {"desktop"},
+		"idMedia":         {id},
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		apiBase+"/media/validation/v2/?"+query.Encode(),
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new: %w", err)
+	}
+
+	c.setHeaders(req)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", res.Status)
+	}
+
+	var r validationResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
+	}
+
+	switch r.ErrorCode {
+	case 0:
+	case 1:
+		return nil, &service.GeoBlockedError{Country: c.config.CountryCode, Reason: "only available in CA"}
+	case 35:
+		return nil, &service.SessionRequiredError{Service: "cbcgem", Host: "gem.cbc.ca", Reason: "validation error 35 (claimsToken cookie)"}
+	default:
+		return nil, fmt.Errorf("validation error %d: %s", r.ErrorCode, r.Message)
+	}
+	if r.URL == "" {
+		return nil, errors.New("no manifest")
+	}
+
+	return &model.Reference{
+		ID:     id,
+		Format: "hls",
+		URL:    r.URL,
+	}, nil
+}
+
+// setHeaders sets the headers of API requests, authorized by the claims
+// token of a logged in session (claimsToken cookie of gem.cbc.ca), if
+// any, as required for content of subscribers. Free content plays
+// without.
+func (c *cbcgem) setHeaders(req *http.Request) {
+	req.Header.Set("Origin", c.origin)
+	req.Header.Set("Referer", c.origin+"/")
+
+	if jar := c.config.CookieJar; jar != nil {
+		u, _ := urlpkg.Parse(c.origin)
+		for _, ck := range jar.Cookies(u) {
+			if ck.Name == "claimsToken" {
+				req.Header.Set("x-claims-token", ck.Value)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package cbcgem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service"
+	"karl/pkg/service/internal/servicetest"
+)
+
+// apiTransport serves the show fixture and the validation of each media,
+// of the fixture unless in validations, checking the claims token of
+// the session is sent.
+func apiTransport(t *testing.T, validations map[string]string) servicetest.RoundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		if tok := r.Header.Get("x-claims-token"); tok != "claims" {
+			t.Errorf("claims token %q, want of the cookie", tok)
+		}
+		var body io.ReadCloser
+		switch r.URL.Path {
+		case "/ott/catalog/v2/gem/show/schitts-creek":
+			f, err := os.Open("../../../testdata/cbcgem/show.json")
+			if err != nil {
+				return nil, err
+			}
+			body = f
+		case "/media/validation/v2/":
+			if v, ok := validations[r.URL.Query().Get("idMedia")]; ok {
+				body = io.NopCloser(strings.NewReader(v))
+				break
+			}
+			f, err := os.Open("../../../testdata/cbcgem/validation.json")
+			if err != nil {
+				return nil, err
+			}
+			body = f
+		default:
+			return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Body: http.NoBody}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: body}, nil
+	}
+}
+
+// newTestClient returns a client of a logged in session in Canada, its
+// API served by rt.
+func newTestClient(t *testing.T, rt http.RoundTripper) *cbcgem {
+	t.Helper()
+	jar := servicetest.NewJar(t)
+	u, _ := url.Parse("https://gem.cbc.ca")
+	jar.SetCookies(u, []*http.Cookie{{Name: "claimsToken", Value: "claims"}})
+
+	return New(&config.AppConfig{CountryCode: "CA", CookieJar: jar}, &http.Client{Transport: rt}).(*cbcgem)
+}
+
+func TestMatches(t *testing.T) {
+	c := New(nil, nil).(*cbcgem)
+	for _, tt := range []struct {
+		url           string
+		show, episode string
+	}{
+		{"https://gem.cbc.ca/schitts-creek", "schitts-creek", ""},
+		{"https://gem.cbc.ca/schitts-creek/s06e14", "schitts-creek", "s06e14"},
+		{"https://gem.cbc.ca/media/schitts-creek/s06e14", "schitts-creek", "s06e14"},
+		{"https://gem.cbc.ca/the-porter/?autoplay=true", "the-porter", ""},
+		{"https://gem.cbc.ca/category/comedy", "", ""},
+		{"https://gem.cbc.ca/schitts-creek/s06e14/extras", "", ""},
+		{"https://example.com/?u=gem.cbc.ca/schitts-creek", "", ""},
+	} {
+		m := c.regex.FindStringSubmatch(tt.url)
+		if tt.show == "" {
+			if m != nil {
+				t.Errorf("%s: matched %q", tt.url, m)
+			}
+			continue
+		}
+		if m == nil || m[1] != tt.show || m[2] != tt.episode {
+			t.Errorf("%s: %q, want %q %q", tt.url, m, tt.show, tt.episode)
+		}
+	}
+}
+
+func TestExtractShow(t *testing.T) {
+	c := newTestClient(t, apiTransport(t, nil))
+
+	var (
+		ids     []string
+		seasons []int32
+	)
+	for _, r := range c.VideoExtract(context.Background(), "https://gem.cbc.ca/schitts-creek") {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		if len(r.Seasons) > 0 {
+			seasons = r.Seasons
+			continue
+		}
+		ids = append(ids, r.Video.ID)
+	}
+	slices.Sort(ids)
+	// Items without media aren't episodes.
+	if want := []string{"1001", "1002", "2001"}; !slices.Equal(ids, want) {
+		t.Errorf("videos %v, want %v", ids, want)
+	}
+	if want := []int32{1, 2}; !slices.Equal(seasons, want) {
+		t.Errorf("seasons %v, want %v", seasons, want)
+	}
+
+	rs := c.VideoExtract(context.Background(), "https://gem.cbc.ca/schitts-creek/s01e02")
+	if len(rs) != 1 || rs[0].Err != nil {
+		t.Fatalf("results %+v, want the episode", rs)
+	}
+	r := rs[0]
+	if r.Season != 1 || r.Episode != 2 {
+		t.Errorf("S%dE%d, want S1E2", r.Season, r.Episode)
+	}
+	v := r.Video
+	if v.ID != "1002" || v.Title != "Schitt's Creek S001E002 The Drip" || v.PlaybackURL != "https://gem.cbc.ca/schitts-creek/s01e02" || v.Duration != 1290 {
+		t.Errorf("video %+v, want of the episode", v)
+	}
+	if want := time.Date(2015, 1, 20, 5, 0, 0, 0, time.UTC); v.AirDate == nil || !v.AirDate.Equal(want) {
+		t.Errorf("air date %v, want %v", v.AirDate, want)
+	}
+	want := model.Reference{ID: "1002", Format: "hls", URL: "https://cbcrcott-gem.akamaized.net/schitts-creek/master.m3u8"}
+	if !reflect.DeepEqual(r.References, []model.Reference{want}) {
+		t.Errorf("references %+v, want %+v", r.References, want)
+	}
+
+	rs = c.VideoExtract(context.Background(), "https://gem.cbc.ca/schitts-creek/s03e01")
+	if len(rs) != 1 || rs[0].Err == nil || !strings.Contains(rs[0].Err.Error(), `episode "s03e01" not found`) {
+		t.Errorf("results %+v, want episode not found", rs)
+	}
+}
+
+func TestExtractValidationErrors(t *testing.T) {
+	c := newTestClient(t, apiTransport(t, map[string]string{
+		"1001": `{"url":null,"errorCode":1,"message":"Ce contenu n'est pas disponible dans votre région."}`,
+		"1002": `{"url":null,"errorCode":35,"message":"Authentication required"}`,
+		"2001": `{"url":null,"errorCode":9,"message":"Media not found"}`,
+	}))
+
+	type episode struct{ season, episode int32 }
+	errs := make(map[episode]error)
+	for _, r := range c.VideoExtract(context.Background(), "https://gem.cbc.ca/schitts-creek") {
+		if len(r.Seasons) == 0 {
+			errs[episode{r.Season, r.Episode}] = r.Err
+		}
+	}
+	if len(errs) != 3 {
+		t.Fatalf("errors %v, want of 3 episodes", errs)
+	}
+
+	var (
+		geo     *service.GeoBlockedError
+		session *service.SessionRequiredError
+	)
+	if err := errs[episode{1, 1}]; !errors.As(err, &geo) || geo.Country != "CA" {
+		t.Errorf("S1E1: error %v, want geo-blocked in CA", err)
+	}
+	if err := errs[episode{1, 2}]; !errors.As(err, &session) || session.Host != "gem.cbc.ca" {
+		t.Errorf("S1E2: error %v, want a session of gem.cbc.ca required", err)
+	}
+	if err := errs[episode{2, 1}]; err == nil || !strings.Contains(err.Error(), "validation error 9: Media not found") {
+		t.Errorf("S2E1: error %v, want of the validation error", err)
+	}
+}
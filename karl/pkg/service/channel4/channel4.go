@@ -0,0 +1,336 @@
+package channel4
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	urlpkg "net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service"
+)
+
+var (
+	_ service.Client            = (*channel4)(nil)
+	_ service.URLExtractor      = (*channel4)(nil)
+	_ service.JustWatchProvider = (*channel4)(nil)
+	_ service.VideoExtractor    = (*channel4)(nil)
+	_ service.VariantExtractor  = (*channel4)(nil)
+	_ service.Fingerprinter     = (*channel4)(nil)
+	_ service.SelfTester        = (*channel4)(nil)
+)
+
+const apiBase = "https://api.channel4.com/online"
+
+type channel4 struct {
+	config            *config.AppConfig
+	httpClient        *http.Client
+	index             *service.IndexCache
+	regex             *regexp.Regexp
+	origin            string
+	justWatchPackages []string
+
+	mu          sync.Mutex
+	accessToken string
+	expiry      time.Time
+}
+
+func init() {
+	service.Register(New)
+}
+
+func New(config *config.AppConfig, httpClient *http.Client) service.Client {
+	return &channel4{
+		config:     config,
+		httpClient: httpClient,
+		index:      service.NewIndexCache(),
+		regex: regexp.MustCompile(
+			`^https?://(?:www\.)?channel4\.com/programmes/([a-z0-9-]+)(?:/on-demand/(\d+-\d+))?`,
+		),
+		origin:            "https://www.channel4.com",
+		justWatchPackages: []string{"ch4"},
+	}
+}
+
+func (c *channel4) ID() service.ID {
+	return "channel4"
+}
+
+func (c *channel4) ExtractURLs(ctx context.Context) ([]string, error) {
+	return service.NewJustWatchURLExtractor(c.config, c.httpClient, c.justWatchPackages).ExtractURLs(ctx)
+}
+
+func (c *channel4) JustWatchPackages() []string {
+	return c.justWatchPackages
+}
+
+func (c *channel4) Matches(url string) bool {
+	return c.regex.MatchString(url)
+}
+
+func (c *channel4) VideoExtract(ctx context.Context, url string) []model.VideoResult {
+	var results []model.VideoResult
+
+	for r := range c.extract(ctx, url) {
+		results = append(results, r)
+	}
+
+	return results
+}
+
+func (c *channel4) ExtractVariants(ctx context.Context, reference model.Reference) ([]model.Variant, error) {
+	return service.NewDefaultVariantExtractor(c.config, c.httpClient, c.origin).ExtractVariants(ctx, reference)
+}
+
+func (c *channel4) Fingerprint(ctx context.Context, variant model.Variant) (model.Fingerprint, error) {
+	return service.NewDefaultFingerprinter(c.config, c.httpClient, c.origin, c.index).Fingerprint(ctx, variant)
+}
+
+// SelfTest exchanges the refresh token of the logged in session for an
+// access token.
+func (c *channel4) SelfTest(ctx context.Context) error {
+	if _, err := c.token(ctx); err != nil {
+		return fmt.Errorf("token: %w", err)
+	}
+	return nil
+}
+
+func (c *channel4) extract(ctx context.Context, url string) <-chan model.VideoResult {
+	results := make(chan model.VideoResult)
+
+	var (
+		m           = c.regex.FindStringSubmatch(url)
+		slug        = m[1]
+		programmeID = m[2]
+	)
+
+	go func() {
+		defer close(results)
+
+		// Channel 4 is only available in the UK.
+		if err := service.RequireCountry(c.config.CountryCode, "GB"); err != nil {
+			results <- model.VideoResult{Err: err}
+			return
+		}
+
+		c.sendBrand(ctx, slug, programmeID, results)
+	}()
+
+	return results
+}
+
+// sendBrand sends the episodes of a brand (show or movie), or only the
+// one of programmeID if set.
+func (c *channel4) sendBrand(ctx context.Context, slug, programmeID string, results chan<- model.VideoResult) {
+	var res brandResponse
+	if err := c.fetchAPI(ctx, "/v1/views/content-hubs/"+slug+".json", &res); err != nil {
+		results <- model.VideoResult{Err: fmt.Errorf("fetch brand %q: %w", slug, err)}
+		return
+	}
+
+	var (
+		brand    = res.Brand
+		episodes []episode
+	)
+	for _, e := range brand.Episodes {
+		if !e.Available || (programmeID != "" && e.ProgrammeID != programmeID) {
+			continue
+		}
+		episodes = append(episodes, e)
+	}
+	if len(episodes) == 0 {
+		results <- model.VideoResult{Err: fmt.Errorf("brand %q: no available episodes", slug)}
+		return
+	}
+
+	g := service.NewVideoGroup(c.config)
+	for _, e := range episodes {
+		g.Go(func() error {
+			c.sendVideo(ctx, slug, brand.Title, e, results)
+			return nil
+		})
+	}
+	g.Wait()
+}
+
+func (c *channel4) sendVideo(ctx context.Context, slug, brandTitle string, e episode, results chan<- model.VideoResult) {
+	ref, err := c.extractVideoReference(ctx, e.ProgrammeID)
+	if err != nil {
+		results <- model.VideoResult{
+			Err:     fmt.Errorf("extract reference %q: %w", e.ProgrammeID, err),
+			Season:  e.SeriesNumber,
+			Episode: e.EpisodeNumber,
+		}
+		return
+	}
+
+	results <- model.VideoResult{
+		Video: model.Video{
+			ID:          e.ProgrammeID,
+			Title:       model.OneTitle(brandTitle, e.Title, e.SeriesNumber, e.EpisodeNumber),
+			PlaybackURL: c.origin + "/programmes/" + slug + "/on-demand/" + e.ProgrammeID,
+			Duration:    e.Duration,
+		},
+		References: []model.Reference{*ref},
+		Season:     e.SeriesNumber,
+		Episode:    e.EpisodeNumber,
+	}
+}
+
+type (
+	brandResponse struct {
+		Brand struct {
+			Title    string    `json:"title"`
+			Episodes []episode `json:"episodes"`
+		} `json:"brand"`
+	}
+
+	episode struct {
+		ProgrammeID   string `json:"programmeId"`
+		Title         string `json:"secondaryTitle"`
+		SeriesNumber  int32  `json:"seriesNumber"`
+		EpisodeNumber int32  `json:"episodeNumber"`
+		Duration      int32  `json:"duration"`
+		Available     bool   `json:"availability"`
+	}
+)
+
+func (c *channel4) extractVideoReference(ctx context.Context, programmeID string) (*model.Reference, error) {
+	var res streamResponse
+	if err := c.fetchAPI(ctx, "/v1/vod/stream/"+programmeID+"?client=android-mod", &res); err != nil {
+		return nil, fmt.Errorf("fetch stream %q: %w", programmeID, err)
+	}
+
+	// Widevine DASH profiles are named e.g. "dashwv-dyn-stream-1".
+	for _, p := range res.VideoProfiles {
+		if !strings.HasPrefix(p.Name, "dashwv") || len(p.Streams) == 0 {
+			continue
+		}
+		return &model.Reference{
+			ID:     p.Name,
+			Format: "dash",
+			URL:    p.Streams[0].URI,
+		}, nil
+	}
+
+	return nil, errors.New("no dash video profile")
+}
+
+type streamResponse struct {
+	VideoProfiles []struct {
+		Name    string `json:"name"`
+		Streams []struct {
+			URI string `json:"uri"`
+		} `json:"streams"`
+	} `json:"videoProfiles"`
+}
+
+func (c *channel4) fetchAPI(ctx context.Context, path string, v any) error {
+	token, err := c.token(ctx)
+	if err != nil {
+		return fmt.Errorf("access token: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiBase+path, nil)
+	if err != nil {
+		return fmt.Errorf("new: %w", err)
+	}
+
+	req.Header.Set("Origin", c.origin)
+	req.Header.Set("Referer", c.origin+"/")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", res.Status)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode body: %w", err)
+	}
+
+	return nil
+}
+
+// token returns the access token required by the API, exchanged for the
+// refresh token of a logged in session (C4_REFRESH_TOKEN cookie) and
+// reused until it expires.
+func (c *channel4) token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.accessToken != "" && time.Now().Before(c.expiry) {
+		return c.accessToken, nil
+	}
+
+	var refreshToken string
+	if jar := c.config.CookieJar; jar != nil {
+		u, _ := urlpkg.Parse(c.origin)
+		for _, ck := range jar.Cookies(u) {
+			if ck.Name == "C4_REFRESH_TOKEN" {
+				refreshToken = ck.Value
+				break
+			}
+		}
+	}
+	if refreshToken == "" {
+		return "", errors.New("login required (C4_REFRESH_TOKEN cookie)")
+	}
+
+	form := urlpkg.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		apiBase+"/v2/auth/token",
+		strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return "", fmt.Errorf("new: %w", err)
+	}
+
+	req.Header.Set("Origin", c.origin)
+	req.Header.Set("Referer", c.origin+"/")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", res.Status)
+	}
+
+	var r struct {
+		AccessToken string `json:"accessToken"`
+		ExpiresIn   int64  `json:"expiresIn"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return "", fmt.Errorf("decode body: %w", err)
+	}
+	if r.AccessToken == "" {
+		return "", errors.New("empty access token")
+	}
+
+	// Renewed a minute ahead of expiry.
+	c.accessToken = r.AccessToken
+	c.expiry = time.Now().Add(time.Duration(r.ExpiresIn)*time.Second - time.Minute)
+
+	return c.accessToken, nil
+}
@@ -0,0 +1,148 @@
+package channel4
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service/internal/servicetest"
+)
+
+// newTestClient returns a client of a logged in session in the UK, its
+// API served by rt.
+func newTestClient(t *testing.T, videoConcurrency int, rt http.RoundTripper) *channel4 {
+	t.Helper()
+	jar := servicetest.NewJar(t)
+	u, _ := url.Parse("https://www.channel4.com")
+	jar.SetCookies(u, []*http.Cookie{{Name: "C4_REFRESH_TOKEN", Value: "refresh"}})
+
+	config := &config.AppConfig{CountryCode: "GB", CookieJar: jar, VideoConcurrency: videoConcurrency}
+	return New(config, &http.Client{Transport: rt}).(*channel4)
+}
+
+// apiTransport serves the token, the brand and the stream fixtures,
+// calling onStream for each stream request.
+func apiTransport(onStream func()) servicetest.RoundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		var body io.ReadCloser
+		switch p := r.URL.Path; {
+		case p == "/online/v2/auth/token":
+			body = io.NopCloser(strings.NewReader(`{"accessToken":"access","expiresIn":3600}`))
+		case strings.HasPrefix(p, "/online/v1/views/content-hubs/"):
+			f, err := os.Open("../../../testdata/channel4/brand.json")
+			if err != nil {
+				return nil, err
+			}
+			body = f
+		case strings.HasPrefix(p, "/online/v1/vod/stream/"):
+			if r.Header.Get("Authorization") != "Bearer access" {
+				return &http.Response{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized", Body: http.NoBody}, nil
+			}
+			onStream()
+			f, err := os.Open("../../../testdata/channel4/stream.json")
+			if err != nil {
+				return nil, err
+			}
+			body = f
+		default:
+			return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Body: http.NoBody}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: body}, nil
+	}
+}
+
+func TestMatches(t *testing.T) {
+	c := New(nil, nil).(*channel4)
+	for _, tt := range []struct {
+		url               string
+		slug, programmeID string
+	}{
+		{"https://www.channel4.com/programmes/the-show", "the-show", ""},
+		{"https://www.channel4.com/programmes/the-show/on-demand/70001-001", "the-show", "70001-001"},
+		{"https://www.channel4.com/programmes/the-show/episode-guide", "the-show", ""},
+		{"https://www.channel4.com/categories/drama", "", ""},
+		{"https://www.channel5.com/programmes/the-show", "", ""},
+		// Of other hosts, merely mentioning one.
+		{"https://example.com/?u=channel4.com/programmes/x", "", ""},
+		{"https://www.notchannel4.com/programmes/the-show", "", ""},
+	} {
+		m := c.regex.FindStringSubmatch(tt.url)
+		if tt.slug == "" {
+			if m != nil || c.Matches(tt.url) {
+				t.Errorf("%s: matched %q", tt.url, m)
+			}
+			continue
+		}
+		if m == nil || m[1] != tt.slug || m[2] != tt.programmeID {
+			t.Errorf("%s: %q, want %q %q", tt.url, m, tt.slug, tt.programmeID)
+		}
+	}
+}
+
+func TestExtractBrand(t *testing.T) {
+	var inFlight servicetest.InFlight
+	c := newTestClient(t, 2, apiTransport(func() {
+		defer inFlight.Enter()()
+		time.Sleep(5 * time.Millisecond)
+	}))
+
+	for _, tt := range []struct {
+		url  string
+		want []string
+	}{
+		// The available episodes.
+		{"https://www.channel4.com/programmes/the-show", []string{"70001-001", "70001-002", "70001-003", "70002-001", "70002-003"}},
+		{"https://www.channel4.com/programmes/the-show/on-demand/70002-003", []string{"70002-003"}},
+	} {
+		var ids []string
+		for _, r := range c.VideoExtract(context.Background(), tt.url) {
+			if r.Err != nil {
+				t.Fatalf("%s: %v", tt.url, r.Err)
+			}
+			ids = append(ids, r.Video.ID)
+		}
+		slices.Sort(ids)
+		if !slices.Equal(ids, tt.want) {
+			t.Errorf("%s: videos %v, want %v", tt.url, ids, tt.want)
+		}
+	}
+	if m := inFlight.Most(); m > 2 {
+		t.Errorf("stream requests in flight = %d, want at most 2", m)
+	}
+
+	rs := c.VideoExtract(context.Background(), "https://www.channel4.com/programmes/the-show/on-demand/70002-003")
+	want := model.Video{
+		ID:          "70002-003",
+		Title:       "The Show S002E003 Finale",
+		PlaybackURL: "https://www.channel4.com/programmes/the-show/on-demand/70002-003",
+		Duration:    3300,
+	}
+	if len(rs) != 1 || !reflect.DeepEqual(rs[0].Video, want) {
+		t.Errorf("results %+v, want %+v", rs, want)
+	}
+	if len(rs) == 1 && (rs[0].Season != 2 || rs[0].Episode != 3) {
+		t.Errorf("result of S%dE%d, want S2E3", rs[0].Season, rs[0].Episode)
+	}
+}
+
+func TestExtractVideoReference(t *testing.T) {
+	c := newTestClient(t, 0, apiTransport(func() {}))
+	ref, err := c.extractVideoReference(context.Background(), "70001-001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first Widevine DASH profile with streams, of its first.
+	want := model.Reference{ID: "dashwv-dyn-stream-1", Format: "dash", URL: "https://cdn.example.com/dash/stream.mpd"}
+	if !reflect.DeepEqual(*ref, want) {
+		t.Errorf("reference %+v, want %+v", *ref, want)
+	}
+}
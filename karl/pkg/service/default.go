@@ -17,10 +17,11 @@ var (
 type defaultService struct {
 	config     *config.AppConfig
 	httpClient *http.Client
+	index      *IndexCache
 }
 
 func newDefaultService(config *config.AppConfig, httpClient *http.Client) Client {
-	return &defaultService{config: config, httpClient: httpClient}
+	return &defaultService{config: config, httpClient: httpClient, index: NewIndexCache()}
 }
 
 func (c *defaultService) ID() ID {
@@ -32,5 +33,5 @@ func (c *defaultService) ExtractVariants(ctx context.Context, reference model.Re
 }
 
 func (c *defaultService) Fingerprint(ctx context.Context, variant model.Variant) (model.Fingerprint, error) {
-	return NewDefaultFingerprinter(c.config, c.httpClient, "").Fingerprint(ctx, variant)
+	return NewDefaultFingerprinter(c.config, c.httpClient, "", c.index).Fingerprint(ctx, variant)
 }
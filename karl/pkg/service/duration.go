@@ -0,0 +1,67 @@
+package service
+
+import (
+	"math"
+	"slices"
+
+	"karl/pkg/model"
+)
+
+// validateDurations returns warnings for the variants of video whose
+// fingerprint duration differs by more than tolerance (a fraction) from
+// the duration of the video, for the main kind only, or from the median
+// of the other variants of its kind. Live variants, windows of the
+// content, are ignored.
+func validateDurations(video model.Video, tolerance float64) []model.DurationWarning {
+	byKind := make(map[string][]float64)
+	for _, v := range video.Variants {
+		if v.Fingerprint == nil || v.Live {
+			continue
+		}
+		if d := v.Fingerprint.Duration(); d > 0 {
+			byKind[v.Kind] = append(byKind[v.Kind], d)
+		}
+	}
+	medians := make(map[string]float64)
+	for kind, durations := range byKind {
+		if len(durations) < 2 {
+			continue
+		}
+		slices.Sort(durations)
+		medians[kind] = durations[len(durations)/2]
+	}
+
+	var warnings []model.DurationWarning
+	for _, v := range video.Variants {
+		if v.Fingerprint == nil || v.Live {
+			continue
+		}
+		d := v.Fingerprint.Duration()
+		if d <= 0 {
+			continue
+		}
+		warn := func(expected float64, source string) {
+			warnings = append(warnings, model.DurationWarning{
+				Width:     v.Width,
+				Height:    v.Height,
+				Bandwidth: v.Bandwidth,
+				Language:  v.Language,
+				Kind:      v.Kind,
+				Duration:  d,
+				Expected:  expected,
+				Source:    source,
+			})
+		}
+		isMain := v.Kind == "" || v.Kind == model.KindMain
+		// The video duration is in whole seconds.
+		if expected := float64(video.Duration); isMain && expected > 0 && math.Abs(d-expected) > max(expected*tolerance, 1) {
+			warn(expected, "metadata")
+			continue
+		}
+		if median, ok := medians[v.Kind]; ok && math.Abs(d-median) > median*tolerance {
+			warn(median, "variants")
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"slices"
+	"testing"
+
+	"karl/pkg/model"
+)
+
+func TestValidateDurations(t *testing.T) {
+	// variant is of kind, of a fingerprint of seconds, told by width.
+	variant := func(width uint32, kind string, seconds float64) model.Variant {
+		return model.Variant{
+			Width:       width,
+			Kind:        kind,
+			Fingerprint: &model.Fingerprint{Timescale: 10, SegmentDurations: []uint32{uint32(seconds * 10)}},
+		}
+	}
+	warning := func(width uint32, kind string, seconds, expected float64, source string) model.DurationWarning {
+		return model.DurationWarning{Width: width, Kind: kind, Duration: seconds, Expected: expected, Source: source}
+	}
+	live := variant(4, "", 30)
+	live.Live = true
+
+	for _, tt := range []struct {
+		name     string
+		duration int32
+		variants []model.Variant
+		want     []model.DurationWarning
+	}{
+		{"matching", 600, []model.Variant{variant(1, "", 600), variant(2, "main", 595)}, nil},
+		// 2% of 600s.
+		{"within tolerance", 600, []model.Variant{variant(1, "", 588)}, nil},
+		{"off the video", 600, []model.Variant{variant(1, "", 600), variant(2, "main", 580)},
+			[]model.DurationWarning{warning(2, "main", 580, 600, "metadata")}},
+		// Of a whole second at least, the video duration rounded.
+		{"short", 30, []model.Variant{variant(1, "", 30.9)}, nil},
+		{"off the variants", 0, []model.Variant{variant(1, "", 600), variant(2, "", 600), variant(3, "", 540)},
+			[]model.DurationWarning{warning(3, "", 540, 600, "variants")}},
+		// Only of the main kind checked against the video, others against
+		// the variants of their kind.
+		{"other kind", 600, []model.Variant{variant(1, "", 600), variant(2, model.KindTrailer, 120), variant(3, model.KindTrailer, 100)},
+			[]model.DurationWarning{warning(3, model.KindTrailer, 100, 120, "variants")}},
+		{"live", 600, []model.Variant{variant(1, "", 600), live}, nil},
+		{"not fingerprinted", 600, []model.Variant{variant(1, "", 600), {Width: 2}}, nil},
+	} {
+		got := validateDurations(model.Video{Duration: tt.duration, Variants: tt.variants}, 0.02)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: warnings %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
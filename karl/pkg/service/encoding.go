@@ -0,0 +1,102 @@
+package service
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Media is requested with identity encoding, as by players, since the
+// lengths of encoded (e.g. gzipped) responses aren't those of segments.
+// Some CDNs encode regardless, so responses are checked for it.
+var (
+	encodedMu sync.Mutex
+	// encodedHosts counts the responses per host encoded although
+	// identity was requested.
+	encodedHosts = make(map[string]int)
+)
+
+// EncodedHosts returns the number of responses per host encoded although
+// identity was requested, whose lengths had to be measured otherwise.
+func EncodedHosts() map[string]int {
+	encodedMu.Lock()
+	defer encodedMu.Unlock()
+
+	counts := make(map[string]int, len(encodedHosts))
+	for host, n := range encodedHosts {
+		counts[host] = n
+	}
+	return counts
+}
+
+// contentEncoding returns the content encoding of res, or "" if identity.
+func contentEncoding(res *http.Response) string {
+	enc := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+	if enc == "" || enc == "identity" {
+		return ""
+	}
+	return enc
+}
+
+// countEncoded counts a segment of host responded with content encoding
+// enc, warning of the first. It's called once per segment, however many
+// of its responses were encoded.
+func countEncoded(host, enc string) {
+	encodedMu.Lock()
+	encodedHosts[host]++
+	first := encodedHosts[host] == 1
+	encodedMu.Unlock()
+	if first {
+		log.Printf("warning: %s responds with content encoding %s although identity requested, measuring decoded sizes\n", host, enc)
+	}
+}
+
+// encodingCheck checks the responses for a segment for content encodings,
+// to count the segment once if any was encoded.
+type encodingCheck struct {
+	host, enc string
+}
+
+// check returns the content encoding of res, noting the first.
+func (c *encodingCheck) check(res *http.Response) string {
+	enc := contentEncoding(res)
+	if enc != "" && c.enc == "" {
+		c.host, c.enc = res.Request.URL.Host, enc
+	}
+	return enc
+}
+
+// done counts the segment if any of its responses was encoded.
+func (c *encodingCheck) done() {
+	if c.enc != "" {
+		countEncoded(c.host, c.enc)
+	}
+}
+
+// decodeBody returns the body of res decoded of its content encoding, if
+// supported.
+func decodeBody(res *http.Response, enc string) (io.Reader, error) {
+	switch enc {
+	case "":
+		return res.Body, nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		return r, nil
+	case "deflate":
+		r, err := zlib.NewReader(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("deflate: %w", err)
+		}
+		return r, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", enc)
+	}
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"karl/pkg/config"
+)
+
+const segmentLen = 4096
+
+// newCompressingServer returns a server of a segment of segmentLen bytes,
+// gzipping its responses, ranges ignored, unless rangesIdentity, where
+// range requests are answered unencoded.
+func newCompressingServer(t *testing.T, rangesIdentity bool) *httptest.Server {
+	t.Helper()
+
+	segment := bytes.Repeat([]byte{0x47}, segmentLen)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(segment)
+	zw.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Accept-Encoding"); got != "identity" {
+			t.Errorf("Accept-Encoding %q, want identity", got)
+		}
+		if rangesIdentity && r.Header.Get("Range") == "bytes=0-0" {
+			w.Header().Set("Content-Range", "bytes 0-0/"+strconv.Itoa(segmentLen))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(segment[:1])
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(gz.Len()))
+		if r.Method != http.MethodHead {
+			w.Write(gz.Bytes())
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func serverHost(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+func TestFetchContentLengthEncoded(t *testing.T) {
+	srv := newCompressingServer(t, false)
+	f := NewDefaultFingerprinter(&config.AppConfig{ContentLengthGET: true}, srv.Client(), "", nil)
+
+	for i := 1; i <= 2; i++ {
+		l, method, err := f.fetchContentLength(context.Background(), srv.URL+"/seg"+strconv.Itoa(i)+".ts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l != segmentLen || method != lengthByGET {
+			t.Errorf("length %d by %s, want %d by %s", l, method, segmentLen, lengthByGET)
+		}
+		// HEAD and GET were encoded, counted once per segment.
+		if n := EncodedHosts()[serverHost(t, srv)]; n != i {
+			t.Errorf("after %d segments, %d encoded, want %d", i, n, i)
+		}
+	}
+}
+
+func TestFetchContentLengthEncodedRange(t *testing.T) {
+	srv := newCompressingServer(t, true)
+	f := NewDefaultFingerprinter(&config.AppConfig{}, srv.Client(), "", nil)
+
+	l, method, err := f.fetchContentLength(context.Background(), srv.URL+"/seg1.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != segmentLen || method != lengthByRange {
+		t.Errorf("length %d by %s, want %d by %s", l, method, segmentLen, lengthByRange)
+	}
+	if n := EncodedHosts()[serverHost(t, srv)]; n != 1 {
+		t.Errorf("%d encoded, want 1", n)
+	}
+}
+
+func TestFetchContentLengthEncodedNoGET(t *testing.T) {
+	srv := newCompressingServer(t, false)
+	f := NewDefaultFingerprinter(&config.AppConfig{}, srv.Client(), "", nil)
+
+	_, _, err := f.fetchContentLength(context.Background(), srv.URL+"/seg1.ts")
+	if err == nil || !strings.Contains(err.Error(), "--content-length-get") {
+		t.Errorf("error %v, want telling --content-length-get", err)
+	}
+	if n := EncodedHosts()[serverHost(t, srv)]; n != 1 {
+		t.Errorf("%d encoded, want 1", n)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	const want = "segment"
+
+	var gz, zl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(want))
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write([]byte(want))
+	zw.Close()
+
+	for _, tt := range []struct {
+		enc  string
+		body []byte
+	}{
+		{"", []byte(want)},
+		{"gzip", gz.Bytes()},
+		{"x-gzip", gz.Bytes()},
+		{"deflate", zl.Bytes()},
+	} {
+		res := &http.Response{Body: io.NopCloser(bytes.NewReader(tt.body))}
+		r, err := decodeBody(res, tt.enc)
+		if err != nil {
+			t.Errorf("%q: %v", tt.enc, err)
+			continue
+		}
+		if got, _ := io.ReadAll(r); string(got) != want {
+			t.Errorf("%q: decoded %q, want %q", tt.enc, got, want)
+		}
+	}
+
+	res := &http.Response{Body: io.NopCloser(strings.NewReader(want))}
+	if _, err := decodeBody(res, "br"); err == nil {
+		t.Error("br decoded, want unsupported")
+	}
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+)
+
+// NotEntitledError is returned by clients when a service refuses content
+// that the account, or the lack of one, isn't entitled to, e.g. a rental
+// not paid for, as told by the service.
+type NotEntitledError struct {
+	// Reason is the signal of the service, e.g. its error code.
+	Reason string
+}
+
+func (e *NotEntitledError) Error() string {
+	return fmt.Sprintf("not entitled (%s): set --cookies of an account that purchased or subscribed to the content", e.Reason)
+}
+
+// SessionRequiredError is returned by clients when a service refuses
+// content for want of a signed in session, which the cookies of Host
+// (e.g. www.amazon.com) from a browser signed in to Service provide.
+type SessionRequiredError struct {
+	Service string
+	Host    string
+	// Reason is the signal of the service, e.g. its error code.
+	Reason string
+}
+
+func (e *SessionRequiredError) Error() string {
+	return fmt.Sprintf("%s session cookie required; pass --cookies %s=\"...\" of a signed in browser (%s)", e.Service, e.Host, e.Reason)
+}
+
+// failureReason returns the class of the failure of a video of err, as
+// of model.Failure.
+func failureReason(err error) string {
+	var (
+		ne *NotEntitledError
+		se *SessionRequiredError
+		ge *GeoBlockedError
+		le *LiveEventError
+	)
+	switch {
+	case errors.As(err, &ne):
+		return "not_entitled"
+	case errors.As(err, &se):
+		return "session_required"
+	case errors.As(err, &ge):
+		return "geo_blocked"
+	case errors.As(err, &le):
+		return "live_event"
+	default:
+		return "error"
+	}
+}
@@ -6,13 +6,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"math"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/abema/go-mp4"
@@ -27,13 +32,19 @@ type DefaultFingerprinter struct {
 	config     *config.AppConfig
 	httpClient *http.Client
 	origin     string
+	progress   func(model.FingerprintProgress)
+	index      *IndexCache
 }
 
-func NewDefaultFingerprinter(config *config.AppConfig, httpClient *http.Client, origin string) *DefaultFingerprinter {
+// NewDefaultFingerprinter returns a fingerprinter reading the indexes of
+// on-demand files through index, if not nil.
+func NewDefaultFingerprinter(config *config.AppConfig, httpClient *http.Client, origin string, index *IndexCache) *DefaultFingerprinter {
 	return &DefaultFingerprinter{
 		config:     config,
 		httpClient: httpClient,
 		origin:     origin,
+		progress:   config.Progress,
+		index:      index,
 	}
 }
 
@@ -42,9 +53,15 @@ func (f *DefaultFingerprinter) Fingerprint(ctx context.Context, variant model.Va
 	case "indexed":
 		return f.fingerprintIndexed(ctx, variant.MimeType, *variant.IndexedAddressingInfo)
 	case "explicit":
-		return f.fingerprintExplicit(ctx, *variant.ExplicitAddressingInfo)
+		return f.fingerprintExplicit(ctx, variant.ID, *variant.ExplicitAddressingInfo)
 	case "fingerprinted":
-		return *variant.Fingerprint, nil
+		fp := *variant.Fingerprint
+		if info := variant.ExplicitAddressingInfo; info != nil {
+			if err := f.fingerprintInit(ctx, *info, &fp); err != nil {
+				return model.Fingerprint{}, err
+			}
+		}
+		return fp, nil
 	default:
 		return model.Fingerprint{}, fmt.Errorf("unsupported addressing mode %q", m)
 	}
@@ -55,7 +72,7 @@ func (f *DefaultFingerprinter) fingerprintIndexed(ctx context.Context, mimeType
 	case "video/mp4":
 		return f.fingerprintIndexedMP4(ctx, info)
 	case "video/webm":
-		return model.Fingerprint{}, errors.New("webm not yet implemented")
+		return f.fingerprintIndexedWebM(ctx, info)
 	default:
 		return model.Fingerprint{}, fmt.Errorf("unsupported mime type %q", mimeType)
 	}
@@ -63,160 +80,1037 @@ func (f *DefaultFingerprinter) fingerprintIndexed(ctx context.Context, mimeType
 
 func (f *DefaultFingerprinter) fingerprintIndexedMP4(ctx context.Context, info model.IndexedAddressingInfo) (model.Fingerprint, error) {
 	parsed, err := url.ParseRequestURI(info.URL)
+	isURL := err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https")
+
+	read := func(byteRange string) ([]byte, error) {
+		if isURL {
+			raw, err := f.fetchIndex(ctx, info.URL, byteRange)
+			if err != nil {
+				return nil, fmt.Errorf("fetch index: %w", err)
+			}
+			return raw, nil
+		}
+		raw, err := readRange(info.URL, byteRange)
+		if err != nil {
+			return nil, fmt.Errorf("read file: %w", err)
+		}
+		return raw, nil
+	}
+
+	fp, offsets, err := f.index.get(ctx, info.URL+" "+info.IndexRange, func() (model.Fingerprint, []int64, error) {
+		return f.indexMP4(read, info.IndexRange, isURL)
+	})
+	if err != nil {
+		return model.Fingerprint{}, err
+	}
+
+	if info.InitRange != "" {
+		fp.InitSegmentSize, err = initRangeSize(info.InitRange)
+		if err != nil {
+			return model.Fingerprint{}, err
+		}
+	}
+	fp.SegmentRanges = segmentRanges(fp.SegmentSizes, offsets)
+
+	if err := f.hashIndexedSegments(ctx, &fp, offsets, info.URL, isURL); err != nil {
+		return model.Fingerprint{}, err
+	}
+
+	return fp, nil
+}
+
+// indexMP4 sizes and times the segments of an MP4 file by its sidx box(es)
+// at indexRange, or else found, also returning their offsets. Without
+// sidx, the segments are the fragments.
+func (f *DefaultFingerprinter) indexMP4(read func(byteRange string) ([]byte, error), indexRange string, isURL bool) (model.Fingerprint, []int64, error) {
 	var (
-		raw        []byte
-		indexRange = info.IndexRange
-		isURL      = err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https")
+		sidx       *mp4.Sidx
+		start, end int64
+		// window is the last read of the file in which the sidx was
+		// found, from windowStart.
+		window      []byte
+		windowStart int64
+		err         error
 	)
-	if indexRange == "" {
-		indexRange = "0-65535"
-	}
-	if isURL {
-		raw, err = f.fetchIndex(ctx, info.URL, indexRange)
+	if indexRange != "" {
+		windowStart, _, err = parseRange(indexRange)
 		if err != nil {
-			return model.Fingerprint{}, fmt.Errorf("fetch index: %w", err)
+			return model.Fingerprint{}, nil, fmt.Errorf("index range: %w", err)
 		}
+		window, err = read(indexRange)
+		if err != nil {
+			return model.Fingerprint{}, nil, err
+		}
+		sidx, start, end, err = f.extractSIDX(window)
+		if err != nil {
+			return model.Fingerprint{}, nil, fmt.Errorf("extract sidx: %w", err)
+		}
+		start += windowStart
+		end += windowStart
 	} else {
-		raw, err = readRange(info.URL, indexRange)
+		sidx, start, end, window, windowStart, err = f.findSIDX(read)
+		// Without sidx, the segments are the fragments (moof boxes), for
+		// URLs only if enabled as a request is made per box.
+		if errors.Is(err, errSIDXNotFound) && (!isURL || f.config.WalkFragments) {
+			fp, offsets, err := walkFragments(read)
+			if err != nil {
+				return model.Fingerprint{}, nil, fmt.Errorf("walk fragments: %w", err)
+			}
+			return fp, offsets, nil
+		}
+		if err != nil {
+			return model.Fingerprint{}, nil, fmt.Errorf("find sidx: %w", err)
+		}
+	}
+
+	var (
+		fp = model.Fingerprint{
+			Timescale:                sidx.Timescale,
+			SIDXRange:                fmt.Sprintf("%d-%d", start, end-1),
+			FirstOffset:              sidx.GetFirstOffset(),
+			EarliestPresentationTime: sidx.GetEarliestPresentationTime(),
+		}
+		offsets    []int64
+		timescales = make(map[uint32]uint32)
+	)
+	if err := appendSIDX(read, sidx, end, &fp, &offsets, timescales, 0); err != nil {
+		return model.Fingerprint{}, nil, err
+	}
+
+	// Consecutive top-level sidx boxes (e.g. one per period) are
+	// concatenated, unless referenced by the first. They're within the
+	// index range, if any.
+	if !slices.ContainsFunc(sidx.References, func(r mp4.SidxReference) bool { return r.ReferenceType }) {
+		for {
+			next, nextEnd, err := followingSIDX(read, window, windowStart, end, indexRange == "")
+			if err != nil {
+				return model.Fingerprint{}, nil, fmt.Errorf("read sidx at %d: %w", end, err)
+			}
+			if next == nil {
+				break
+			}
+			if err := appendSIDX(read, next, nextEnd, &fp, &offsets, timescales, 0); err != nil {
+				return model.Fingerprint{}, nil, err
+			}
+			end = nextEnd
+		}
+	}
+
+	return fp, offsets, nil
+}
+
+// initRangeSize returns the size of the init segment at initRange.
+func initRangeSize(initRange string) (uint32, error) {
+	start, end, err := parseRange(initRange)
+	if err != nil {
+		return 0, fmt.Errorf("init range: %w", err)
+	}
+	if end < start {
+		return 0, fmt.Errorf("invalid init range %s", initRange)
+	}
+	if end-start+1 > math.MaxUint32 {
+		return 0, errors.New("init segment size > uint32")
+	}
+	return uint32(end - start + 1), nil
+}
+
+// fingerprintIndexedWebM sizes and times the clusters of a WebM file by
+// its Cues, read from the index range. The Segment and Info elements are
+// read from the init range, or else the first 64KB (which may then also
+// contain the Cues).
+func (f *DefaultFingerprinter) fingerprintIndexedWebM(ctx context.Context, info model.IndexedAddressingInfo) (model.Fingerprint, error) {
+	parsed, err := url.ParseRequestURI(info.URL)
+	var (
+		initRange = info.InitRange
+		isURL     = err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https")
+	)
+	if initRange == "" {
+		initRange = "0-65535"
+	}
+	// Checked before reading it.
+	var initSize uint32
+	if info.InitRange != "" {
+		if initSize, err = initRangeSize(info.InitRange); err != nil {
+			return model.Fingerprint{}, err
+		}
+	}
+
+	read := func(byteRange string) ([]byte, int64, error) {
+		start, _, err := parseRange(byteRange)
 		if err != nil {
-			return model.Fingerprint{}, fmt.Errorf("read file: %w", err)
+			return nil, 0, err
+		}
+		var raw []byte
+		if isURL {
+			raw, err = f.fetchIndex(ctx, info.URL, byteRange)
+		} else {
+			raw, err = readRange(info.URL, byteRange)
+		}
+		return raw, start, err
+	}
+
+	w := newWebMIndex()
+	for _, r := range []string{initRange, info.IndexRange} {
+		if r == "" || (r == info.IndexRange && r == initRange) {
+			continue
+		}
+		raw, start, err := read(r)
+		if err != nil {
+			return model.Fingerprint{}, fmt.Errorf("read range %s: %w", r, err)
+		}
+		if err := w.parse(raw, start); err != nil {
+			return model.Fingerprint{}, fmt.Errorf("parse webm: %w", err)
 		}
 	}
 
-	sidx, err := f.extractSIDX(raw)
+	fileSize := func() (int64, error) {
+		if isURL {
+			l, _, err := f.fetchContentLength(ctx, info.URL)
+			return l, err
+		}
+		fi, err := os.Stat(info.URL)
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	timescale, sizes, durations, err := w.fingerprint(fileSize)
 	if err != nil {
-		return model.Fingerprint{}, fmt.Errorf("extract sidx: %w", err)
+		return model.Fingerprint{}, err
 	}
 
 	fp := model.Fingerprint{
-		SegmentSizes:     make([]uint32, len(sidx.References)),
-		SegmentDurations: make([]uint32, len(sidx.References)),
-		Timescale:        sidx.Timescale,
+		SegmentSizes:     sizes,
+		SegmentDurations: durations,
+		Timescale:        timescale,
+		InitSegmentSize:  initSize,
 	}
 
-	for i, r := range sidx.References {
-		fp.SegmentSizes[i] = r.ReferencedSize
-		fp.SegmentDurations[i] = r.SubsegmentDuration
+	offsets := w.offsets()
+	fp.SegmentRanges = segmentRanges(fp.SegmentSizes, offsets)
+
+	if err := f.hashIndexedSegments(ctx, &fp, offsets, info.URL, isURL); err != nil {
+		return model.Fingerprint{}, err
 	}
 
 	return fp, nil
 }
 
+// maxIndexSize caps the size of a single range read for the index, in
+// case of bogus ranges or box sizes.
+const maxIndexSize = 64 << 20
+
 func (f *DefaultFingerprinter) fetchIndex(ctx context.Context, url, indexRange string) ([]byte, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	start, end, err := parseRange(indexRange)
 	if err != nil {
-		return nil, fmt.Errorf("new: %w", err)
+		return nil, err
 	}
-
-	if f.origin != "" {
-		req.Header.Set("Origin", f.origin)
-		req.Header.Set("Referer", f.origin+"/")
+	if end < start || end-start+1 > maxIndexSize {
+		return nil, fmt.Errorf("invalid range %s", indexRange)
 	}
 
-	req.Header.Set("Range", "bytes="+indexRange)
+	body, err := f.openRange(ctx, url, indexRange)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
 
-	res, err := f.httpClient.Do(req)
+	raw, err := io.ReadAll(body)
 	if err != nil {
-		return nil, fmt.Errorf("do: %w", err)
+		return nil, fmt.Errorf("read body: %w", err)
 	}
-	defer res.Body.Close()
 
-	return io.ReadAll(res.Body)
+	return raw, nil
 }
 
-func (f *DefaultFingerprinter) extractSIDX(raw []byte) (*mp4.Sidx, error) {
-	boxes, err := mp4.ExtractBoxWithPayload(
-		bytes.NewReader(raw),
-		nil,
-		mp4.BoxPath{mp4.BoxTypeSidx()},
-	)
+// openRange requests byteRange of url, returning a body of the range,
+// read as streamed (e.g. of segments too large to buffer). The body is
+// cut short at the end of the resource, and empty past it.
+func (f *DefaultFingerprinter) openRange(ctx context.Context, url, byteRange string) (io.ReadCloser, error) {
+	start, end, err := parseRange(byteRange)
 	if err != nil {
 		return nil, err
 	}
+	if end < start {
+		return nil, fmt.Errorf("invalid range %s", byteRange)
+	}
+
+	res, err := f.doRequest(ctx, http.MethodGet, url, byteRange)
+	if err != nil {
+		return nil, err
+	}
+
+	if enc := contentEncoding(res); enc != "" && res.StatusCode/100 == 2 {
+		// Ranges are of the encoded content.
+		res.Body.Close()
+		countEncoded(res.Request.URL.Host, enc)
+		return nil, fmt.Errorf("content encoding %s", enc)
+	}
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		if err := checkContentRange(res.Header.Get("Content-Range"), start, end); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Past the end.
+		res.Body.Close()
+		return http.NoBody, nil
+	case http.StatusOK:
+		// Range ignored, the whole resource is returned. Only the range
+		// is read of it, empty if the resource ends before it.
+		if _, err := io.CopyN(io.Discard, res.Body, start); err != nil {
+			res.Body.Close()
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return http.NoBody, nil
+			}
+			return nil, fmt.Errorf("skip to range start: %w", err)
+		}
+	default:
+		defer res.Body.Close()
+		const snippetLen = 256
+		snippet, _ := io.ReadAll(io.LimitReader(res.Body, snippetLen))
+		return nil, fmt.Errorf("status %s from %s: %q", res.Status, res.Request.URL, snippet)
+	}
+
+	return rangeBody{io.LimitReader(res.Body, end-start+1), res.Body}, nil
+}
+
+// rangeBody reads a range of a body, closing the body.
+type rangeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// checkContentRange checks that the Content-Range of a partial response
+// starts at start and ends no later than end (only cut short at the end
+// of the resource).
+func checkContentRange(contentRange string, start, end int64) error {
+	r, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return fmt.Errorf("invalid content range %q", contentRange)
+	}
+	r, _, _ = strings.Cut(r, "/")
+	gotStart, gotEnd, err := parseRange(r)
+	if err != nil {
+		return fmt.Errorf("invalid content range %q", contentRange)
+	}
+	if gotStart != start || gotEnd > end {
+		return fmt.Errorf("content range %q, requested %d-%d", contentRange, start, end)
+	}
+	return nil
+}
+
+// extractSIDX returns the first top-level sidx box of raw, skipping any
+// other boxes before it (e.g. styp, emsg, prft or free), and where in raw
+// it starts and ends.
+func (f *DefaultFingerprinter) extractSIDX(raw []byte) (*mp4.Sidx, int64, int64, error) {
+	sidx, start, end, _, found, err := scanSIDX(raw)
+	if err != nil || sidx != nil {
+		return sidx, start, end, err
+	}
+	return nil, 0, 0, sidxNotFoundError(found)
+}
+
+// maxSIDXDepth limits the levels of hierarchical sidx boxes followed.
+const maxSIDXDepth = 8
+
+// appendSIDX appends the subsegments of sidx, ending at offset end of the
+// file, to fp and their offsets to offsets. References to further sidx
+// boxes (hierarchical or daisy-chained) are read and resolved to their
+// subsegments.
+//
+// Boxes of a stream (reference_ID) must keep its timescale, kept in
+// timescales. Durations of other streams' boxes (e.g. one per track) are
+// rescaled to that of fp.
+func appendSIDX(read func(byteRange string) ([]byte, error), sidx *mp4.Sidx, end int64, fp *model.Fingerprint, offsets *[]int64, timescales map[uint32]uint32, depth int) error {
+	if depth > maxSIDXDepth {
+		return errors.New("sidx hierarchy too deep")
+	}
+	if sidx.Timescale == 0 {
+		return fmt.Errorf("sidx of stream %d: timescale 0", sidx.ReferenceID)
+	}
+	if ts, ok := timescales[sidx.ReferenceID]; ok && ts != sidx.Timescale {
+		return fmt.Errorf("sidx of stream %d: timescale %d, expected %d", sidx.ReferenceID, sidx.Timescale, ts)
+	}
+	timescales[sidx.ReferenceID] = sidx.Timescale
+
+	offset := end + int64(sidx.GetFirstOffset())
+	for _, r := range sidx.References {
+		if r.ReferenceType {
+			child, childEnd, err := readSIDXAt(read, offset)
+			if err != nil {
+				return fmt.Errorf("read sidx at %d: %w", offset, err)
+			}
+			if child == nil {
+				return fmt.Errorf("sidx at %d not found", offset)
+			}
+			if err := appendSIDX(read, child, childEnd, fp, offsets, timescales, depth+1); err != nil {
+				return err
+			}
+		} else {
+			fp.SegmentSizes = append(fp.SegmentSizes, r.ReferencedSize)
+			d := r.SubsegmentDuration
+			if sidx.Timescale != fp.Timescale {
+				d = uint32(uint64(d) * uint64(fp.Timescale) / uint64(sidx.Timescale))
+			}
+			fp.SegmentDurations = append(fp.SegmentDurations, d)
+			*offsets = append(*offsets, offset)
+		}
+		offset += int64(r.ReferencedSize)
+	}
+
+	return nil
+}
+
+// followingSIDX returns the sidx box at offset end of the file, if any,
+// and where it ends. It's looked for in window, read from windowStart,
+// and only read from the file if partially in the window, or if extend
+// and the window ends at end (before any box header).
+func followingSIDX(read func(byteRange string) ([]byte, error), window []byte, windowStart, end int64, extend bool) (*mp4.Sidx, int64, error) {
+	var rest []byte
+	if i := end - windowStart; i >= 0 && i < int64(len(window)) {
+		rest = window[i:]
+	}
+	bi, err := mp4.ReadBoxInfo(bytes.NewReader(rest))
+	switch {
+	case err != nil:
+		// No box header in the window.
+		if !extend {
+			return nil, 0, nil
+		}
+		return readSIDXAt(read, end)
+	case bi.Type != mp4.BoxTypeSidx():
+		return nil, 0, nil
+	case bi.Size > uint64(len(rest)):
+		return readSIDXAt(read, end)
+	}
+
+	sidx, _, boxEnd, _, _, err := scanSIDX(rest[:bi.Size])
+	if err != nil {
+		return nil, 0, err
+	}
+	return sidx, end + boxEnd, nil
+}
+
+// readSIDXAt reads the sidx box at offset of the file, also returning
+// where it ends. Returns nil if there's another box (or none) at offset,
+// of which only the header is read, as it's usually the first moof.
+func readSIDXAt(read func(byteRange string) ([]byte, error), offset int64) (*mp4.Sidx, int64, error) {
+	// Up to a 64-bit size.
+	header, err := read(fmt.Sprintf("%d-%d", offset, offset+15))
+	if err != nil {
+		return nil, 0, err
+	}
+	bi, err := mp4.ReadBoxInfo(bytes.NewReader(header))
+	if err != nil || bi.Type != mp4.BoxTypeSidx() {
+		return nil, 0, nil
+	}
+	if bi.Size < bi.HeaderSize {
+		return nil, 0, fmt.Errorf("sidx box: invalid size %d", bi.Size)
+	}
+	if bi.Size > sidxMaxRead {
+		return nil, 0, fmt.Errorf("sidx of %d bytes: over the %d byte read limit", bi.Size, sidxMaxRead)
+	}
+
+	raw, err := read(fmt.Sprintf("%d-%d", offset, offset+int64(bi.Size)-1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if uint64(len(raw)) < bi.Size {
+		return nil, 0, errors.New("sidx truncated")
+	}
+
+	sidx, _, end, _, _, err := scanSIDX(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sidx, offset + end, nil
+}
+
+const (
+	// sidxWindow is read at a time when searching for the sidx without
+	// an index range, up to sidxMaxRead in total.
+	sidxWindow  = 64 * 1024
+	sidxMaxRead = 4 * 1024 * 1024
+)
+
+// findSIDX searches for the sidx from the start of a file, reading a
+// window at a time, returning it, where in the file it starts and ends,
+// and the window it was found in and where that starts. Boxes extending
+// past a window (e.g. a large moov) are skipped by continuing from their
+// end, and a partially read sidx is read in full.
+func (f *DefaultFingerprinter) findSIDX(read func(byteRange string) ([]byte, error)) (sidx *mp4.Sidx, start, end int64, window []byte, windowStart int64, err error) {
+	var (
+		offset int64
+		length int64 = sidxWindow
+		total  int64
+		found  []string
+	)
+	for total < sidxMaxRead {
+		length = min(length, sidxMaxRead-total)
+		raw, err := read(fmt.Sprintf("%d-%d", offset, offset+length-1))
+		if err != nil {
+			return nil, 0, 0, nil, 0, err
+		}
+		total += int64(len(raw))
+
+		sidx, start, resume, need, types, err := scanSIDX(raw)
+		found = append(found, types...)
+		if err != nil {
+			return nil, 0, 0, nil, 0, err
+		}
+		if sidx != nil {
+			return sidx, offset + start, offset + resume, raw, offset, nil
+		}
+		// End of file.
+		if int64(len(raw)) < length && resume == int64(len(raw)) {
+			break
+		}
+
+		offset += resume
+		if need > sidxMaxRead-total {
+			return nil, 0, 0, nil, 0, fmt.Errorf("sidx of %d bytes at %d: over the %d byte read limit", need, offset, sidxMaxRead)
+		}
+		length = max(need, sidxWindow)
+	}
+
+	return nil, 0, 0, nil, 0, sidxNotFoundError(found)
+}
+
+// scanSIDX walks the top-level boxes of raw for the sidx, returning it
+// and where in raw it starts and ends. If not found, returns where in raw
+// to resume reading and at least how much to read (the whole sidx, if
+// partially read), along with the types of the boxes found.
+func scanSIDX(raw []byte) (sidx *mp4.Sidx, start, resume, need int64, found []string, err error) {
+	r := bytes.NewReader(raw)
+	for {
+		boxStart := int64(len(raw) - r.Len())
+		bi, err := mp4.ReadBoxInfo(r)
+		if err != nil {
+			// Box header partially read, or end of raw.
+			return nil, 0, boxStart, 0, found, nil
+		}
+		found = append(found, bi.Type.String())
+		if bi.Size < bi.HeaderSize || bi.Size > math.MaxInt64-bi.Offset {
+			return nil, 0, 0, 0, found, fmt.Errorf("%s box: invalid size %d", bi.Type, bi.Size)
+		}
+
+		end := int64(bi.Offset + bi.Size)
+		if bi.Type == mp4.BoxTypeSidx() {
+			if end > int64(len(raw)) {
+				return nil, 0, boxStart, int64(bi.Size), found[:len(found)-1], nil
+			}
+			var sidx mp4.Sidx
+			if _, err := mp4.Unmarshal(r, bi.Size-bi.HeaderSize, &sidx, bi.Context); err != nil {
+				return nil, 0, 0, 0, found, fmt.Errorf("unmarshal sidx: %w", err)
+			}
+			return &sidx, boxStart, end, 0, found, nil
+		}
 
-	if len(boxes) > 0 {
-		if sidx, ok := boxes[0].Payload.(*mp4.Sidx); ok {
-			return sidx, nil
+		if end >= int64(len(raw)) {
+			return nil, 0, end, 0, found, nil
+		}
+		if _, err := bi.SeekToEnd(r); err != nil {
+			return nil, 0, 0, 0, found, err
 		}
 	}
+}
+
+var errSIDXNotFound = errors.New("sidx box not found")
 
-	return nil, errors.New("sidx box not found")
+func sidxNotFoundError(found []string) error {
+	if len(found) == 0 {
+		return fmt.Errorf("%w, no boxes", errSIDXNotFound)
+	}
+	return fmt.Errorf("%w, top-level boxes: %s", errSIDXNotFound, strings.Join(found, ", "))
 }
 
-func (f *DefaultFingerprinter) fingerprintExplicit(ctx context.Context, info model.ExplicitAddressingInfo) (model.Fingerprint, error) {
+// inFlightContentLengths counts the segment content lengths being fetched.
+var inFlightContentLengths atomic.Int64
+
+// InFlightContentLengths returns the number of segment content lengths
+// being fetched, e.g. for progress reporting.
+func InFlightContentLengths() int64 {
+	return inFlightContentLengths.Load()
+}
+
+// segmentConcurrency returns the limit of segments of a variant to fetch
+// content lengths of concurrently, or -1 if unlimited.
+func segmentConcurrency(config *config.AppConfig) int {
+	if n := config.SegmentConcurrency; n > 0 {
+		return n
+	}
+	return -1
+}
+
+func (f *DefaultFingerprinter) fingerprintExplicit(ctx context.Context, variantID string, info model.ExplicitAddressingInfo) (model.Fingerprint, error) {
 	fp := model.Fingerprint{
+		Granularity:      info.Granularity,
 		SegmentSizes:     make([]uint32, len(info.URLs)),
 		SegmentDurations: info.SegmentDurations,
 		Timescale:        info.Timescale,
+		Gaps:             info.Gaps,
+		Discontinuities:  info.Discontinuities,
 	}
 
-	g, ctx := errgroup.WithContext(ctx)
+	// Segments without URL have known sizes (e.g. byte-ranged).
 	for i, u := range info.URLs {
-		g.Go(func() error {
-			const (
-				retries    = 5
-				maxSleepMS = 1000
-			)
-			try := 0
-			for {
-				timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-				defer cancel()
-				if l := len(info.Servers); l > 0 {
-					u = strings.Replace(u, "$Server$", info.Servers[rand.Intn(l)], 1)
+		if u != "" {
+			continue
+		}
+		if i >= len(info.SegmentSizes) || info.SegmentSizes[i] == 0 {
+			return model.Fingerprint{}, fmt.Errorf("segment %d: no URL or size", i)
+		}
+		fp.SegmentSizes[i] = info.SegmentSizes[i]
+	}
+
+	var (
+		mu sync.Mutex
+		// Content length methods by host.
+		methods  = make(map[string]map[string]int)
+		progress = model.FingerprintProgress{VariantID: variantID}
+		errs     = make([]error, len(info.URLs))
+		h        = f.newSegmentHasher()
+	)
+	h.init(&fp, len(info.URLs))
+
+	// Past this many segments gone or forbidden, the others likely are
+	// too (e.g. the manifest token expired), so the variant is failed
+	// rather than trying them.
+	var (
+		numPermanent atomic.Int64
+		maxPermanent = int64(len(info.URLs) * f.config.PermanentFailures / 100)
+	)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// A failing segment is recorded rather than cancelling the others,
+	// to be retried in a second pass.
+	fetch := func(ctx context.Context, indices []int) error {
+		var g errgroup.Group
+		g.SetLimit(segmentConcurrency(f.config))
+		// Segments are fetched in order, keeping CDN caches warm, unless
+		// stealthy, not to look like a scraper.
+		if f.config.Stealth {
+			indices = slices.Clone(indices)
+			rand.Shuffle(len(indices), func(i, j int) {
+				indices[i], indices[j] = indices[j], indices[i]
+			})
+		}
+		for _, i := range indices {
+			if ctx.Err() != nil {
+				break
+			}
+			g.Go(func() error {
+				if f.config.Stealth {
+					if err := sleepStealth(ctx); err != nil {
+						return nil
+					}
 				}
-				l, err := f.fetchContentLength(timeoutCtx, u)
-				if ctx.Err() != nil {
-					return ctx.Err()
+				var hasher *segmentHasher
+				if h.wants(i) {
+					hasher = h
 				}
-				if err != nil && try < retries {
-					cancel()
-					time.Sleep(time.Duration(rand.Intn(maxSleepMS)) * time.Millisecond)
-					try++
-					continue
+				l, method, sum, err := f.fetchSegment(ctx, hasher, info.URLs[i], info.Servers)
+				if f.progress != nil && ctx.Err() == nil {
+					mu.Lock()
+					switch {
+					case errs[i] == nil:
+						// First pass.
+						progress.Done++
+						if err != nil {
+							progress.Failed++
+						}
+					case err == nil:
+						progress.Failed--
+					}
+					f.progress(progress)
+					mu.Unlock()
 				}
 				if err != nil {
-					return fmt.Errorf("fetch content length: %w", err)
-				}
-				if l > math.MaxUint32 {
-					return errors.New("content length > uint32")
+					errs[i] = err
+					if !isPermanent(err) || f.config.PermanentFailures >= 100 {
+						return nil
+					}
+					if n := numPermanent.Add(1); n > maxPermanent {
+						cancel(fmt.Errorf("%d of %d segments gone or forbidden, manifest token likely expired, latest: segment %d: %w", n, len(info.URLs), i, err))
+					}
+					return nil
 				}
+				errs[i] = nil
 				fp.SegmentSizes[i] = uint32(l)
+				if sum != "" {
+					fp.SegmentHashes[i] = sum
+				}
+				if parsed, err := url.Parse(info.URLs[i]); err == nil && method != "" {
+					mu.Lock()
+					if methods[parsed.Host] == nil {
+						methods[parsed.Host] = make(map[string]int)
+					}
+					methods[parsed.Host][method]++
+					mu.Unlock()
+				}
 				return nil
-			}
-		})
+			})
+		}
+		g.Wait()
+		if context.Cause(ctx) != nil {
+			return context.Cause(ctx)
+		}
+		return nil
+	}
+
+	var indices []int
+	for i, u := range info.URLs {
+		if u != "" {
+			indices = append(indices, i)
+		}
+	}
+	if len(indices) > 0 {
+		progress.URL = info.URLs[indices[0]]
 	}
+	progress.Total = len(indices)
+	if f.progress != nil {
+		f.progress(progress)
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return f.fingerprintInit(gctx, info, &fp)
+	})
+	g.Go(func() error {
+		if err := fetch(gctx, indices); err != nil {
+			return err
+		}
+		var failed []int
+		for _, i := range indices {
+			if errs[i] != nil {
+				failed = append(failed, i)
+			}
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		// Second pass, with other servers (if any).
+		return fetch(gctx, failed)
+	})
 	err := g.Wait()
+	if f.progress != nil {
+		progress.Finished = true
+		f.progress(progress)
+	}
+	if f.config.Verbose {
+		logLengthMethods(methods)
+	}
+	if err != nil {
+		return fp, err
+	}
 
-	return fp, err
+	var (
+		numFailed int
+		firstErr  error
+	)
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if numFailed == 0 {
+			firstErr = fmt.Errorf("segment %d: %w", i, err)
+		}
+		numFailed++
+		fp.MissingSegments = append(fp.MissingSegments, uint32(i))
+	}
+	if numFailed > 0 && !f.config.AllowPartial {
+		return fp, fmt.Errorf("%d of %d segments failed, first: %w", numFailed, len(indices), firstErr)
+	}
+
+	return fp, nil
 }
 
-func (f *DefaultFingerprinter) fetchContentLength(ctx context.Context, url string) (int64, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+// fetchSegment fetches the size of the segment at u, retrying transient
+// errors, choosing a server at random if templated. If h is set, the segment is
+// downloaded instead to also return its hash.
+func (f *DefaultFingerprinter) fetchSegment(ctx context.Context, h *segmentHasher, u string, servers []string) (size int64, method, sum string, err error) {
+	inFlightContentLengths.Add(1)
+	defer inFlightContentLengths.Add(-1)
+
+	if l := len(servers); l > 0 {
+		u = strings.Replace(u, "$Server$", servers[rand.Intn(l)], 1)
+	}
+	// Segments on disk (e.g. of an archived playlist).
+	if !isHTTPURL(u) {
+		return localSegment(h, u)
+	}
+	var (
+		hashed  = h != nil
+		timeout = 10 * time.Second
+	)
+	if hashed {
+		timeout = time.Minute
+	}
+	for try := 0; ; try++ {
+		timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+		if hashed {
+			size, sum, err = f.fetchSegmentHash(timeoutCtx, h, u)
+			method = lengthByGET
+		} else {
+			size, method, err = f.fetchContentLength(timeoutCtx, u)
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return 0, "", "", ctx.Err()
+		}
+		// Only transient errors are retried.
+		if err != nil && try < f.config.Retries && isRetryable(err) {
+			if err := SleepRetry(ctx, f.config, try); err != nil {
+				return 0, "", "", err
+			}
+			continue
+		}
+		if err != nil && hashed {
+			return 0, "", "", fmt.Errorf("fetch segment: %w", err)
+		}
+		if err != nil {
+			return 0, "", "", fmt.Errorf("fetch content length: %w", err)
+		}
+		if size > math.MaxUint32 {
+			return 0, "", "", errors.New("content length > uint32")
+		}
+		return size, method, sum, nil
+	}
+}
+
+// localSegment returns the size of the segment file at path (or file
+// URL), and its hash if h is set.
+func localSegment(h *segmentHasher, path string) (size int64, method, sum string, err error) {
+	if parsed, err := url.Parse(path); err == nil && parsed.Scheme == "file" {
+		path = filepath.FromSlash(parsed.Path)
+	}
+
+	if h == nil {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return 0, "", "", err
+		}
+		return fi.Size(), "", "", nil
+	}
+
+	file, err := os.Open(path)
 	if err != nil {
-		return 0, fmt.Errorf("new: %w", err)
+		return 0, "", "", err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, "", "", err
+	}
+	if !h.reserve(fi.Size()) {
+		return fi.Size(), "", "", nil
+	}
+	ch := newHash()
+	if _, err := io.Copy(ch, file); err != nil {
+		return 0, "", "", fmt.Errorf("read file: %w", err)
+	}
+	return ch.n, "", ch.sum(), nil
+}
+
+func isHTTPURL(s string) bool {
+	parsed, err := url.ParseRequestURI(s)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https")
+}
+
+func (f *DefaultFingerprinter) fingerprintInit(ctx context.Context, info model.ExplicitAddressingInfo, fp *model.Fingerprint) error {
+	if info.InitSize > 0 {
+		fp.InitSegmentSize = info.InitSize
+		return nil
+	}
+	if info.InitURL == "" {
+		return nil
+	}
+
+	u := info.InitURL
+	if l := len(info.Servers); l > 0 {
+		u = strings.Replace(u, "$Server$", info.Servers[rand.Intn(l)], 1)
+	}
+	var (
+		l   int64
+		err error
+	)
+	if isHTTPURL(u) {
+		l, _, err = f.fetchContentLength(ctx, u)
+	} else {
+		l, _, _, err = localSegment(nil, u)
+	}
+	if err != nil {
+		return fmt.Errorf("fetch init content length: %w", err)
+	}
+	if l > math.MaxUint32 {
+		return errors.New("init content length > uint32")
+	}
+	fp.InitSegmentSize = uint32(l)
+
+	return nil
+}
+
+// Methods by which content lengths are fetched, in order of preference.
+const (
+	lengthByHEAD  = "head"
+	lengthByRange = "range"
+	lengthByGET   = "get"
+)
+
+// fetchContentLength fetches the content length of url by a HEAD request.
+// If not allowed or without length, it falls back to a range request of
+// the first byte, and then (if enabled) a full GET counting the bytes.
+// Also returns the method used.
+func (f *DefaultFingerprinter) fetchContentLength(ctx context.Context, url string) (int64, string, error) {
+	var ec encodingCheck
+	defer ec.done()
+
+	res, err := f.doRequest(ctx, http.MethodHead, url, "")
+	if err != nil {
+		return 0, "", err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusMethodNotAllowed || res.StatusCode == http.StatusNotImplemented:
+	case res.StatusCode/100 != 2:
+		return 0, "", newStatusError(res)
+	case ec.check(res) != "":
+		// The length is of the encoded content.
+	case res.ContentLength >= 0:
+		return res.ContentLength, lengthByHEAD, nil
+	}
+
+	res, err = f.doRequest(ctx, http.MethodGet, url, "0-0")
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+
+	enc := ec.check(res)
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		_, total, _ := strings.Cut(res.Header.Get("Content-Range"), "/")
+		if l, err := strconv.ParseInt(total, 10, 64); err == nil && enc == "" {
+			return l, lengthByRange, nil
+		}
+	case http.StatusOK:
+		// Range ignored, the whole resource is returned.
+		if res.ContentLength >= 0 && enc == "" {
+			return res.ContentLength, lengthByRange, nil
+		}
+		if f.config.ContentLengthGET {
+			l, err := countBody(res, enc)
+			if err != nil {
+				return 0, "", err
+			}
+			return l, lengthByGET, nil
+		}
+	default:
+		return 0, "", newStatusError(res)
+	}
+
+	if !f.config.ContentLengthGET {
+		if enc != "" {
+			return 0, "", fmt.Errorf("content encoding %s, count it decoded with --content-length-get", enc)
+		}
+		return 0, "", errors.New("no content length, count it with --content-length-get")
+	}
+
+	res, err = f.doRequest(ctx, http.MethodGet, url, "")
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, "", newStatusError(res)
+	}
+	l, err := countBody(res, ec.check(res))
+	if err != nil {
+		return 0, "", err
+	}
+
+	return l, lengthByGET, nil
+}
+
+// countBody returns the length of the body of res, decoded of enc.
+func countBody(res *http.Response, enc string) (int64, error) {
+	body, err := decodeBody(res, enc)
+	if err != nil {
+		return 0, err
+	}
+	l, err := io.Copy(io.Discard, body)
+	if err != nil {
+		return 0, fmt.Errorf("read body: %w", err)
+	}
+	return l, nil
+}
+
+// doRequest does a request of url, of byteRange if set, with identity
+// encoding.
+func (f *DefaultFingerprinter) doRequest(ctx context.Context, method, url, byteRange string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new: %w", err)
 	}
 
 	if f.origin != "" {
 		req.Header.Set("Origin", f.origin)
 		req.Header.Set("Referer", f.origin+"/")
 	}
+	if byteRange != "" {
+		req.Header.Set("Range", "bytes="+byteRange)
+	}
+	// Otherwise gzip is requested, and lengths may be of the encoded
+	// content.
+	req.Header.Set("Accept-Encoding", "identity")
 
 	res, err := f.httpClient.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("do: %w", err)
+		return nil, fmt.Errorf("do: %w", err)
 	}
-	defer res.Body.Close()
 
-	return res.ContentLength, nil
+	return res, nil
 }
 
-func readRange(filename string, indexRange string) ([]byte, error) {
-	startStr, endStr, _ := strings.Cut(indexRange, "-")
+// logLengthMethods logs the methods by which content lengths were fetched
+// per host, for hosts where HEAD requests didn't suffice.
+func logLengthMethods(methods map[string]map[string]int) {
+	for host, counts := range methods {
+		if len(counts) == 1 && counts[lengthByHEAD] > 0 {
+			continue
+		}
+		var s []string
+		for _, m := range []string{lengthByHEAD, lengthByRange, lengthByGET} {
+			if counts[m] > 0 {
+				s = append(s, fmt.Sprintf("%s %d", m, counts[m]))
+			}
+		}
+		log.Printf("content lengths of %s by %s\n", host, strings.Join(s, ", "))
+	}
+}
+
+func parseRange(byteRange string) (int64, int64, error) {
+	startStr, endStr, _ := strings.Cut(byteRange, "-")
 	start, err := strconv.ParseInt(startStr, 10, 64)
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
 	end, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+func readRange(filename string, indexRange string) ([]byte, error) {
+	start, end, err := parseRange(indexRange)
 	if err != nil {
 		return nil, err
 	}
@@ -227,14 +1121,39 @@ func readRange(filename string, indexRange string) ([]byte, error) {
 	}
 	defer f.Close()
 
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
 	if _, err := f.Seek(start, io.SeekStart); err != nil {
 		return nil, err
 	}
 
-	buf := make([]byte, end-start+1)
-	if _, err := io.ReadFull(f, buf); err != nil {
+	// Ranges past the end of the file are cut short.
+	buf := make([]byte, max(0, min(end, info.Size()-1)-start+1))
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+// openFileRange opens byteRange of the file, cut short at its end.
+func openFileRange(filename, byteRange string) (io.ReadCloser, error) {
+	start, end, err := parseRange(byteRange)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		f.Close()
 		return nil, err
 	}
 
-	return buf, nil
+	return rangeBody{io.LimitReader(f, end-start+1), f}, nil
 }
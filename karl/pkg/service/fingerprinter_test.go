@@ -0,0 +1,547 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service/internal/servicetest"
+)
+
+func fingerprintFile(t *testing.T, path string) (model.Fingerprint, error) {
+	t.Helper()
+	f := NewDefaultFingerprinter(&config.AppConfig{}, http.DefaultClient, "", nil)
+	return f.Fingerprint(context.Background(), model.Variant{
+		AddressingMode:        "indexed",
+		MimeType:              "video/mp4",
+		IndexedAddressingInfo: &model.IndexedAddressingInfo{URL: path},
+	})
+}
+
+func TestFingerprintSIDXPerTrack(t *testing.T) {
+	fp, err := fingerprintFile(t, "../../testdata/dash/sidx/multitrack.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The audio sidx (timescale 48000) is rescaled to the video's.
+	if fp.Timescale != 90000 {
+		t.Errorf("timescale %d, want 90000", fp.Timescale)
+	}
+	if want := []uint32{1000, 1200, 300, 300}; !slices.Equal(fp.SegmentSizes, want) {
+		t.Errorf("sizes %v, want %v", fp.SegmentSizes, want)
+	}
+	if want := []uint32{180000, 180000, 180000, 180000}; !slices.Equal(fp.SegmentDurations, want) {
+		t.Errorf("durations %v, want %v", fp.SegmentDurations, want)
+	}
+	if want := []string{"132-1131", "1132-2331", "2332-2631", "2632-2931"}; !slices.Equal(fp.SegmentRanges, want) {
+		t.Errorf("ranges %v, want %v", fp.SegmentRanges, want)
+	}
+}
+
+func TestFingerprintSIDXTimescaleMismatch(t *testing.T) {
+	_, err := fingerprintFile(t, "../../testdata/dash/sidx/mismatch.mp4")
+	if err == nil || !strings.Contains(err.Error(), "stream 1: timescale 48000, expected 90000") {
+		t.Errorf("error %v, want timescale mismatch of stream 1", err)
+	}
+}
+
+func TestFingerprintSIDXHierarchical(t *testing.T) {
+	fp, err := fingerprintFile(t, "../../testdata/dash/sidx/hierarchical.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []uint32{500, 600, 700, 800}; !slices.Equal(fp.SegmentSizes, want) {
+		t.Errorf("sizes %v, want %v", fp.SegmentSizes, want)
+	}
+	if want := []uint32{90000, 90000, 90000, 90000}; !slices.Equal(fp.SegmentDurations, want) {
+		t.Errorf("durations %v, want %v", fp.SegmentDurations, want)
+	}
+	if want := []string{"132-631", "632-1231", "1288-1987", "1988-2787"}; !slices.Equal(fp.SegmentRanges, want) {
+		t.Errorf("ranges %v, want %v", fp.SegmentRanges, want)
+	}
+}
+
+func TestFingerprintSIDXAfterOtherBoxes(t *testing.T) {
+	// styp, emsg, prft and free boxes before the sidx.
+	fp, err := fingerprintFile(t, "../../testdata/dash/sidx/emsg.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{1000, 1200}; !slices.Equal(fp.SegmentSizes, want) {
+		t.Errorf("sizes %v, want %v", fp.SegmentSizes, want)
+	}
+	if want := []string{"196-1195", "1196-2395"}; !slices.Equal(fp.SegmentRanges, want) {
+		t.Errorf("ranges %v, want %v", fp.SegmentRanges, want)
+	}
+}
+
+func TestFingerprintSIDXVersions(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		sidxRange string
+		ept       uint64
+		ranges    []string
+	}{
+		{"v0.mp4", "20-75", 900000, []string{"92-1091", "1092-2291"}},
+		// 64-bit earliest_presentation_time and first_offset.
+		{"v1.mp4", "20-83", 1 << 33, []string{"100-1099", "1100-2299"}},
+	} {
+		fp, err := fingerprintFile(t, "../../testdata/dash/sidx/"+tt.name)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if fp.SIDXRange != tt.sidxRange || fp.FirstOffset != 16 || fp.EarliestPresentationTime != tt.ept {
+			t.Errorf("%s: sidx %s, first offset %d, earliest presentation time %d, want %s, 16 and %d", tt.name, fp.SIDXRange, fp.FirstOffset, fp.EarliestPresentationTime, tt.sidxRange, tt.ept)
+		}
+		// Segments start first_offset after the sidx.
+		if !slices.Equal(fp.SegmentRanges, tt.ranges) {
+			t.Errorf("%s: ranges %v, want %v", tt.name, fp.SegmentRanges, tt.ranges)
+		}
+	}
+
+	// Left out unless indexed.
+	b, err := json.Marshal(model.Fingerprint{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"sidx_range", "first_offset", "earliest_presentation_time"} {
+		if strings.Contains(string(b), k) {
+			t.Errorf("%s in %s, want omitted", k, b)
+		}
+	}
+}
+
+func TestIndexMP4Reads(t *testing.T) {
+	const path = "../../testdata/dash/sidx/v0.mp4"
+	f := NewDefaultFingerprinter(&config.AppConfig{}, http.DefaultClient, "", nil)
+
+	for _, tt := range []struct {
+		name       string
+		indexRange string
+		// size is of the file, cut short after the sidx if not 0.
+		size int64
+		want []string
+	}{
+		// The box after the sidx, the first moof, is in the window read.
+		{"window", "", 0, []string{"0-65535"}},
+		{"index range", "20-75", 0, []string{"20-75"}},
+		// Only the header of the box after the window ending at the sidx.
+		{"window ending at the sidx", "", 76, []string{"0-65535", "76-91"}},
+	} {
+		var ranges []string
+		read := func(byteRange string) ([]byte, error) {
+			ranges = append(ranges, byteRange)
+			raw, err := readRange(path, byteRange)
+			if start, _, _ := parseRange(byteRange); tt.size > 0 && err == nil {
+				raw = raw[:max(0, min(int64(len(raw)), tt.size-start))]
+			}
+			return raw, err
+		}
+
+		fp, _, err := f.indexMP4(read, tt.indexRange, true)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(fp.SegmentSizes) != 2 {
+			t.Errorf("%s: sizes %v, want 2", tt.name, fp.SegmentSizes)
+		}
+		if !slices.Equal(ranges, tt.want) {
+			t.Errorf("%s: ranges read %v, want %v", tt.name, ranges, tt.want)
+		}
+	}
+}
+
+func TestExtractSIDXNotFound(t *testing.T) {
+	raw, err := os.ReadFile("../../testdata/dash/sidx/emsg.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewDefaultFingerprinter(&config.AppConfig{}, http.DefaultClient, "", nil)
+
+	// Up to the sidx.
+	_, _, _, err = f.extractSIDX(raw[:140])
+	if !errors.Is(err, errSIDXNotFound) || !strings.Contains(err.Error(), "top-level boxes: ftyp, styp, emsg, prft, free") {
+		t.Errorf("error %v, want sidx not found listing the boxes", err)
+	}
+}
+
+func TestFingerprintSIDXCorruptSize(t *testing.T) {
+	for _, tt := range []struct {
+		name, want string
+	}{
+		// 64-bit sizes of 1TB, read up to the limit only.
+		{"huge.mp4", "over the 4194304 byte read limit"},
+		{"huge_next.mp4", "over the 4194304 byte read limit"},
+		// Past the largest offset.
+		{"overflow.mp4", "free box: invalid size"},
+	} {
+		_, err := fingerprintFile(t, "../../testdata/dash/sidx/"+tt.name)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	// Cut short at the end of the file, however large.
+	raw, err := readRange("../../testdata/dash/sidx/huge.mp4", "0-1099511627775")
+	if err != nil || len(raw) != 72 {
+		t.Errorf("read %d bytes, %v, want the 72 of the file", len(raw), err)
+	}
+}
+
+func TestFingerprintFragments(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		init      uint32
+		sizes     []uint32
+		durations []uint32
+		timescale uint32
+	}{
+		// Durations of the samples, of the video track, with the styp
+		// and the audio fragments part of the segments.
+		{"samples.mp4", 450, []uint32{1516, 1616, 1716}, []uint32{180000, 180000, 180000}, 90000},
+		// Durations of the default of trex, or else of tfhd.
+		{"defaults.mp4", 245, []uint32{892, 906, 912}, []uint32{25600, 25600, 12800}, 12800},
+	} {
+		fp, err := fingerprintFile(t, "../../testdata/mp4/fragments/"+tt.name)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if fp.InitSegmentSize != tt.init || fp.Timescale != tt.timescale {
+			t.Errorf("%s: init %d, timescale %d, want %d and %d", tt.name, fp.InitSegmentSize, fp.Timescale, tt.init, tt.timescale)
+		}
+		if !slices.Equal(fp.SegmentSizes, tt.sizes) {
+			t.Errorf("%s: sizes %v, want %v", tt.name, fp.SegmentSizes, tt.sizes)
+		}
+		if !slices.Equal(fp.SegmentDurations, tt.durations) {
+			t.Errorf("%s: durations %v, want %v", tt.name, fp.SegmentDurations, tt.durations)
+		}
+	}
+}
+
+func TestFingerprintFragmentsURL(t *testing.T) {
+	srv := httptest.NewServer(http.FileServer(http.Dir("../../testdata/mp4/fragments")))
+	defer srv.Close()
+	variant := model.Variant{
+		AddressingMode:        "indexed",
+		MimeType:              "video/mp4",
+		IndexedAddressingInfo: &model.IndexedAddressingInfo{URL: srv.URL + "/defaults.mp4"},
+	}
+
+	// Only if enabled, as a request is made per box.
+	f := NewDefaultFingerprinter(&config.AppConfig{}, srv.Client(), "", nil)
+	if _, err := f.Fingerprint(context.Background(), variant); !errors.Is(err, errSIDXNotFound) {
+		t.Errorf("error %v, want sidx not found", err)
+	}
+
+	f = NewDefaultFingerprinter(&config.AppConfig{WalkFragments: true}, srv.Client(), "", nil)
+	fp, err := f.Fingerprint(context.Background(), variant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{892, 906, 912}; !slices.Equal(fp.SegmentSizes, want) {
+		t.Errorf("sizes %v, want %v", fp.SegmentSizes, want)
+	}
+}
+
+func TestInitRangeSize(t *testing.T) {
+	for _, tt := range []struct {
+		initRange string
+		want      uint32
+		wantErr   bool
+	}{
+		{"0-999", 1000, false},
+		{"100-4294967394", 4294967295, false},
+		{"0-4294967295", 0, true},
+		{"10-5", 0, true},
+		{"x", 0, true},
+	} {
+		got, err := initRangeSize(tt.initRange)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: %d, %v, want %d (error %t)", tt.initRange, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFingerprintWebMInitRangeOverflow(t *testing.T) {
+	f := NewDefaultFingerprinter(&config.AppConfig{}, http.DefaultClient, "", nil)
+	_, err := f.Fingerprint(context.Background(), model.Variant{
+		AddressingMode: "indexed",
+		MimeType:       "video/webm",
+		IndexedAddressingInfo: &model.IndexedAddressingInfo{
+			URL:        "video.webm",
+			InitRange:  "0-4294967295",
+			IndexRange: "4294967296-4294968295",
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "> uint32") {
+		t.Errorf("error %v, want init segment size > uint32", err)
+	}
+}
+
+func TestFingerprintWebM(t *testing.T) {
+	// Laid out as for DASH, the Info within the init range and the Cues
+	// the index range, with cue points of both tracks of the first
+	// cluster.
+	f := NewDefaultFingerprinter(&config.AppConfig{}, http.DefaultClient, "", nil)
+	fp, err := f.Fingerprint(context.Background(), model.Variant{
+		AddressingMode: "indexed",
+		MimeType:       "video/webm",
+		IndexedAddressingInfo: &model.IndexedAddressingInfo{
+			URL:        "../../testdata/webm/cues.webm",
+			InitRange:  "0-46",
+			IndexRange: "47-127",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp.InitSegmentSize != 47 || fp.Timescale != 1000 {
+		t.Errorf("init %d, timescale %d, want 47 and 1000 of a timecode scale of 1ms", fp.InitSegmentSize, fp.Timescale)
+	}
+	if want := []uint32{315, 515, 215}; !slices.Equal(fp.SegmentSizes, want) {
+		t.Errorf("sizes %v, want %v", fp.SegmentSizes, want)
+	}
+	if want := []uint32{2000, 2000, 2000}; !slices.Equal(fp.SegmentDurations, want) {
+		t.Errorf("durations %v, want %v", fp.SegmentDurations, want)
+	}
+	if want := []string{"128-442", "443-957", "958-1172"}; !slices.Equal(fp.SegmentRanges, want) {
+		t.Errorf("ranges %v, want %v", fp.SegmentRanges, want)
+	}
+
+	// A Segment of unknown size, ending with the file, and the Cues within
+	// the first read.
+	srv := httptest.NewServer(http.FileServer(http.Dir("../../testdata/webm")))
+	defer srv.Close()
+	f = NewDefaultFingerprinter(&config.AppConfig{}, srv.Client(), "", nil)
+	fp, err = f.Fingerprint(context.Background(), model.Variant{
+		AddressingMode:        "indexed",
+		MimeType:              "video/webm",
+		IndexedAddressingInfo: &model.IndexedAddressingInfo{URL: srv.URL + "/unknown.webm"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp.Timescale != 10000 {
+		t.Errorf("timescale %d, want 10000 of a timecode scale of 100us", fp.Timescale)
+	}
+	if want := []uint32{415, 113}; !slices.Equal(fp.SegmentSizes, want) {
+		t.Errorf("sizes %v, want %v", fp.SegmentSizes, want)
+	}
+	if want := []uint32{20000, 25000}; !slices.Equal(fp.SegmentDurations, want) {
+		t.Errorf("durations %v, want %v", fp.SegmentDurations, want)
+	}
+}
+
+// newSegmentServer returns a server of segments of size, counting the
+// requests in flight at most.
+func newSegmentServer(tb testing.TB, size int, maxInFlight *atomic.Int64) *httptest.Server {
+	tb.Helper()
+	var inFlight atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+func explicitVariant(baseURL string, n int) model.Variant {
+	info := &model.ExplicitAddressingInfo{Timescale: 1}
+	for i := range n {
+		info.URLs = append(info.URLs, fmt.Sprintf("%s/seg%d.ts", baseURL, i))
+		info.SegmentDurations = append(info.SegmentDurations, 2)
+	}
+	return model.Variant{AddressingMode: "explicit", ExplicitAddressingInfo: info}
+}
+
+func TestFingerprintExplicitConcurrency(t *testing.T) {
+	var maxInFlight atomic.Int64
+	srv := newSegmentServer(t, 1000, &maxInFlight)
+	f := NewDefaultFingerprinter(&config.AppConfig{SegmentConcurrency: 4}, srv.Client(), "", nil)
+
+	fp, err := f.Fingerprint(context.Background(), explicitVariant(srv.URL, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fp.SegmentSizes) != 100 || fp.SegmentSizes[99] != 1000 {
+		t.Errorf("sizes %v, want 100 of 1000", fp.SegmentSizes)
+	}
+	if n := maxInFlight.Load(); n > 4 {
+		t.Errorf("%d segments in flight, want at most 4", n)
+	}
+	if n := InFlightContentLengths(); n != 0 {
+		t.Errorf("%d segments in flight after, want 0", n)
+	}
+}
+
+func TestFingerprintExplicitCancelledRetrying(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	f := NewDefaultFingerprinter(&config.AppConfig{Retries: 100, RetryBackoff: 10 * time.Second}, srv.Client(), "", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := f.Fingerprint(ctx, explicitVariant(srv.URL, 4))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error %v, want cancelled", err)
+	}
+	// Backing off, not waiting for the next try.
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("returned after %s, want promptly when cancelled", elapsed)
+	}
+}
+
+// timeoutError is a net.Error timing out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestFingerprintExplicitRetries(t *testing.T) {
+	status := func(code int) func() (*http.Response, error) {
+		return func() (*http.Response, error) {
+			return &http.Response{StatusCode: code, Status: http.StatusText(code), Body: http.NoBody}, nil
+		}
+	}
+	fail := func(err error) func() (*http.Response, error) {
+		return func() (*http.Response, error) { return nil, err }
+	}
+	for _, tt := range []struct {
+		name     string
+		respond  func() (*http.Response, error)
+		attempts int64
+	}{
+		{"not found", status(http.StatusNotFound), 1},
+		{"forbidden", status(http.StatusForbidden), 1},
+		{"server error", status(http.StatusInternalServerError), 3},
+		{"throttled", status(http.StatusTooManyRequests), 3},
+		{"timeout", fail(timeoutError{}), 3},
+		{"connection reset", fail(syscall.ECONNRESET), 3},
+	} {
+		var attempts atomic.Int64
+		client := &http.Client{Transport: servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+			attempts.Add(1)
+			return tt.respond()
+		})}
+		// One segment, not to bail on permanent failures.
+		f := NewDefaultFingerprinter(&config.AppConfig{Retries: 2, PermanentFailures: 100}, client, "", nil)
+		if _, err := f.Fingerprint(context.Background(), explicitVariant("https://example.com", 1)); err == nil {
+			t.Errorf("%s: fingerprinted, want error", tt.name)
+		}
+		// Twice as failed segments are tried again in a second pass.
+		if n := attempts.Load(); n != 2*tt.attempts {
+			t.Errorf("%s: %d attempts, want %d", tt.name, n, 2*tt.attempts)
+		}
+	}
+}
+
+func TestFingerprintExplicitPermanentFailures(t *testing.T) {
+	var attempts atomic.Int64
+	client := &http.Client{Transport: servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		attempts.Add(1)
+		return &http.Response{StatusCode: http.StatusForbidden, Status: "403 Forbidden", Body: http.NoBody}, nil
+	})}
+	f := NewDefaultFingerprinter(&config.AppConfig{PermanentFailures: 10, SegmentConcurrency: 1}, client, "", nil)
+
+	_, err := f.Fingerprint(context.Background(), explicitVariant("https://example.com", 100))
+	if err == nil || !strings.Contains(err.Error(), "manifest token likely expired") {
+		t.Errorf("error %v, want manifest token expired", err)
+	}
+	// Bailing after more than 10%, rather than fetching the rest.
+	if n := attempts.Load(); n > 20 {
+		t.Errorf("%d attempts, want bailing after 11", n)
+	}
+}
+
+func TestOpenRangeIgnored(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		body    io.Reader
+		want    string
+		wantErr bool
+	}{
+		{"within", strings.NewReader("0123456789"), "45", false},
+		// Past the end.
+		{"short", strings.NewReader("012"), "", false},
+		{"reset", io.MultiReader(strings.NewReader("01"), iotest.ErrReader(syscall.ECONNRESET)), "", true},
+	} {
+		client := &http.Client{Transport: servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+			// Range ignored.
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(tt.body), Request: r}, nil
+		})}
+		f := NewDefaultFingerprinter(&config.AppConfig{}, client, "", nil)
+
+		body, err := f.openRange(context.Background(), "https://example.com/v.mp4", "4-5")
+		if tt.wantErr {
+			if !errors.Is(err, syscall.ECONNRESET) {
+				t.Errorf("%s: error %v, want connection reset", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		raw, _ := io.ReadAll(body)
+		body.Close()
+		if string(raw) != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, raw, tt.want)
+		}
+	}
+}
+
+// BenchmarkFingerprintExplicit fingerprints a variant of 5,000 segments
+// (e.g. a 3 hour movie of 2 second segments), unlimited (as before the
+// segment concurrency) and with the default limit.
+func BenchmarkFingerprintExplicit(b *testing.B) {
+	for _, bb := range []struct {
+		name        string
+		concurrency int
+	}{
+		{"unlimited", 0},
+		{"default", 16},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			var maxInFlight atomic.Int64
+			srv := newSegmentServer(b, 1000, &maxInFlight)
+			f := NewDefaultFingerprinter(&config.AppConfig{SegmentConcurrency: bb.concurrency}, srv.Client(), "", nil)
+			variant := explicitVariant(srv.URL, 5000)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if _, err := f.Fingerprint(context.Background(), variant); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
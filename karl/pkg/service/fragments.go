@@ -0,0 +1,268 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/abema/go-mp4"
+	"karl/pkg/model"
+)
+
+// fragmentTrack is the track of a fragmented MP4 file segments are timed
+// by, with its defaults (trex) for sample durations.
+type fragmentTrack struct {
+	id                    uint32
+	timescale             uint32
+	defaultSampleDuration uint32
+}
+
+type fragment struct {
+	start    int64
+	duration uint64
+	// Base media decode time (tfdt), if any.
+	decodeTime    uint64
+	hasDecodeTime bool
+}
+
+// walkFragments fingerprints a fragmented MP4 file without sidx by
+// walking its top-level boxes, reading only the headers of others than
+// moov and moof. Each moof of the track (the first video track, or else
+// the first track) and the boxes up to the next are a segment, timed by
+// the sample durations of the track (or else the tfdt of the next).
+// Boxes before the first moof are the init segment. Also returns the
+// offsets of the segments.
+func walkFragments(read func(byteRange string) ([]byte, error)) (model.Fingerprint, []int64, error) {
+	var (
+		offset    int64
+		track     *fragmentTrack
+		fragments []fragment
+		// Start of styp, emsg or prft boxes preceding the next moof.
+		pending int64 = -1
+	)
+	for {
+		header, err := read(fmt.Sprintf("%d-%d", offset, offset+15))
+		if err != nil {
+			return model.Fingerprint{}, nil, err
+		}
+		if len(header) < 8 {
+			break
+		}
+		bi, err := mp4.ReadBoxInfo(bytes.NewReader(header))
+		if err != nil {
+			return model.Fingerprint{}, nil, fmt.Errorf("box at %d: %w", offset, err)
+		}
+		// Size 0 is the last box, up to the end of the file.
+		if bi.Size == 0 {
+			return model.Fingerprint{}, nil, fmt.Errorf("%s box at %d: size unknown", bi.Type, offset)
+		}
+		if bi.Size < bi.HeaderSize {
+			return model.Fingerprint{}, nil, fmt.Errorf("%s box at %d: invalid size %d", bi.Type, offset, bi.Size)
+		}
+
+		var raw []byte
+		if bi.Type == mp4.BoxTypeMoov() || bi.Type == mp4.BoxTypeMoof() {
+			if bi.Size > maxIndexSize {
+				return model.Fingerprint{}, nil, fmt.Errorf("%s box at %d: too large", bi.Type, offset)
+			}
+			raw, err = read(fmt.Sprintf("%d-%d", offset, offset+int64(bi.Size)-1))
+			if err != nil {
+				return model.Fingerprint{}, nil, err
+			}
+			if len(raw) < int(bi.Size) {
+				return model.Fingerprint{}, nil, fmt.Errorf("%s box at %d: truncated", bi.Type, offset)
+			}
+		}
+
+		switch bi.Type {
+		case mp4.BoxTypeMoov():
+			track, err = parseFragmentTrack(raw)
+			if err != nil {
+				return model.Fingerprint{}, nil, fmt.Errorf("moov: %w", err)
+			}
+		case mp4.BoxTypeStyp(), mp4.BoxTypeEmsg(), mp4.StrToBoxType("prft"):
+			if pending < 0 {
+				pending = offset
+			}
+		case mp4.BoxTypeMoof():
+			if track == nil {
+				return model.Fingerprint{}, nil, errors.New("moof before moov")
+			}
+			frag, ok, err := parseFragment(raw, track)
+			if err != nil {
+				return model.Fingerprint{}, nil, fmt.Errorf("moof at %d: %w", offset, err)
+			}
+			// Fragments of other tracks are part of the segment.
+			if ok {
+				frag.start = offset
+				if pending >= 0 {
+					frag.start = pending
+				}
+				fragments = append(fragments, frag)
+			}
+			pending = -1
+		default:
+			pending = -1
+		}
+
+		offset += int64(bi.Size)
+	}
+
+	if len(fragments) == 0 {
+		return model.Fingerprint{}, nil, errors.New("no moof boxes")
+	}
+
+	var (
+		fp = model.Fingerprint{
+			SegmentSizes:     make([]uint32, len(fragments)),
+			SegmentDurations: make([]uint32, len(fragments)),
+			Timescale:        track.timescale,
+		}
+		offsets = make([]int64, len(fragments))
+	)
+	for i, frag := range fragments {
+		end := offset
+		if i+1 < len(fragments) {
+			end = fragments[i+1].start
+		}
+		duration := frag.duration
+		if duration == 0 && i+1 < len(fragments) && frag.hasDecodeTime && fragments[i+1].hasDecodeTime {
+			duration = fragments[i+1].decodeTime - frag.decodeTime
+		}
+		if duration == 0 {
+			return model.Fingerprint{}, nil, fmt.Errorf("segment %d: no duration", i)
+		}
+		if end-frag.start > math.MaxUint32 || duration > math.MaxUint32 {
+			return model.Fingerprint{}, nil, fmt.Errorf("segment %d: size or duration > uint32", i)
+		}
+		fp.SegmentSizes[i] = uint32(end - frag.start)
+		fp.SegmentDurations[i] = uint32(duration)
+		offsets[i] = frag.start
+	}
+	if fragments[0].start > math.MaxUint32 {
+		return model.Fingerprint{}, nil, errors.New("init segment size > uint32")
+	}
+	fp.InitSegmentSize = uint32(fragments[0].start)
+
+	return fp, offsets, nil
+}
+
+// parseFragmentTrack returns the track of moov to time segments by.
+func parseFragmentTrack(raw []byte) (*fragmentTrack, error) {
+	r := bytes.NewReader(raw)
+	traks, err := mp4.ExtractBox(r, nil, mp4.BoxPath{mp4.BoxTypeMoov(), mp4.BoxTypeTrak()})
+	if err != nil {
+		return nil, err
+	}
+
+	var track *fragmentTrack
+	for _, trak := range traks {
+		boxes, err := mp4.ExtractBoxesWithPayload(r, trak, []mp4.BoxPath{
+			{mp4.BoxTypeTkhd()},
+			{mp4.BoxTypeMdia(), mp4.BoxTypeMdhd()},
+			{mp4.BoxTypeMdia(), mp4.BoxTypeHdlr()},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			t       fragmentTrack
+			isVideo bool
+		)
+		for _, b := range boxes {
+			switch p := b.Payload.(type) {
+			case *mp4.Tkhd:
+				t.id = p.TrackID
+			case *mp4.Mdhd:
+				t.timescale = p.Timescale
+			case *mp4.Hdlr:
+				isVideo = string(p.HandlerType[:]) == "vide"
+			}
+		}
+		if t.timescale == 0 {
+			continue
+		}
+		if track == nil || isVideo {
+			track = &t
+		}
+		if isVideo {
+			break
+		}
+	}
+	if track == nil {
+		return nil, errors.New("no track")
+	}
+
+	trexs, err := mp4.ExtractBoxWithPayload(r, nil, mp4.BoxPath{mp4.BoxTypeMoov(), mp4.BoxTypeMvex(), mp4.BoxTypeTrex()})
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range trexs {
+		if trex := b.Payload.(*mp4.Trex); trex.TrackID == track.id {
+			track.defaultSampleDuration = trex.DefaultSampleDuration
+		}
+	}
+
+	return track, nil
+}
+
+const trunSampleDurationPresent = 0x000100
+
+// parseFragment returns the duration (and tfdt) of the samples of track
+// in moof, or false if none.
+func parseFragment(raw []byte, track *fragmentTrack) (fragment, bool, error) {
+	r := bytes.NewReader(raw)
+	trafs, err := mp4.ExtractBox(r, nil, mp4.BoxPath{mp4.BoxTypeMoof(), mp4.BoxTypeTraf()})
+	if err != nil {
+		return fragment{}, false, err
+	}
+
+	for _, traf := range trafs {
+		boxes, err := mp4.ExtractBoxesWithPayload(r, traf, []mp4.BoxPath{
+			{mp4.BoxTypeTfhd()},
+			{mp4.BoxTypeTfdt()},
+			{mp4.BoxTypeTrun()},
+		})
+		if err != nil {
+			return fragment{}, false, err
+		}
+
+		var (
+			frag            fragment
+			defaultDuration = track.defaultSampleDuration
+		)
+		if len(boxes) == 0 {
+			return fragment{}, false, errors.New("traf without tfhd")
+		}
+		tfhd, ok := boxes[0].Payload.(*mp4.Tfhd)
+		if !ok {
+			return fragment{}, false, errors.New("traf without tfhd")
+		}
+		if tfhd.TrackID != track.id {
+			continue
+		}
+		if tfhd.CheckFlag(mp4.TfhdDefaultSampleDurationPresent) {
+			defaultDuration = tfhd.DefaultSampleDuration
+		}
+		for _, b := range boxes[1:] {
+			switch p := b.Payload.(type) {
+			case *mp4.Tfdt:
+				frag.decodeTime = p.GetBaseMediaDecodeTime()
+				frag.hasDecodeTime = true
+			case *mp4.Trun:
+				if p.CheckFlag(trunSampleDurationPresent) {
+					for _, e := range p.Entries {
+						frag.duration += uint64(e.SampleDuration)
+					}
+				} else {
+					frag.duration += uint64(p.SampleCount) * uint64(defaultDuration)
+				}
+			}
+		}
+		return frag, true, nil
+	}
+
+	return fragment{}, false, nil
+}
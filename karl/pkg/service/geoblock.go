@@ -0,0 +1,89 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ErrNoCountryCode is returned by clients requiring the country code when
+// none is set, as when not geolocated (--no-geolocate).
+var ErrNoCountryCode = errors.New("no country code: set --country-code, required by the service")
+
+// RequireCountry returns an error unless country is want, the only one a
+// service is available in: ErrNoCountryCode if unset, or else geo-blocked.
+func RequireCountry(country, want string) error {
+	switch country {
+	case want:
+		return nil
+	case "":
+		return ErrNoCountryCode
+	default:
+		return &GeoBlockedError{Country: country, Reason: "only available in " + want}
+	}
+}
+
+// GeoBlockedError is returned by clients when a service refuses content
+// because of the location of the request, as told by the service (e.g. an
+// error code), rather than failing in a way that may have other causes.
+type GeoBlockedError struct {
+	// Country is the configured country code.
+	Country string
+	// Reason is the signal of the service, e.g. its error code.
+	Reason string
+}
+
+func (e *GeoBlockedError) Error() string {
+	return fmt.Sprintf(
+		"geo-blocked (%s) from country %q: set --country-code to one where the content is available and request from there, e.g. through a proxy (--proxy)",
+		e.Reason,
+		e.Country,
+	)
+}
+
+// countGeoBlocked returns the first of errs that is geo-blocked, if any,
+// and how many are.
+func countGeoBlocked(errs []error) (*GeoBlockedError, int) {
+	var (
+		first *GeoBlockedError
+		n     int
+	)
+	for _, err := range errs {
+		var ge *GeoBlockedError
+		if errors.As(err, &ge) {
+			if first == nil {
+				first = ge
+			}
+			n++
+		}
+	}
+	return first, n
+}
+
+// geoBlockedPhrases are those of bodies of responses refused by the
+// location of the request, as told by CDNs and services.
+var geoBlockedPhrases = []string{
+	"block access from your country",
+	"not available in your country",
+	"not available in your region",
+	"not available in your territory",
+	"not available in your location",
+	"geo-restricted",
+	"geo restricted",
+	"georestricted",
+	"geo-blocked",
+	"geo blocked",
+	"geoblock",
+}
+
+// geoBlockedBody returns whether the body of a response refusing access
+// tells of the location of the request, as of CDNs (e.g. "configured to
+// block access from your country"). Mere mentions of a country (e.g. a
+// country picker of an error page) don't.
+func geoBlockedBody(body []byte) bool {
+	b := strings.Join(strings.Fields(strings.ToLower(string(body))), " ")
+	return slices.ContainsFunc(geoBlockedPhrases, func(p string) bool {
+		return strings.Contains(b, p)
+	})
+}
@@ -0,0 +1,24 @@
+package service
+
+import "testing"
+
+func TestGeoBlockedBody(t *testing.T) {
+	for _, tt := range []struct {
+		body string
+		want bool
+	}{
+		{"The Amazon CloudFront distribution is configured to block access from your country.", true},
+		{"<h1>Sorry</h1><p>This video is not available\n  in your country.</p>", true},
+		{`{"error":"GEO_RESTRICTED","message":"Content is geo-restricted"}`, true},
+		{"Geoblocked: outside of the service area", true},
+		{"Access Denied", false},
+		{`<select name="country"><option>Sweden</option></select> Access Denied`, false},
+		{`Forbidden <img alt="GeoTrust Secured">`, false},
+		{"This content is not available in your territory yet.", true},
+		{"Territory settings: forbidden", false},
+	} {
+		if got := geoBlockedBody([]byte(tt.body)); got != tt.want {
+			t.Errorf("%q: %t, want %t", tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+package hotstar
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	urlpkg "net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service"
+)
+
+var (
+	_ service.Client            = (*hotstar)(nil)
+	_ service.URLExtractor      = (*hotstar)(nil)
+	_ service.JustWatchProvider = (*hotstar)(nil)
+	_ service.VideoExtractor    = (*hotstar)(nil)
+	_ service.VariantExtractor  = (*hotstar)(nil)
+	_ service.Fingerprinter     = (*hotstar)(nil)
+	_ service.SelfTester        = (*hotstar)(nil)
+)
+
+type hotstar struct {
+	config            *config.AppConfig
+	httpClient        *http.Client
+	index             *service.IndexCache
+	regex             *regexp.Regexp
+	origin            string
+	justWatchPackages []string
+
+	mu        sync.Mutex
+	userToken string
+	// guest is whether userToken is of the device handshake, not of a
+	// logged in session.
+	guest bool
+}
+
+func init() {
+	service.Register(New)
+}
+
+func New(config *config.AppConfig, httpClient *http.Client) service.Client {
+	return &hotstar{
+		config:     config,
+		httpClient: httpClient,
+		index:      service.NewIndexCache(),
+		regex: regexp.MustCompile(
+			`^https?://(?:www\.)?hotstar\.com/(?:[a-z]{2}/)?(movies|shows|tv)/(?:[^?#]*?/)?(\d{6,})(?:[/?#]|$)`,
+		),
+		origin:            "https://www.hotstar.com",
+		justWatchPackages: []string{"hst"},
+	}
+}
+
+func (c *hotstar) ID() service.ID {
+	return "hotstar"
+}
+
+func (c *hotstar) ExtractURLs(ctx context.Context) ([]string, error) {
+	return service.NewJustWatchURLExtractor(c.config, c.httpClient, c.justWatchPackages).ExtractURLs(ctx)
+}
+
+func (c *hotstar) JustWatchPackages() []string {
+	return c.justWatchPackages
+}
+
+func (c *hotstar) Matches(url string) bool {
+	return c.regex.MatchString(url)
+}
+
+func (c *hotstar) VideoExtract(ctx context.Context, url string) []model.VideoResult {
+	var results []model.VideoResult
+
+	for r := range c.extract(ctx, url) {
+		results = append(results, r)
+	}
+
+	return results
+}
+
+func (c *hotstar) ExtractVariants(ctx context.Context, reference model.Reference) ([]model.Variant, error) {
+	return service.NewDefaultVariantExtractor(c.config, c.httpClient, c.origin).ExtractVariants(ctx, reference)
+}
+
+func (c *hotstar) Fingerprint(ctx context.Context, variant model.Variant) (model.Fingerprint, error) {
+	return service.NewDefaultFingerprinter(c.config, c.httpClient, c.origin, c.index).Fingerprint(ctx, variant)
+}
+
+// SelfTest obtains the user token, through the device handshake if not
+// logged in.
+func (c *hotstar) SelfTest(ctx context.Context) error {
+	if _, err := c.token(ctx); err != nil {
+		return fmt.Errorf("token: %w", err)
+	}
+	return nil
+}
+
+func (c *hotstar) extract(ctx context.Context, url string) <-chan model.VideoResult {
+	results := make(chan model.VideoResult)
+
+	var (
+		m         = c.regex.FindStringSubmatch(url)
+		mediaType = m[1]
+		id        = m[2]
+	)
+
+	go func() {
+		defer close(results)
+
+		// Hotstar is only available in India.
+		if err := service.RequireCountry(c.config.CountryCode, "IN"); err != nil {
+			results <- model.VideoResult{Err: err}
+			return
+		}
+
+		switch mediaType {
+		case "movies":
+			c.sendMovie(ctx, id, results)
+		case "shows", "tv":
+			c.sendSeries(ctx, id, results)
+		default:
+			results <- model.VideoResult{Err: fmt.Errorf("media type %q", mediaType)}
+		}
+	}()
+
+	return results
+}
+
+func (c *hotstar) sendMovie(ctx context.Context, id string, results chan<- model.VideoResult) {
+	var res detailResponse
+	if err := c.fetchAPI(ctx, "/o/v1/movie/detail?contentId="+id, &res); err != nil {
+		results <- model.VideoResult{Err: fmt.Errorf("fetch movie detail %q: %w", id, err)}
+		return
+	}
+
+	items := res.Body.Results.Item
+	if items.ContentID == 0 {
+		results <- model.VideoResult{Err: fmt.Errorf("movie %q: not found", id)}
+		return
+	}
+
+	c.sendVideo(ctx, items, "", results)
+}
+
+func (c *hotstar) sendSeries(ctx context.Context, id string, results chan<- model.VideoResult) {
+	var res detailResponse
+	if err := c.fetchAPI(ctx, "/o/v1/show/detail?contentId="+id, &res); err != nil {
+		results <- model.VideoResult{Err: fmt.Errorf("fetch show detail %q: %w", id, err)}
+		return
+	}
+
+	var (
+		seriesTitle = res.Body.Results.Item.Title
+		seasons     = res.Body.Results.Trays.seasons()
+	)
+	if len(seasons) == 0 {
+		results <- model.VideoResult{Err: fmt.Errorf("show %q: no seasons", id)}
+		return
+	}
+
+	service.SendSeries(ctx, c.config, service.Series[season, detailItem]{
+		Seasons: seasons,
+		Number: func(s season) int32 {
+			return s.number
+		},
+		Episodes: func(ctx context.Context, s season) ([]detailItem, error) {
+			episodes, err := c.seasonEpisodes(ctx, s.id)
+			if err != nil {
+				return nil, fmt.Errorf("fetch season %q (%d): %w", id, s.id, err)
+			}
+			return episodes, nil
+		},
+		EpisodeNumber: func(e detailItem) (int32, int32) {
+			return e.SeasonNo, e.EpisodeNo
+		},
+		Send: func(ctx context.Context, e detailItem, results chan<- model.VideoResult) {
+			c.sendVideo(ctx, e, seriesTitle, results)
+		},
+	}, results)
+}
+
+// seasonEpisodes fetches the episodes of a season, a page at a time.
+func (c *hotstar) seasonEpisodes(ctx context.Context, seasonID int64) ([]detailItem, error) {
+	var (
+		episodes []detailItem
+		offset   = 0
+	)
+	for {
+		var res trayResponse
+		path := fmt.Sprintf("/o/v1/tray/g/1/items?etid=0&eid=%d&tao=%d&tas=100", seasonID, offset)
+		if err := c.fetchAPI(ctx, path, &res); err != nil {
+			return nil, err
+		}
+
+		episodes = append(episodes, res.Body.Results.Items...)
+
+		offset += len(res.Body.Results.Items)
+		if len(res.Body.Results.Items) == 0 || offset >= res.Body.Results.TotalResults {
+			return episodes, nil
+		}
+	}
+}
+
+func (c *hotstar) sendVideo(ctx context.Context, item detailItem, seriesTitle string, results chan<- model.VideoResult) {
+	id := strconv.FormatInt(item.ContentID, 10)
+
+	ref, err := c.extractVideoReference(ctx, id)
+	if err != nil {
+		results <- model.VideoResult{
+			Err:     fmt.Errorf("extract reference %q: %w", id, err),
+			Season:  item.SeasonNo,
+			Episode: item.EpisodeNo,
+		}
+		return
+	}
+
+	title := item.Title
+	if seriesTitle != "" {
+		title = model.OneTitle(seriesTitle, item.Title, item.SeasonNo, item.EpisodeNo)
+	}
+
+	results <- model.VideoResult{
+		Video: model.Video{
+			ID:          id,
+			Title:       title,
+			PlaybackURL: c.origin + "/in/" + id + "/watch",
+			Duration:    item.Duration,
+		},
+		References: []model.Reference{*ref},
+		Season:     item.SeasonNo,
+		Episode:    item.EpisodeNo,
+	}
+}
+
+type (
+	detailResponse struct {
+		Body struct {
+			Results struct {
+				Item  detailItem `json:"item"`
+				Trays trays      `json:"trays"`
+			} `json:"results"`
+		} `json:"body"`
+	}
+
+	trayResponse struct {
+		Body struct {
+			Results struct {
+				Items        []detailItem `json:"items"`
+				TotalResults int          `json:"totalResults"`
+			} `json:"results"`
+		} `json:"body"`
+	}
+
+	detailItem struct {
+		ContentID int64  `json:"contentId"`
+		Title     string `json:"title"`
+		Duration  int32  `json:"duration"`
+		SeasonNo  int32  `json:"seasonNo"`
+		EpisodeNo int32  `json:"episodeNo"`
+	}
+
+	trays struct {
+		Items []struct {
+			AssetType string `json:"assetType"`
+
+			Assets struct {
+				Items []struct {
+					ID       int64 `json:"id"`
+					SeasonNo int32 `json:"seasonNo"`
+				} `json:"items"`
+			} `json:"assets"`
+		} `json:"items"`
+	}
+)
+
+// season is of the season tray of a show, its number 0 if not told.
+type season struct {
+	id     int64
+	number int32
+}
+
+func (t *trays) seasons() []season {
+	var seasons []season
+	for _, tray := range t.Items {
+		if tray.AssetType != "SEASON" {
+			continue
+		}
+		for _, a := range tray.Assets.Items {
+			seasons = append(seasons, season{id: a.ID, number: a.SeasonNo})
+		}
+	}
+	return seasons
+}
+
+func (c *hotstar) extractVideoReference(ctx context.Context, id string) (*model.Reference, error) {
+	var res playbackResponse
+	path := "/play/v2/playback/content/" + id + "?desired-config=" + urlpkg.QueryEscape(
+		"audio_channel:stereo|encryption:plain|ladder:tv|package:dash|resolution:fhd|video_codec:h264",
+	) + "&device-id=" + deviceID + "&os-name=Windows&os-version=10"
+	if err := c.fetchAPI(ctx, path, &res); err != nil {
+		return nil, fmt.Errorf("fetch playback %q: %w", id, err)
+	}
+
+	for _, s := range res.Data.PlayBackSets {
+		if strings.Contains(s.TagsCombination, "package:dash") {
+			return &model.Reference{
+				ID:     s.TagsCombination,
+				Format: "dash",
+				URL:    s.PlaybackURL,
+			}, nil
+		}
+	}
+
+	return nil, errors.New("no dash playback set")
+}
+
+type playbackResponse struct {
+	Data struct {
+		PlayBackSets []struct {
+			PlaybackURL     string `json:"playbackUrl"`
+			TagsCombination string `json:"tagsCombination"`
+		} `json:"playBackSets"`
+	} `json:"data"`
+}
+
+// fetchAPI decodes the response of the API to path into v. If
+// unauthorized, the request is sent again with a refreshed token (e.g. a
+// guest token expired mid-run).
+func (c *hotstar) fetchAPI(ctx context.Context, path string, v any) error {
+	token, err := c.token(ctx)
+	if err != nil {
+		return fmt.Errorf("user token: %w", err)
+	}
+
+	var res *http.Response
+	for refreshed := false; ; refreshed = true {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.hotstar.com"+path, nil)
+		if err != nil {
+			return fmt.Errorf("new: %w", err)
+		}
+
+		setAPIHeaders(req, c.origin)
+		req.Header["x-hs-usertoken"] = []string{token}
+
+		res, err = c.httpClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("do: %w", err)
+		}
+		if res.StatusCode != http.StatusUnauthorized || refreshed {
+			break
+		}
+		res.Body.Close()
+
+		if token, err = c.refreshToken(ctx, token); err != nil {
+			return fmt.Errorf("refresh user token: %w", err)
+		}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", res.Status)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode body: %w", err)
+	}
+
+	return nil
+}
+
+// token returns the user token required by the API. A logged in
+// session (userUP cookie) is preferred, otherwise a guest token is
+// obtained through the device handshake and reused.
+func (c *hotstar) token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.userToken != "" {
+		return c.userToken, nil
+	}
+
+	if jar := c.config.CookieJar; jar != nil {
+		u, _ := urlpkg.Parse(c.origin)
+		for _, ck := range jar.Cookies(u) {
+			if ck.Name == "userUP" {
+				c.userToken = ck.Value
+				return c.userToken, nil
+			}
+		}
+	}
+
+	token, err := c.fetchGuestToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.userToken, c.guest = token, true
+
+	return c.userToken, nil
+}
+
+// refreshToken returns a user token replacing rejected, which the API
+// responded unauthorized to. Only guest tokens are refreshed, through the
+// device handshake again.
+func (c *hotstar) refreshToken(ctx context.Context, rejected string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.guest {
+		return "", errors.New("user token (userUP cookie) rejected")
+	}
+	// Already refreshed by another request.
+	if c.userToken != rejected {
+		return c.userToken, nil
+	}
+
+	token, err := c.fetchGuestToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.userToken = token
+
+	return c.userToken, nil
+}
+
+func (c *hotstar) fetchGuestToken(ctx context.Context) (string, error) {
+	body := fmt.Sprintf(`{"device_ids": [{"id": "%s", "type": "device_id"}]}`, deviceID)
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		"https://api.hotstar.com/um/v3/users",
+		strings.NewReader(body),
+	)
+	if err != nil {
+		return "", fmt.Errorf("new: %w", err)
+	}
+
+	setAPIHeaders(req, c.origin)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("status %s", res.Status)
+	}
+
+	var r struct {
+		UserIdentity string `json:"user_identity"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return "", fmt.Errorf("decode body: %w", err)
+	}
+	if r.UserIdentity == "" {
+		return "", errors.New("empty user identity")
+	}
+
+	return r.UserIdentity, nil
+}
+
+const deviceID = "6e5a1e1c-0b2f-4b6f-9e3a-6c1f1b6f0e2d"
+
+// Public key used by the web client to sign the hotstarauth header.
+var akamaiKey = []byte{0x05, 0xfc, 0x1a, 0x01, 0xca, 0xc9, 0x4b, 0xc4, 0x12, 0xfc, 0x53, 0x12, 0x07, 0x75, 0xf9, 0xee}
+
+func setAPIHeaders(req *http.Request, origin string) {
+	var (
+		st   = time.Now().Unix()
+		auth = fmt.Sprintf("st=%d~exp=%d~acl=/*", st, st+6000)
+		mac  = hmac.New(sha256.New, akamaiKey)
+	)
+	mac.Write([]byte(auth))
+
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Referer", origin+"/")
+	req.Header["hotstarauth"] = []string{auth + "~hmac=" + hex.EncodeToString(mac.Sum(nil))}
+	req.Header["x-hs-platform"] = []string{"web"}
+	req.Header["x-hs-appversion"] = []string{"7.41.0"}
+	req.Header["x-country-code"] = []string{"in"}
+}
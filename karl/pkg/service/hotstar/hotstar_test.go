@@ -0,0 +1,198 @@
+package hotstar
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"karl/pkg/config"
+	"karl/pkg/service/internal/servicetest"
+)
+
+func TestMatches(t *testing.T) {
+	c := New(&config.AppConfig{}, http.DefaultClient).(*hotstar)
+
+	for _, tt := range []struct {
+		url       string
+		mediaType string
+		id        string
+	}{
+		{"https://www.hotstar.com/in/movies/the-movie/1260012345", "movies", "1260012345"},
+		{"https://www.hotstar.com/in/movies/the-movie/1260012345/watch", "movies", "1260012345"},
+		{"https://hotstar.com/shows/the-show/1260098765", "shows", "1260098765"},
+		{"https://www.hotstar.com/in/shows/the-show/1260098765/episode-1/1260098766/watch", "shows", "1260098765"},
+		{"https://www.hotstar.com/in/tv/the-show/8184?x=1", "", ""},
+	} {
+		m := c.regex.FindStringSubmatch(tt.url)
+		if tt.id == "" {
+			if m != nil {
+				t.Errorf("%s matched %v, want not", tt.url, m)
+			}
+			continue
+		}
+		if m == nil || m[1] != tt.mediaType || m[2] != tt.id {
+			t.Errorf("%s matched %v, want %s %s", tt.url, m, tt.mediaType, tt.id)
+		}
+	}
+
+	for _, url := range []string{
+		"https://www.jiocinema.com/movies/the-movie/1260012345",
+		"https://www.nothotstar.com/in/movies/the-movie/1260012345",
+		"https://example.com/?u=hotstar.com/in/movies/the-movie/1260012345",
+		"https://www.hotstar.com.example.com/in/movies/the-movie/1260012345",
+	} {
+		if c.Matches(url) {
+			t.Errorf("%s matched, want only Hotstar hosts", url)
+		}
+	}
+}
+
+// apiTransport serves the show, season and playback fixtures, failing
+// those missing and the playback of failing, counting the requests in
+// flight.
+func apiTransport(failing string, inFlight *servicetest.InFlight) servicetest.RoundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		defer inFlight.Enter()()
+		time.Sleep(2 * time.Millisecond)
+
+		var name string
+		switch p := r.URL.Path; {
+		case p == "/o/v1/show/detail":
+			name = "show.json"
+		case p == "/o/v1/tray/g/1/items":
+			name = "season_" + r.URL.Query().Get("eid") + ".json"
+		case strings.HasPrefix(p, "/play/v2/playback/content/") && !strings.HasSuffix(p, "/"+failing):
+			name = "playback.json"
+		}
+		f, err := os.Open("../../../testdata/hotstar/" + name)
+		if name == "" || os.IsNotExist(err) {
+			return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Body: http.NoBody}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: f}, nil
+	}
+}
+
+func TestExtractSeries(t *testing.T) {
+	jar := servicetest.NewJar(t)
+	u, _ := url.Parse("https://www.hotstar.com")
+	jar.SetCookies(u, []*http.Cookie{{Name: "userUP", Value: "token"}})
+
+	var inFlight servicetest.InFlight
+	config := &config.AppConfig{CountryCode: "IN", CookieJar: jar, VideoConcurrency: 2}
+	c := New(config, &http.Client{Transport: apiTransport("1260000202", &inFlight)}).(*hotstar)
+
+	type result struct {
+		id              string
+		season, episode int32
+		failed          bool
+	}
+	var (
+		seasons []int32
+		got     []result
+	)
+	for _, r := range c.VideoExtract(context.Background(), "https://www.hotstar.com/in/shows/the-show/1260098765") {
+		if r.Seasons != nil {
+			seasons = r.Seasons
+			continue
+		}
+		got = append(got, result{r.Video.ID, r.Season, r.Episode, r.Err != nil})
+	}
+	slices.SortFunc(got, func(a, b result) int {
+		return int(a.season*100+a.episode) - int(b.season*100+b.episode)
+	})
+
+	if want := []int32{1, 2, 3}; !slices.Equal(seasons, want) {
+		t.Errorf("seasons %v, want %v", seasons, want)
+	}
+	// Failures of an episode and of a season attributed to them.
+	want := []result{
+		{"1260000101", 1, 1, false},
+		{"1260000102", 1, 2, false},
+		{"1260000103", 1, 3, false},
+		{"1260000201", 2, 1, false},
+		{"", 2, 2, true},
+		{"", 3, 0, true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("results %+v, want %+v", got, want)
+	}
+	// Of 2 seasons or episodes at a time.
+	if m := inFlight.Most(); m > 2 {
+		t.Errorf("requests in flight = %d, want at most 2", m)
+	}
+}
+
+func TestGuestTokenRefreshed(t *testing.T) {
+	var handshakes atomic.Int32
+	rt := servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if len(r.Header["hotstarauth"]) != 1 || r.Header.Get("Origin") != "https://www.hotstar.com" {
+			t.Errorf("%s: headers %v, want those of the web client", r.URL, r.Header)
+		}
+		if r.Method == http.MethodPost && r.URL.Path == "/um/v3/users" {
+			n := handshakes.Add(1)
+			body := fmt.Sprintf(`{"user_identity":"guest-%d"}`, n)
+			return &http.Response{StatusCode: http.StatusCreated, Body: io.NopCloser(strings.NewReader(body))}, nil
+		}
+		// The first guest token expired.
+		if r.Header["x-hs-usertoken"][0] != "guest-2" {
+			return &http.Response{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized", Body: http.NoBody}, nil
+		}
+		f, err := os.Open("../../../testdata/hotstar/show.json")
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: f}, nil
+	})
+	c := New(&config.AppConfig{CookieJar: servicetest.NewJar(t)}, &http.Client{Transport: rt}).(*hotstar)
+
+	var res detailResponse
+	if err := c.fetchAPI(context.Background(), "/o/v1/show/detail?contentId=1260098765", &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Body.Results.Item.Title == "" {
+		t.Errorf("show %+v, want decoded", res.Body.Results.Item)
+	}
+	if n := handshakes.Load(); n != 2 {
+		t.Errorf("handshakes = %d, want 2", n)
+	}
+	// The refreshed token is reused.
+	if err := c.fetchAPI(context.Background(), "/o/v1/show/detail?contentId=1260098765", &res); err != nil || handshakes.Load() != 2 {
+		t.Errorf("%v, handshakes = %d, want the refreshed token reused", err, handshakes.Load())
+	}
+}
+
+func TestUserTokenRejected(t *testing.T) {
+	jar := servicetest.NewJar(t)
+	u, _ := url.Parse("https://www.hotstar.com")
+	jar.SetCookies(u, []*http.Cookie{{Name: "userUP", Value: "token"}})
+
+	var requests atomic.Int32
+	rt := servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requests.Add(1)
+		if r.Method == http.MethodPost {
+			t.Errorf("handshake %s, want the logged in session not replaced", r.URL)
+		}
+		return &http.Response{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized", Body: http.NoBody}, nil
+	})
+	c := New(&config.AppConfig{CookieJar: jar}, &http.Client{Transport: rt}).(*hotstar)
+
+	var res detailResponse
+	if err := c.fetchAPI(context.Background(), "/o/v1/show/detail?contentId=1260098765", &res); err == nil || !strings.Contains(err.Error(), "userUP") {
+		t.Errorf("error %v, want the user token rejected", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("requests = %d, want 1", n)
+	}
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"karl/pkg/model"
+)
+
+// maxCachedIndexes is the most indexes kept by an IndexCache.
+const maxCachedIndexes = 256
+
+// IndexCache keeps the indexes of on-demand files read during a run. The
+// same file may be referenced by several periods of an MPD (or several
+// MPDs of a run), each a variant fingerprinted in turn. Its index is read
+// and parsed once, keyed by URL and index range, of the most recently
+// used.
+type IndexCache struct {
+	*loadCache[indexValue]
+}
+
+// NewIndexCache returns an empty cache, of a client for the run of its
+// Manager.
+func NewIndexCache() *IndexCache {
+	return &IndexCache{newLoadCache[indexValue]("index", maxCachedIndexes)}
+}
+
+type indexValue struct {
+	fp      model.Fingerprint
+	offsets []int64
+}
+
+// get returns the fingerprint and segment offsets of the index of key,
+// from load if not cached (or being loaded by another caller). A nil
+// cache always loads.
+func (c *IndexCache) get(ctx context.Context, key string, load func() (model.Fingerprint, []int64, error)) (model.Fingerprint, []int64, error) {
+	if c == nil {
+		return load()
+	}
+	v, err := c.loadCache.get(ctx, key, func() (indexValue, error) {
+		fp, offsets, err := load()
+		return indexValue{fp, offsets}, err
+	})
+	if err != nil {
+		return model.Fingerprint{}, nil, err
+	}
+
+	// Callers complete their copies (e.g. init size, hashes).
+	fp := v.fp
+	fp.SegmentSizes = slices.Clone(fp.SegmentSizes)
+	fp.SegmentDurations = slices.Clone(fp.SegmentDurations)
+	return fp, slices.Clone(v.offsets), nil
+}
+
+// loadCache keeps the values of up to max keys, the least recently used
+// evicted first, each loaded by one caller at a time while others wait.
+// Failed loads aren't cached, to be retried by the next caller.
+type loadCache[V any] struct {
+	name string
+	max  int
+
+	mu      sync.Mutex
+	entries map[string]*loadEntry[V]
+	// lru is of the entries loaded, the most recently used first.
+	lru list.List
+}
+
+type loadEntry[V any] struct {
+	key  string
+	done chan struct{}
+	v    V
+	err  error
+	// elem is of the entry in lru, once loaded.
+	elem *list.Element
+}
+
+func newLoadCache[V any](name string, max int) *loadCache[V] {
+	return &loadCache[V]{name: name, max: max, entries: make(map[string]*loadEntry[V])}
+}
+
+// get returns the value of key, from load if not cached. If being loaded
+// by another caller, it's waited for, and loaded again under ctx if that
+// caller's context ended it.
+func (c *loadCache[V]) get(ctx context.Context, key string, load func() (V, error)) (V, error) {
+	for {
+		c.mu.Lock()
+		e, ok := c.entries[key]
+		if !ok {
+			e = &loadEntry[V]{key: key, done: make(chan struct{})}
+			c.entries[key] = e
+		} else if e.elem != nil {
+			c.lru.MoveToFront(e.elem)
+		}
+		c.mu.Unlock()
+
+		if !ok {
+			v, err := load()
+			c.put(e, v, err)
+			return v, err
+		}
+
+		select {
+		case <-ctx.Done():
+			var zero V
+			return zero, fmt.Errorf("wait for %s: %w", c.name, ctx.Err())
+		case <-e.done:
+		}
+		if e.err != nil && isContextError(e.err) && ctx.Err() == nil {
+			continue
+		}
+		return e.v, e.err
+	}
+}
+
+// put completes the load of e, caching it if succeeded and evicting the
+// least recently used beyond max.
+func (c *loadCache[V]) put(e *loadEntry[V], v V, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(e.done)
+
+	e.v, e.err = v, err
+	if err != nil {
+		delete(c.entries, e.key)
+		return
+	}
+	e.elem = c.lru.PushFront(e)
+	for c.lru.Len() > c.max {
+		old := c.lru.Remove(c.lru.Back()).(*loadEntry[V])
+		delete(c.entries, old.key)
+	}
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// segmentRanges returns the byte ranges ("start-end") of segments of
+// sizes starting at offsets.
+func segmentRanges(sizes []uint32, offsets []int64) []string {
+	ranges := make([]string, len(sizes))
+	for i, size := range sizes {
+		ranges[i] = fmt.Sprintf("%d-%d", offsets[i], offsets[i]+int64(size)-1)
+	}
+	return ranges
+}
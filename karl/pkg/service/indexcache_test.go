@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"karl/pkg/model"
+)
+
+func TestIndexCacheHit(t *testing.T) {
+	c := &IndexCache{newLoadCache[indexValue]("index", 4)}
+
+	var loads int
+	load := func() (model.Fingerprint, []int64, error) {
+		loads++
+		return model.Fingerprint{SegmentSizes: []uint32{10, 20}}, []int64{100, 110}, nil
+	}
+
+	fp, offsets, err := c.get(context.Background(), "a.mp4 0-99", load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Copies are the caller's to complete.
+	fp.SegmentSizes[0] = 0
+	offsets[0] = 0
+
+	fp, offsets, err = c.get(context.Background(), "a.mp4 0-99", load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loads != 1 {
+		t.Errorf("loads = %d, want 1", loads)
+	}
+	if fp.SegmentSizes[0] != 10 || offsets[0] != 100 {
+		t.Errorf("cached value modified by a caller: %v %v", fp.SegmentSizes, offsets)
+	}
+}
+
+func TestIndexCacheConcurrentLoadOnce(t *testing.T) {
+	c := &IndexCache{newLoadCache[indexValue]("index", 4)}
+
+	var (
+		loads   atomic.Int32
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+	load := func() (model.Fingerprint, []int64, error) {
+		loads.Add(1)
+		<-release
+		return model.Fingerprint{SegmentSizes: []uint32{1}}, []int64{0}, nil
+	}
+
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := c.get(context.Background(), "a.mp4 0-99", load)
+			errs <- err
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := loads.Load(); n != 1 {
+		t.Errorf("loads = %d, want 1", n)
+	}
+}
+
+func TestIndexCacheCancelledLoader(t *testing.T) {
+	c := &IndexCache{newLoadCache[indexValue]("index", 4)}
+
+	var (
+		started = make(chan struct{})
+		cancel  = make(chan struct{})
+	)
+	go c.get(context.Background(), "a.mp4 0-99", func() (model.Fingerprint, []int64, error) {
+		close(started)
+		<-cancel
+		return model.Fingerprint{}, nil, fmt.Errorf("fetch index: %w", context.Canceled)
+	})
+	<-started
+
+	done := make(chan error)
+	go func() {
+		fp, _, err := c.get(context.Background(), "a.mp4 0-99", func() (model.Fingerprint, []int64, error) {
+			return model.Fingerprint{SegmentSizes: []uint32{1}}, []int64{0}, nil
+		})
+		if err == nil && len(fp.SegmentSizes) != 1 {
+			err = errors.New("not loaded by the waiter")
+		}
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(cancel)
+
+	if err := <-done; err != nil {
+		t.Errorf("waiter: %v, want loaded under its own context", err)
+	}
+}
+
+func TestIndexCacheFailedLoadNotCached(t *testing.T) {
+	c := &IndexCache{newLoadCache[indexValue]("index", 4)}
+
+	if _, _, err := c.get(context.Background(), "k", func() (model.Fingerprint, []int64, error) {
+		return model.Fingerprint{}, nil, errors.New("boom")
+	}); err == nil {
+		t.Fatal("want error")
+	}
+	if _, _, err := c.get(context.Background(), "k", func() (model.Fingerprint, []int64, error) {
+		return model.Fingerprint{}, nil, nil
+	}); err != nil {
+		t.Errorf("failed load cached: %v", err)
+	}
+}
+
+func TestLoadCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLoadCache[int]("test", 2)
+
+	var loads int
+	get := func(key string) {
+		c.get(context.Background(), key, func() (int, error) {
+			loads++
+			return 0, nil
+		})
+	}
+	get("a")
+	get("b")
+	get("a") // b least recently used
+	get("c") // evicts b
+	get("a")
+	if loads != 3 {
+		t.Errorf("loads = %d, want 3", loads)
+	}
+	get("b")
+	if loads != 4 {
+		t.Errorf("loads = %d, want 4 (b evicted)", loads)
+	}
+	if n := len(c.entries); n != 2 {
+		t.Errorf("entries = %d, want 2", n)
+	}
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/abema/go-mp4"
+	"karl/pkg/model"
+)
+
+// maxInitSize is the most read of an initialization segment without a
+// range, from the start of the file or of the resource.
+const maxInitSize = 1 << 20
+
+// maxCachedInits is the most initialization segments kept by
+// sharedInitCache.
+const maxCachedInits = 1024
+
+// Initialization segments are probed once, keyed by URL and range, of
+// the most recently used, as representations may be repeated across
+// periods and MPDs.
+var sharedInitCache = newLoadCache[initInfo]("init", maxCachedInits)
+
+// initInfo is of the video track of an initialization segment.
+type initInfo struct {
+	codecs        string
+	width, height uint32
+}
+
+// probeInit fills the codecs and dimensions of v missing from the MPD,
+// from its initialization segment (moov), and recomputes its ID.
+func (ve *DefaultVariantExtractor) probeInit(ctx context.Context, v *model.Variant) error {
+	var u, byteRange string
+	switch {
+	case v.IndexedAddressingInfo != nil:
+		info := v.IndexedAddressingInfo
+		u, byteRange = info.URL, info.InitRange
+		// The initialization segment precedes the index.
+		if byteRange == "" && info.IndexRange != "" {
+			if start, _, err := parseRange(info.IndexRange); err == nil && start > 0 {
+				byteRange = "0-" + strconv.FormatInt(start-1, 10)
+			}
+		}
+	case v.ExplicitAddressingInfo != nil && v.ExplicitAddressingInfo.InitURL != "":
+		info := v.ExplicitAddressingInfo
+		u = info.InitURL
+		if l := len(info.Servers); l > 0 {
+			u = strings.Replace(u, "$Server$", info.Servers[rand.Intn(l)], 1)
+		}
+	default:
+		return errors.New("no initialization segment")
+	}
+	if byteRange == "" {
+		byteRange = "0-" + strconv.Itoa(maxInitSize-1)
+	}
+
+	info, err := sharedInitCache.get(ctx, u+" "+byteRange, func() (initInfo, error) {
+		var (
+			raw []byte
+			err error
+		)
+		if isHTTPURL(u) {
+			raw, err = NewDefaultFingerprinter(ve.config, ve.httpClient, ve.origin, nil).fetchIndex(ctx, u, byteRange)
+		} else {
+			raw, err = readRange(u, byteRange)
+		}
+		if err != nil {
+			return initInfo{}, fmt.Errorf("fetch: %w", err)
+		}
+		return parseInitSegment(raw)
+	})
+	if err != nil {
+		return err
+	}
+
+	if v.Codecs == "" {
+		v.Codecs = info.codecs
+	}
+	if v.Width == 0 || v.Height == 0 {
+		v.Width, v.Height = info.width, info.height
+	}
+	v.ID = computeID(v.MimeType, v.Codecs, v.Width, v.Height, v.Bandwidth, v.FrameRate)
+
+	return nil
+}
+
+// parseInitSegment returns the codecs (RFC 6381) and dimensions of the
+// video track of an initialization segment, of its track header (tkhd)
+// and sample description (stsd), the original format of which is used
+// if encrypted (encv).
+func parseInitSegment(raw []byte) (initInfo, error) {
+	var (
+		stsd    = mp4.BoxPath{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd()}
+		entries = []mp4.BoxType{mp4.BoxTypeAvc1(), mp4.BoxTypeHvc1(), mp4.BoxTypeHev1(), mp4.BoxTypeAv01(), mp4.BoxTypeVp09(), mp4.BoxTypeEncv()}
+		configs = []mp4.BoxType{mp4.BoxTypeAvcC(), mp4.BoxTypeHvcC(), mp4.BoxTypeAv1C(), mp4.BoxTypeVpcC()}
+		paths   = []mp4.BoxPath{{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeTkhd()}}
+	)
+	for _, e := range entries {
+		entry := append(stsd[:len(stsd):len(stsd)], e)
+		paths = append(paths, entry)
+		for _, c := range configs {
+			paths = append(paths, append(entry[:len(entry):len(entry)], c))
+		}
+	}
+	paths = append(paths, append(stsd[:len(stsd):len(stsd)], mp4.BoxTypeEncv(), mp4.BoxTypeSinf(), mp4.BoxTypeFrma()))
+
+	boxes, err := mp4.ExtractBoxesWithPayload(bytes.NewReader(raw), nil, paths)
+	if err != nil {
+		return initInfo{}, fmt.Errorf("extract boxes: %w", err)
+	}
+
+	var (
+		info   initInfo
+		format string
+		suffix string
+	)
+	for _, b := range boxes {
+		switch p := b.Payload.(type) {
+		case *mp4.Tkhd:
+			// Only video tracks have dimensions.
+			if w, h := p.GetWidthInt(), p.GetHeightInt(); w > 0 && h > 0 && info.width == 0 {
+				info.width, info.height = uint32(w), uint32(h)
+			}
+		case *mp4.VisualSampleEntry:
+			if format == "" || format == "encv" {
+				format = b.Info.Type.String()
+			}
+			if info.width == 0 && p.Width > 0 && p.Height > 0 {
+				info.width, info.height = uint32(p.Width), uint32(p.Height)
+			}
+		case *mp4.Frma:
+			format = string(p.DataFormat[:])
+		case *mp4.AVCDecoderConfiguration:
+			suffix = fmt.Sprintf(".%02x%02x%02x", p.Profile, p.ProfileCompatibility, p.Level)
+		case *mp4.HvcC:
+			suffix = hevcCodecSuffix(p)
+		case *mp4.Av1C:
+			suffix = av1CodecSuffix(p)
+		case *mp4.VpcC:
+			suffix = fmt.Sprintf(".%02d.%02d.%02d", p.Profile, p.Level, p.BitDepth)
+		}
+	}
+	if format == "" || format == "encv" {
+		return initInfo{}, errors.New("no video sample entry")
+	}
+	info.codecs = format + suffix
+
+	return info, nil
+}
+
+// hevcCodecSuffix returns the parameters of an HEVC codecs string, as of
+// ISO/IEC 14496-15 annex E, e.g. ".1.6.L93.B0".
+func hevcCodecSuffix(c *mp4.HvcC) string {
+	var compat uint32
+	for i, f := range c.GeneralProfileCompatibility {
+		if f {
+			compat |= 1 << i
+		}
+	}
+	tier := "L"
+	if c.GeneralTierFlag {
+		tier = "H"
+	}
+	s := fmt.Sprintf(".%s%d.%X.%s%d", []string{"", "A", "B", "C"}[c.GeneralProfileSpace&3], c.GeneralProfileIdc, compat, tier, c.GeneralLevelIdc)
+
+	// Trailing zero bytes of constraints are omitted.
+	constraints := c.GeneralConstraintIndicator[:]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, b := range constraints {
+		s += fmt.Sprintf(".%X", b)
+	}
+	return s
+}
+
+// av1CodecSuffix returns the parameters of an AV1 codecs string, e.g.
+// ".0.08M.10".
+func av1CodecSuffix(c *mp4.Av1C) string {
+	tier, depth := "M", 8
+	if c.SeqTier0 == 1 {
+		tier = "H"
+	}
+	switch {
+	case c.HighBitdepth == 1 && c.TwelveBit == 1:
+		depth = 12
+	case c.HighBitdepth == 1:
+		depth = 10
+	}
+	return fmt.Sprintf(".%d.%02d%s.%02d", c.SeqProfile, c.SeqLevelIdx0, tier, depth)
+}
@@ -0,0 +1,69 @@
+// Package servicetest provides stubs for tests of service clients.
+package servicetest
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"sync/atomic"
+	"testing"
+
+	"karl/pkg/model"
+)
+
+// RoundTripFunc is an http.RoundTripper of a func, serving requests of
+// tests without network.
+type RoundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f RoundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// NewJar returns an empty cookie jar.
+func NewJar(tb testing.TB) *cookiejar.Jar {
+	tb.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return jar
+}
+
+// NewClient returns a client of a cookie jar, its requests served by rt.
+func NewClient(tb testing.TB, rt http.RoundTripper) *http.Client {
+	tb.Helper()
+	return &http.Client{Jar: NewJar(tb), Transport: rt}
+}
+
+// Collect returns the results sent by send, until it returns.
+func Collect(send func(chan<- model.VideoResult)) []model.VideoResult {
+	results := make(chan model.VideoResult)
+	go func() {
+		defer close(results)
+		send(results)
+	}()
+	var rs []model.VideoResult
+	for r := range results {
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// InFlight counts requests in flight, keeping the most at once.
+type InFlight struct {
+	n, most atomic.Int32
+}
+
+// Enter counts a request in flight until leave is called.
+func (f *InFlight) Enter() (leave func()) {
+	n := f.n.Add(1)
+	for {
+		m := f.most.Load()
+		if n <= m || f.most.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	return func() { f.n.Add(-1) }
+}
+
+// Most returns the most requests in flight at once.
+func (f *InFlight) Most() int32 {
+	return f.most.Load()
+}
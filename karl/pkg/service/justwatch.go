@@ -6,7 +6,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"maps"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -34,6 +37,10 @@ func NewJustWatchURLExtractor(config *config.AppConfig, httpClient *http.Client,
 }
 
 func (c *justWatchURLExtractor) ExtractURLs(ctx context.Context) ([]string, error) {
+	if c.config.CountryCode == "" {
+		return nil, ErrNoCountryCode
+	}
+
 	var (
 		urlSet = make(map[string]struct{})
 		mu     sync.Mutex
@@ -59,7 +66,7 @@ func (c *justWatchURLExtractor) ExtractURLs(ctx context.Context) ([]string, erro
 		}
 
 		g.Go(func() error {
-			urls, err := c.extractURLs(ctx, filter)
+			urls, err := c.extractSplitURLs(ctx, filter)
 			mu.Lock()
 			defer mu.Unlock()
 			if err == nil {
@@ -82,6 +89,85 @@ func (c *justWatchURLExtractor) ExtractURLs(ctx context.Context) ([]string, erro
 	return urls, nil
 }
 
+var errTooManyTitles = errors.New("too many titles")
+
+// justWatchGenres are the (short) names of the genres of JustWatch.
+var justWatchGenres = []string{
+	"act", "ani", "cmy", "crm", "doc", "drm", "eur", "fml", "fnt", "hrr",
+	"hst", "msc", "rly", "rma", "scf", "spt", "trl", "war", "wsn",
+}
+
+// justWatchSplits split a filter matching more titles than can be
+// paginated through, in turn: by object type, then by genre, and of
+// none of the genres. Titles of several genres are matched by each.
+var justWatchSplits = []func(filter map[string]any) []map[string]any{
+	func(filter map[string]any) []map[string]any {
+		var filters []map[string]any
+		for _, t := range []string{"MOVIE", "SHOW"} {
+			f := maps.Clone(filter)
+			f["objectTypes"] = []string{t}
+			filters = append(filters, f)
+		}
+		return filters
+	},
+	func(filter map[string]any) []map[string]any {
+		var filters []map[string]any
+		for _, g := range justWatchGenres {
+			f := maps.Clone(filter)
+			f["genres"] = []string{g}
+			filters = append(filters, f)
+		}
+		f := maps.Clone(filter)
+		f["excludeGenres"] = justWatchGenres
+		return append(filters, f)
+	},
+}
+
+// extractSplitURLs splits the filter by justWatchSplits while it
+// matches more titles than can be paginated through. Titles of a split
+// still matching too many are skipped, logged, rather than failing
+// those of the others.
+func (c *justWatchURLExtractor) extractSplitURLs(ctx context.Context, filter map[string]any) ([]string, error) {
+	return c.extractSplit(ctx, filter, justWatchSplits)
+}
+
+func (c *justWatchURLExtractor) extractSplit(ctx context.Context, filter map[string]any, splits []func(map[string]any) []map[string]any) ([]string, error) {
+	urls, err := c.extractURLs(ctx, filter)
+	if !errors.Is(err, errTooManyTitles) {
+		return urls, err
+	}
+	if len(splits) == 0 {
+		log.Printf("justwatch: skipped titles of %s: %v\n", describeFilter(filter), err)
+		return nil, nil
+	}
+
+	urls = nil
+	for _, f := range splits[0](filter) {
+		u, err := c.extractSplit(ctx, f, splits[1:])
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u...)
+	}
+
+	return urls, nil
+}
+
+// describeFilter describes the restrictions of filter splitting titles,
+// e.g. "releaseYear=map[max:2020 min:2020] objectTypes=[SHOW]".
+func describeFilter(filter map[string]any) string {
+	var parts []string
+	for _, k := range []string{"releaseYear", "objectTypes", "genres"} {
+		if v, ok := filter[k]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%v", k, v))
+		}
+	}
+	if _, ok := filter["excludeGenres"]; ok {
+		parts = append(parts, "genres=none")
+	}
+	return strings.Join(parts, " ")
+}
+
 func (c *justWatchURLExtractor) extractURLs(ctx context.Context, filter map[string]any) ([]string, error) {
 	const (
 		maxReturned   = 1900
@@ -107,7 +193,7 @@ func (c *justWatchURLExtractor) extractURLs(ctx context.Context, filter map[stri
 			return nil, res.Errors[0]
 		}
 		if count := res.Data.PopularTitles.TotalCount; count > maxReturned {
-			return nil, fmt.Errorf("too many titles (%d): restrict filter", count)
+			return nil, fmt.Errorf("%w (%d): restrict filter", errTooManyTitles, count)
 		}
 
 		urls = append(urls, res.Data.urls()...)
@@ -225,3 +311,159 @@ func (d *justWatchGraphQLURLData) urls() []string {
 func (e justWatchGraphQLError) Error() string {
 	return "graphql: " + e.Extensions.Code + ": " + e.Message
 }
+
+// ExtractTitleURLs resolves the web URLs offering a single title on the
+// packages, identified by an IMDb ("tt1234567") or TMDB ("movie/123",
+// "tv/123") ID.
+func (c *justWatchURLExtractor) ExtractTitleURLs(ctx context.Context, provider, id string) ([]string, error) {
+	if c.config.CountryCode == "" {
+		return nil, ErrNoCountryCode
+	}
+
+	var (
+		objectType string
+		searchID   = id
+	)
+	switch provider {
+	case "imdb":
+		if !strings.HasPrefix(id, "tt") {
+			return nil, fmt.Errorf("invalid imdb id %q", id)
+		}
+	case "tmdb":
+		t, tmdbID, ok := strings.Cut(id, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid tmdb id %q: expected movie/ID or tv/ID", id)
+		}
+		switch t {
+		case "movie":
+			objectType = "MOVIE"
+		case "tv":
+			objectType = "SHOW"
+		default:
+			return nil, fmt.Errorf("invalid tmdb type %q", t)
+		}
+		searchID = tmdbID
+	default:
+		return nil, fmt.Errorf("unsupported provider %q", provider)
+	}
+
+	country := c.config.CountryCode
+	for range 2 {
+		res, err := c.fetchGraphQLTitleURLs(ctx, searchID, country)
+		if err != nil {
+			return nil, fmt.Errorf("fetch title urls: %w", err)
+		}
+		if len(res.Errors) > 0 {
+			if strings.Contains(res.Errors[0].Message, "locale") && country != "US" {
+				country = "US"
+				continue
+			}
+			return nil, res.Errors[0]
+		}
+
+		return res.Data.urls(provider, searchID, objectType), nil
+	}
+
+	return nil, errors.New("too many iterations")
+}
+
+func (c *justWatchURLExtractor) fetchGraphQLTitleURLs(ctx context.Context, searchID, country string) (*justWatchGraphQLTitleResponse, error) {
+	const query = "query GetTitleOffers($country: Country! $searchQuery: String! " +
+		"$offersFilter: OfferFilter!) { popularTitles(country: $country first: 10 " +
+		"filter: {searchQuery: $searchQuery}) { edges { node { objectType content(" +
+		"country: $country, language: \"en\") { externalIds { imdbId tmdbId } } " +
+		"offers(country: $country, platform: WEB, filter: $offersFilter) " +
+		"{ standardWebURL } } } } }"
+
+	body := map[string]any{
+		"operationName": "GetTitleOffers",
+		"variables": map[string]any{
+			"searchQuery": searchID,
+			"offersFilter": map[string][]string{
+				"packages": c.packages,
+			},
+			"country": country,
+		},
+		"query": query,
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return nil, fmt.Errorf("encode body: %w", err)
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		"https://apis.justwatch.com/graphql",
+		&buf,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", c.origin)
+	req.Header.Set("Referer", c.origin+"/")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	var r justWatchGraphQLTitleResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
+	}
+
+	return &r, nil
+}
+
+type (
+	justWatchGraphQLTitleResponse struct {
+		Data   justWatchGraphQLTitleData `json:"data"`
+		Errors []justWatchGraphQLError   `json:"errors"`
+	}
+
+	justWatchGraphQLTitleData struct {
+		PopularTitles struct {
+			Edges []struct {
+				Node struct {
+					ObjectType string `json:"objectType"`
+
+					Content struct {
+						ExternalIDs struct {
+							IMDbID string `json:"imdbId"`
+							TMDbID string `json:"tmdbId"`
+						} `json:"externalIds"`
+					} `json:"content"`
+
+					Offers []struct {
+						StandardWebURL string `json:"standardWebURL"`
+					} `json:"offers"`
+				} `json:"node"`
+			} `json:"edges"`
+		} `json:"popularTitles"`
+	}
+)
+
+// urls returns the offer URLs of the title matching the external ID,
+// as the search may return other titles as well.
+func (d *justWatchGraphQLTitleData) urls(provider, id, objectType string) []string {
+	var urls []string
+	for _, e := range d.PopularTitles.Edges {
+		ids := e.Node.Content.ExternalIDs
+		switch {
+		case provider == "imdb" && ids.IMDbID != id:
+			continue
+		case provider == "tmdb" && (ids.TMDbID != id || e.Node.ObjectType != objectType):
+			continue
+		}
+		for _, o := range e.Node.Offers {
+			if o.StandardWebURL != "" && !slices.Contains(urls, o.StandardWebURL) {
+				urls = append(urls, o.StandardWebURL)
+			}
+		}
+	}
+	return urls
+}
@@ -0,0 +1,230 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"karl/pkg/config"
+	"karl/pkg/service/internal/servicetest"
+)
+
+// graphQLRequest is of the variables of a JustWatch GraphQL request.
+type graphQLRequest struct {
+	OperationName string `json:"operationName"`
+	Variables     struct {
+		Country             string         `json:"country"`
+		SearchQuery         string         `json:"searchQuery"`
+		PopularTitlesFilter map[string]any `json:"popularTitlesFilter"`
+	} `json:"variables"`
+}
+
+// graphQLTransport responds to JustWatch GraphQL requests with the body
+// returned by respond.
+func graphQLTransport(t *testing.T, respond func(graphQLRequest) string) servicetest.RoundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		var req graphQLRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(respond(req)))}, nil
+	}
+}
+
+func TestExtractSplitURLs(t *testing.T) {
+	var requests atomic.Int32
+	c := NewJustWatchURLExtractor(&config.AppConfig{CountryCode: "IN"}, &http.Client{Transport: graphQLTransport(t, func(req graphQLRequest) string {
+		requests.Add(1)
+		types, ok := req.Variables.PopularTitlesFilter["objectTypes"].([]any)
+		// More titles of the year than can be paginated through.
+		if !ok {
+			return `{"data":{"popularTitles":{"totalCount":5000}}}`
+		}
+		url := fmt.Sprintf("https://www.hotstar.com/in/%v/1", types[0])
+		return `{"data":{"popularTitles":{"edges":[{"node":{"watchNowOffer":{"standardWebURL":"` + url + `"}}}],"totalCount":1}}}`
+	})}, []string{"hst"})
+
+	urls, err := c.extractSplitURLs(context.Background(), map[string]any{"packages": []string{"hst"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"https://www.hotstar.com/in/MOVIE/1", "https://www.hotstar.com/in/SHOW/1"}; !slices.Equal(urls, want) {
+		t.Errorf("urls %v, want %v", urls, want)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("requests = %d, want the filter, then one of each object type", n)
+	}
+}
+
+func TestExtractSplitURLsByGenre(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	c := NewJustWatchURLExtractor(&config.AppConfig{CountryCode: "IN"}, &http.Client{Transport: graphQLTransport(t, func(req graphQLRequest) string {
+		f := req.Variables.PopularTitlesFilter
+		types, _ := f["objectTypes"].([]any)
+		genres, _ := f["genres"].([]any)
+		_, none := f["excludeGenres"]
+		title := func(url string) string {
+			return `{"data":{"popularTitles":{"edges":[{"node":{"watchNowOffer":{"standardWebURL":"` + url + `"}}}],"totalCount":1}}}`
+		}
+		tooMany := `{"data":{"popularTitles":{"totalCount":5000}}}`
+		switch {
+		case len(types) == 0:
+			return tooMany
+		case types[0] == "SHOW":
+			return title("https://www.hotstar.com/in/shows/1")
+		case none:
+			return title("https://www.hotstar.com/in/movies/none")
+		case len(genres) == 0:
+			return tooMany
+		case genres[0] == "act":
+			return title("https://www.hotstar.com/in/movies/act")
+		case genres[0] == "drm":
+			// Still too many, skipped.
+			return tooMany
+		}
+		return `{"data":{"popularTitles":{"edges":[],"totalCount":0}}}`
+	})}, []string{"hst"})
+
+	urls, err := c.extractSplitURLs(context.Background(), map[string]any{"releaseYear": map[string]int{"min": 2020, "max": 2020}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"https://www.hotstar.com/in/movies/act",
+		"https://www.hotstar.com/in/movies/none",
+		"https://www.hotstar.com/in/shows/1",
+	}
+	if !slices.Equal(urls, want) {
+		t.Errorf("urls %v, want %v", urls, want)
+	}
+	if got := buf.String(); !strings.Contains(got, "skipped titles of releaseYear=map[max:2020 min:2020] objectTypes=[MOVIE] genres=[drm]") {
+		t.Errorf("logged %q, want the split skipped", got)
+	}
+}
+
+// titleHit is a search hit of a JustWatch title query, offered at urls.
+func titleHit(objectType, imdbID, tmdbID string, urls ...string) string {
+	offers := make([]string, len(urls))
+	for i, u := range urls {
+		offers[i] = `{"standardWebURL":"` + u + `"}`
+	}
+	return fmt.Sprintf(`{"node":{"objectType":%q,"content":{"externalIds":{"imdbId":%q,"tmdbId":%q}},"offers":[%s]}}`,
+		objectType, imdbID, tmdbID, strings.Join(offers, ","))
+}
+
+func titleResponse(hits ...string) string {
+	return `{"data":{"popularTitles":{"edges":[` + strings.Join(hits, ",") + `]}}}`
+}
+
+func TestExtractTitleURLs(t *testing.T) {
+	// Searching by the ID also hits other titles, e.g. of the other object
+	// type sharing a TMDB ID.
+	search := titleResponse(
+		titleHit("MOVIE", "tt0133093", "603", "https://www.svtplay.se/video/1", "https://www.svtplay.se/video/1"),
+		titleHit("SHOW", "tt0000603", "603", "https://www.svtplay.se/show/2"),
+		titleHit("MOVIE", "tt0234215", "604", "https://www.svtplay.se/video/3"),
+	)
+	localeError := `{"errors":[{"message":"unsupported locale","extensions":{"code":"GRAPHQL_VALIDATION_FAILED"}}]}`
+
+	tests := []struct {
+		name      string
+		provider  string
+		id        string
+		responses map[string]string // by country
+		want      []string
+		wantErr   string
+		countries []string // requested, in order
+	}{
+		{name: "imdb", provider: "imdb", id: "tt0133093", responses: map[string]string{"SE": search},
+			want: []string{"https://www.svtplay.se/video/1"}, countries: []string{"SE"}},
+		{name: "tmdb movie", provider: "tmdb", id: "movie/603", responses: map[string]string{"SE": search},
+			want: []string{"https://www.svtplay.se/video/1"}, countries: []string{"SE"}},
+		{name: "tmdb tv", provider: "tmdb", id: "tv/603", responses: map[string]string{"SE": search},
+			want: []string{"https://www.svtplay.se/show/2"}, countries: []string{"SE"}},
+		{name: "not found", provider: "imdb", id: "tt9999999", responses: map[string]string{"SE": search},
+			countries: []string{"SE"}},
+		{name: "locale fallback", provider: "imdb", id: "tt0133093", responses: map[string]string{"SE": localeError, "US": search},
+			want: []string{"https://www.svtplay.se/video/1"}, countries: []string{"SE", "US"}},
+		{name: "graphql error", provider: "imdb", id: "tt0133093", responses: map[string]string{"SE": `{"errors":[{"message":"rate limited","extensions":{"code":"TOO_MANY"}}]}`},
+			wantErr: "graphql: TOO_MANY: rate limited", countries: []string{"SE"}},
+		{name: "invalid imdb", provider: "imdb", id: "0133093", wantErr: `invalid imdb id "0133093"`},
+		{name: "tmdb without type", provider: "tmdb", id: "603", wantErr: "expected movie/ID or tv/ID"},
+		{name: "tmdb of other type", provider: "tmdb", id: "person/603", wantErr: `invalid tmdb type "person"`},
+		{name: "other provider", provider: "tvdb", id: "603", wantErr: `unsupported provider "tvdb"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var countries []string
+			c := NewJustWatchURLExtractor(&config.AppConfig{CountryCode: "SE"}, &http.Client{Transport: graphQLTransport(t, func(req graphQLRequest) string {
+				countries = append(countries, req.Variables.Country)
+				return tt.responses[req.Variables.Country]
+			})}, []string{"svt"})
+
+			urls, err := c.ExtractTitleURLs(context.Background(), tt.provider, tt.id)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(urls, tt.want) {
+				t.Errorf("urls %v, want %v", urls, tt.want)
+			}
+			if !slices.Equal(countries, tt.countries) {
+				t.Errorf("requested countries %v, want %v", countries, tt.countries)
+			}
+		})
+	}
+}
+
+func TestResolveExternalID(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		want    string
+		wantErr string
+	}{
+		// The first URL of a registered service.
+		{name: "offered", id: "imdb:tt0133093", want: "fake://1"},
+		{name: "not offered", id: "imdb:tt0234215", wantErr: `"imdb:tt0234215" not offered on any registered service`},
+		{name: "invalid", id: "tmdb:603", wantErr: `resolve "tmdb:603": invalid tmdb id`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(&http.Client{Transport: graphQLTransport(t, func(graphQLRequest) string {
+				return titleResponse(
+					titleHit("MOVIE", "tt0133093", "603", "https://example.com/1", "fake://1", "fake://2"),
+					titleHit("MOVIE", "tt0234215", "604", "https://example.com/2"),
+				)
+			})}, &config.AppConfig{CountryCode: "SE"})
+			m.Register(func(*config.AppConfig, *http.Client) Client { return &fakeClient{} })
+
+			u, err := m.resolveExternalID(context.Background(), tt.id)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u != tt.want {
+				t.Errorf("resolved %q, want %q", u, tt.want)
+			}
+		})
+	}
+}
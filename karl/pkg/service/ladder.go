@@ -0,0 +1,50 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+
+	"karl/pkg/model"
+)
+
+// ladderOutlierFactor is how many times the bandwidth per pixel of a
+// variant may differ from the median of its ladder.
+const ladderOutlierFactor = 4
+
+// validateLadder returns warnings for the variants whose bandwidth per
+// pixel is an outlier relative to the ladder. Variants without
+// resolution or bandwidth are ignored, as are ladders of fewer than three.
+func validateLadder(variants []model.Variant) []string {
+	type rated struct {
+		variant *model.Variant
+		bpp     float64
+	}
+	var ladder []rated
+	for i, v := range variants {
+		if pixels := v.Width * v.Height; pixels > 0 && v.Bandwidth > 0 && v.Type == "" {
+			ladder = append(ladder, rated{&variants[i], float64(v.Bandwidth) / float64(pixels)})
+		}
+	}
+	if len(ladder) < 3 {
+		return nil
+	}
+
+	bpps := make([]float64, len(ladder))
+	for i, r := range ladder {
+		bpps[i] = r.bpp
+	}
+	slices.Sort(bpps)
+	median := bpps[len(bpps)/2]
+
+	var warnings []string
+	for _, r := range ladder {
+		if r.bpp > median*ladderOutlierFactor || r.bpp < median/ladderOutlierFactor {
+			warnings = append(warnings, fmt.Sprintf(
+				"%dx%d at %d bps: %.3f bits per pixel, ladder median %.3f",
+				r.variant.Width, r.variant.Height, r.variant.Bandwidth, r.bpp, median,
+			))
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"slices"
+	"testing"
+
+	"karl/pkg/model"
+)
+
+func TestValidateLadder(t *testing.T) {
+	// Of 0.1 bits per pixel.
+	rung := func(w, h uint32) model.Variant {
+		return model.Variant{Width: w, Height: h, Bandwidth: w * h / 10}
+	}
+	ladder := []model.Variant{rung(640, 360), rung(1280, 720), rung(1920, 1080)}
+
+	for _, tt := range []struct {
+		name     string
+		variants []model.Variant
+		want     []string
+	}{
+		{"consistent", ladder, nil},
+		{"too few", []model.Variant{rung(640, 360), {Width: 1920, Height: 1080, Bandwidth: 100000000}}, nil},
+		{"over", append(slices.Clone(ladder), model.Variant{Width: 960, Height: 540, Bandwidth: 30000000}),
+			[]string{"960x540 at 30000000 bps: 57.870 bits per pixel, ladder median 0.100"}},
+		{"under", append(slices.Clone(ladder), model.Variant{Width: 3840, Height: 2160, Bandwidth: 100000}),
+			[]string{"3840x2160 at 100000 bps: 0.012 bits per pixel, ladder median 0.100"}},
+		// Within the factor either way.
+		{"near", append(slices.Clone(ladder), model.Variant{Width: 960, Height: 540, Bandwidth: 960 * 540 * 3 / 10}), nil},
+		// Without resolution or bandwidth, or of a trick play type, not
+		// of the ladder.
+		{"ignored", append(slices.Clone(ladder),
+			model.Variant{Bandwidth: 128000},
+			model.Variant{Width: 1920, Height: 1080},
+			model.Variant{Width: 320, Height: 180, Bandwidth: 10000000, Type: "iframe"},
+		), nil},
+	} {
+		if got := validateLadder(tt.variants); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: warnings %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package service
+
+import (
+	"fmt"
+	"time"
+)
+
+// LiveEventError is returned by clients for live events (e.g. sports)
+// that aren't fingerprintable yet, being upcoming or on air, rather than
+// failing to play them.
+type LiveEventError struct {
+	Title string
+	// Status is "upcoming" or "live".
+	Status string
+	// StartsAt is the scheduled start of the event, if told.
+	StartsAt *time.Time
+}
+
+func (e *LiveEventError) Error() string {
+	start := "start not scheduled"
+	if e.StartsAt != nil {
+		start = "scheduled to start " + e.StartsAt.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("live event %q %s (%s): not fingerprintable until a replay is available", e.Title, e.Status, start)
+}
@@ -0,0 +1,110 @@
+package max
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"karl/pkg/model"
+)
+
+// collectionResponse is the page of a collection (hub) route, the titles
+// of which are included as shows, whatever their type.
+type collectionResponse struct {
+	Included []struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+
+		Attributes struct {
+			Name     string `json:"name"`
+			ShowType string `json:"showType"`
+		} `json:"attributes"`
+	} `json:"included"`
+}
+
+// sendCollection sends the videos of the titles of collection id, each
+// extracted as of its own URL.
+func (c *max) sendCollection(ctx context.Context, id string, results chan<- model.VideoResult) {
+	res, err := c.fetchCollectionPage(ctx, id)
+	if err != nil {
+		results <- model.VideoResult{Err: fmt.Errorf("fetch collection page %q: %w", id, err)}
+		return
+	}
+
+	titles := res.titles()
+	if len(titles) == 0 {
+		results <- model.VideoResult{Err: fmt.Errorf("collection %q: no titles", id)}
+		return
+	}
+
+	// Titles are extracted one after the other, as series fan out.
+	for _, t := range titles {
+		if ctx.Err() != nil {
+			return
+		}
+		if t.mediaType == "" {
+			results <- model.VideoResult{Err: fmt.Errorf("collection %q: unsupported show type %q of %q", id, t.showType, t.name)}
+			continue
+		}
+		for r := range c.extract(ctx, "https://play.max.com/"+t.mediaType+"/"+t.id) {
+			// Seasons are of the series, not of the collection.
+			if len(r.Seasons) > 0 && r.Err == nil && r.Video.ID == "" {
+				continue
+			}
+			r.Season, r.Episode = 0, 0
+			results <- r
+		}
+	}
+}
+
+func (c *max) fetchCollectionPage(ctx context.Context, id string) (*collectionResponse, error) {
+	body, err := c.FetchRoute(ctx, "collection/"+url.PathEscape(id), "?include=default")
+	if err != nil {
+		return nil, fmt.Errorf("fetch route: %w", err)
+	}
+	defer body.Close()
+
+	var r collectionResponse
+	if err := json.NewDecoder(body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
+	}
+
+	return &r, nil
+}
+
+type collectionTitle struct {
+	id, name, showType string
+	// mediaType is of the URL of the title, empty if not supported.
+	mediaType string
+}
+
+// titles returns the titles of the collection, in order.
+func (r *collectionResponse) titles() []collectionTitle {
+	var (
+		titles []collectionTitle
+		seen   = make(map[string]struct{})
+	)
+	for _, in := range r.Included {
+		if in.Type != "show" || in.ID == "" {
+			continue
+		}
+		if _, ok := seen[in.ID]; ok {
+			continue
+		}
+		seen[in.ID] = struct{}{}
+
+		t := collectionTitle{id: in.ID, name: in.Attributes.Name, showType: in.Attributes.ShowType}
+		switch t.showType {
+		case "MOVIE", "STANDALONE":
+			t.mediaType = "movie"
+		case "SERIES", "MINISERIES", "TOPICAL":
+			t.mediaType = "show"
+		case "STANDALONE_EVENT":
+			t.mediaType = "event"
+		}
+		titles = append(titles, t)
+	}
+
+	return titles
+}
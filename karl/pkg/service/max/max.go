@@ -1,46 +1,69 @@
 package max
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"regexp"
 	"slices"
-	"strings"
+	"strconv"
 	"sync"
+	"time"
 
-	"golang.org/x/net/html"
 	"golang.org/x/sync/errgroup"
 	"karl/pkg/config"
 	"karl/pkg/model"
 	"karl/pkg/service"
+	"karl/pkg/service/wbd"
 )
 
 var (
-	_ service.Client           = (*max)(nil)
-	_ service.URLExtractor     = (*max)(nil)
-	_ service.VideoExtractor   = (*max)(nil)
-	_ service.VariantExtractor = (*max)(nil)
-	_ service.Fingerprinter    = (*max)(nil)
+	_ service.Client            = (*max)(nil)
+	_ service.URLExtractor      = (*max)(nil)
+	_ service.JustWatchProvider = (*max)(nil)
+	_ service.VideoExtractor    = (*max)(nil)
+	_ service.VariantExtractor  = (*max)(nil)
+	_ service.Fingerprinter     = (*max)(nil)
+	_ service.SelfTester        = (*max)(nil)
 )
 
 type max struct {
+	*wbd.Client
+
 	config            *config.AppConfig
 	httpClient        *http.Client
+	index             *service.IndexCache
 	regex             *regexp.Regexp
+	watchRegex        *regexp.Regexp
+	collectionRegex   *regexp.Regexp
+	tokens            *tokenSource
 	origin            string
 	justWatchPackages []string
 }
 
+func init() {
+	service.Register(New)
+}
+
 func New(config *config.AppConfig, httpClient *http.Client) service.Client {
+	const (
+		origin  = "https://play.max.com"
+		apiBase = "https://default.any-any.prd.api.max.com"
+	)
+	tokens := newTokenSource(config, httpClient, origin, apiBase)
 	return &max{
+		Client:            wbd.NewClient(config, httpClient, origin, apiBase, tokens),
+		tokens:            tokens,
 		config:            config,
 		httpClient:        httpClient,
-		regex:             regexp.MustCompile(`max\.com/.*(movie|show|mini-series)s?/?.*/([a-z0-9\-]+)`),
-		origin:            "https://play.max.com",
+		index:             service.NewIndexCache(),
+		regex:             regexp.MustCompile(`max\.com/(?:.*/)?(movie|show|mini-series|event|sport)s?/(?:.*/)?([a-z0-9\-]+)`),
+		watchRegex:        regexp.MustCompile(`play\.max\.com/video/watch/([a-z0-9\-]+)/([a-z0-9\-]+)`),
+		collectionRegex:   regexp.MustCompile(`max\.com/(?:.*/)?collections?/([a-z0-9\-]+)`),
+		origin:            origin,
 		justWatchPackages: []string{"mxx"},
 	}
 }
@@ -51,14 +74,15 @@ func (c *max) ID() service.ID {
 
 func (c *max) ExtractURLs(ctx context.Context) ([]string, error) {
 	var (
-		urls []string
-		mu   sync.Mutex
+		urls    []string
+		mu      sync.Mutex
+		locales = c.sitemapLocales(ctx)
 	)
 
 	g, ctx := errgroup.WithContext(ctx)
 	for _, mediaType := range []string{"movies", "shows"} {
 		g.Go(func() error {
-			u, err := c.extractURLs(ctx, mediaType)
+			u, err := c.extractURLs(ctx, mediaType, locales)
 			mu.Lock()
 			defer mu.Unlock()
 			if err == nil {
@@ -72,8 +96,12 @@ func (c *max) ExtractURLs(ctx context.Context) ([]string, error) {
 	return urls, err
 }
 
+func (c *max) JustWatchPackages() []string {
+	return c.justWatchPackages
+}
+
 func (c *max) Matches(url string) bool {
-	return c.regex.MatchString(url)
+	return c.watchRegex.MatchString(url) || c.collectionRegex.MatchString(url) || c.regex.MatchString(url)
 }
 
 func (c *max) VideoExtract(ctx context.Context, url string) []model.VideoResult {
@@ -91,154 +119,147 @@ func (c *max) ExtractVariants(ctx context.Context, reference model.Reference) ([
 }
 
 func (c *max) Fingerprint(ctx context.Context, variant model.Variant) (model.Fingerprint, error) {
-	return service.NewDefaultFingerprinter(c.config, c.httpClient, c.origin).Fingerprint(ctx, variant)
+	return service.NewDefaultFingerprinter(c.config, c.httpClient, c.origin, c.index).Fingerprint(ctx, variant)
 }
 
-func (c *max) fetchSiteMap(ctx context.Context, mediaType string) (io.ReadCloser, error) {
-	u := fmt.Sprintf(
-		"https://www.max.com/%s/en/sitemap/%s",
-		strings.ToLower(c.config.CountryCode),
-		mediaType,
-	)
-
-	for range 2 {
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
-		if err != nil {
-			return nil, fmt.Errorf("new: %w", err)
-		}
-
-		res, err := c.httpClient.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("do: %w", err)
-		}
-
-		if res.StatusCode != http.StatusOK {
-			res.Body.Close()
-
-			if res.StatusCode == http.StatusNotFound {
-				u = "https://www.max.com/sitemap/" + mediaType
-				continue
-			}
-
-			return nil, fmt.Errorf("status %s", res.Status)
-		}
-
-		return res.Body, nil
+// SelfTest obtains the API token, bootstrapping an anonymous one unless
+// set.
+func (c *max) SelfTest(ctx context.Context) error {
+	if _, err := c.tokens.Token(ctx); err != nil {
+		return fmt.Errorf("token: %w", err)
 	}
-
-	return nil, fmt.Errorf("status %d", http.StatusNotFound)
+	return nil
 }
 
-func (c *max) extractURLs(ctx context.Context, mediaType string) ([]string, error) {
-	body, err := c.fetchSiteMap(ctx, mediaType)
-	if err != nil {
-		return nil, fmt.Errorf("fetch sitemap: %w", err)
+// manifestFormats returns the manifest formats to request playback of,
+// those fingerprinted. DASH unless HLS was asked for.
+func (c *max) manifestFormats() []string {
+	switch c.config.Format {
+	case "hls":
+		return []string{"hls"}
+	case "both":
+		return []string{"dash", "hls"}
+	default:
+		return []string{"dash"}
 	}
-	defer body.Close()
-
-	doc, err := html.Parse(body)
-	if err != nil {
-		return nil, fmt.Errorf("html parse: %w", err)
-	}
-
-	var urls []string
-	for ch := range doc.Descendants() {
-		if ch.Type != html.ElementNode || ch.Data != "a" {
-			continue
-		}
-		for _, attr := range ch.Attr {
-			if attr.Key != "href" {
-				continue
-			}
-			if u := "https://www.max.com" + attr.Val; c.regex.MatchString(u) {
-				urls = append(urls, u)
-			}
-		}
-	}
-
-	return urls, nil
 }
 
 func (c *max) extract(ctx context.Context, url string) <-chan model.VideoResult {
 	results := make(chan model.VideoResult)
 
-	var (
-		m         = c.regex.FindStringSubmatch(url)
-		mediaType = m[1]
-		id        = m[2]
-	)
+	// Direct watch URLs give the edit, without page to look it up in.
+	if m := c.watchRegex.FindStringSubmatch(url); m != nil {
+		go func() {
+			defer close(results)
+			c.sendWatch(ctx, m[1], m[2], results)
+		}()
+		return results
+	}
+
+	// Collections are expanded into their titles, each extracted as of
+	// its own URL.
+	if m := c.collectionRegex.FindStringSubmatch(url); m != nil {
+		go func() {
+			defer close(results)
+			c.sendCollection(ctx, m[1], results)
+		}()
+		return results
+	}
+
+	var mediaType, id string
+	if m := c.regex.FindStringSubmatch(url); m != nil {
+		mediaType, id = m[1], m[2]
+	}
 
 	go func() {
 		defer close(results)
 
 		switch mediaType {
-		case "movie":
-			c.sendMovie(ctx, id, results)
+		case "":
+			results <- model.VideoResult{Err: fmt.Errorf("unsupported url %q", url)}
+		case "movie", "event", "sport":
+			c.sendMovie(ctx, mediaType, id, results)
 		case "show", "mini-series":
 			c.sendSeries(ctx, id, results)
 		default:
-			results <- model.VideoResult{Err: fmt.Errorf("media type %q", mediaType)}
+			results <- model.VideoResult{Err: fmt.Errorf("unsupported max media type %q", mediaType)}
 		}
 	}()
 
 	return results
 }
 
-func (c *max) sendMovie(ctx context.Context, id string, results chan<- model.VideoResult) {
-	res, err := c.fetchMoviePage(ctx, id)
-	if err != nil {
-		results <- model.VideoResult{Err: fmt.Errorf("fetch movie page %q: %w", id, err)}
-		return
-	}
+func (c *max) sendWatch(ctx context.Context, videoID, editID string, results chan<- model.VideoResult) {
+	c.sendVideo(ctx, model.VideoResult{Video: model.Video{ID: videoID}}, editID, fmt.Sprintf("%q", editID), results)
+}
 
-	m, err := res.movie()
+// sendMovie sends the video of a movie, or of a standalone event or
+// sport replay, pages of which are alike.
+func (c *max) sendMovie(ctx context.Context, mediaType, id string, results chan<- model.VideoResult) {
+	res, err := c.fetchMoviePage(ctx, mediaType, id)
 	if err != nil {
-		results <- model.VideoResult{Err: fmt.Errorf("movie %q: %w", id, err)}
+		results <- model.VideoResult{Err: fmt.Errorf("fetch %s page %q: %w", mediaType, id, err)}
 		return
 	}
 
-	ref, duration, err := c.extractVideoReference(ctx, m.EditID)
+	m, err := res.movie()
 	if err != nil {
-		results <- model.VideoResult{Err: fmt.Errorf("extract reference %q: %w", id, err)}
+		results <- model.VideoResult{Err: fmt.Errorf("%s %q: %w", mediaType, id, err)}
 		return
 	}
 
-	results <- model.VideoResult{
-		Video: model.Video{
-			ID:          m.ID,
-			Title:       m.Name,
-			PlaybackURL: "https://play.max.com/video/watch/" + m.ID + "/" + m.EditID,
-			Duration:    duration,
-		},
-		References: []model.Reference{*ref},
+	v := model.Video{
+		ID:          m.ID,
+		Title:       m.Name,
+		Description: m.Description,
+		AirDate:     m.AirDate,
+		Genres:      m.Genres,
 	}
+	c.sendVideo(ctx, model.VideoResult{Video: v}, m.EditID, fmt.Sprintf("%q", id), results)
 }
 
-func (c *max) fetchCollection(ctx context.Context, resource, query string) (io.ReadCloser, error) {
-	req, err := http.NewRequestWithContext(
-		ctx,
-		http.MethodGet,
-		"https://default.any-any.prd.api.max.com/cms/collections/"+resource+query,
-		nil,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("new: %w", err)
+// sendVideo sends the video of r with the references of its edit editID,
+// or, if all edits are asked for, a video of each of its edits labeled
+// with the edit. Errors are of the video described by what, sent as of r
+// (e.g. its season and episode).
+func (c *max) sendVideo(ctx context.Context, r model.VideoResult, editID, what string, results chan<- model.VideoResult) {
+	v := r.Video
+	fail := func(err error) {
+		res := r
+		res.Video, res.Err = model.Video{}, err
+		results <- res
+	}
+
+	editIDs := []string{editID}
+	if c.config.AllEdits {
+		ids, err := c.FetchEditIDs(ctx, v.ID)
+		if err != nil {
+			fail(fmt.Errorf("fetch edits %s: %w", what, err))
+			return
+		}
+		if !slices.Contains(ids, editID) {
+			ids = append([]string{editID}, ids...)
+		}
+		editIDs = ids
 	}
 
-	req.Header.Set("Origin", c.origin)
-	req.Header.Set("Referer", c.origin+"/")
-
-	res, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("do: %w", err)
-	}
+	for _, id := range editIDs {
+		refs, duration, err := c.ExtractVideoReferences(ctx, id, c.manifestFormats()...)
+		if err != nil {
+			fail(fmt.Errorf("extract reference %s: %w", what, err))
+			continue
+		}
 
-	if res.StatusCode != http.StatusOK {
-		res.Body.Close()
-		return nil, fmt.Errorf("status %s", res.Status)
+		vid := v
+		vid.PlaybackURL = "https://play.max.com/video/watch/" + v.ID + "/" + id
+		vid.Duration = duration
+		if c.config.AllEdits {
+			vid.Edit = id
+		}
+		res := r
+		res.Video, res.References = vid, refs
+		results <- res
 	}
-
-	return res.Body, nil
 }
 
 type (
@@ -258,6 +279,7 @@ type (
 
 			Attributes struct {
 				Name string `json:"name"`
+				metadataAttributes
 			} `json:"attributes"`
 
 			Relationships struct {
@@ -272,21 +294,45 @@ type (
 						ID string `json:"id"`
 					} `json:"data"`
 				} `json:"edit"`
+
+				TxGenres relationships `json:"txGenres"`
 			} `json:"relationships"`
 		} `json:"included"`
 	}
 
+	// metadataAttributes are those of shows and videos describing them.
+	// Dates are in RFC 3339, or empty.
+	metadataAttributes struct {
+		Description        string `json:"description"`
+		AirDate            string `json:"airDate"`
+		FirstAvailableDate string `json:"firstAvailableDate"`
+	}
+
+	relationships struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+
 	movie struct {
 		ID     string
 		Name   string
 		EditID string
+		metadata
+	}
+
+	// metadata is of a video, as of model.Video.
+	metadata struct {
+		Description string
+		AirDate     *time.Time
+		Genres      []string
 	}
 )
 
-func (c *max) fetchMoviePage(ctx context.Context, id string) (*moviePageResponse, error) {
+func (c *max) fetchMoviePage(ctx context.Context, mediaType, id string) (*moviePageResponse, error) {
 	query := "?include=default&ph%5Bshow.id%5D=" + id
 
-	body, err := c.fetchCollection(ctx, "generic-movie-page-rail-hero", query)
+	body, err := c.FetchCollection(ctx, "generic-"+mediaType+"-page-rail-hero", query)
 	if err != nil {
 		return nil, fmt.Errorf("fetch collection: %w", err)
 	}
@@ -313,15 +359,22 @@ func (c *max) sendSeries(ctx context.Context, id string, results chan<- model.Vi
 		return
 	}
 
-	var wg sync.WaitGroup
-	for _, n := range nums {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			c.sendSeason(ctx, id, n, results)
-		}()
-	}
-	wg.Wait()
+	service.SendSeries(ctx, c.config, service.Series[string, episode]{
+		Seasons: nums,
+		Number: func(n string) int32 {
+			i, _ := strconv.ParseInt(n, 10, 32)
+			return int32(i)
+		},
+		Episodes: func(ctx context.Context, n string) ([]episode, error) {
+			return c.seasonEpisodes(ctx, id, n)
+		},
+		EpisodeNumber: func(e episode) (int32, int32) {
+			return e.SeasonNumber, e.Number
+		},
+		Send: func(ctx context.Context, e episode, results chan<- model.VideoResult) {
+			c.sendEpisode(ctx, id, e, results)
+		},
+	}, results)
 }
 
 type (
@@ -359,6 +412,7 @@ type (
 				Name          string `json:"name"`
 				SeasonNumber  int32  `json:"seasonNumber"`
 				EpisodeNumber int32  `json:"episodeNumber"`
+				metadataAttributes
 			} `json:"attributes"`
 
 			Relationships struct {
@@ -379,6 +433,8 @@ type (
 						ID string `json:"id"`
 					} `json:"data"`
 				} `json:"edit"`
+
+				TxGenres relationships `json:"txGenres"`
 			} `json:"relationships"`
 		} `json:"included"`
 	}
@@ -390,13 +446,14 @@ type (
 		Number       int32
 		SeasonNumber int32
 		EditID       string
+		metadata
 	}
 )
 
 func (c *max) fetchSeasonNumbers(ctx context.Context, id string) (*seasonNumbersResponse, error) {
 	query := "?include=items&pf%5BseasonNumber%5D&pf%5Bshow.id%5D=" + id
 
-	body, err := c.fetchCollection(ctx, "generic-show-page-rail-episodes-tabbed-content", query)
+	body, err := c.FetchCollection(ctx, "generic-show-page-rail-episodes-tabbed-content", query)
 	if err != nil {
 		return nil, fmt.Errorf("fetch collection: %w", err)
 	}
@@ -410,51 +467,36 @@ func (c *max) fetchSeasonNumbers(ctx context.Context, id string) (*seasonNumbers
 	return &r, nil
 }
 
-func (c *max) sendSeason(ctx context.Context, id, num string, results chan<- model.VideoResult) {
+func (c *max) seasonEpisodes(ctx context.Context, id, num string) ([]episode, error) {
 	res, err := c.fetchSeason(ctx, id, num)
 	if err != nil {
-		results <- model.VideoResult{Err: fmt.Errorf("fetch season %q (%s): %w", id, num, err)}
-		return
+		return nil, fmt.Errorf("fetch season %q (season %s): %w", id, num, err)
 	}
 
 	eps, err := res.episodes()
 	if err != nil {
-		results <- model.VideoResult{Err: fmt.Errorf("season %q (%s) episodes: %w", id, num, err)}
-		return
+		return nil, fmt.Errorf("season %q (season %s) episodes: %w", id, num, err)
 	}
 
-	var wg sync.WaitGroup
-	for _, e := range eps {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			ref, duration, err := c.extractVideoReference(ctx, e.EditID)
-			if err != nil {
-				results <- model.VideoResult{
-					Err: fmt.Errorf("extract reference %q (%s): %w", id, num, err),
-				}
-				return
-			}
+	return eps, nil
+}
 
-			results <- model.VideoResult{
-				Video: model.Video{
-					ID:          e.ID,
-					Title:       model.OneTitle(e.SeriesName, e.Name, e.SeasonNumber, e.Number),
-					PlaybackURL: "https://play.max.com/video/watch/" + e.ID + "/" + e.EditID,
-					Duration:    duration,
-				},
-				References: []model.Reference{*ref},
-			}
-		}()
+func (c *max) sendEpisode(ctx context.Context, id string, e episode, results chan<- model.VideoResult) {
+	v := model.Video{
+		ID:          e.ID,
+		Title:       model.OneTitle(e.SeriesName, e.Name, e.SeasonNumber, e.Number),
+		Description: e.Description,
+		AirDate:     e.AirDate,
+		Genres:      e.Genres,
 	}
-	wg.Wait()
+	r := model.VideoResult{Video: v, Season: e.SeasonNumber, Episode: e.Number}
+	c.sendVideo(ctx, r, e.EditID, fmt.Sprintf("%q (season %d, episode %d)", id, e.SeasonNumber, e.Number), results)
 }
 
 func (c *max) fetchSeason(ctx context.Context, id, number string) (*seasonPageResponse, error) {
 	query := "?include=default&pf%5BseasonNumber%5D=" + number + "&pf%5Bshow.id%5D=" + id
 
-	body, err := c.fetchCollection(ctx, "generic-show-page-rail-episodes-tabbed-content", query)
+	body, err := c.FetchCollection(ctx, "generic-show-page-rail-episodes-tabbed-content", query)
 	if err != nil {
 		return nil, fmt.Errorf("fetch collection: %w", err)
 	}
@@ -468,97 +510,20 @@ func (c *max) fetchSeason(ctx context.Context, id, number string) (*seasonPageRe
 	return &r, nil
 }
 
-func (c *max) extractVideoReference(ctx context.Context, editID string) (*model.Reference, int32, error) {
-	r, err := c.fetchPlaybackInfo(ctx, editID)
-	if err != nil {
-		return nil, 0, fmt.Errorf("fetch playback info %q: %w", editID, err)
-	}
-
+func (r *moviePageResponse) movie() (movie, error) {
 	var (
-		id       string
-		duration int32
-	)
-
-	for _, v := range r.Videos {
-		if v.Type == "main" {
-			id = v.ManifestationID
-			duration = int32(v.Duration)
-			break
-		}
-	}
-
-	return &model.Reference{
-		ID:     id,
-		Format: r.Manifest.Format,
-		URL:    r.Manifest.URL,
-	}, duration, nil
-}
-
-type (
-	playbackInfoResponse struct {
-		Videos []struct {
-			ManifestationID string  `json:"manifestationId"`
-			Duration        float64 `json:"duration"`
-			Type            string  `json:"type"`
-		} `json:"videos"`
-
-		Manifest struct {
-			Format string `json:"format"`
-			URL    string `json:"url"`
-		} `json:"manifest"`
-	}
-)
-
-func (c *max) fetchPlaybackInfo(ctx context.Context, editID string) (*playbackInfoResponse, error) {
-	const fmtQuery = `{"editId": "%s", "appBundle": "", "consumptionType": "streaming",
-		"deviceInfo": {"player": {"sdk": {"name": "", "version": ""}, "mediaEngine": {
-		"name": "", "version": ""}, "playerView": {"height": 2160, "width": 3840}}},
-		"capabilities": {"manifests": {"formats": {"dash": {}}}, "codecs": {"audio": {
-		"decoders": [{"codec": "avc", "profiles": ["lc", "hev", "hev2"]}]}, "video": {
-		"decoders": [{"codec": "h264", "profiles": ["high", "main", "baseline"],
-		"maxLevel": "5.2", "levelConstraints": {"width": {"min": 0, "max": 3840},
-		"height": {"min": 0, "max": 2160}, "framerate": {"min": 0, "max": 60}}}],
-		"hdrFormats": []}}}, "gdpr": false, "firstPlay": false, "playbackSessionId": "",
-		"applicationSessionId": "", "userPreferences": { "videoQuality": "best"}}`
-
-	req, err := http.NewRequestWithContext(
-		ctx,
-		http.MethodPost,
-		"https://default.any-any.prd.api.max.com/any/playback/v1/playbackInfo",
-		strings.NewReader(fmt.Sprintf(fmtQuery, editID)),
+		videoID string
+		show    metadata
+		names   = make(map[string]string)
 	)
-	if err != nil {
-		return nil, fmt.Errorf("new: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Origin", c.origin)
-	req.Header.Set("Referer", c.origin+"/")
-
-	res, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("do: %w", err)
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status %s", res.Status)
-	}
-
-	var r playbackInfoResponse
-	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-		return nil, fmt.Errorf("decode body: %w", err)
+	for _, inc := range r.Included {
+		names[inc.ID] = inc.Attributes.Name
 	}
-
-	return &r, nil
-}
-
-func (r *moviePageResponse) movie() (movie, error) {
-	videoID := ""
 	for _, it := range r.Data.Relationships.Items.Data {
 		for _, inc := range r.Included {
 			if inc.ID == it.ID {
 				videoID = inc.Relationships.ActiveVideoForShow.Data.ID
+				show = newMetadata(inc.Attributes.metadataAttributes, inc.Relationships.TxGenres, names)
 				break
 			}
 		}
@@ -568,10 +533,18 @@ func (r *moviePageResponse) movie() (movie, error) {
 	}
 	for _, inc := range r.Included {
 		if inc.ID == videoID {
+			// The show of the movie describes it where its video doesn't.
+			md := newMetadata(inc.Attributes.metadataAttributes, inc.Relationships.TxGenres, names)
+			md.Description = cmp.Or(md.Description, show.Description)
+			md.AirDate = cmp.Or(md.AirDate, show.AirDate)
+			if len(md.Genres) == 0 {
+				md.Genres = show.Genres
+			}
 			return movie{
-				ID:     videoID,
-				Name:   inc.Attributes.Name,
-				EditID: inc.Relationships.Edit.Data.ID,
+				ID:       videoID,
+				Name:     inc.Attributes.Name,
+				EditID:   inc.Relationships.Edit.Data.ID,
+				metadata: md,
 			}, nil
 		}
 	}
@@ -608,7 +581,13 @@ func (r *seasonPageResponse) episodes() ([]episode, error) {
 		}
 	}
 
-	seriesName := ""
+	var (
+		seriesName string
+		names      = make(map[string]string)
+	)
+	for _, inc := range r.Included {
+		names[inc.ID] = inc.Attributes.Name
+	}
 	for _, inc := range r.Included {
 		if !slices.Contains(videoIDs, inc.ID) {
 			continue
@@ -628,6 +607,7 @@ func (r *seasonPageResponse) episodes() ([]episode, error) {
 			Number:       inc.Attributes.EpisodeNumber,
 			SeasonNumber: inc.Attributes.SeasonNumber,
 			EditID:       inc.Relationships.Edit.Data.ID,
+			metadata:     newMetadata(inc.Attributes.metadataAttributes, inc.Relationships.TxGenres, names),
 		})
 	}
 	if len(episodes) == 0 {
@@ -636,3 +616,28 @@ func (r *seasonPageResponse) episodes() ([]episode, error) {
 
 	return episodes, nil
 }
+
+// newMetadata returns the metadata of attrs, with the names of genres,
+// as of names by ID.
+func newMetadata(attrs metadataAttributes, genres relationships, names map[string]string) metadata {
+	md := metadata{
+		Description: attrs.Description,
+		AirDate:     parseDate(cmp.Or(attrs.AirDate, attrs.FirstAvailableDate)),
+	}
+	for _, g := range genres.Data {
+		if n := names[g.ID]; n != "" {
+			md.Genres = append(md.Genres, n)
+		}
+	}
+	return md
+}
+
+// parseDate parses a date of the API, or returns nil if missing or
+// malformed.
+func parseDate(s string) *time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,409 @@
+package max
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	urlpkg "net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service/internal/servicetest"
+)
+
+func jsonResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// seasonPage returns a season page of n episodes of season num.
+func seasonPage(num string, n int) string {
+	var items, included []string
+	for i := range n {
+		id := fmt.Sprintf("s%se%d", num, i+1)
+		items = append(items, `{"id":"item-`+id+`"}`)
+		included = append(included,
+			`{"id":"item-`+id+`","relationships":{"video":{"data":{"id":"`+id+`"}}}}`,
+			fmt.Sprintf(`{"id":%q,"attributes":{"name":"Episode","seasonNumber":%s,"episodeNumber":%d},"relationships":{"edit":{"data":{"id":"edit-%s"}}}}`, id, num, i+1, id),
+		)
+	}
+	return `{"data":{"relationships":{"items":{"data":[` + strings.Join(items, ",") + `]}}},"included":[` + strings.Join(included, ",") + `]}`
+}
+
+// newTestClient returns a client of a series of seasons of n episodes
+// each, whose playback requests are made by playback.
+func newTestClient(t *testing.T, concurrency, n int, playback func(*http.Request) (*http.Response, error)) *max {
+	t.Helper()
+	return newTestClientConfig(t, &config.AppConfig{VideoConcurrency: concurrency}, n, playback)
+}
+
+func newTestClientConfig(t *testing.T, config *config.AppConfig, n int, playback func(*http.Request) (*http.Response, error)) *max {
+	t.Helper()
+	jar := servicetest.NewJar(t)
+	config.CookieJar = jar
+	c := New(config, &http.Client{Jar: jar, Transport: servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Method != http.MethodGet {
+			return playback(r)
+		}
+		q := r.URL.Query()
+		if !q.Has("pf[seasonNumber]") {
+			return nil, fmt.Errorf("unexpected request %s", r.URL)
+		}
+		if num := q.Get("pf[seasonNumber]"); num != "" {
+			return jsonResponse(seasonPage(num, n)), nil
+		}
+		return jsonResponse(`{"data":{"attributes":{"component":{"filters":[{"id":"seasonNumber","options":[{"id":"1"},{"id":"2"},{"id":"3"}]}]}}}}`), nil
+	})}).(*max)
+	// A user token, not to bootstrap an anonymous one.
+	u, _ := urlpkg.Parse(c.tokens.apiBase)
+	jar.SetCookies(u, []*http.Cookie{{Name: "st", Value: "token", Path: "/"}})
+	return c
+}
+
+func TestSendSeriesBounded(t *testing.T) {
+	c := newTestClient(t, 2, 8, func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("offline")
+	})
+	// Season and playback requests alike are counted.
+	var (
+		inFlight servicetest.InFlight
+		rt       = c.httpClient.Transport
+	)
+	c.httpClient.Transport = servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		defer inFlight.Enter()()
+		time.Sleep(2 * time.Millisecond)
+		return rt.RoundTrip(r)
+	})
+
+	rs := servicetest.Collect(func(results chan<- model.VideoResult) {
+		c.sendSeries(context.Background(), "series", results)
+	})
+	// The seasons, then an error of each episode.
+	if len(rs) != 1+3*8 {
+		t.Fatalf("results = %d, want %d", len(rs), 1+3*8)
+	}
+	for _, r := range rs[1:] {
+		if r.Err == nil || r.Season == 0 || r.Episode == 0 {
+			t.Errorf("result %+v, want an error of an episode", r)
+		}
+	}
+	if m := inFlight.Most(); m > 2 {
+		t.Errorf("requests in flight = %d, want at most 2", m)
+	}
+}
+
+func TestSendSeriesCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newTestClient(t, 1, 4, func(r *http.Request) (*http.Response, error) {
+		cancel()
+		return nil, r.Context().Err()
+	})
+
+	rs := servicetest.Collect(func(results chan<- model.VideoResult) {
+		c.sendSeries(ctx, "series", results)
+	})
+	var episodes int
+	for _, r := range rs {
+		if r.Episode > 0 {
+			episodes++
+			if !errors.Is(r.Err, context.Canceled) {
+				t.Errorf("result %+v, want cancelled", r)
+			}
+		}
+	}
+	// Episodes of the seasons fetched before the cancellation are each
+	// told, none dropped.
+	if episodes == 0 || episodes%4 != 0 {
+		t.Errorf("episode results = %d, want those of whole seasons", episodes)
+	}
+}
+
+func TestSendSeriesThrottled(t *testing.T) {
+	playback, err := os.ReadFile("../../../testdata/wbd/playbackinfo.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A burst of throttled playback requests, then their retries succeed.
+	var requests atomic.Int32
+	c := newTestClientConfig(t, &config.AppConfig{VideoConcurrency: 2, Retries: 5}, 4, func(r *http.Request) (*http.Response, error) {
+		if requests.Add(1) <= 5 {
+			return &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Status:     "429 Too Many Requests",
+				Header:     http.Header{"Retry-After": {"0"}},
+				Body:       http.NoBody,
+			}, nil
+		}
+		return jsonResponse(string(playback)), nil
+	})
+
+	rs := servicetest.Collect(func(results chan<- model.VideoResult) {
+		c.sendSeries(context.Background(), "series", results)
+	})
+	if len(rs) != 1+3*4 {
+		t.Fatalf("results = %d, want %d", len(rs), 1+3*4)
+	}
+	for _, r := range rs[1:] {
+		if r.Err != nil || len(r.References) == 0 {
+			t.Errorf("result %+v, want references of an episode", r)
+		}
+	}
+}
+
+func decodeFile(t *testing.T, path string, v any) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func date(s string) *time.Time {
+	d, _ := time.Parse(time.RFC3339, s)
+	return &d
+}
+
+func TestSeasonPageEpisodes(t *testing.T) {
+	var r seasonPageResponse
+	decodeFile(t, "../../../testdata/max/seasonpage.json", &r)
+
+	eps, err := r.episodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []episode{
+		// The air date rather than first available.
+		{ID: "e1", Name: "Pilot", SeriesName: "The Show", Number: 1, SeasonNumber: 1, EditID: "edit-e1", metadata: metadata{
+			Description: "It begins.", AirDate: date("2023-03-05T02:00:00Z"), Genres: []string{"Drama", "Crime"},
+		}},
+		{ID: "e2", Name: "Second", SeriesName: "The Show", Number: 2, SeasonNumber: 1, EditID: "edit-e2", metadata: metadata{
+			AirDate: date("2023-03-13T02:00:00Z"),
+		}},
+		// Malformed dates are left out.
+		{ID: "e3", Name: "Third", SeriesName: "The Show", Number: 3, SeasonNumber: 1, EditID: "edit-e3"},
+	}
+	if !reflect.DeepEqual(eps, want) {
+		t.Errorf("episodes %+v, want %+v", eps, want)
+	}
+}
+
+func TestMoviePageMovie(t *testing.T) {
+	var r moviePageResponse
+	decodeFile(t, "../../../testdata/max/moviepage.json", &r)
+
+	m, err := r.movie()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Described by the show, where the video isn't.
+	want := movie{ID: "video-1", Name: "The Movie", EditID: "edit-1", metadata: metadata{
+		Description: "A movie.", AirDate: date("2022-01-01T08:00:00Z"), Genres: []string{"Sci-Fi"},
+	}}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("movie %+v, want %+v", m, want)
+	}
+}
+
+func TestExtractWatchURL(t *testing.T) {
+	playback, err := os.ReadFile("../../../testdata/wbd/playbackinfo.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body string
+	// Any page lookup (GET) is unexpected, failing.
+	c := newTestClient(t, 1, 0, func(r *http.Request) (*http.Response, error) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		return jsonResponse(string(playback)), nil
+	})
+
+	rs := servicetest.Collect(func(results chan<- model.VideoResult) {
+		for r := range c.extract(context.Background(), "https://play.max.com/video/watch/0b5e2e0b-video/8c3f1f7e-edit") {
+			results <- r
+		}
+	})
+	if len(rs) != 1 || rs[0].Err != nil {
+		t.Fatalf("results %+v, want 1 video", rs)
+	}
+	if v := rs[0].Video; v.ID != "0b5e2e0b-video" || v.PlaybackURL != "https://play.max.com/video/watch/0b5e2e0b-video/8c3f1f7e-edit" {
+		t.Errorf("video %+v, want of the URL", v)
+	}
+	if !strings.Contains(body, `"editId": "8c3f1f7e-edit"`) {
+		t.Errorf("playback request %s, want of the edit of the URL", body)
+	}
+	if len(rs[0].References) == 0 {
+		t.Error("no references")
+	}
+}
+
+func TestExtractEventURL(t *testing.T) {
+	event, err := os.ReadFile("../../../testdata/max/eventpage.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	playback, err := os.ReadFile("../../../testdata/wbd/playbackinfo.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body string
+	c := newTestClient(t, 1, 0, func(r *http.Request) (*http.Response, error) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		return jsonResponse(string(playback)), nil
+	})
+	// The event page of the collections API, and playback as above.
+	transport := c.httpClient.Transport
+	c.httpClient.Transport = servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(r.URL.Path, "/cms/collections/generic-event-page-rail-hero") {
+			if id := r.URL.Query().Get("ph[show.id]"); id != "the-final" {
+				return nil, fmt.Errorf("event %q, want the-final", id)
+			}
+			return jsonResponse(string(event)), nil
+		}
+		return transport.RoundTrip(r)
+	})
+
+	rs := servicetest.Collect(func(results chan<- model.VideoResult) {
+		for r := range c.extract(context.Background(), "https://www.max.com/us/en/event/the-final") {
+			results <- r
+		}
+	})
+	if len(rs) != 1 || rs[0].Err != nil {
+		t.Fatalf("results %+v, want 1 video", rs)
+	}
+	if v := rs[0].Video; v.ID != "video-event" || v.Title != "The Final" || v.Description != "The final, live." {
+		t.Errorf("video %+v, want the event", v)
+	}
+	if !strings.Contains(body, `"editId": "edit-event"`) {
+		t.Errorf("playback request %s, want of the edit of the event", body)
+	}
+}
+
+func TestExtractUnsupportedURL(t *testing.T) {
+	c := newTestClient(t, 1, 0, func(r *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("unexpected request %s", r.URL)
+	})
+
+	for _, url := range []string{
+		"https://play.max.com/video/watch/0b5e2e0b-video",
+		"https://www.max.com/",
+		"https://play.max.com/search",
+	} {
+		rs := servicetest.Collect(func(results chan<- model.VideoResult) {
+			for r := range c.extract(context.Background(), url) {
+				results <- r
+			}
+		})
+		if len(rs) != 1 || rs[0].Err == nil || !strings.Contains(rs[0].Err.Error(), "unsupported url") {
+			t.Errorf("%s: results %+v, want unsupported", url, rs)
+		}
+	}
+}
+
+// tokenTransport serves anonymous tokens, numbered by the count of
+// tokens obtained, recording the device of each request.
+func tokenTransport(tokens *atomic.Int32, deviceIDs *[]string) servicetest.RoundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		switch r.URL.Path {
+		case "/token":
+			*deviceIDs = append(*deviceIDs, r.URL.Query().Get("deviceId"))
+			return jsonResponse(fmt.Sprintf(`{"data":{"attributes":{"token":"anon%d"}}}`, tokens.Add(1))), nil
+		case "/session-context/headwaiter/v1/bootstrap":
+			return jsonResponse(`{}`), nil
+		}
+		return nil, fmt.Errorf("unexpected request %s", r.URL)
+	}
+}
+
+func TestTokenKeptAcrossRuns(t *testing.T) {
+	var (
+		tokens    atomic.Int32
+		deviceIDs []string
+		cacheDir  = t.TempDir()
+	)
+	run := func(country string) *tokenSource {
+		config := &config.AppConfig{CountryCode: country, CacheDir: cacheDir, CookieJar: servicetest.NewJar(t)}
+		return newTokenSource(config, &http.Client{Transport: tokenTransport(&tokens, &deviceIDs)}, "https://play.max.com", "https://default.any-any.prd.api.max.com")
+	}
+	token := func(ts *tokenSource) string {
+		t.Helper()
+		tok, err := ts.Token(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+
+	first := run("SE")
+	if tok := token(first); tok != "anon1" {
+		t.Fatalf("token %q, want bootstrapped", tok)
+	}
+	// Of the next run, for the same device.
+	next := run("SE")
+	if tok := token(next); tok != "anon1" || next.deviceID != first.deviceID {
+		t.Errorf("token %q of device %s, want anon1 of %s kept", tok, next.deviceID, first.deviceID)
+	}
+	if n := tokens.Load(); n != 1 {
+		t.Errorf("%d tokens obtained, want 1", n)
+	}
+
+	// Replaced once rejected.
+	if tok, err := next.Refresh(context.Background(), "anon1"); err != nil || tok != "anon2" {
+		t.Fatalf("refreshed %q, %v, want anon2", tok, err)
+	}
+	if tok := token(run("SE")); tok != "anon2" {
+		t.Errorf("token %q, want the refreshed anon2 kept", tok)
+	}
+
+	// Not of another country.
+	if tok := token(run("NO")); tok != "anon3" {
+		t.Errorf("token %q, want anon3 bootstrapped for NO", tok)
+	}
+
+	// Nor once expired.
+	kept := keptToken{Token: "anon3", DeviceID: "device", Country: "NO", Expires: time.Now().Add(-time.Hour)}
+	b, _ := json.Marshal(kept)
+	if err := os.WriteFile(filepath.Join(cacheDir, tokenFile), b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if tok := token(run("NO")); tok != "anon4" {
+		t.Errorf("token %q, want anon4 bootstrapped", tok)
+	}
+	if last := deviceIDs[len(deviceIDs)-1]; last == "device" {
+		t.Errorf("device %s of the expired token, want a new one", last)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"exp":1767312000}`))
+	for _, tt := range []struct {
+		token string
+		want  time.Time
+	}{
+		{"eyJhbGciOiJSUzI1NiJ9." + claims + ".sig", time.Unix(1767312000, 0)},
+		{"opaque", now.Add(tokenTTL)},
+		{"a.!.c", now.Add(tokenTTL)},
+	} {
+		if got := tokenExpiry(tt.token, now); !got.Equal(tt.want) {
+			t.Errorf("%s: expires %s, want %s", tt.token, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package max
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	urlpkg "net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// knownLocales are the languages of the sitemaps of markets not in
+// English, tried if the home of the market doesn't redirect to one.
+var knownLocales = map[string][]string{
+	"br": {"pt"},
+	"dk": {"da"},
+	"es": {"es"},
+	"fi": {"fi"},
+	"mx": {"es"},
+	"nl": {"nl"},
+	"no": {"no", "nb"},
+	"pl": {"pl"},
+	"pt": {"pt"},
+	"se": {"sv"},
+}
+
+// sitemapLocales returns the languages to try sitemaps of the market in,
+// in order: that the home of the market redirects to (e.g. /br/pt), the
+// known ones and English. None if no country code is set, leaving the
+// global sitemap only.
+func (c *max) sitemapLocales(ctx context.Context) []string {
+	var (
+		cc      = strings.ToLower(c.config.CountryCode)
+		locales []string
+	)
+	if cc == "" {
+		return nil
+	}
+
+	if locale, err := c.fetchHomeLocale(ctx, cc); err == nil && locale != "" {
+		locales = append(locales, locale)
+	} else if err != nil && c.config.Verbose {
+		log.Printf("max: locale of market %q: %v\n", cc, err)
+	}
+	for _, l := range slices.Concat(knownLocales[cc], []string{"en"}) {
+		if !slices.Contains(locales, l) {
+			locales = append(locales, l)
+		}
+	}
+
+	return locales
+}
+
+// fetchHomeLocale returns the language of the path the home of the
+// market cc redirects to, if any.
+func (c *max) fetchHomeLocale(ctx context.Context, cc string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://www.max.com/"+cc, nil)
+	if err != nil {
+		return "", fmt.Errorf("new: %w", err)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("do: %w", err)
+	}
+	res.Body.Close()
+
+	segments := strings.Split(strings.Trim(res.Request.URL.Path, "/"), "/")
+	if len(segments) >= 2 && segments[0] == cc && len(segments[1]) == 2 {
+		return segments[1], nil
+	}
+
+	return "", nil
+}
+
+var errSiteMapNotFound = errors.New("status 404 Not Found")
+
+// fetchSiteMap fetches the first page of the sitemap of mediaType in the
+// first of locales found, or else the global one, returning its URL.
+func (c *max) fetchSiteMap(ctx context.Context, mediaType string, locales []string) (string, io.ReadCloser, error) {
+	cc := strings.ToLower(c.config.CountryCode)
+
+	var candidates []string
+	for _, l := range locales {
+		candidates = append(candidates, fmt.Sprintf("https://www.max.com/%s/%s/sitemap/%s", cc, l, mediaType))
+	}
+	candidates = append(candidates, "https://www.max.com/sitemap/"+mediaType)
+
+	for _, u := range candidates {
+		body, err := c.fetchSiteMapPage(ctx, u)
+		if errors.Is(err, errSiteMapNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		return u, body, nil
+	}
+
+	return "", nil, errSiteMapNotFound
+}
+
+func (c *max) fetchSiteMapPage(ctx context.Context, u string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new: %w", err)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+
+		if res.StatusCode == http.StatusNotFound {
+			return nil, errSiteMapNotFound
+		}
+
+		return nil, fmt.Errorf("status %s", res.Status)
+	}
+
+	return res.Body, nil
+}
+
+// extractURLs extracts the URLs of titles of mediaType from the sitemap,
+// following its pages (?page=N) as long as linked.
+func (c *max) extractURLs(ctx context.Context, mediaType string, locales []string) ([]string, error) {
+	base, body, err := c.fetchSiteMap(ctx, mediaType, locales)
+	if err != nil {
+		return nil, fmt.Errorf("fetch sitemap: %w", err)
+	}
+
+	var (
+		urls     []string
+		seen     = make(map[string]struct{})
+		lastPage = 1
+		page     = 1
+	)
+	for ; page <= lastPage; page++ {
+		if page > 1 {
+			body, err = c.fetchSiteMapPage(ctx, base+"?page="+strconv.Itoa(page))
+			if err != nil {
+				return nil, fmt.Errorf("fetch sitemap page %d: %w", page, err)
+			}
+		}
+
+		doc, err := html.Parse(body)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("html parse page %d: %w", page, err)
+		}
+
+		for ch := range doc.Descendants() {
+			if ch.Type != html.ElementNode || ch.Data != "a" {
+				continue
+			}
+			for _, attr := range ch.Attr {
+				if attr.Key != "href" {
+					continue
+				}
+				if n := sitemapPage(base, attr.Val); n > lastPage {
+					lastPage = n
+				}
+				u := "https://www.max.com" + attr.Val
+				if _, ok := seen[u]; ok || !c.regex.MatchString(u) {
+					continue
+				}
+				seen[u] = struct{}{}
+				urls = append(urls, u)
+			}
+		}
+	}
+
+	if c.config.Verbose {
+		log.Printf("max: %d %s from %d sitemap page(s) of %s\n", len(urls), mediaType, page-1, base)
+	}
+
+	return urls, nil
+}
+
+// sitemapPage returns the number of the page of the sitemap at base that
+// href links to, or 0 if not one.
+func sitemapPage(base, href string) int {
+	b, err := urlpkg.Parse(base)
+	if err != nil {
+		return 0
+	}
+	u, err := b.Parse(href)
+	if err != nil || u.Host != b.Host || strings.TrimSuffix(u.Path, "/") != b.Path {
+		return 0
+	}
+	n, err := strconv.Atoi(u.Query().Get("page"))
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,281 @@
+package max
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	urlpkg "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"karl/pkg/config"
+	"karl/pkg/service/wbd"
+)
+
+var _ wbd.TokenSource = (*tokenSource)(nil)
+
+// tokenSource provides the token required by the API in most regions. A
+// user token (st cookie of the API host) is preferred, otherwise an
+// anonymous one is obtained as by the web player, for a generated
+// device, and reused until rejected or expired, across runs if kept in
+// the cache directory.
+type tokenSource struct {
+	config     *config.AppConfig
+	httpClient *http.Client
+	origin     string
+	apiBase    string
+	deviceID   string
+
+	mu    sync.Mutex
+	token string
+	user  bool
+}
+
+func newTokenSource(config *config.AppConfig, httpClient *http.Client, origin, apiBase string) *tokenSource {
+	return &tokenSource{
+		config:     config,
+		httpClient: httpClient,
+		origin:     origin,
+		apiBase:    apiBase,
+		deviceID:   newDeviceID(),
+	}
+}
+
+func (ts *tokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" {
+		return ts.token, nil
+	}
+
+	if jar := ts.config.CookieJar; jar != nil {
+		u, _ := urlpkg.Parse(ts.apiBase)
+		for _, ck := range jar.Cookies(u) {
+			if ck.Name == "st" {
+				ts.token, ts.user = ck.Value, true
+				return ts.token, nil
+			}
+		}
+	}
+
+	if t, ok := ts.loadToken(); ok {
+		ts.token, ts.deviceID = t.Token, t.DeviceID
+		ts.setCookie(t.Token)
+		return ts.token, nil
+	}
+
+	return ts.bootstrap(ctx)
+}
+
+func (ts *tokenSource) Refresh(ctx context.Context, rejected string) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.user {
+		return "", errors.New("user token (st cookie) rejected")
+	}
+	// Already refreshed by another request.
+	if ts.token != rejected {
+		return ts.token, nil
+	}
+
+	return ts.bootstrap(ctx)
+}
+
+// bootstrap obtains an anonymous token for the device and starts a
+// session with it, keeping it in the cookie jar for the API host as the
+// web player does.
+func (ts *tokenSource) bootstrap(ctx context.Context) (string, error) {
+	token, err := ts.fetchToken(ctx)
+	if err != nil {
+		return "", fmt.Errorf("fetch token: %w", err)
+	}
+	if err := ts.fetchBootstrap(ctx, token); err != nil {
+		return "", fmt.Errorf("bootstrap: %w", err)
+	}
+
+	ts.setCookie(token)
+	ts.token = token
+	if err := ts.saveToken(token); err != nil && ts.config.Verbose {
+		log.Printf("max: keep token: %v\n", err)
+	}
+
+	return token, nil
+}
+
+func (ts *tokenSource) setCookie(token string) {
+	if jar := ts.config.CookieJar; jar != nil {
+		u, _ := urlpkg.Parse(ts.apiBase)
+		jar.SetCookies(u, []*http.Cookie{{Name: "st", Value: token, Path: "/"}})
+	}
+}
+
+const (
+	// tokenFile is the name of the file of the anonymous token in the
+	// cache directory.
+	tokenFile = "max_token.json"
+	// tokenTTL is how long an anonymous token is kept, unless it tells
+	// when it expires.
+	tokenTTL = 24 * time.Hour
+)
+
+// keptToken is an anonymous token kept across runs, with the device and
+// the country it was obtained for.
+type keptToken struct {
+	Token    string    `json:"token"`
+	DeviceID string    `json:"device_id"`
+	Country  string    `json:"country"`
+	Expires  time.Time `json:"expires"`
+}
+
+// loadToken returns the token kept in the cache directory, if any, of
+// the country and not about to expire.
+func (ts *tokenSource) loadToken() (keptToken, bool) {
+	if ts.config.CacheDir == "" {
+		return keptToken{}, false
+	}
+	b, err := os.ReadFile(filepath.Join(ts.config.CacheDir, tokenFile))
+	if err != nil {
+		return keptToken{}, false
+	}
+	var t keptToken
+	if err := json.Unmarshal(b, &t); err != nil || t.Token == "" || t.DeviceID == "" {
+		return keptToken{}, false
+	}
+	if t.Country != ts.config.CountryCode || time.Until(t.Expires) < time.Minute {
+		return keptToken{}, false
+	}
+	return t, true
+}
+
+// saveToken keeps token in the cache directory, if any, until it
+// expires.
+func (ts *tokenSource) saveToken(token string) error {
+	if ts.config.CacheDir == "" {
+		return nil
+	}
+	b, err := json.Marshal(keptToken{
+		Token:    token,
+		DeviceID: ts.deviceID,
+		Country:  ts.config.CountryCode,
+		Expires:  tokenExpiry(token, time.Now()),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ts.config.CacheDir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(ts.config.CacheDir, tokenFile), b, 0o600)
+}
+
+// tokenExpiry returns when token, obtained at now, expires: its exp
+// claim if a JWT, else after tokenTTL.
+func tokenExpiry(token string, now time.Time) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		var claims struct {
+			Exp int64 `json:"exp"`
+		}
+		if b, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil && json.Unmarshal(b, &claims) == nil && claims.Exp > 0 {
+			return time.Unix(claims.Exp, 0)
+		}
+	}
+	return now.Add(tokenTTL)
+}
+
+func (ts *tokenSource) fetchToken(ctx context.Context) (string, error) {
+	query := urlpkg.Values{
+		"realm":    {"bolt"},
+		"deviceId": {ts.deviceID},
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		ts.apiBase+"/token?"+query.Encode(),
+		nil,
+	)
+	if err != nil {
+		return "", fmt.Errorf("new: %w", err)
+	}
+
+	ts.setHeaders(req)
+
+	res, err := ts.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", res.Status)
+	}
+
+	var r struct {
+		Data struct {
+			Attributes struct {
+				Token string `json:"token"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return "", fmt.Errorf("decode body: %w", err)
+	}
+	if r.Data.Attributes.Token == "" {
+		return "", errors.New("empty token")
+	}
+
+	return r.Data.Attributes.Token, nil
+}
+
+func (ts *tokenSource) fetchBootstrap(ctx context.Context, token string) error {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		ts.apiBase+"/session-context/headwaiter/v1/bootstrap",
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("new: %w", err)
+	}
+
+	ts.setHeaders(req)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := ts.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", res.Status)
+	}
+
+	return nil
+}
+
+func (ts *tokenSource) setHeaders(req *http.Request) {
+	req.Header.Set("Origin", ts.origin)
+	req.Header.Set("Referer", ts.origin+"/")
+	req.Header.Set("X-Device-Info", "beam/5.0.0 (desktop/desktop; Windows/10; "+ts.deviceID+"/"+ts.deviceID+")")
+	req.Header.Set("X-Disco-Client", "WEB:10:beam:5.0.0")
+}
+
+// newDeviceID returns a random (version 4) UUID.
+func newDeviceID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
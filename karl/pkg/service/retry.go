@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"karl/pkg/config"
+)
+
+const (
+	// maxRetryBackoff caps the backoff between retries.
+	maxRetryBackoff = 10 * time.Second
+	// maxRetryAfter caps the wait requested by Retry-After headers.
+	maxRetryAfter = time.Minute
+)
+
+// statusError is returned for a response of unexpected status.
+type statusError struct {
+	code   int
+	status string
+}
+
+func newStatusError(res *http.Response) *statusError {
+	return &statusError{code: res.StatusCode, status: res.Status}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status %s", e.status)
+}
+
+// isRetryable returns whether err may be transient: a timeout, server
+// error, throttling or connection error. Errors of requests that would
+// fail the same way again (e.g. a host not found, a certificate not
+// verified or too many redirects) aren't, though *url.Error is a
+// net.Error.
+func isRetryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusRequestTimeout || se.code == http.StatusTooManyRequests
+	}
+	var (
+		dnsErr  *net.DNSError
+		certErr *tls.CertificateVerificationError
+	)
+	if (errors.As(err, &dnsErr) && dnsErr.IsNotFound) || errors.As(err, &certErr) {
+		return false
+	}
+	var (
+		netErr net.Error
+		opErr  *net.OpError
+	)
+	return errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) ||
+		errors.As(err, &opErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// isPermanent returns whether err is of a resource that's gone or
+// forbidden, which for segments is usually an expired manifest token.
+func isPermanent(err error) bool {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	switch se.code {
+	case http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// retryBackoff returns the time to wait before retry try (from 0), at
+// random up to the configured backoff doubled for each try ("full
+// jitter").
+func retryBackoff(config *config.AppConfig, try int) time.Duration {
+	d := min(config.RetryBackoff<<min(try, 16), maxRetryBackoff)
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// SleepRetry waits before retry try, returning early with the error of
+// ctx if done.
+func SleepRetry(ctx context.Context, config *config.AppConfig, try int) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(retryBackoff(config, try)):
+		return nil
+	}
+}
+
+// maxStealthDelay is the most a stealthy request is delayed by.
+const maxStealthDelay = 500 * time.Millisecond
+
+// sleepStealth sleeps for a random delay up to maxStealthDelay, or until
+// ctx is done, for requests not to come at a regular pace.
+func sleepStealth(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(rand.Int63n(int64(maxStealthDelay)))):
+		return nil
+	}
+}
+
+// RetryDelay returns whether to retry a request of try (from 0) that
+// failed with err, or was responded res, and after how long: transient
+// failures, up to the configured retries. The wait requested by
+// Retry-After (e.g. when throttled) is honored, up to a minute.
+func RetryDelay(config *config.AppConfig, try int, res *http.Response, err error) (time.Duration, bool) {
+	if try >= config.Retries {
+		return 0, false
+	}
+	if err != nil {
+		return retryBackoff(config, try), isRetryable(err)
+	}
+	if !isRetryable(newStatusError(res)) {
+		return 0, false
+	}
+	if d, ok := retryAfter(res); ok {
+		return d, true
+	}
+	return retryBackoff(config, try), true
+}
+
+// retryAfter returns the wait requested by the Retry-After header of res,
+// in seconds or until a date, if any.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	v := res.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return min(time.Duration(s)*time.Second, maxRetryAfter), true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return min(max(time.Until(t), 0), maxRetryAfter), true
+	}
+	return 0, false
+}
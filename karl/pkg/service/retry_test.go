@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+)
+
+func TestIsRetryable(t *testing.T) {
+	// As returned by http.Client.Do.
+	do := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://cdn.example.com/seg1.m4s", Err: err}
+	}
+	status := func(code int) error {
+		return fmt.Errorf("fetch segment: %w", &statusError{code: code, status: fmt.Sprintf("%d %s", code, http.StatusText(code))})
+	}
+
+	for _, tt := range []struct {
+		name      string
+		err       error
+		retryable bool
+		permanent bool
+	}{
+		{"server error", status(http.StatusBadGateway), true, false},
+		{"request timeout", status(http.StatusRequestTimeout), true, false},
+		{"throttled", status(http.StatusTooManyRequests), true, false},
+		{"forbidden", status(http.StatusForbidden), false, true},
+		{"not found", status(http.StatusNotFound), false, true},
+		{"gone", status(http.StatusGone), false, true},
+		{"bad request", status(http.StatusBadRequest), false, false},
+		{"deadline", context.DeadlineExceeded, true, false},
+		{"timeout", do(timeoutError{}), true, false},
+		{"connection refused", do(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), true, false},
+		{"connection reset", do(fmt.Errorf("read: %w", syscall.ECONNRESET)), true, false},
+		{"unexpected eof", do(io.ErrUnexpectedEOF), true, false},
+		{"host not found", do(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "cdn.example.com", IsNotFound: true}}), false, false},
+		{"dns timeout", do(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "i/o timeout", Name: "cdn.example.com", IsTimeout: true}}), true, false},
+		{"certificate", do(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), false, false},
+		{"unsupported scheme", do(errors.New(`unsupported protocol scheme "ftp"`)), false, false},
+		{"too many redirects", do(errors.New("stopped after 10 redirects")), false, false},
+		{"cancelled", do(context.Canceled), false, false},
+	} {
+		if got := isRetryable(tt.err); got != tt.retryable {
+			t.Errorf("%s: retryable = %t, want %t", tt.name, got, tt.retryable)
+		}
+		if got := isPermanent(tt.err); got != tt.permanent {
+			t.Errorf("%s: permanent = %t, want %t", tt.name, got, tt.permanent)
+		}
+	}
+}
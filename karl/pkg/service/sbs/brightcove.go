@@ -0,0 +1,225 @@
+package sbs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"karl/pkg/model"
+	"karl/pkg/service"
+)
+
+// Videos are played by a Brightcove player, embedded in their pages,
+// which requests playback of the Brightcove video from the playback API
+// with the policy key of the player.
+
+// maxPageSize is the most read of a page, the player embedded early.
+const maxPageSize = 4 << 20
+
+var (
+	playerRegex  = regexp.MustCompile(`players\.brightcove\.net/(\d+)/([A-Za-z0-9_-]+?)_default`)
+	videoIDRegex = regexp.MustCompile(`data-video-id="([^"]+)"`)
+)
+
+type player struct {
+	AccountID string
+	PlayerID  string
+	// VideoID is of the Brightcove video, or its reference ID
+	// ("ref:...").
+	VideoID string
+}
+
+// fetchPlayer fetches the page of video id and returns the player
+// embedded in it.
+func (c *sbs) fetchPlayer(ctx context.Context, id string) (player, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.origin+"/ondemand/watch/"+id, nil)
+	if err != nil {
+		return player{}, fmt.Errorf("new: %w", err)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return player{}, fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return player{}, fmt.Errorf("status %s", res.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxPageSize))
+	if err != nil {
+		return player{}, fmt.Errorf("read body: %w", err)
+	}
+
+	m := playerRegex.FindSubmatch(b)
+	if m == nil {
+		return player{}, errors.New("no brightcove player")
+	}
+	p := player{
+		AccountID: string(m[1]),
+		PlayerID:  string(m[2]),
+		VideoID:   "ref:" + id,
+	}
+	if m := videoIDRegex.FindSubmatch(b); m != nil {
+		p.VideoID = string(m[1])
+	}
+
+	return p, nil
+}
+
+// policyKey returns the policy key of the player, authorizing playback
+// requests, fetched from its configuration once.
+func (c *sbs) policyKey(ctx context.Context, p player) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := p.AccountID + "/" + p.PlayerID
+	if pk, ok := c.policyKeys[key]; ok {
+		return pk, nil
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		"https://players.brightcove.net/"+key+"_default/config.json",
+		nil,
+	)
+	if err != nil {
+		return "", fmt.Errorf("new: %w", err)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", res.Status)
+	}
+
+	var r struct {
+		VideoCloud struct {
+			PolicyKey string `json:"policy_key"`
+		} `json:"video_cloud"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return "", fmt.Errorf("decode body: %w", err)
+	}
+	if r.VideoCloud.PolicyKey == "" {
+		return "", errors.New("empty policy key")
+	}
+	c.policyKeys[key] = r.VideoCloud.PolicyKey
+
+	return r.VideoCloud.PolicyKey, nil
+}
+
+type (
+	playbackResponse struct {
+		ID       string  `json:"id"`
+		Name     string  `json:"name"`
+		Duration float64 `json:"duration"`
+
+		Sources []struct {
+			Src  string `json:"src"`
+			Type string `json:"type"`
+		} `json:"sources"`
+	}
+
+	playbackError struct {
+		ErrorCode    string `json:"error_code"`
+		ErrorSubcode string `json:"error_subcode"`
+		Message      string `json:"message"`
+	}
+)
+
+// fetchPlayback fetches the playback (sources and metadata) of the video
+// of p from the playback API.
+func (c *sbs) fetchPlayback(ctx context.Context, p player) (*playbackResponse, error) {
+	pk, err := c.policyKey(ctx, p)
+	if err != nil {
+		return nil, fmt.Errorf("policy key: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		"https://edge.api.brightcove.com/playback/v1/accounts/"+p.AccountID+"/videos/"+p.VideoID,
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json;pk="+pk)
+	req.Header.Set("Origin", c.origin)
+	req.Header.Set("Referer", c.origin+"/")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, c.playbackError(res)
+	}
+
+	var r playbackResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
+	}
+
+	return &r, nil
+}
+
+// playbackError returns the error of an unsuccessful playback response,
+// as geo-blocked if refused for the location of the client (CLIENT_GEO).
+func (c *sbs) playbackError(res *http.Response) error {
+	var errs []playbackError
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<16)).Decode(&errs); err != nil || len(errs) == 0 {
+		return fmt.Errorf("status %s", res.Status)
+	}
+
+	e := errs[0]
+	if e.ErrorSubcode == "CLIENT_GEO" {
+		return fmt.Errorf("status %s: %w", res.Status, &service.GeoBlockedError{Country: c.config.CountryCode, Reason: e.ErrorSubcode})
+	}
+	return fmt.Errorf("status %s: %s: %s", res.Status, e.ErrorCode, e.Message)
+}
+
+// references returns a reference of the first HTTPS source of each
+// format. Sources are duplicated per protocol and key system.
+func (r *playbackResponse) references() []model.Reference {
+	var refs []model.Reference
+	for _, s := range r.Sources {
+		var format string
+		switch strings.ToLower(s.Type) {
+		case "application/dash+xml":
+			format = "dash"
+		case "application/x-mpegurl", "application/vnd.apple.mpegurl":
+			format = "hls"
+		default:
+			continue
+		}
+		if !strings.HasPrefix(s.Src, "https://") {
+			continue
+		}
+		if slices.ContainsFunc(refs, func(ref model.Reference) bool { return ref.Format == format }) {
+			continue
+		}
+		refs = append(refs, model.Reference{
+			ID:     r.ID,
+			Format: format,
+			URL:    s.Src,
+		})
+	}
+	return refs
+}
@@ -0,0 +1,236 @@
+package sbs
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service"
+)
+
+var (
+	_ service.Client            = (*sbs)(nil)
+	_ service.URLExtractor      = (*sbs)(nil)
+	_ service.JustWatchProvider = (*sbs)(nil)
+	_ service.VideoExtractor    = (*sbs)(nil)
+	_ service.VariantExtractor  = (*sbs)(nil)
+	_ service.Fingerprinter     = (*sbs)(nil)
+)
+
+type sbs struct {
+	config            *config.AppConfig
+	httpClient        *http.Client
+	index             *service.IndexCache
+	regex             *regexp.Regexp
+	origin            string
+	justWatchPackages []string
+
+	mu         sync.Mutex
+	policyKeys map[string]string
+}
+
+func init() {
+	service.Register(New)
+}
+
+func New(config *config.AppConfig, httpClient *http.Client) service.Client {
+	return &sbs{
+		config:     config,
+		httpClient: httpClient,
+		index:      service.NewIndexCache(),
+		// Videos, of episodes or movies. Series (tv-program/<slug>/<id>)
+		// aren't videos themselves and aren't matched.
+		regex: regexp.MustCompile(
+			`^https?://(?:www\.)?sbs\.com\.au/ondemand/(?:watch|movie/[a-z0-9-]+)/(\d+)`,
+		),
+		origin:            "https://www.sbs.com.au",
+		justWatchPackages: []string{"sbs"},
+		policyKeys:        make(map[string]string),
+	}
+}
+
+func (c *sbs) ID() service.ID {
+	return "sbs"
+}
+
+func (c *sbs) ExtractURLs(ctx context.Context) ([]string, error) {
+	var (
+		urls []string
+		seen = make(map[string]struct{})
+		mu   sync.Mutex
+	)
+	err := c.walkSitemap(ctx, c.origin+"/ondemand/sitemap.xml", func(loc string) {
+		if !c.regex.MatchString(loc) {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := seen[loc]; !ok {
+			seen[loc] = struct{}{}
+			urls = append(urls, loc)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sitemap: %w", err)
+	}
+	slices.Sort(urls)
+
+	return urls, nil
+}
+
+func (c *sbs) JustWatchPackages() []string {
+	return c.justWatchPackages
+}
+
+func (c *sbs) Matches(url string) bool {
+	return c.regex.MatchString(url)
+}
+
+func (c *sbs) VideoExtract(ctx context.Context, url string) []model.VideoResult {
+	var results []model.VideoResult
+
+	for r := range c.extract(ctx, url) {
+		results = append(results, r)
+	}
+
+	return results
+}
+
+func (c *sbs) ExtractVariants(ctx context.Context, reference model.Reference) ([]model.Variant, error) {
+	return service.NewDefaultVariantExtractor(c.config, c.httpClient, c.origin).ExtractVariants(ctx, reference)
+}
+
+func (c *sbs) Fingerprint(ctx context.Context, variant model.Variant) (model.Fingerprint, error) {
+	return service.NewDefaultFingerprinter(c.config, c.httpClient, c.origin, c.index).Fingerprint(ctx, variant)
+}
+
+func (c *sbs) extract(ctx context.Context, url string) <-chan model.VideoResult {
+	results := make(chan model.VideoResult)
+
+	m := c.regex.FindStringSubmatch(url)
+
+	go func() {
+		defer close(results)
+
+		if m == nil {
+			results <- model.VideoResult{Err: fmt.Errorf("unsupported url %q", url)}
+			return
+		}
+		c.sendVideo(ctx, m[1], results)
+	}()
+
+	return results
+}
+
+func (c *sbs) sendVideo(ctx context.Context, id string, results chan<- model.VideoResult) {
+	p, err := c.fetchPlayer(ctx, id)
+	if err != nil {
+		results <- model.VideoResult{Err: fmt.Errorf("fetch player %q: %w", id, err)}
+		return
+	}
+
+	v, err := c.fetchPlayback(ctx, p)
+	if err != nil {
+		results <- model.VideoResult{Err: fmt.Errorf("fetch playback %q: %w", id, err)}
+		return
+	}
+
+	refs := v.references()
+	if len(refs) == 0 {
+		results <- model.VideoResult{Err: fmt.Errorf("playback %q: no manifest", id)}
+		return
+	}
+
+	results <- model.VideoResult{
+		Video: model.Video{
+			ID:          id,
+			Title:       v.Name,
+			PlaybackURL: c.origin + "/ondemand/watch/" + id,
+			Duration:    int32(v.Duration / 1000),
+		},
+		References: refs,
+	}
+}
+
+// walkSitemap calls visit with the location of each page of the sitemap
+// at u, following those of sitemap indexes. Each sitemap is fetched once,
+// however often listed, e.g. by an index listing itself.
+func (c *sbs) walkSitemap(ctx context.Context, u string, visit func(loc string)) error {
+	var (
+		mu      sync.Mutex
+		visited = make(map[string]struct{})
+		walk    func(ctx context.Context, u string) error
+	)
+	walk = func(ctx context.Context, u string) error {
+		mu.Lock()
+		_, ok := visited[u]
+		visited[u] = struct{}{}
+		mu.Unlock()
+		if ok {
+			return nil
+		}
+
+		r, err := c.fetchSitemap(ctx, u)
+		if err != nil {
+			return fmt.Errorf("fetch %q: %w", u, err)
+		}
+
+		for _, u := range r.URLs {
+			visit(u.Loc)
+		}
+
+		g, ctx := errgroup.WithContext(ctx)
+		g.SetLimit(service.VideoConcurrency(c.config))
+		for _, s := range r.Sitemaps {
+			g.Go(func() error {
+				return walk(ctx, s.Loc)
+			})
+		}
+
+		return g.Wait()
+	}
+
+	return walk(ctx, u)
+}
+
+// sitemapResponse is a sitemap index, listing sitemaps, or a sitemap
+// (urlset), listing pages.
+type sitemapResponse struct {
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+}
+
+func (c *sbs) fetchSitemap(ctx context.Context, u string) (*sitemapResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new: %w", err)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", res.Status)
+	}
+
+	var r sitemapResponse
+	if err := xml.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
+	}
+
+	return &r, nil
+}
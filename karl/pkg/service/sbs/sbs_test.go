@@ -0,0 +1,172 @@
+package sbs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service"
+	"karl/pkg/service/internal/servicetest"
+)
+
+// apiTransport serves the pages, sitemaps, player configuration and
+// playback fixtures, counting the requests of each path. Playback of
+// the video geoBlocked is refused for the location of the client.
+func apiTransport(t *testing.T, requests map[string]*atomic.Int32, geoBlocked string) servicetest.RoundTripFunc {
+	pages := map[string]string{
+		"/ondemand/watch/2254729795960": "watch.html",
+		"/ondemand/watch/1878925379625": "movie.html",
+	}
+	return func(r *http.Request) (*http.Response, error) {
+		if n, ok := requests[r.URL.Path]; ok {
+			n.Add(1)
+		}
+		var name string
+		switch p := r.URL.Path; {
+		case r.URL.Host == "www.sbs.com.au" && pages[p] != "":
+			name = pages[p]
+		case r.URL.Host == "www.sbs.com.au" && strings.HasPrefix(p, "/ondemand/sitemap"):
+			name = path.Base(p)
+		case r.URL.Host == "players.brightcove.net" && p == "/6058004172001/HJH2fAy1l_default/config.json":
+			name = "config.json"
+		case r.URL.Host == "edge.api.brightcove.com" && strings.HasPrefix(p, "/playback/v1/accounts/6058004172001/videos/"):
+			if pk := r.Header.Get("Accept"); pk != "application/json;pk=BCpkADawqM1policykey" {
+				t.Errorf("accept %q, want of the policy key", pk)
+			}
+			if path.Base(p) == geoBlocked {
+				body := `[{"error_code":"ACCESS_DENIED","error_subcode":"CLIENT_GEO","message":"Access to this resource is forbidden by access policy."}]`
+				return &http.Response{StatusCode: http.StatusForbidden, Status: "403 Forbidden", Body: io.NopCloser(strings.NewReader(body))}, nil
+			}
+			name = "playback.json"
+		}
+		f, err := os.Open("../../../testdata/sbs/" + name)
+		if name == "" || errors.Is(err, os.ErrNotExist) {
+			return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Body: http.NoBody}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: f}, nil
+	}
+}
+
+func TestMatches(t *testing.T) {
+	c := New(nil, nil).(*sbs)
+	for _, tt := range []struct {
+		url string
+		id  string
+	}{
+		{"https://www.sbs.com.au/ondemand/watch/2254729795960", "2254729795960"},
+		{"https://sbs.com.au/ondemand/watch/2254729795960", "2254729795960"},
+		{"https://www.sbs.com.au/ondemand/movie/the-hunt/1878925379625", "1878925379625"},
+		// Series aren't videos.
+		{"https://www.sbs.com.au/ondemand/tv-program/alone-australia/2185463875887", ""},
+		{"https://www.sbs.com.au/ondemand/tv-series/alone-australia", ""},
+		// Of other hosts, merely mentioning one.
+		{"https://example.com/?u=sbs.com.au/ondemand/watch/2254729795960", ""},
+		{"https://www.notsbs.com.au/ondemand/watch/2254729795960", ""},
+	} {
+		m := c.regex.FindStringSubmatch(tt.url)
+		if tt.id == "" {
+			if m != nil {
+				t.Errorf("%s: matched %q", tt.url, m)
+			}
+			continue
+		}
+		if m == nil || m[1] != tt.id {
+			t.Errorf("%s: %q, want %s", tt.url, m, tt.id)
+		}
+	}
+}
+
+func TestVideoExtract(t *testing.T) {
+	requests := map[string]*atomic.Int32{"/6058004172001/HJH2fAy1l_default/config.json": new(atomic.Int32)}
+	c := New(&config.AppConfig{CountryCode: "AU"}, &http.Client{Transport: apiTransport(t, requests, "")}).(*sbs)
+
+	rs := c.VideoExtract(context.Background(), "https://www.sbs.com.au/ondemand/watch/2254729795960")
+	if len(rs) != 1 || rs[0].Err != nil {
+		t.Fatalf("results %+v, want a video", rs)
+	}
+	want := model.Video{
+		ID:          "2254729795960",
+		Title:       "Alone Australia S2 Ep1",
+		PlaybackURL: "https://www.sbs.com.au/ondemand/watch/2254729795960",
+		Duration:    2653,
+	}
+	if !reflect.DeepEqual(rs[0].Video, want) {
+		t.Errorf("video %+v, want %+v", rs[0].Video, want)
+	}
+	// The first HTTPS source of each format.
+	wantRefs := []model.Reference{
+		{ID: "6338495402112", Format: "dash", URL: "https://sbsvod-f.akamaihd.net/6338495402112/manifest.mpd"},
+		{ID: "6338495402112", Format: "hls", URL: "https://sbsvod-f.akamaihd.net/6338495402112/master.m3u8"},
+	}
+	if !reflect.DeepEqual(rs[0].References, wantRefs) {
+		t.Errorf("references %+v, want %+v", rs[0].References, wantRefs)
+	}
+
+	// Of a page without a video ID, the video is referenced by its ID.
+	p, err := c.fetchPlayer(context.Background(), "1878925379625")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (player{AccountID: "6058004172001", PlayerID: "HJH2fAy1l", VideoID: "ref:1878925379625"}); p != want {
+		t.Errorf("player %+v, want %+v", p, want)
+	}
+	if _, err := c.fetchPlayback(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests["/6058004172001/HJH2fAy1l_default/config.json"].Load(); n != 1 {
+		t.Errorf("config fetched %d times, want the policy key of the player once", n)
+	}
+}
+
+func TestVideoExtractGeoBlocked(t *testing.T) {
+	c := New(&config.AppConfig{CountryCode: "SE"}, &http.Client{Transport: apiTransport(t, nil, "6338495402112")}).(*sbs)
+
+	rs := c.VideoExtract(context.Background(), "https://www.sbs.com.au/ondemand/watch/2254729795960")
+	var geo *service.GeoBlockedError
+	if len(rs) != 1 || !errors.As(rs[0].Err, &geo) {
+		t.Fatalf("results %+v, want geo-blocked", rs)
+	}
+	if geo.Country != "SE" || geo.Reason != "CLIENT_GEO" {
+		t.Errorf("geo-blocked %+v, want in SE for CLIENT_GEO", geo)
+	}
+}
+
+func TestExtractURLs(t *testing.T) {
+	requests := make(map[string]*atomic.Int32)
+	for _, p := range []string{"/ondemand/sitemap.xml", "/ondemand/sitemap-1.xml"} {
+		requests[p] = new(atomic.Int32)
+	}
+	c := New(&config.AppConfig{}, &http.Client{Transport: apiTransport(t, requests, "")}).(*sbs)
+
+	// The index lists itself, and another index lists a sitemap again.
+	urls, err := c.ExtractURLs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"https://www.sbs.com.au/ondemand/movie/the-hunt/1878925379625",
+		"https://www.sbs.com.au/ondemand/watch/1097215043882",
+		"https://www.sbs.com.au/ondemand/watch/2254729795960",
+	}
+	if !slices.Equal(urls, want) {
+		t.Errorf("urls %v, want %v", urls, want)
+	}
+	for p, n := range requests {
+		if n.Load() != 1 {
+			t.Errorf("%s fetched %d times, want once", p, n.Load())
+		}
+	}
+}
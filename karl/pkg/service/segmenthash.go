@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+	"karl/pkg/model"
+)
+
+// segmentHashAlgorithm names the segment hashes: the first 8 bytes of
+// the SHA-256 of the segment, hex encoded.
+const segmentHashAlgorithm = "sha256-64"
+
+// segmentHasher tracks the hashing of the segments of a variant, limited
+// to the first (or all) segments and a cap on the bytes downloaded. The
+// bytes of segments of known size are reserved before they're
+// downloaded, so that concurrent downloads don't exceed the cap.
+type segmentHasher struct {
+	numSegments int
+	maxBytes    int64
+	bytes       atomic.Int64
+}
+
+// newSegmentHasher returns a hasher as configured, or nil if segments
+// aren't hashed.
+func (f *DefaultFingerprinter) newSegmentHasher() *segmentHasher {
+	if f.config.HashSegments == 0 {
+		return nil
+	}
+	return &segmentHasher{
+		numSegments: f.config.HashSegments,
+		maxBytes:    f.config.HashMaxBytes,
+	}
+}
+
+// wants returns whether segment i is to be hashed, which is false for
+// all once the cap is reached.
+func (h *segmentHasher) wants(i int) bool {
+	if h == nil || (h.numSegments > 0 && i >= h.numSegments) {
+		return false
+	}
+	return h.maxBytes <= 0 || h.bytes.Load() < h.maxBytes
+}
+
+// reserve reserves n bytes to download of the cap, returning false if
+// they'd exceed it.
+func (h *segmentHasher) reserve(n int64) bool {
+	for {
+		b := h.bytes.Load()
+		if h.maxBytes > 0 && b+n > h.maxBytes {
+			return false
+		}
+		if h.bytes.CompareAndSwap(b, b+n) {
+			return true
+		}
+	}
+}
+
+// init prepares fp for the hashes of its n segments.
+func (h *segmentHasher) init(fp *model.Fingerprint, n int) {
+	if h == nil {
+		return
+	}
+	if h.numSegments > 0 {
+		n = min(n, h.numSegments)
+	}
+	fp.HashAlgorithm = segmentHashAlgorithm
+	fp.SegmentHashes = make([]string, n)
+}
+
+// newHash returns a hash counting the bytes written.
+func newHash() *countingHash {
+	return &countingHash{Hash: sha256.New()}
+}
+
+type countingHash struct {
+	hash.Hash
+	n int64
+}
+
+func (c *countingHash) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return c.Hash.Write(p)
+}
+
+// sum returns the (truncated) hash, hex encoded.
+func (c *countingHash) sum() string {
+	return hex.EncodeToString(c.Sum(nil)[:8])
+}
+
+// fetchSegmentHash fetches the segment at url, returning its size and
+// hash. The segment isn't hashed (only sized) if its length would exceed
+// the cap of h. Segments without length (e.g. encoded) are only counted
+// as downloaded.
+func (f *DefaultFingerprinter) fetchSegmentHash(ctx context.Context, h *segmentHasher, url string) (int64, string, error) {
+	res, err := f.doRequest(ctx, http.MethodGet, url, "")
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, "", newStatusError(res)
+	}
+
+	enc := contentEncoding(res)
+	if enc != "" {
+		countEncoded(res.Request.URL.Host, enc)
+	}
+	sized := enc == "" && res.ContentLength >= 0
+	if sized && !h.reserve(res.ContentLength) {
+		return res.ContentLength, "", nil
+	}
+	body, err := decodeBody(res, enc)
+	if err != nil {
+		return 0, "", err
+	}
+	ch := newHash()
+	_, err = io.Copy(ch, f.throttle(ctx, body))
+	if !sized {
+		h.bytes.Add(ch.n)
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("read body: %w", err)
+	}
+
+	return ch.n, ch.sum(), nil
+}
+
+// hashIndexedSegments hashes the segments of fp, starting at offsets of
+// the file (or URL), by reading their byte ranges.
+func (f *DefaultFingerprinter) hashIndexedSegments(ctx context.Context, fp *model.Fingerprint, offsets []int64, file string, isURL bool) error {
+	h := f.newSegmentHasher()
+	if h == nil {
+		return nil
+	}
+	h.init(fp, len(fp.SegmentSizes))
+
+	for i := range fp.SegmentHashes {
+		size := int64(fp.SegmentSizes[i])
+		if !h.wants(i) || !h.reserve(size) {
+			break
+		}
+		sum, err := f.hashRange(ctx, file, isURL, offsets[i], size)
+		if err != nil {
+			return fmt.Errorf("hash segment %d: %w", i, err)
+		}
+		fp.SegmentHashes[i] = sum
+	}
+
+	return nil
+}
+
+// hashRange hashes size bytes at offset of the file (or URL).
+func (f *DefaultFingerprinter) hashRange(ctx context.Context, file string, isURL bool, offset, size int64) (string, error) {
+	var (
+		byteRange = fmt.Sprintf("%d-%d", offset, offset+size-1)
+		body      io.ReadCloser
+		err       error
+	)
+	if isURL {
+		body, err = f.openRange(ctx, file, byteRange)
+	} else {
+		body, err = openFileRange(file, byteRange)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+	if isURL {
+		r = f.throttle(ctx, body)
+	}
+	ch := newHash()
+	if _, err := io.Copy(ch, r); err != nil {
+		return "", fmt.Errorf("read body: %w", err)
+	}
+	if ch.n != size {
+		return "", fmt.Errorf("read %d of %d bytes", ch.n, size)
+	}
+
+	return ch.sum(), nil
+}
+
+// throttle returns r limited to the bandwidth configured, if any, for
+// segments downloaded to be hashed.
+func (f *DefaultFingerprinter) throttle(ctx context.Context, r io.Reader) io.Reader {
+	if f.config.BandwidthLimiter == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, limiter: f.config.BandwidthLimiter}
+}
+
+// throttledReader waits for the bytes read of its limiter, reading at
+// most its burst at a time.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if b := t.limiter.Burst(); len(p) > b {
+		p = p[:b]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if err := t.limiter.WaitN(t.ctx, n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
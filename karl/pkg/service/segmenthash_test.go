@@ -0,0 +1,147 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"karl/pkg/config"
+	"karl/pkg/model"
+)
+
+func truncatedHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+func TestSegmentHasherReserve(t *testing.T) {
+	h := &segmentHasher{maxBytes: 1000}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		reserved int
+	)
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if h.reserve(100) {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != 10 || h.bytes.Load() != 1000 {
+		t.Errorf("reserved %d (%d bytes), want 10 (1000 bytes)", reserved, h.bytes.Load())
+	}
+}
+
+func TestFetchSegmentHashCap(t *testing.T) {
+	segment := bytes.Repeat([]byte{1}, 400)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(segment)))
+		w.Write(segment)
+	}))
+	defer srv.Close()
+
+	f := NewDefaultFingerprinter(&config.AppConfig{HashSegments: -1, HashMaxBytes: 1000}, srv.Client(), "", nil)
+	h := f.newSegmentHasher()
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		hashed int
+	)
+	for i := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			size, sum, err := f.fetchSegmentHash(context.Background(), h, srv.URL+"/seg"+strconv.Itoa(i)+".ts")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if size != int64(len(segment)) {
+				t.Errorf("size %d, want %d", size, len(segment))
+			}
+			if sum != "" {
+				mu.Lock()
+				hashed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The cap fits 2 segments, however many are downloaded concurrently.
+	if hashed != 2 || h.bytes.Load() != 800 {
+		t.Errorf("hashed %d (%d bytes), want 2 (800 bytes)", hashed, h.bytes.Load())
+	}
+}
+
+func TestHashIndexedSegmentsLarge(t *testing.T) {
+	// Larger than an index is read (maxIndexSize), streamed instead.
+	const size = maxIndexSize + 1024
+	file := make([]byte, 2*size)
+	file[size] = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(file))
+	}))
+	defer srv.Close()
+
+	f := NewDefaultFingerprinter(&config.AppConfig{HashSegments: -1}, srv.Client(), "", nil)
+	fp := model.Fingerprint{SegmentSizes: []uint32{size, size}}
+	if err := f.hashIndexedSegments(context.Background(), &fp, []int64{0, size}, srv.URL+"/video.mp4", true); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{truncatedHash(file[:size]), truncatedHash(file[size:])}
+	for i := range want {
+		if fp.SegmentHashes[i] != want[i] {
+			t.Errorf("hash %d %s, want %s", i, fp.SegmentHashes[i], want[i])
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	const (
+		perSecond = 64 << 10
+		burst     = 8 << 10
+		n         = 24 << 10
+	)
+	f := NewDefaultFingerprinter(&config.AppConfig{
+		BandwidthLimiter: rate.NewLimiter(perSecond, burst),
+	}, http.DefaultClient, "", nil)
+
+	start := time.Now()
+	read, err := io.Copy(io.Discard, f.throttle(context.Background(), bytes.NewReader(make([]byte, n))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != n {
+		t.Errorf("read %d, want %d", read, n)
+	}
+	// The burst is free, the rest at the rate.
+	if elapsed, want := time.Since(start), time.Duration(n-burst)*time.Second/perSecond; elapsed < want*9/10 {
+		t.Errorf("read in %s, want at least %s", elapsed, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := io.Copy(io.Discard, f.throttle(ctx, bytes.NewReader(make([]byte, n)))); err == nil {
+		t.Error("read cancelled, want error")
+	}
+}
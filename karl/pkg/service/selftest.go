@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// SelfTester is implemented by clients with checks of their own, e.g.
+// obtaining a token, run by self-tests before extracting, so that
+// failures of authentication tell apart from those of content APIs.
+type SelfTester interface {
+	SelfTest(ctx context.Context) error
+}
+
+// SelfTestResult is the outcome of a self-test of a service.
+type SelfTestResult struct {
+	Service     ID
+	URL         string
+	Duration    time.Duration
+	NumVideos   int
+	NumVariants int
+	NumFailed   int
+	Err         error
+}
+
+// SelfTest checks that service works, by its own checks (if a
+// SelfTester) and by extracting and fingerprinting url through the full
+// pipeline. Failures, e.g. of url not being set, are returned in the
+// result.
+func (m *Manager) SelfTest(ctx context.Context, service ID, url, format string) SelfTestResult {
+	var (
+		result = SelfTestResult{Service: service, URL: url}
+		start  = time.Now()
+	)
+	result.Err = m.selfTest(ctx, &result, format)
+	result.Duration = time.Since(start)
+	return result
+}
+
+func (m *Manager) selfTest(ctx context.Context, result *SelfTestResult, format string) error {
+	c, ok := m.clients[result.Service]
+	if !ok {
+		return fmt.Errorf("unknown service %q", result.Service)
+	}
+	ve, ok := c.(VideoExtractor)
+	if !ok {
+		return fmt.Errorf("%q not video extractor", result.Service)
+	}
+
+	// Extracting the URLs of a service to pick one to test is as heavy as
+	// a full run (e.g. walking a sitemap), so a URL is required.
+	if result.URL == "" {
+		return fmt.Errorf("no URL to test, set one with --url %s=URL", result.Service)
+	}
+	if !ve.Matches(result.URL) {
+		return fmt.Errorf("%q not of service", result.URL)
+	}
+
+	if st, ok := c.(SelfTester); ok {
+		if err := st.SelfTest(ctx); err != nil {
+			return fmt.Errorf("self-test: %w", err)
+		}
+	}
+
+	pg, ctx := errgroup.WithContext(ctx)
+	pg.SetLimit(runtime.NumCPU())
+	extracted, err := m.Extract(ctx, pg, result.URL, format, nil)
+	for _, v := range extracted.Videos {
+		result.NumVideos++
+		result.NumVariants += len(v.Variants)
+	}
+	result.NumFailed = extracted.NumFailed
+	if err != nil {
+		if len(extracted.FailedErrors) > 0 {
+			return fmt.Errorf("%w (first failure: %w)", err, extracted.FailedErrors[0])
+		}
+		return err
+	}
+
+	return nil
+}
@@ -1,14 +1,23 @@
 package service
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"runtime/debug"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 	"karl/pkg/config"
@@ -40,8 +49,74 @@ type (
 	Fingerprinter interface {
 		Fingerprint(ctx context.Context, variant model.Variant) (model.Fingerprint, error)
 	}
+
+	// JustWatchProvider is implemented by clients with offers
+	// listed on JustWatch under the returned packages.
+	JustWatchProvider interface {
+		JustWatchPackages() []string
+	}
+
+	// MatchPrioritizer is implemented by video extractors matching URLs
+	// that others may match too, to be matched before them (higher) or
+	// after (lower, e.g. a generic fallback). Others have priority 0.
+	MatchPrioritizer interface {
+		MatchPriority() int
+	}
+
+	// ThrottleReporter is implemented by clients counting their requests
+	// throttled by the service during the run.
+	ThrottleReporter interface {
+		NumThrottled() int64
+	}
+
+	VideoWriter interface {
+		WriteVideo(video model.Video) error
+	}
+
+	// StreamFunc opens a writer that videos of an extraction are
+	// written to as they complete, rather than kept in the result.
+	StreamFunc func(service ID, url string) (VideoWriter, error)
+)
+
+// VariantHints label variants whose attributes are unknown,
+// e.g. the single variant of an HLS media playlist.
+type VariantHints struct {
+	Width     uint32
+	Height    uint32
+	Bandwidth uint32
+}
+
+func (h VariantHints) apply(v *model.Variant) {
+	if v.Width != 0 || v.Height != 0 || v.Bandwidth != 0 {
+		return
+	}
+	v.Width, v.Height, v.Bandwidth = h.Width, h.Height, h.Bandwidth
+	v.ID = computeID(v.MimeType, v.Codecs, v.Width, v.Height, v.Bandwidth, v.FrameRate)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []Constructor
 )
 
+// Register adds the constructor of a service to those registered with
+// each manager by the app. Called from the init function of the service
+// package, so that a service is added by importing it (blank, if only
+// for that).
+func Register(constructor Constructor) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, constructor)
+}
+
+// Registered returns the registered constructors, in order of
+// registration.
+func Registered() []Constructor {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return slices.Clone(registry)
+}
+
 type Manager struct {
 	config            *config.AppConfig
 	httpClient        *http.Client
@@ -50,6 +125,10 @@ type Manager struct {
 	videoExtractors   map[ID]VideoExtractor
 	variantExtractors map[ID]VariantExtractor
 	fingerprinters    map[ID]Fingerprinter
+	justWatchPackages []string
+	// matchOrder are the IDs of video extractors in the order URLs are
+	// matched against them: by priority, then by ID.
+	matchOrder []ID
 }
 
 func NewManager(httpClient *http.Client, config *config.AppConfig) *Manager {
@@ -90,6 +169,13 @@ func (m *Manager) register(constructor Constructor) ID {
 
 	if e, ok := c.(VideoExtractor); ok {
 		m.videoExtractors[id] = e
+		m.matchOrder = append(m.matchOrder, id)
+		slices.SortFunc(m.matchOrder, func(a, b ID) int {
+			return cmp.Or(
+				cmp.Compare(m.matchPriority(b), m.matchPriority(a)),
+				cmp.Compare(a, b),
+			)
+		})
 	}
 
 	if ve, ok := c.(VariantExtractor); ok {
@@ -100,18 +186,68 @@ func (m *Manager) register(constructor Constructor) ID {
 		m.fingerprinters[id] = f
 	}
 
+	if jp, ok := c.(JustWatchProvider); ok {
+		m.justWatchPackages = append(m.justWatchPackages, jp.JustWatchPackages()...)
+	}
+
 	return id
 }
 
+// matchURL returns the ID of the video extractor of u, the first in
+// order of priority matching it.
 func (m *Manager) matchURL(u string) (ID, bool) {
-	for id, ve := range m.videoExtractors {
-		if ve.Matches(u) {
+	for _, id := range m.matchOrder {
+		if m.videoExtractors[id].Matches(u) {
 			return id, true
 		}
 	}
 	return "", false
 }
 
+// Throttled returns the number of requests throttled during the run, by
+// service, of those throttled at all.
+func (m *Manager) Throttled() map[ID]int64 {
+	throttled := make(map[ID]int64)
+	for id, c := range m.clients {
+		if r, ok := c.(ThrottleReporter); ok {
+			if n := r.NumThrottled(); n > 0 {
+				throttled[id] = n
+			}
+		}
+	}
+	return throttled
+}
+
+func (m *Manager) matchPriority(id ID) int {
+	if p, ok := m.clients[id].(MatchPrioritizer); ok {
+		return p.MatchPriority()
+	}
+	return 0
+}
+
+// resolveExternalID resolves an IMDb ("imdb:tt1234567") or TMDB
+// ("tmdb:movie/123") ID to the URL of a registered service offering it.
+func (m *Manager) resolveExternalID(ctx context.Context, externalID string) (string, error) {
+	provider, id, _ := strings.Cut(externalID, ":")
+
+	urls, err := NewJustWatchURLExtractor(m.config, m.httpClient, m.justWatchPackages).ExtractTitleURLs(ctx, provider, id)
+	if err != nil {
+		return "", fmt.Errorf("resolve %q: %w", externalID, err)
+	}
+
+	for _, u := range urls {
+		if _, ok := m.matchURL(u); ok {
+			return u, nil
+		}
+	}
+
+	return "", fmt.Errorf("%q not offered on any registered service", externalID)
+}
+
+func isExternalID(s string) bool {
+	return strings.HasPrefix(s, "imdb:") || strings.HasPrefix(s, "tmdb:")
+}
+
 func (m *Manager) ExtractURLs(ctx context.Context, service ID) (model.URLExtractResult, error) {
 	ue, ok := m.urlExtractors[service]
 	if !ok {
@@ -129,31 +265,104 @@ func (m *Manager) ExtractURLs(ctx context.Context, service ID) (model.URLExtract
 	}, nil
 }
 
-func (m *Manager) Extract(ctx context.Context, pg *errgroup.Group, url, format string) (model.ExtractResult, error) {
+// Extract extracts and fingerprints the videos of url. The returned result
+// always carries the URL and matched service, even on error. If stream is
+// non-nil and the number of videos exceeds the configured stream
+// threshold, videos are written to the opened stream instead of
+// being collected in the result. A panic (e.g. of a service client
+// parsing a response of unexpected shape) fails url, or only the video,
+// rather than the run. Goroutines of service clients themselves must
+// recover on their own.
+func (m *Manager) Extract(ctx context.Context, pg *errgroup.Group, url, format string, stream StreamFunc) (result model.ExtractResult, err error) {
+	var numVideos int
+	// Deferred first to observe the outcome of a panic recovered.
+	defer func() {
+		if result.Service != "" {
+			m.config.Metrics.ObserveExtract(result.Service, err == nil, numVideos, result.NumFailed)
+		}
+	}()
+	defer m.recoverPanic(&err)
+	result = model.ExtractResult{URL: url}
+
+	if isExternalID(url) {
+		u, err := m.resolveExternalID(ctx, url)
+		if err != nil {
+			return result, err
+		}
+		url = u
+		result.URL = u
+	}
+
 	id, ok := m.matchURL(url)
 	if !ok {
-		return model.ExtractResult{}, fmt.Errorf("%q missing video extractor", url)
+		return result, fmt.Errorf("%q missing video extractor", url)
 	}
+	result.Service = id
 
-	result := model.ExtractResult{
-		URL:     url,
-		Service: id,
+	var (
+		results = m.videoExtractors[id].VideoExtract(ctx, url)
+		vw      VideoWriter
+	)
+	// Results telling the structure of a series aren't videos.
+	results = slices.DeleteFunc(results, func(r model.VideoResult) bool {
+		if len(r.Seasons) == 0 || r.Err != nil || r.Video.ID != "" {
+			return false
+		}
+		for _, n := range r.Seasons {
+			if !slices.Contains(result.Seasons, n) {
+				result.Seasons = append(result.Seasons, n)
+			}
+		}
+		return true
+	})
+	slices.Sort(result.Seasons)
+	if t := m.config.StreamThreshold; stream != nil && t > 0 && len(results) > t {
+		w, err := stream(id, url)
+		if err != nil {
+			return result, fmt.Errorf("stream %q: %w", url, err)
+		}
+		vw = w
 	}
 
 	var (
 		pMu sync.Mutex
 		wg  sync.WaitGroup
 	)
-	for _, r := range m.videoExtractors[id].VideoExtract(ctx, url) {
+	for _, r := range results {
 		if ctx.Err() != nil {
 			break
 		}
+		// fail counts the video as failed, and its season, if any.
+		fail := func(err error) {
+			result.NumFailed++
+			result.FailedErrors = append(result.FailedErrors, err)
+			result.Failures = append(result.Failures, model.Failure{
+				Season:  r.Season,
+				Episode: r.Episode,
+				Reason:  failureReason(err),
+				Error:   err.Error(),
+			})
+			if n := r.Season; n > 0 && !slices.Contains(result.FailedSeasons, n) {
+				result.FailedSeasons = append(result.FailedSeasons, n)
+			}
+		}
 		wg.Add(1)
-		pg.Go(func() error {
+		pg.Go(func() (err error) {
 			defer wg.Done()
+			// A panic fails the video only.
+			defer func() {
+				if err != nil {
+					pMu.Lock()
+					fail(fmt.Errorf("extract %q: %w", url, err))
+					pMu.Unlock()
+				}
+				err = nil
+			}()
+			defer m.recoverPanic(&err)
 			if r.Err != nil {
-				result.NumFailed++
-				result.FailedErrors = append(result.FailedErrors, fmt.Errorf("video extract %q: %w", url, r.Err))
+				pMu.Lock()
+				fail(fmt.Errorf("video extract %q: %w", url, r.Err))
+				pMu.Unlock()
 				return nil
 			}
 
@@ -161,17 +370,48 @@ func (m *Manager) Extract(ctx context.Context, pg *errgroup.Group, url, format s
 				vid       = r.Video
 				parentCtx = ctx
 				variants  []model.Variant
+				skipped   []error
 				mu        sync.Mutex
 			)
+			var (
+				// otherFormats are of the references not of format.
+				otherFormats []string
+				selected     int
+			)
 			g, ctx := errgroup.WithContext(parentCtx)
 			for _, ref := range r.References {
 				if format != "both" && ref.Format != format {
+					if !slices.Contains(otherFormats, ref.Format) {
+						otherFormats = append(otherFormats, ref.Format)
+					}
+					continue
+				}
+				kind := ref.Kind
+				if kind == "" {
+					kind = model.KindMain
+				}
+				if kinds := m.config.Kinds; len(kinds) > 0 && !slices.Contains(kinds, kind) {
 					continue
 				}
 
-				g.Go(func() error {
+				selected++
+				g.Go(func() (err error) {
+					defer m.recoverPanic(&err)
 					vs, err := m.extractVariants(ctx, id, ref)
+					var se *SkippedVariantsError
+					if errors.As(err, &se) {
+						mu.Lock()
+						skipped = append(skipped, fmt.Errorf("extract variants %q (%s): %w", url, vid.ID, se))
+						mu.Unlock()
+						err = nil
+					}
 					if err == nil {
+						for i := range vs {
+							vs[i].Language = ref.Language
+							vs[i].Kind = ref.Kind
+							vs[i].CDN = ref.CDN
+							vs[i].Encoding = ref.Encoding
+						}
 						mu.Lock()
 						variants = append(variants, vs...)
 						mu.Unlock()
@@ -179,54 +419,141 @@ func (m *Manager) Extract(ctx context.Context, pg *errgroup.Group, url, format s
 					return err
 				})
 			}
-			if err := g.Wait(); err != nil {
-				result.NumFailed++
-				result.FailedErrors = append(result.FailedErrors, fmt.Errorf("extract variants %q: %w", url, err))
+			err = g.Wait()
+			if selected == 0 && len(otherFormats) > 0 {
+				pMu.Lock()
+				fail(fmt.Errorf("extract variants %q (%s): no %s references, only %s: pass --format %s", url, vid.ID, format, strings.Join(otherFormats, ", "), otherFormats[0]))
+				pMu.Unlock()
+				return nil
+			}
+			if len(skipped) > 0 {
+				pMu.Lock()
+				result.FailedErrors = append(result.FailedErrors, skipped...)
+				pMu.Unlock()
+			}
+			if err != nil {
+				pMu.Lock()
+				fail(fmt.Errorf("extract variants %q: %w", url, err))
+				pMu.Unlock()
 				return nil
 			}
 
-			seen := make(map[string]struct{})
+			var unique []model.Variant
+			unique, vid.Thumbnails = uniqueVariants(variants, vid.Thumbnails)
+
 			g, ctx = errgroup.WithContext(parentCtx)
-			for _, v := range variants {
-				if _, ok := seen[v.ID]; ok {
-					continue
-				}
-				seen[v.ID] = struct{}{}
-				g.Go(func() error {
-					err := m.fingerprint(ctx, id, &v)
-					if err == nil {
-						mu.Lock()
-						vid.Variants = append(vid.Variants, v)
-						mu.Unlock()
-					}
-					return err
+			g.SetLimit(variantConcurrency(m.config))
+			for i := range unique {
+				g.Go(func() (err error) {
+					defer m.recoverPanic(&err)
+					return m.fingerprint(ctx, id, &unique[i])
 				})
 			}
 			if err := g.Wait(); err != nil {
-				result.NumFailed++
-				result.FailedErrors = append(result.FailedErrors, fmt.Errorf("fingerprint %q: %w", url, err))
+				pMu.Lock()
+				fail(fmt.Errorf("fingerprint %q: %w", url, err))
+				pMu.Unlock()
 				return nil
 			}
+			vid.Variants = append(vid.Variants, unique...)
+			if m.config.Sort != "none" {
+				sortVariants(vid.Variants)
+			}
+
+			if m.config.ValidateLadder {
+				vid.LadderWarnings = validateLadder(vid.Variants)
+				if len(vid.LadderWarnings) > 0 {
+					pMu.Lock()
+					result.Warnings = append(result.Warnings, fmt.Errorf("validate ladder %q (%s): %s", url, vid.ID, strings.Join(vid.LadderWarnings, ", ")))
+					pMu.Unlock()
+				}
+			}
+
+			if m.config.DurationTolerance > 0 {
+				vid.DurationWarnings = validateDurations(vid, m.config.DurationTolerance/100)
+				if n := len(vid.DurationWarnings); n > 0 {
+					pMu.Lock()
+					result.NumDurationWarnings += n
+					result.Warnings = append(result.Warnings, fmt.Errorf("validate durations %q (%s): %d variant(s) off", url, vid.ID, n))
+					pMu.Unlock()
+				}
+			}
 
 			pMu.Lock()
-			result.Videos = append(result.Videos, vid)
-			pMu.Unlock()
+			defer pMu.Unlock()
+			if vw == nil {
+				result.Videos = append(result.Videos, vid)
+				numVideos++
+				return nil
+			}
+			if err := vw.WriteVideo(vid); err != nil {
+				fail(fmt.Errorf("write video %q: %w", url, err))
+				return nil
+			}
+			numVideos++
 			return nil
 		})
 	}
 	wg.Wait()
+	slices.Sort(result.FailedSeasons)
 
-	if len(result.Videos) == 0 {
-		return model.ExtractResult{}, fmt.Errorf("extract %q: no fingerprints", url)
+	// Geo-blocking is reported, even if not verbose, as actionable.
+	geoBlocked, numGeoBlocked := countGeoBlocked(result.FailedErrors)
+	if numVideos == 0 {
+		if geoBlocked != nil {
+			return result, fmt.Errorf("extract %q: no fingerprints: %w", url, geoBlocked)
+		}
+		// Live events not concluded yet are told why, as expected.
+		for _, err := range result.FailedErrors {
+			var le *LiveEventError
+			if errors.As(err, &le) {
+				return result, fmt.Errorf("extract %q: no fingerprints: %w", url, le)
+			}
+		}
+		return result, fmt.Errorf("extract %q: no fingerprints", url)
+	}
+	if geoBlocked != nil && !m.config.Verbose {
+		log.Printf("warning: extract %q: %d video(s) failed: %v\n", url, numGeoBlocked, geoBlocked)
+	}
+	// Streamed videos are written as completed.
+	if m.config.Sort != "none" {
+		sortVideos(result.Videos)
 	}
 
 	return result, nil
 }
 
-func (m *Manager) Fingerprint(ctx context.Context, fileOrURL, baseURL, indexRange string) (model.FingerprintResult, error) {
+// recoverPanic recovers a panic of the calling goroutine, if any, as err,
+// with the stack if verbose. Must be deferred.
+func (m *Manager) recoverPanic(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if m.config.Verbose {
+		*err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		return
+	}
+	*err = fmt.Errorf("panic: %v", r)
+}
+
+func (m *Manager) Fingerprint(ctx context.Context, fileOrURL, baseURL, indexRange string, hints VariantHints) (model.FingerprintResult, error) {
 	result := model.FingerprintResult{URL: fileOrURL}
 
-	switch ext := getExtension(fileOrURL); ext {
+	ext := getExtension(fileOrURL)
+	switch ext {
+	case ".mpd", ".m3u8", ".mp4", ".webm":
+	default:
+		sniffed, err := m.sniffExtension(ctx, fileOrURL)
+		if err != nil {
+			return model.FingerprintResult{}, fmt.Errorf("sniff %q: %w", fileOrURL, err)
+		}
+		if sniffed != "" {
+			ext = sniffed
+		}
+	}
+
+	switch ext {
 	case ".mpd":
 		vs, err := m.fingerprintVariants(ctx, "dash", fileOrURL, baseURL)
 		if err != nil {
@@ -238,10 +565,13 @@ func (m *Manager) Fingerprint(ctx context.Context, fileOrURL, baseURL, indexRang
 		if err != nil {
 			return model.FingerprintResult{}, err
 		}
+		for i := range vs {
+			hints.apply(&vs[i])
+		}
 		result.Variants = &vs
-	case ".mp4":
+	case ".mp4", ".webm":
 		v := model.Variant{
-			MimeType:       "video/mp4",
+			MimeType:       "video/" + strings.TrimPrefix(ext, "."),
 			AddressingMode: "indexed",
 			IndexedAddressingInfo: &model.IndexedAddressingInfo{
 				URL:        fileOrURL,
@@ -252,6 +582,9 @@ func (m *Manager) Fingerprint(ctx context.Context, fileOrURL, baseURL, indexRang
 		if err != nil {
 			return model.FingerprintResult{}, fmt.Errorf("fingerprint: %w", err)
 		}
+		if m.config.Summary {
+			fp.Summary = model.Summarize(fp)
+		}
 		result.Fingerprint = &fp
 	default:
 		return model.FingerprintResult{}, fmt.Errorf("unsupported file %q", ext)
@@ -277,11 +610,20 @@ func (m *Manager) fingerprintVariants(ctx context.Context, format, fileOrURL, ba
 	}
 
 	vs, err := m.variantExtractors["default"].ExtractVariants(ctx, ref)
+	vs = slices.DeleteFunc(vs, func(v model.Variant) bool { return v.Thumbnail != nil })
+	var se *SkippedVariantsError
+	if errors.As(err, &se) {
+		if m.config.Verbose {
+			log.Println(se)
+		}
+		err = nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("extract variants: %w", err)
 	}
 
 	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(variantConcurrency(m.config))
 	for i := range vs {
 		g.Go(func() error {
 			return m.fingerprint(ctx, "default", &vs[i])
@@ -298,14 +640,85 @@ func (m *Manager) fingerprint(ctx context.Context, service ID, variant *model.Va
 		return fmt.Errorf("%q missing fingerprinter", service)
 	}
 
+	start := time.Now()
 	fp, err := f.Fingerprint(ctx, *variant)
+	m.config.Metrics.ObserveFingerprint(string(service), time.Since(start))
 	if err != nil {
 		return err
 	}
+	if m.config.Summary {
+		fp.Summary = model.Summarize(fp)
+	}
 	variant.Fingerprint = &fp
+	if m.config.IncludeAddressing {
+		variant.Addressing = &model.Addressing{
+			Mode:     variant.AddressingMode,
+			Indexed:  variant.IndexedAddressingInfo,
+			Explicit: variant.ExplicitAddressingInfo,
+		}
+	}
 	return nil
 }
 
+// variantKey identifies a variant among those of the references of a
+// video, e.g. the same track of several manifests of a CDN.
+type variantKey struct {
+	id, language, kind, cdn, encoding string
+}
+
+// uniqueVariants returns the variants to fingerprint, the first of each
+// variantKey, and appends the thumbnail tracks, which aren't
+// fingerprinted, to thumbnails.
+func uniqueVariants(variants []model.Variant, thumbnails []model.Thumbnail) ([]model.Variant, []model.Thumbnail) {
+	var (
+		seen   = make(map[variantKey]struct{})
+		unique []model.Variant
+	)
+	for _, v := range variants {
+		if t := v.Thumbnail; t != nil {
+			if !slices.ContainsFunc(thumbnails, func(o model.Thumbnail) bool { return o.URL == t.URL }) {
+				thumbnails = append(thumbnails, *t)
+			}
+			continue
+		}
+		key := variantKey{v.ID, v.Language, v.Kind, v.CDN, v.Encoding}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		unique = append(unique, v)
+	}
+	return unique, thumbnails
+}
+
+// VideoConcurrency returns the limit of videos (e.g. episodes) of a
+// service URL extracted concurrently, for use with errgroup.Group.SetLimit.
+func VideoConcurrency(config *config.AppConfig) int {
+	if n := config.VideoConcurrency; n > 0 {
+		return n
+	}
+	return -1
+}
+
+// NewVideoGroup returns a group limited to the videos (e.g. episodes) of
+// a URL extracted concurrently. Nested fan-outs (e.g. episodes of seasons)
+// share a VideoLimiter instead, as adding to a group full of tasks adding
+// to it deadlocks.
+func NewVideoGroup(config *config.AppConfig) *errgroup.Group {
+	g := new(errgroup.Group)
+	g.SetLimit(VideoConcurrency(config))
+	return g
+}
+
+// variantConcurrency returns the limit of variants of a video extracted
+// or fingerprinted concurrently, for use with errgroup.Group.SetLimit.
+func variantConcurrency(config *config.AppConfig) int {
+	if n := config.VariantConcurrency; n > 0 {
+		return n
+	}
+	return -1
+}
+
 func getExtension(fileOrURL string) string {
 	parsedURL, err := url.Parse(fileOrURL)
 	if err != nil {
@@ -313,3 +726,119 @@ func getExtension(fileOrURL string) string {
 	}
 	return strings.ToLower(path.Ext(parsedURL.Path))
 }
+
+// contentTypeExtensions are the extensions of the media types manifests
+// and media are served as.
+var contentTypeExtensions = map[string]string{
+	"application/dash+xml":          ".mpd",
+	"application/vnd.apple.mpegurl": ".m3u8",
+	"application/x-mpegurl":         ".m3u8",
+	"audio/mpegurl":                 ".m3u8",
+	"audio/x-mpegurl":               ".m3u8",
+	"video/mp4":                     ".mp4",
+	"audio/mp4":                     ".mp4",
+	"video/webm":                    ".webm",
+	"audio/webm":                    ".webm",
+}
+
+func contentTypeExtension(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return contentTypeExtensions[mediaType]
+}
+
+// sniffExtension returns the extension matching the content of a file or
+// URL without a recognized extension, judging from its first bytes. URLs
+// are judged from the Content-Type of a HEAD first, and, if the content
+// is unrecognized, of the GET. Returns empty string if unrecognized.
+func (m *Manager) sniffExtension(ctx context.Context, fileOrURL string) (string, error) {
+	const sniffLen = 1024
+
+	var (
+		prefix      []byte
+		contentType string
+		err         error
+	)
+	if parsed, perr := url.ParseRequestURI(fileOrURL); perr == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") {
+		if ext := m.headExtension(ctx, fileOrURL); ext != "" {
+			return ext, nil
+		}
+		prefix, contentType, err = m.fetchPrefix(ctx, fileOrURL, sniffLen)
+	} else {
+		prefix, err = readPrefix(fileOrURL, sniffLen)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	prefix = bytes.TrimPrefix(prefix, []byte("\xef\xbb\xbf"))
+	trimmed := bytes.TrimSpace(prefix)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("#EXTM3U")):
+		return ".m3u8", nil
+	case bytes.Contains(trimmed, []byte("<MPD")):
+		return ".mpd", nil
+	case len(prefix) >= 8 && string(prefix[4:8]) == "ftyp":
+		return ".mp4", nil
+	case bytes.HasPrefix(prefix, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return ".webm", nil
+	}
+
+	return contentTypeExtension(contentType), nil
+}
+
+// headExtension returns the extension of the Content-Type of url, as of a
+// HEAD request. Returns empty string if the request fails, as servers
+// refusing HEAD may well serve GET, or the type is unrecognized.
+func (m *Manager) headExtension(ctx context.Context, url string) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return ""
+	}
+
+	res, err := m.httpClient.Do(req)
+	if err != nil {
+		return ""
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	return contentTypeExtension(res.Header.Get("Content-Type"))
+}
+
+func (m *Manager) fetchPrefix(ctx context.Context, url string, n int64) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("new: %w", err)
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+
+	res, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return nil, "", fmt.Errorf("status %s", res.Status)
+	}
+
+	prefix, err := io.ReadAll(io.LimitReader(res.Body, n))
+	return prefix, res.Header.Get("Content-Type"), err
+}
+
+func readPrefix(filename string, n int64) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(io.LimitReader(f, n))
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/sync/errgroup"
+	"karl/pkg/config"
+	"karl/pkg/model"
+)
+
+// fakeClient extracts the results of its URLs, prefixed "fake://".
+type fakeClient struct {
+	results []model.VideoResult
+}
+
+func (c *fakeClient) ID() ID { return "fake" }
+
+func (c *fakeClient) Matches(url string) bool { return strings.HasPrefix(url, "fake://") }
+
+func (c *fakeClient) VideoExtract(ctx context.Context, url string) []model.VideoResult {
+	return c.results
+}
+
+func newFakeManager(t *testing.T, results ...model.VideoResult) *Manager {
+	t.Helper()
+	m := NewManager(http.DefaultClient, &config.AppConfig{})
+	m.Register(func(*config.AppConfig, *http.Client) Client { return &fakeClient{results: results} })
+	return m
+}
+
+func TestExtractOtherFormatOnly(t *testing.T) {
+	m := newFakeManager(t, model.VideoResult{
+		Video:      model.Video{ID: "1"},
+		References: []model.Reference{{URL: "https://example.com/1.m3u8", Format: "hls"}},
+	})
+
+	var pg errgroup.Group
+	result, _ := m.Extract(context.Background(), &pg, "fake://1", "dash", nil)
+	if result.NumFailed != 1 || len(result.FailedErrors) != 1 {
+		t.Fatalf("failed = %d %v, want 1", result.NumFailed, result.FailedErrors)
+	}
+	if err := result.FailedErrors[0].Error(); !strings.Contains(err, "--format hls") {
+		t.Errorf("error %q, want telling --format hls", err)
+	}
+}
+
+func TestExtractFailures(t *testing.T) {
+	m := newFakeManager(t,
+		model.VideoResult{Err: fmt.Errorf("fetch playback: %w", &NotEntitledError{Reason: "PRS.NoRights.NotOwned"}), Season: 1, Episode: 2},
+		model.VideoResult{Err: &GeoBlockedError{Country: "US", Reason: "only available in CA"}, Season: 1, Episode: 3},
+		model.VideoResult{Err: errors.New("decode body: EOF")},
+	)
+
+	var pg errgroup.Group
+	result, err := m.Extract(context.Background(), &pg, "fake://1", "dash", nil)
+	if err == nil {
+		t.Fatal("want error of no fingerprints")
+	}
+	want := []model.Failure{
+		{Season: 1, Episode: 2, Reason: "not_entitled"},
+		{Season: 1, Episode: 3, Reason: "geo_blocked"},
+		{Reason: "error"},
+	}
+	if len(result.Failures) != len(want) {
+		t.Fatalf("failures = %+v, want %d", result.Failures, len(want))
+	}
+	slices.SortFunc(result.Failures, func(a, b model.Failure) int { return cmp.Compare(a.Episode, b.Episode) })
+	slices.SortFunc(want, func(a, b model.Failure) int { return cmp.Compare(a.Episode, b.Episode) })
+	for i, f := range result.Failures {
+		if f.Season != want[i].Season || f.Episode != want[i].Episode || f.Reason != want[i].Reason || f.Error == "" {
+			t.Errorf("failure %d = %+v, want %+v", i, f, want[i])
+		}
+	}
+}
+
+// panicClient panics extracting, as of a response of unexpected shape.
+type panicClient struct{}
+
+func (c *panicClient) ID() ID { return "panic" }
+
+func (c *panicClient) Matches(url string) bool { return strings.HasPrefix(url, "panic://") }
+
+func (c *panicClient) VideoExtract(ctx context.Context, url string) []model.VideoResult {
+	var episodes []int
+	_ = episodes[1]
+	return nil
+}
+
+func TestExtractPanic(t *testing.T) {
+	m := NewManager(http.DefaultClient, &config.AppConfig{})
+	m.Register(func(*config.AppConfig, *http.Client) Client { return &panicClient{} })
+
+	var pg errgroup.Group
+	_, err := m.Extract(context.Background(), &pg, "panic://1", "dash", nil)
+	if err == nil || !strings.Contains(err.Error(), "panic: runtime error: index out of range") {
+		t.Errorf("error %v, want the panic", err)
+	}
+}
+
+func TestFingerprintMediaPlaylistHints(t *testing.T) {
+	m := NewManager(http.DefaultClient, &config.AppConfig{})
+	hints := VariantHints{Width: 1280, Height: 720, Bandwidth: 1200000}
+	result, err := m.Fingerprint(context.Background(), "../../testdata/hls/media/byterange.m3u8", "", "", hints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Variants == nil || len(*result.Variants) != 1 {
+		t.Fatalf("variants %+v, want 1", result.Variants)
+	}
+	v := (*result.Variants)[0]
+	if v.Width != 1280 || v.Height != 720 || v.Bandwidth != 1200000 {
+		t.Errorf("variant %dx%d at %d, want labeled 1280x720 at 1200000", v.Width, v.Height, v.Bandwidth)
+	}
+	if want := computeID(v.MimeType, v.Codecs, 1280, 720, 1200000, 0); v.ID != want {
+		t.Errorf("id %s, want %s of the hints", v.ID, want)
+	}
+}
+
+// matcher matches URLs with prefix, of priority.
+type matcher struct {
+	id       ID
+	prefix   string
+	priority int
+}
+
+func (c *matcher) ID() ID { return c.id }
+
+func (c *matcher) Matches(url string) bool { return strings.HasPrefix(url, c.prefix) }
+
+func (c *matcher) MatchPriority() int { return c.priority }
+
+func (c *matcher) VideoExtract(ctx context.Context, url string) []model.VideoResult { return nil }
+
+func TestMatchURLPriority(t *testing.T) {
+	clients := []*matcher{
+		{"generic", "https://", -1},
+		{"specific", "https://video.example.com/", 0},
+		{"also-specific", "https://video.example.com/", 0},
+	}
+	// However registered, the most specific, then first by ID, wins.
+	for range 10 {
+		m := NewManager(http.DefaultClient, &config.AppConfig{})
+		for _, i := range rand.Perm(len(clients)) {
+			m.Register(func(*config.AppConfig, *http.Client) Client { return clients[i] })
+		}
+
+		for _, tt := range []struct {
+			url  string
+			want ID
+		}{
+			{"https://video.example.com/watch/1", "also-specific"},
+			{"https://other.example.com/watch/1", "generic"},
+		} {
+			if id, ok := m.matchURL(tt.url); !ok || id != tt.want {
+				t.Errorf("%s: matched %q, want %q", tt.url, id, tt.want)
+			}
+		}
+	}
+}
+
+func TestUniqueVariants(t *testing.T) {
+	variants := []model.Variant{
+		{ID: "a1", Kind: "audio"},
+		// Of the same key once concatenated.
+		{ID: "a", Language: "1", Kind: "audio"},
+		{ID: "a1", Kind: "audio", CDN: "akamai"},
+		{ID: "a1", Kind: "audio"},
+		{ID: "thumbs", Thumbnail: &model.Thumbnail{URL: "https://example.com/t.jpg"}},
+	}
+
+	unique, thumbnails := uniqueVariants(variants, nil)
+	if len(unique) != 3 {
+		t.Errorf("variants %+v, want the first 3", unique)
+	}
+	if len(thumbnails) != 1 {
+		t.Errorf("thumbnails %+v, want 1", thumbnails)
+	}
+}
+
+// selfTestClient is a fakeClient with checks of its own, failing with err,
+// a variant of each reference and URLs to extract, counting the times
+// extracted.
+type selfTestClient struct {
+	fakeClient
+	err       error
+	checked   int
+	extracted int
+}
+
+func (c *selfTestClient) SelfTest(ctx context.Context) error {
+	c.checked++
+	return c.err
+}
+
+func (c *selfTestClient) ExtractVariants(ctx context.Context, reference model.Reference) ([]model.Variant, error) {
+	return []model.Variant{{ID: "1"}}, nil
+}
+
+func (c *selfTestClient) Fingerprint(ctx context.Context, variant model.Variant) (model.Fingerprint, error) {
+	return model.Fingerprint{}, nil
+}
+
+func (c *selfTestClient) ExtractURLs(ctx context.Context) ([]string, error) {
+	c.extracted++
+	return []string{"fake://1"}, nil
+}
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		err     error
+		want    string
+		videos  int
+		checked int
+	}{
+		{name: "no url", want: "--url fake=URL"},
+		{name: "other service", url: "https://example.com/1", want: "not of service"},
+		{name: "check failed", url: "fake://1", err: errors.New("fetch token: 401"), want: "self-test: fetch token: 401", checked: 1},
+		{name: "pass", url: "fake://1", videos: 1, checked: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &selfTestClient{err: tt.err, fakeClient: fakeClient{results: []model.VideoResult{{
+				Video:      model.Video{ID: "1"},
+				References: []model.Reference{{URL: "https://example.com/1.m3u8", Format: "hls"}},
+			}}}}
+			m := NewManager(http.DefaultClient, &config.AppConfig{})
+			m.Register(func(*config.AppConfig, *http.Client) Client { return c })
+
+			r := m.SelfTest(context.Background(), "fake", tt.url, "hls")
+			if tt.want == "" && r.Err != nil {
+				t.Fatalf("error %v, want passed", r.Err)
+			}
+			if tt.want != "" && (r.Err == nil || !strings.Contains(r.Err.Error(), tt.want)) {
+				t.Fatalf("error %v, want %q", r.Err, tt.want)
+			}
+			if r.NumVideos != tt.videos || (tt.videos > 0 && r.NumVariants == 0) {
+				t.Errorf("%d video(s), %d variant(s), want %d video(s) with variants", r.NumVideos, r.NumVariants, tt.videos)
+			}
+			if c.checked != tt.checked {
+				t.Errorf("checked %d times, want %d", c.checked, tt.checked)
+			}
+			if c.extracted != 0 {
+				t.Error("URLs extracted, want a URL required instead")
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"cmp"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"karl/pkg/model"
+)
+
+var episodeRegex = regexp.MustCompile(`\bS(\d+)E(\d+)\b`)
+
+// sortVideos sorts videos by season and episode, as in titles (e.g.
+// "S001E002", see model.OneTitle), those without first, and then by ID
+// and edit.
+func sortVideos(videos []model.Video) {
+	slices.SortStableFunc(videos, func(a, b model.Video) int {
+		as, ae := parseEpisode(a.Title)
+		bs, be := parseEpisode(b.Title)
+		return cmp.Or(
+			cmp.Compare(as, bs),
+			cmp.Compare(ae, be),
+			cmp.Compare(a.ID, b.ID),
+			cmp.Compare(a.Edit, b.Edit),
+		)
+	})
+}
+
+// parseEpisode returns the season and episode in title, or zeros.
+func parseEpisode(title string) (season, episode int) {
+	m := episodeRegex.FindStringSubmatch(title)
+	if m == nil {
+		return 0, 0
+	}
+	season, _ = strconv.Atoi(m[1])
+	episode, _ = strconv.Atoi(m[2])
+	return season, episode
+}
+
+// sortVariants sorts variants by bandwidth, and then by what tells those
+// of the same bandwidth apart, as extracted concurrently per manifest.
+func sortVariants(variants []model.Variant) {
+	slices.SortStableFunc(variants, func(a, b model.Variant) int {
+		return cmp.Or(
+			cmp.Compare(a.Bandwidth, b.Bandwidth),
+			cmp.Compare(a.Type, b.Type),
+			cmp.Compare(a.Language, b.Language),
+			cmp.Compare(a.Kind, b.Kind),
+			cmp.Compare(a.ID, b.ID),
+			cmp.Compare(a.CDN, b.CDN),
+			cmp.Compare(a.Encoding, b.Encoding),
+		)
+	})
+}
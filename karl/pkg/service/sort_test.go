@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"golang.org/x/sync/errgroup"
+	"karl/pkg/config"
+	"karl/pkg/model"
+)
+
+func TestParseEpisode(t *testing.T) {
+	for _, tt := range []struct {
+		title           string
+		season, episode int
+	}{
+		{"The Show S001E002 Pilot", 1, 2},
+		{"The Show S2E10", 2, 10},
+		{"The Show S000E003 Special", 0, 3},
+		// Missing, or not a word of its own.
+		{"The Show", 0, 0},
+		{"The Show Pilot", 0, 0},
+		{"The Show XS001E002", 0, 0},
+		{"The Show S001", 0, 0},
+	} {
+		if s, e := parseEpisode(tt.title); s != tt.season || e != tt.episode {
+			t.Errorf("%q: S%dE%d, want S%dE%d", tt.title, s, e, tt.season, tt.episode)
+		}
+	}
+}
+
+func TestSortVideos(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		videos []model.Video
+		want   []string
+	}{
+		{
+			name: "episodes",
+			videos: []model.Video{
+				{ID: "c", Title: "Show S002E001"},
+				{ID: "b", Title: "Show S001E010"},
+				{ID: "a", Title: "Show S001E002"},
+			},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "missing first",
+			videos: []model.Video{
+				{ID: "a", Title: "Show S001E001"},
+				{ID: "z", Title: "Show Special"},
+				{ID: "y", Title: "Show"},
+			},
+			want: []string{"y", "z", "a"},
+		},
+		{
+			name: "ties by ID and edit",
+			videos: []model.Video{
+				{ID: "b", Title: "Show S001E001"},
+				{ID: "a", Title: "Show S001E001", Edit: "sdh"},
+				{ID: "a", Title: "Show S001E001"},
+			},
+			want: []string{"a", "a/sdh", "b"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sortVideos(tt.videos)
+			var got []string
+			for _, v := range tt.videos {
+				id := v.ID
+				if v.Edit != "" {
+					id += "/" + v.Edit
+				}
+				got = append(got, id)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("order %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// sortClient is a fakeClient with variants of each reference highest
+// bandwidth first.
+type sortClient struct {
+	fakeClient
+}
+
+func (c *sortClient) ExtractVariants(ctx context.Context, reference model.Reference) ([]model.Variant, error) {
+	return []model.Variant{{ID: "hi", Bandwidth: 2000}, {ID: "lo", Bandwidth: 1000}}, nil
+}
+
+func (c *sortClient) Fingerprint(ctx context.Context, variant model.Variant) (model.Fingerprint, error) {
+	return model.Fingerprint{}, nil
+}
+
+func TestExtractSort(t *testing.T) {
+	var results []model.VideoResult
+	for _, title := range []string{"Show S001E002", "Show S001E001", "Show Special"} {
+		results = append(results, model.VideoResult{
+			Video:      model.Video{ID: title, Title: title},
+			References: []model.Reference{{URL: "https://example.com/1.mpd", Format: "dash"}},
+		})
+	}
+
+	for _, tt := range []struct {
+		sort     string
+		videos   []string
+		variants []string
+	}{
+		{"episode", []string{"Show Special", "Show S001E001", "Show S001E002"}, []string{"lo", "hi"}},
+		// As completed, of one video at a time.
+		{"none", []string{"Show S001E002", "Show S001E001", "Show Special"}, []string{"hi", "lo"}},
+	} {
+		t.Run(tt.sort, func(t *testing.T) {
+			m := NewManager(http.DefaultClient, &config.AppConfig{Sort: tt.sort})
+			m.Register(func(*config.AppConfig, *http.Client) Client { return &sortClient{fakeClient{results: results}} })
+
+			var pg errgroup.Group
+			pg.SetLimit(1)
+			result, err := m.Extract(context.Background(), &pg, "fake://1", "dash", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var videos []string
+			for _, v := range result.Videos {
+				videos = append(videos, v.ID)
+				var variants []string
+				for _, vr := range v.Variants {
+					variants = append(variants, vr.ID)
+				}
+				if !slices.Equal(variants, tt.variants) {
+					t.Errorf("%s: variants %v, want %v", v.ID, variants, tt.variants)
+				}
+			}
+			if !slices.Equal(videos, tt.videos) {
+				t.Errorf("videos %v, want %v", videos, tt.videos)
+			}
+		})
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
-	"sync"
 	"time"
 
 	"karl/pkg/config"
@@ -26,14 +25,20 @@ var (
 type svt struct {
 	config     *config.AppConfig
 	httpClient *http.Client
+	index      *service.IndexCache
 	regex      *regexp.Regexp
 	origin     string
 }
 
+func init() {
+	service.Register(New)
+}
+
 func New(config *config.AppConfig, httpClient *http.Client) service.Client {
 	return &svt{
 		config:     config,
 		httpClient: httpClient,
+		index:      service.NewIndexCache(),
 		regex:      regexp.MustCompile(`svtplay.se/(video/\w+|[\w-]+)`),
 		origin:     "https://www.svtplay.se",
 	}
@@ -66,10 +71,14 @@ func (c *svt) ExtractVariants(ctx context.Context, reference model.Reference) ([
 }
 
 func (c *svt) Fingerprint(ctx context.Context, variant model.Variant) (model.Fingerprint, error) {
-	return service.NewDefaultFingerprinter(c.config, c.httpClient, c.origin).Fingerprint(ctx, variant)
+	return service.NewDefaultFingerprinter(c.config, c.httpClient, c.origin, c.index).Fingerprint(ctx, variant)
 }
 
 func (c *svt) extractURLs(ctx context.Context) ([]string, error) {
+	if c.config.SVTCategory != "" {
+		return c.extractCategoryURLs(ctx, c.config.SVTCategory)
+	}
+
 	res, err := c.fetchGraphQLURLs(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("fetch urls: %w", err)
@@ -173,6 +182,114 @@ func (e graphQLError) Error() string {
 	return "graphql: " + e.Extensions.Classification
 }
 
+var categoryRegex = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// extractCategoryURLs extracts the URLs of the titles (series, shows and
+// singles) of a category, e.g. "nyheter", rather than of all episodes.
+func (c *svt) extractCategoryURLs(ctx context.Context, category string) ([]string, error) {
+	if !categoryRegex.MatchString(category) {
+		return nil, fmt.Errorf("invalid category %q", category)
+	}
+
+	res, err := c.fetchGraphQLCategoryURLs(ctx, category)
+	if err != nil {
+		return nil, fmt.Errorf("fetch category urls %q: %w", category, err)
+	}
+	if len(res.Errors) > 0 {
+		return nil, res.Errors[0]
+	}
+
+	urls := res.Data.urls()
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no urls for category %q", category)
+	}
+
+	return urls, nil
+}
+
+func (c *svt) fetchGraphQLCategoryURLs(ctx context.Context, category string) (*graphQLCategoryURLsResponse, error) {
+	const fmtQuery = `{"query": ` +
+		`"query { categoryPage(id: \"%s\") { lazyLoadedTabs(tabs: [\"all\"]) ` +
+		`{ selections { items { item { ` +
+		`... on TvSeries { urls { svtplay } } ... on TvShow { urls { svtplay } } ` +
+		`... on KidsTvShow { urls { svtplay } } ... on Single { urls { svtplay } } ` +
+		`} } } } } }"}`
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		"https://api.svt.se/contento/graphql",
+		strings.NewReader(fmt.Sprintf(fmtQuery, category)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", c.origin)
+	req.Header.Set("Referer", c.origin+"/")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", res.Status)
+	}
+
+	var r graphQLCategoryURLsResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
+	}
+
+	return &r, nil
+}
+
+type (
+	graphQLCategoryURLsResponse struct {
+		Data   graphQLCategoryURLsData `json:"data"`
+		Errors []graphQLError          `json:"errors"`
+	}
+
+	graphQLCategoryURLsData struct {
+		CategoryPage struct {
+			LazyLoadedTabs []struct {
+				Selections []struct {
+					Items []struct {
+						Item struct {
+							URLs struct {
+								SvtPlay string `json:"svtplay"`
+							} `json:"urls"`
+						} `json:"item"`
+					} `json:"items"`
+				} `json:"selections"`
+			} `json:"lazyLoadedTabs"`
+		} `json:"categoryPage"`
+	}
+)
+
+func (d *graphQLCategoryURLsData) urls() []string {
+	paths := make(map[string]struct{})
+	for _, t := range d.CategoryPage.LazyLoadedTabs {
+		for _, s := range t.Selections {
+			for _, i := range s.Items {
+				if i.Item.URLs.SvtPlay != "" {
+					paths[i.Item.URLs.SvtPlay] = struct{}{}
+				}
+			}
+		}
+	}
+
+	urls := make([]string, 0, len(paths))
+	for path := range paths {
+		urls = append(urls, "https://www.svtplay.se"+path)
+	}
+
+	return urls
+}
+
 func (c *svt) extract(ctx context.Context, url string) <-chan model.VideoResult {
 	results := make(chan model.VideoResult)
 
@@ -305,17 +422,17 @@ func (d *graphQLPathIDsData) pathIDs() []string {
 	return ids
 }
 
+// sendVideos sends the videos of ids as they are fetched, a limited
+// number at a time.
 func (c *svt) sendVideos(ctx context.Context, ids []string, results chan<- model.VideoResult) {
-	var wg sync.WaitGroup
-	for _, id := range ids[1:] {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+	g := service.NewVideoGroup(c.config)
+	for _, id := range ids {
+		g.Go(func() error {
 			c.sendVideo(ctx, id, results)
-		}()
+			return nil
+		})
 	}
-	c.sendVideo(ctx, ids[0], results)
-	wg.Wait()
+	g.Wait()
 }
 
 func (c *svt) sendVideo(ctx context.Context, id string, results chan<- model.VideoResult) {
@@ -324,6 +441,14 @@ func (c *svt) sendVideo(ctx context.Context, id string, results chan<- model.Vid
 		results <- model.VideoResult{Err: fmt.Errorf("fetch video %q: %w", id, err)}
 		return
 	}
+	// Manifests of videos only available in Sweden are refused by the CDN
+	// elsewhere.
+	if res.Rights.OnlyAvailableInSweden {
+		if err := service.RequireCountry(c.config.CountryCode, "SE"); err != nil {
+			results <- model.VideoResult{Err: fmt.Errorf("video %q: %w", id, err)}
+			return
+		}
+	}
 
 	results <- model.VideoResult{Video: res.video(), References: res.references()}
 }
@@ -367,12 +492,14 @@ type videoResponse struct {
 	ContentDuration int32  `json:"contentDuration"`
 
 	Rights struct {
-		ValidTo time.Time `json:"validTo"`
+		ValidTo               time.Time `json:"validTo"`
+		OnlyAvailableInSweden bool      `json:"onlyAvailableInSweden"`
 	} `json:"rights"`
 
 	VideoReferences []struct {
-		URL    string `json:"url"`
-		Format string `json:"format"`
+		URL      string `json:"url"`
+		Format   string `json:"format"`
+		Language string `json:"language"`
 	} `json:"videoReferences"`
 }
 
@@ -403,11 +530,19 @@ func (r *videoResponse) references() []model.Reference {
 		default:
 			continue
 		}
+		// Audio described (syntolkade) formats are suffixed, e.g.
+		// "dash-avc-ad".
+		kind := model.KindMain
+		if strings.HasSuffix(ref.Format, "-ad") {
+			kind = model.KindAudioDescription
+		}
 		refs[i] = model.Reference{
-			ID:      ref.Format,
-			Format:  format,
-			URL:     akamaiRe.ReplaceAllString(ref.URL, "$$Server$$.akamaized.net"),
-			Servers: servers,
+			ID:       ref.Format,
+			Format:   format,
+			URL:      akamaiRe.ReplaceAllString(ref.URL, "$$Server$$.akamaized.net"),
+			Servers:  servers,
+			Language: ref.Language,
+			Kind:     kind,
 		}
 	}
 
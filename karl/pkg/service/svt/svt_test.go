@@ -0,0 +1,117 @@
+package svt
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service/internal/servicetest"
+)
+
+func newTestClient(videoConcurrency int, rt http.RoundTripper) *svt {
+	config := &config.AppConfig{CountryCode: "SE", VideoConcurrency: videoConcurrency}
+	return New(config, &http.Client{Transport: rt}).(*svt)
+}
+
+func TestExtractCategoryURLs(t *testing.T) {
+	c := newTestClient(0, servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Host != "api.svt.se" || !strings.Contains(string(body), `categoryPage(id: \"nyheter\")`) {
+			t.Errorf("request %s %s", r.URL, body)
+		}
+		f, err := os.Open("../../../testdata/svt/category.json")
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: f}, nil
+	}))
+
+	urls, err := c.extractCategoryURLs(context.Background(), "nyheter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The titles of all selections, once each.
+	want := []string{
+		"https://www.svtplay.se/agenda",
+		"https://www.svtplay.se/rapport",
+		"https://www.svtplay.se/video/jXvB7Qm/nyhetsmorgon-special",
+	}
+	slices.Sort(urls)
+	if !slices.Equal(urls, want) {
+		t.Errorf("urls %v, want %v", urls, want)
+	}
+}
+
+func TestExtractCategoryURLsInvalid(t *testing.T) {
+	c := newTestClient(0, servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("requested %s", r.URL)
+		return nil, http.ErrNotSupported
+	}))
+
+	// Those that would escape the query.
+	for _, category := range []string{"", "Nyheter", `nyheter\"`, `nyheter") { x } #`, "barn/drama"} {
+		if _, err := c.extractCategoryURLs(context.Background(), category); err == nil || !strings.Contains(err.Error(), "invalid category") {
+			t.Errorf("%q: error %v, want invalid", category, err)
+		}
+	}
+}
+
+func TestSendVideos(t *testing.T) {
+	video, err := os.ReadFile("../../../testdata/svt/video.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		inFlight servicetest.InFlight
+		release  = make(chan struct{})
+	)
+	c := newTestClient(2, servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		defer inFlight.Enter()()
+		if r.URL.Path == "/video/slow" {
+			<-release
+		}
+		time.Sleep(2 * time.Millisecond)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(string(video)))}, nil
+	}))
+
+	ids := []string{"slow", "a", "b", "c", "d", "e"}
+	results := make(chan model.VideoResult)
+	go func() {
+		defer close(results)
+		c.sendVideos(context.Background(), ids, results)
+	}()
+
+	// Those fetched are sent while another is still fetched.
+	for range len(ids) - 1 {
+		select {
+		case r := <-results:
+			if r.Err != nil {
+				t.Fatal(r.Err)
+			}
+			if r.Video.Title != "Rapport - 18.00" || len(r.References) != 2 {
+				t.Errorf("result %+v", r)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("results not sent while a video is fetched")
+		}
+	}
+	close(release)
+	var n int
+	for range results {
+		n++
+	}
+	if n != 1 {
+		t.Errorf("%d results after the slow one, want 1", n)
+	}
+
+	if m := inFlight.Most(); m > 2 {
+		t.Errorf("video requests in flight = %d, want at most 2", m)
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+	"karl/pkg/config"
+)
+
+const (
+	// minThrottledRate is the least the rate of requests to a throttled
+	// host is reduced to, per second.
+	minThrottledRate = rate.Limit(0.5)
+	// throttlePeriod is how long the rate of requests to a throttled host
+	// is kept reduced after it last throttled.
+	throttlePeriod = time.Minute
+)
+
+// Throttler slows down requests to hosts throttling them (e.g. responding
+// 429 or 503), halving the rate of their limiter for each throttled
+// request, down to minThrottledRate, until calm for throttlePeriod. Hosts
+// without a limiter of their own aren't slowed down. Throttled requests
+// are counted.
+type Throttler struct {
+	config *config.AppConfig
+
+	mu    sync.Mutex
+	hosts map[string]*throttledHost
+
+	n atomic.Int64
+}
+
+type throttledHost struct {
+	// base is the rate of the limiter before throttled.
+	base rate.Limit
+	// gen is of the last throttled request, for earlier ones not to
+	// restore the rate.
+	gen int
+}
+
+func NewThrottler(config *config.AppConfig) *Throttler {
+	return &Throttler{
+		config: config,
+		hosts:  make(map[string]*throttledHost),
+	}
+}
+
+// Throttled records a request to host throttled, slowing down those to
+// come.
+func (t *Throttler) Throttled(host string) {
+	t.n.Add(1)
+
+	limiter := t.config.RequestLimiter[host]
+	if limiter == nil || limiter.Limit() == rate.Inf {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.hosts[host]
+	if !ok {
+		h = &throttledHost{base: limiter.Limit()}
+		t.hosts[host] = h
+	}
+	h.gen++
+	limiter.SetLimit(max(limiter.Limit()/2, min(minThrottledRate, h.base)))
+
+	gen := h.gen
+	time.AfterFunc(throttlePeriod, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if h.gen == gen {
+			limiter.SetLimit(h.base)
+			delete(t.hosts, host)
+		}
+	})
+}
+
+// Count returns the number of requests throttled.
+func (t *Throttler) Count() int64 {
+	return t.n.Load()
+}
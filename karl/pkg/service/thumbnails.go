@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Eyevinn/dash-mpd/mpd"
+	"github.com/bluenviron/gohlslib/v2/pkg/playlist/primitives"
+	"karl/pkg/model"
+)
+
+// mpdThumbnailTileScheme is of the EssentialProperty telling the layout of
+// the tiles of thumbnail images (e.g. "10x20"), as of DASH-IF IOP.
+const mpdThumbnailTileScheme = "http://dashif.org/thumbnail_tile"
+
+// isMPDImageAdaptationSet returns whether as is of thumbnail images.
+func isMPDImageAdaptationSet(as *mpd.AdaptationSetType) bool {
+	return as.ContentType == "image" || strings.HasPrefix(as.MimeType, "image/")
+}
+
+// mpdThumbnail returns the thumbnail track of a representation of an
+// image adaptation set, as a variant of type "image". Its width and
+// height are of whole images, divided by the layout of tiles, if told.
+func mpdThumbnail(u string, r *mpd.RepresentationType) model.Variant {
+	t := &model.Thumbnail{
+		MimeType:  r.GetMimeType(),
+		Codecs:    r.GetCodecs(),
+		Bandwidth: r.Bandwidth,
+		Width:     r.Width,
+		Height:    r.Height,
+	}
+
+	// Cloned, not to append to the representation's.
+	props := slices.Clone(r.EssentialProperties)
+	if a := r.Parent(); a != nil {
+		props = append(props, a.EssentialProperties...)
+	}
+	for _, p := range props {
+		if p == nil || string(p.SchemeIdUri) != mpdThumbnailTileScheme {
+			continue
+		}
+		if cols, rows, ok := parseTileLayout(p.Value); ok {
+			t.Columns, t.Rows = cols, rows
+			t.Width, t.Height = r.Width/cols, r.Height/rows
+		}
+		break
+	}
+
+	if r.Parent() != nil {
+		if st := r.GetSegmentTemplate(); st != nil {
+			if media, err := r.GetMedia(); err == nil {
+				t.URL = resolveReference(u, media)
+			}
+			if st.Duration != nil {
+				d := float64(*st.Duration) / float64(st.GetTimescale())
+				if n := t.Columns * t.Rows; n > 0 {
+					d /= float64(n)
+				}
+				t.Duration = d
+			}
+		}
+	}
+	if t.URL == "" {
+		t.URL = u
+	}
+
+	return model.Variant{Type: "image", MimeType: t.MimeType, Thumbnail: t}
+}
+
+// parseTileLayout parses a layout of tiles, columns by rows (e.g. "5x5").
+func parseTileLayout(s string) (uint32, uint32, bool) {
+	c, r, ok := strings.Cut(strings.ToLower(s), "x")
+	if !ok {
+		return 0, 0, false
+	}
+	cols, err := strconv.ParseUint(c, 10, 32)
+	if err != nil || cols == 0 {
+		return 0, 0, false
+	}
+	rows, err := strconv.ParseUint(r, 10, 32)
+	if err != nil || rows == 0 {
+		return 0, 0, false
+	}
+	return uint32(cols), uint32(rows), true
+}
+
+// parseTileResolution parses a resolution (e.g. "320x180").
+func parseTileResolution(s string) (uint32, uint32) {
+	w, h, _ := parseTileLayout(s)
+	return w, h
+}
+
+// m3u8Thumbnails returns the thumbnail tracks of the image streams
+// (EXT-X-IMAGE-STREAM-INF, as of Roku) of a multivariant playlist of URL
+// u, which the playlist package skips over, as variants of type "image".
+// Their tile geometry is of the first EXT-X-TILES tag of their playlists,
+// left out if failing to fetch.
+func (ve *DefaultVariantExtractor) m3u8Thumbnails(ctx context.Context, u string, raw []byte) ([]model.Variant, error) {
+	var variants []model.Variant
+	for _, line := range strings.Split(string(raw), "\n") {
+		line, ok := strings.CutPrefix(strings.TrimSpace(line), "#EXT-X-IMAGE-STREAM-INF:")
+		if !ok {
+			continue
+		}
+
+		var attrs primitives.Attributes
+		if err := attrs.Unmarshal(line); err != nil {
+			return nil, fmt.Errorf("image stream attributes: %w", err)
+		}
+
+		t := &model.Thumbnail{
+			URL:      resolveReference(u, attrs["URI"]),
+			MimeType: "image/jpeg",
+			Codecs:   attrs["CODECS"],
+		}
+		if b, err := strconv.ParseUint(attrs["BANDWIDTH"], 10, 32); err == nil {
+			t.Bandwidth = uint32(b)
+		}
+		t.Width, t.Height = parseTileResolution(attrs["RESOLUTION"])
+
+		if strings.HasPrefix(t.URL, "http") {
+			if err := ve.m3u8Tiles(ctx, t); err != nil && ve.config.Verbose {
+				log.Printf("thumbnail tiles of %q: %v\n", t.URL, err)
+			}
+		}
+
+		variants = append(variants, model.Variant{Type: "image", MimeType: t.MimeType, Thumbnail: t})
+	}
+
+	return variants, nil
+}
+
+// m3u8Tiles sets the tile geometry of t from the first EXT-X-TILES tag of
+// its playlist, whose RESOLUTION is of a thumbnail and DURATION of its
+// time.
+func (ve *DefaultVariantExtractor) m3u8Tiles(ctx context.Context, t *model.Thumbnail) error {
+	raw, _, err := ve.fetchManifest(ctx, t.URL)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(raw), "\n") {
+		line, ok := strings.CutPrefix(strings.TrimSpace(line), "#EXT-X-TILES:")
+		if !ok {
+			continue
+		}
+
+		var attrs primitives.Attributes
+		if err := attrs.Unmarshal(line); err != nil {
+			return fmt.Errorf("tiles attributes: %w", err)
+		}
+		if w, h := parseTileResolution(attrs["RESOLUTION"]); w > 0 {
+			t.Width, t.Height = w, h
+		}
+		if cols, rows, ok := parseTileLayout(attrs["LAYOUT"]); ok {
+			t.Columns, t.Rows = cols, rows
+		}
+		if d, err := strconv.ParseFloat(attrs["DURATION"], 64); err == nil {
+			t.Duration = d
+		}
+		return nil
+	}
+
+	return nil
+}
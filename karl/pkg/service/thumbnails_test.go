@@ -0,0 +1,53 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/Eyevinn/dash-mpd/mpd"
+	"karl/pkg/config"
+)
+
+func TestExtractMPDThumbnails(t *testing.T) {
+	vs, err := extractFileVariantsConfig(t, &config.AppConfig{Thumbnails: true}, "../../testdata/dash/thumbnails/manifest.mpd", "dash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var thumbnails int
+	for _, v := range vs {
+		th := v.Thumbnail
+		if th == nil {
+			continue
+		}
+		thumbnails++
+		// Tiles of the adaptation set's layout, past the
+		// representation's own property.
+		if th.Columns != 10 || th.Rows != 5 || th.Width != 320 || th.Height != 180 {
+			t.Errorf("thumbnail %dx%d of %dx%d, want 320x180 of 10x5", th.Width, th.Height, th.Columns, th.Rows)
+		}
+		if th.Duration != 60.0/50 {
+			t.Errorf("duration %g, want %g", th.Duration, 60.0/50)
+		}
+	}
+	if thumbnails != 1 {
+		t.Errorf("thumbnails = %d, want 1", thumbnails)
+	}
+}
+
+func TestMPDThumbnailKeepsProperties(t *testing.T) {
+	m, err := mpd.ReadFromFile("../../testdata/dash/thumbnails/manifest.mpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := m.Periods[0].AdaptationSets[1].Representations[0]
+	// Of spare capacity, which the adaptation set's mustn't be appended
+	// into.
+	props := make([]*mpd.DescriptorType, len(r.EssentialProperties), len(r.EssentialProperties)+1)
+	copy(props, r.EssentialProperties)
+	r.EssentialProperties = props
+
+	mpdThumbnail("https://example.com/manifest.mpd", r)
+	if spare := props[:cap(props)][len(props)]; spare != nil {
+		t.Errorf("representation properties appended to: %+v", spare)
+	}
+}
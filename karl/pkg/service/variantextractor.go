@@ -1,24 +1,29 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"math"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Eyevinn/dash-mpd/mpd"
 	"github.com/bluenviron/gohlslib/v2/pkg/playlist"
+	"github.com/bluenviron/gohlslib/v2/pkg/playlist/primitives"
 	"golang.org/x/sync/errgroup"
 	"karl/pkg/config"
 	"karl/pkg/model"
@@ -62,7 +67,7 @@ func (ve *DefaultVariantExtractor) extractMPDVariants(ctx context.Context, refer
 		if l := len(reference.Servers); l > 0 {
 			u = strings.Replace(u, "$Server$", reference.Servers[rand.Intn(l)], 1)
 		}
-		m, err = ve.fetchMPD(ctx, u)
+		m, u, err = ve.fetchMPD(ctx, u)
 		if err != nil {
 			return nil, fmt.Errorf("fetch mpd: %w", err)
 		}
@@ -79,12 +84,18 @@ func (ve *DefaultVariantExtractor) extractMPDVariants(ctx context.Context, refer
 		}
 	}
 
+	if reason := mpdLowLatency(m); reason != "" {
+		return nil, fmt.Errorf("%w: %s", errLowLatencyDASH, reason)
+	}
 	if m.GetType() != mpd.STATIC_TYPE {
 		return nil, errors.New("mpd is not static")
 	}
 
 	u = resolveBaseURLTypes(u, m.BaseURL)
-	group := newVariantGroup()
+	var (
+		group      = newVariantGroup()
+		thumbnails []model.Variant
+	)
 	for _, p := range m.Periods {
 		var periodDuration time.Duration
 		if d, err := p.GetDuration(); err == nil {
@@ -104,6 +115,15 @@ func (ve *DefaultVariantExtractor) extractMPDVariants(ctx context.Context, refer
 
 		u := resolveBaseURLTypes(u, p.BaseURLs)
 		for _, as := range p.AdaptationSets {
+			if isMPDImageAdaptationSet(as) {
+				if ve.config.Thumbnails {
+					u := resolveBaseURLTypes(u, as.BaseURLs)
+					for _, r := range as.Representations {
+						thumbnails = append(thumbnails, mpdThumbnail(resolveBaseURLTypes(u, r.BaseURLs), r))
+					}
+				}
+				continue
+			}
 			if as.ContentType != "" && as.ContentType != "video" {
 				continue
 			}
@@ -119,71 +139,81 @@ func (ve *DefaultVariantExtractor) extractMPDVariants(ctx context.Context, refer
 				if err != nil {
 					return nil, fmt.Errorf("extract mpd variant: %w", err)
 				}
+				// Otherwise such variants are fingerprinted as is, their
+				// IDs possibly colliding.
+				if ve.config.ProbeInit && (v.Codecs == "" || v.Width == 0 || v.Height == 0) {
+					if err := ve.probeInit(ctx, v); err != nil && ve.config.Verbose {
+						log.Printf("probe init of representation %q: %v\n", r.Id, err)
+					}
+				}
 
 				group.add(v, periodDuration)
 			}
 		}
 	}
 	if v := group.merge(); len(v) > 0 {
-		return v, nil
+		return append(v, thumbnails...), nil
 	}
 
 	return nil, errors.New("no variants found")
 }
 
-func (ve *DefaultVariantExtractor) fetchMPD(ctx context.Context, url string) (*mpd.MPD, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("new: %w", err)
-	}
-
-	if ve.origin != "" {
-		req.Header.Set("Origin", ve.origin)
-		req.Header.Set("Referer", ve.origin+"/")
-	}
-
-	res, err := ve.httpClient.Do(req)
+// fetchMPD fetches and parses an MPD, also returning its URL after any
+// redirects to resolve relative references against.
+func (ve *DefaultVariantExtractor) fetchMPD(ctx context.Context, url string) (*mpd.MPD, string, error) {
+	raw, url, err := ve.fetchManifest(ctx, url)
 	if err != nil {
-		return nil, fmt.Errorf("do: %w", err)
+		return nil, "", err
 	}
-	defer res.Body.Close()
 
-	raw, err := io.ReadAll(res.Body)
+	m, err := mpd.MPDFromBytes(raw)
 	if err != nil {
-		return nil, fmt.Errorf("read body: %w", err)
+		return nil, "", err
 	}
 
-	return mpd.MPDFromBytes(raw)
+	return m, url, nil
 }
 
 func (ve *DefaultVariantExtractor) extractMPDVariant(u string, servers []string, r *mpd.RepresentationType) (*model.Variant, error) {
 	var (
-		mimeType = r.GetMimeType()
-		codecs   = r.GetCodecs()
+		mimeType  = r.GetMimeType()
+		codecs    = r.GetCodecs()
+		frameRate = r.FrameRate
 	)
+	if frameRate == "" && r.Parent() != nil {
+		frameRate = r.Parent().FrameRate
+	}
+	fps, err := parseMPDFrameRate(frameRate)
+	if err != nil {
+		return nil, fmt.Errorf("frame rate: %w", err)
+	}
 
 	v := &model.Variant{
-		ID:        computeID(mimeType, codecs, r.Width, r.Height, r.Bandwidth),
-		MimeType:  mimeType,
-		Codecs:    codecs,
-		Width:     r.Width,
-		Height:    r.Height,
-		Bandwidth: r.Bandwidth,
+		ID:           computeID(mimeType, codecs, r.Width, r.Height, r.Bandwidth, fps),
+		MimeType:     mimeType,
+		Codecs:       codecs,
+		Width:        r.Width,
+		Height:       r.Height,
+		Bandwidth:    r.Bandwidth,
+		FrameRate:    fps,
+		DynamicRange: mpdDynamicRange(r),
 	}
 
+	indexRange, initRange, segmentBase := mpdSegmentBase(r)
 	switch {
-	case r.SegmentBase != nil:
+	case r.SegmentBase != nil || segmentBase && r.SegmentTemplate == nil && r.SegmentList == nil:
 		v.AddressingMode = "indexed"
 		if len(servers) > 0 {
 			u = strings.Replace(u, "$Server$", servers[rand.Intn(len(servers))], 1)
 		}
 		v.IndexedAddressingInfo = &model.IndexedAddressingInfo{
 			URL:        u,
-			IndexRange: r.SegmentBase.IndexRange,
+			IndexRange: indexRange,
+			InitRange:  initRange,
 		}
 	case r.SegmentTemplate != nil:
 		v.AddressingMode = "explicit"
-		info, err := parseMPDExplicitAddressingInfo(u, r.SegmentTemplate)
+		info, err := parseMPDExplicitAddressingInfo(u, r)
 		if err != nil {
 			return nil, fmt.Errorf("explicit addressing info: %w", err)
 		}
@@ -198,16 +228,117 @@ func (ve *DefaultVariantExtractor) extractMPDVariant(u string, servers []string,
 	return v, nil
 }
 
-func parseMPDExplicitAddressingInfo(u string, st *mpd.SegmentTemplateType) (*model.ExplicitAddressingInfo, error) {
+// mpdSegmentBase returns the index and initialization ranges of the
+// SegmentBase of r, each inherited from the adaptation set and period if
+// not set on r, and whether there is a SegmentBase at all.
+func mpdSegmentBase(r *mpd.RepresentationType) (indexRange, initRange string, ok bool) {
+	bases := []*mpd.SegmentBaseType{r.SegmentBase}
+	if as := r.Parent(); as != nil {
+		bases = append(bases, as.SegmentBase)
+		if p := as.Parent(); p != nil {
+			bases = append(bases, p.SegmentBase)
+		}
+	}
+	for _, sb := range bases {
+		if sb == nil {
+			continue
+		}
+		ok = true
+		if indexRange == "" {
+			indexRange = sb.IndexRange
+		}
+		if initRange == "" && sb.Initialization != nil {
+			initRange = sb.Initialization.Range
+		}
+	}
+	return indexRange, initRange, ok
+}
+
+// errLowLatencyDASH is returned for dynamic MPDs signalling low-latency
+// DASH, of segments made available in chunks (CMAF) as they're encoded,
+// rather than failing as not static.
+var errLowLatencyDASH = errors.New("low-latency (chunked CMAF) DASH is not supported")
+
+// mpdLowLatency returns the low-latency signalling of m if dynamic, if
+// any: a service description with target latency or of its segment
+// templates. Static MPDs are of complete segments, whatever their
+// signalling.
+func mpdLowLatency(m *mpd.MPD) string {
+	if m.GetType() != mpd.DYNAMIC_TYPE {
+		return ""
+	}
+
+	descs := m.ServiceDescription
+	for _, p := range m.Periods {
+		descs = append(descs, p.ServiceDescriptions...)
+	}
+	for _, sd := range descs {
+		if sd != nil && len(sd.Latencies) > 0 {
+			return "service description with latency"
+		}
+	}
+
+	for _, p := range m.Periods {
+		templates := []*mpd.SegmentTemplateType{p.SegmentTemplate}
+		for _, as := range p.AdaptationSets {
+			templates = append(templates, as.SegmentTemplate)
+			for _, r := range as.Representations {
+				templates = append(templates, r.SegmentTemplate)
+			}
+		}
+		for _, st := range templates {
+			if st == nil {
+				continue
+			}
+			if reason := templateLowLatency(st); reason != "" {
+				return reason
+			}
+		}
+	}
+	return ""
+}
+
+// templateLowLatency returns the low-latency signalling of st, if any:
+// $SubNumber$, segment sequences (S@k) or early (partial) availability.
+func templateLowLatency(st *mpd.SegmentTemplateType) string {
+	switch {
+	case strings.Contains(st.Media, "$SubNumber$"):
+		return "$SubNumber$ in segment template"
+	case st.AvailabilityTimeOffset > 0:
+		return "availabilityTimeOffset in segment template"
+	case st.AvailabilityTimeComplete != nil && !*st.AvailabilityTimeComplete:
+		return "availabilityTimeComplete false in segment template"
+	}
+	if st.SegmentTimeline != nil {
+		for _, s := range st.SegmentTimeline.S {
+			if s != nil && s.K != nil && *s.K > 1 {
+				return "segment sequences (S@k) in segment timeline"
+			}
+		}
+	}
+	return ""
+}
+
+func parseMPDExplicitAddressingInfo(u string, r *mpd.RepresentationType) (*model.ExplicitAddressingInfo, error) {
+	st := r.SegmentTemplate
 	if st.SegmentTimeline == nil {
 		return nil, errors.New("missing segment timeline")
 	}
 
+	replacer := strings.NewReplacer(
+		"$RepresentationID$", r.Id,
+		"$Bandwidth$", strconv.FormatUint(uint64(r.Bandwidth), 10),
+	)
+
 	info := &model.ExplicitAddressingInfo{
-		TemplateURL: resolveReference(u, st.Media),
+		TemplateURL: resolveReference(u, replacer.Replace(st.Media)),
 		Timescale:   st.GetTimescale(),
 	}
 
+	if st.Initialization != "" {
+		info.InitURL = resolveReference(u, replacer.Replace(st.Initialization))
+	}
+
 	timePlaceholder := false
 	if strings.Contains(st.Media, "$Time$") {
 		timePlaceholder = true
@@ -215,12 +346,18 @@ func parseMPDExplicitAddressingInfo(u string, st *mpd.SegmentTemplateType) (*mod
 	if !timePlaceholder && !strings.Contains(st.Media, "$Number$") {
 		return nil, fmt.Errorf("unknown placeholder in %q", st.Media)
 	}
+	// Segment sequences (S@k) of static MPDs are of k segments each,
+	// numbered from 1 by $SubNumber$, of the sequence's duration split.
+	subNumberPlaceholder := strings.Contains(st.Media, "$SubNumber$")
 
 	num := 1
 	if st.StartNumber != nil {
 		num = int(*st.StartNumber)
 	}
 
+	// Segments without a time follow the end of the previous, the first
+	// starting at 0.
+	var t uint64
 	for _, s := range st.SegmentTimeline.S {
 		if s == nil {
 			continue
@@ -229,29 +366,34 @@ func parseMPDExplicitAddressingInfo(u string, st *mpd.SegmentTemplateType) (*mod
 		if s.D > math.MaxUint32 {
 			return nil, errors.New("segment duration > uint32")
 		}
-
-		if timePlaceholder {
-			if s.T == nil {
-				return nil, errors.New("missing time in segment timeline")
-			}
-			info.URLs = append(
-				info.URLs,
-				strings.Replace(info.TemplateURL, "$Time$", strconv.FormatUint(*s.T, 10), 1),
-			)
-			info.SegmentDurations = append(info.SegmentDurations, uint32(s.D))
-			continue
-		}
-
 		if s.R < 0 {
 			return nil, errors.New("unlimited repeat in segment timeline")
 		}
+		if s.T != nil {
+			t = *s.T
+		}
+
+		k := uint64(1)
+		if subNumberPlaceholder && s.K != nil && *s.K > 1 {
+			k = *s.K
+		}
+
 		for range 1 + s.R {
-			info.URLs = append(
-				info.URLs,
-				strings.Replace(info.TemplateURL, "$Number$", strconv.Itoa(num), 1),
-			)
-			info.SegmentDurations = append(info.SegmentDurations, uint32(s.D))
+			url := info.TemplateURL
+			if timePlaceholder {
+				url = strings.Replace(url, "$Time$", strconv.FormatUint(t, 10), 1)
+			}
+			url = strings.Replace(url, "$Number$", strconv.Itoa(num), 1)
+			for sub := range k {
+				d := s.D / k
+				if sub == k-1 {
+					d = s.D - d*(k-1)
+				}
+				info.URLs = append(info.URLs, strings.Replace(url, "$SubNumber$", strconv.FormatUint(sub+1, 10), 1))
+				info.SegmentDurations = append(info.SegmentDurations, uint32(d))
+			}
 			num++
+			t += s.D
 		}
 	}
 
@@ -261,7 +403,7 @@ func parseMPDExplicitAddressingInfo(u string, st *mpd.SegmentTemplateType) (*mod
 func (ve *DefaultVariantExtractor) extractM3U8Variants(ctx context.Context, reference model.Reference) ([]model.Variant, error) {
 	parsed, err := url.ParseRequestURI(reference.URL)
 	var (
-		p     playlist.Playlist
+		raw   []byte
 		u     = reference.URL
 		isURL = err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https")
 	)
@@ -269,41 +411,122 @@ func (ve *DefaultVariantExtractor) extractM3U8Variants(ctx context.Context, refe
 		if l := len(reference.Servers); l > 0 {
 			u = strings.Replace(u, "$Server$", reference.Servers[rand.Intn(l)], 1)
 		}
-		p, err = ve.fetchM3U8(ctx, u)
+		raw, u, err = ve.fetchManifest(ctx, u)
 		if err != nil {
 			return nil, fmt.Errorf("fetch m3u8: %w", err)
 		}
 	} else {
-		b, err := os.ReadFile(u)
+		raw, err = os.ReadFile(u)
 		if err != nil {
 			return nil, fmt.Errorf("read file: %w", err)
 		}
-		p, err = playlist.Unmarshal(b)
-		if err != nil {
-			return nil, fmt.Errorf("read m3u8: %w", err)
-		}
-		if len(reference.Servers) > 0 {
+		if len(reference.Servers) > 0 && reference.Servers[0] != "" {
 			u = reference.Servers[0]
+		} else {
+			// Without base URL, relative URIs are files next to the
+			// playlist.
+			abs, err := filepath.Abs(u)
+			if err != nil {
+				return nil, fmt.Errorf("abs: %w", err)
+			}
+			u = (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String()
 		}
 	}
 
-	g, ctx := errgroup.WithContext(ctx)
+	p, err := playlist.Unmarshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("read m3u8: %w", err)
+	}
+
 	if p, ok := p.(*playlist.Multivariant); ok {
-		variants := make([]model.Variant, len(p.Variants))
-		for i, v := range p.Variants {
-			if v.Resolution == "" {
+		// The playlist package only parses EXT-X-STREAM-INF tags into
+		// variants, and EXT-X-MEDIA tags (audio, subtitle and closed
+		// caption groups) into renditions, which aren't video and are
+		// never extracted. EXT-X-I-FRAME-STREAM-INF tags are skipped by
+		// it and parsed here, to be extracted only if trick play is
+		// included and otherwise to exclude variants by their URI.
+		iFrameStreams, err := parseM3U8IFrameStreams(raw)
+		if err != nil {
+			return nil, err
+		}
+		excludedURIs := make(map[string]string)
+		for _, r := range p.Renditions {
+			if r.URI != nil {
+				excludedURIs[*r.URI] = strings.ToLower(string(r.Type)) + " rendition"
+			}
+		}
+		for _, v := range iFrameStreams {
+			excludedURIs[v.URI] = "i-frame stream"
+		}
+		if !ve.config.IncludeTrickplay {
+			iFrameStreams = nil
+		}
+
+		sessionKeys, err := parseM3U8SessionKeys(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		streamAttrs, err := parseM3U8StreamAttributes(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		// A failing variant is recorded rather than cancelling the others.
+		var (
+			variants = make([]model.Variant, len(p.Variants)+len(iFrameStreams))
+			skipped  = &SkippedVariantsError{}
+			g        errgroup.Group
+			mu       sync.Mutex
+		)
+		g.SetLimit(variantConcurrency(ve.config))
+		for i, v := range slices.Concat(p.Variants, iFrameStreams) {
+			iFrame := i >= len(p.Variants)
+			if reason, ok := excludedURIs[v.URI]; ok && !iFrame {
+				skipped.add(v.URI, reason)
+				continue
+			}
+			// Variants without resolution may still be video, but not
+			// those with codecs all of which are audio. Video codecs
+			// aren't listed, as new ones (e.g. Dolby Vision dvav) would
+			// be dropped.
+			if v.Resolution == "" && len(v.Codecs) > 0 && !slices.ContainsFunc(v.Codecs, func(c string) bool { return !isAudioCodec(c) }) {
+				skipped.add(v.URI, "audio-only")
+				continue
+			}
+			if v.Resolution == "" && len(v.Codecs) == 0 {
+				skipped.add(v.URI, "no resolution or video codec")
 				continue
 			}
 			g.Go(func() error {
-				variant, err := ve.extractM3U8Variant(ctx, u, reference.Servers, v)
+				variant, err := ve.extractM3U8Variant(ctx, u, reference.Servers, v, streamAttrs[v.URI], iFrame)
+				if errors.Is(err, errIFramesOnly) {
+					mu.Lock()
+					skipped.add(v.URI, err.Error())
+					mu.Unlock()
+					return nil
+				}
 				if err != nil {
-					return fmt.Errorf("extract m3u8 variant: %w", err)
+					mu.Lock()
+					skipped.add(v.URI, fmt.Sprintf("extract m3u8 variant: %v", err))
+					skipped.NumFailed++
+					mu.Unlock()
+					return nil
+				}
+				if iFrame {
+					variant.Type = "iframe"
+				}
+				if variant.Protection == nil {
+					variant.Protection = sessionKeys
 				}
 				variants[i] = *variant
 				return nil
 			})
 		}
-		err := g.Wait()
+		g.Wait()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		var filtered []model.Variant
 		for _, v := range variants {
 			if v.AddressingMode == "" {
@@ -311,16 +534,92 @@ func (ve *DefaultVariantExtractor) extractM3U8Variants(ctx context.Context, refe
 			}
 			filtered = append(filtered, v)
 		}
-		return filtered, err
+		if len(filtered) == 0 && skipped.NumFailed > 0 {
+			return nil, fmt.Errorf("all variants failed: %s", strings.Join(skipped.Reasons, ", "))
+		}
+		if ve.config.Thumbnails {
+			thumbnails, err := ve.m3u8Thumbnails(ctx, u, raw)
+			if err != nil {
+				return nil, err
+			}
+			filtered = append(filtered, thumbnails...)
+		}
+		if len(skipped.Reasons) > 0 {
+			return filtered, skipped
+		}
+		return filtered, nil
+	}
+
+	if p, ok := p.(*playlist.Media); ok {
+		var (
+			variant = &model.Variant{}
+			pollURL string
+		)
+		if isURL {
+			pollURL = u
+		}
+		p, err := ve.windowM3U8(ctx, pollURL, p, variant)
+		if err != nil {
+			return nil, err
+		}
+		variant, err = parseM3U8MediaVariant(u, reference.Servers, p, ve.config.HLSParts, variant)
+		if err != nil {
+			return nil, fmt.Errorf("extract m3u8 media variant: %w", err)
+		}
+		return []model.Variant{*variant}, nil
 	}
 
-	return nil, errors.New("master playlist not found")
+	return nil, errors.New("unsupported playlist")
 }
 
-func (ve *DefaultVariantExtractor) fetchM3U8(ctx context.Context, url string) (playlist.Playlist, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+func (ve *DefaultVariantExtractor) fetchM3U8(ctx context.Context, url string) (playlist.Playlist, string, error) {
+	raw, url, err := ve.fetchManifest(ctx, url)
 	if err != nil {
-		return nil, fmt.Errorf("new: %w", err)
+		return nil, "", err
+	}
+
+	p, err := playlist.Unmarshal(raw)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return p, url, nil
+}
+
+// fetchManifest fetches a manifest (MPD or playlist), retrying server
+// errors with backoff. Also returns its URL after any redirects to
+// resolve relative URIs against.
+func (ve *DefaultVariantExtractor) fetchManifest(ctx context.Context, url string) ([]byte, string, error) {
+	for try := 0; ; try++ {
+		raw, final, status, err := ve.fetchManifestOnce(ctx, url)
+		if err == nil || status < http.StatusInternalServerError || try >= ve.config.Retries {
+			return raw, final, err
+		}
+		if err := SleepRetry(ctx, ve.config, try); err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+func (ve *DefaultVariantExtractor) fetchManifestOnce(ctx context.Context, u string) ([]byte, string, int, error) {
+	// Media playlists of a local playlist are files next to it.
+	if parsed, err := url.Parse(u); err == nil && parsed.Scheme == "file" {
+		file, err := os.Open(filepath.FromSlash(parsed.Path))
+		if err != nil {
+			return nil, "", 0, fmt.Errorf("open: %w", err)
+		}
+		defer file.Close()
+
+		raw, err := ve.readManifest(file)
+		if err != nil {
+			return nil, "", 0, fmt.Errorf("read file: %w", err)
+		}
+		return raw, u, 0, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("new: %w", err)
 	}
 
 	if ve.origin != "" {
@@ -330,32 +629,139 @@ func (ve *DefaultVariantExtractor) fetchM3U8(ctx context.Context, url string) (p
 
 	res, err := ve.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("do: %w", err)
+		return nil, "", 0, fmt.Errorf("do: %w", err)
 	}
 	defer res.Body.Close()
 
-	raw, err := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		const snippetLen = 256
+		snippet, _ := io.ReadAll(io.LimitReader(res.Body, snippetLen))
+		// CDNs refuse manifests by location with a 403 telling so.
+		if res.StatusCode == http.StatusForbidden && geoBlockedBody(snippet) {
+			return nil, "", res.StatusCode, &GeoBlockedError{Country: ve.config.CountryCode, Reason: fmt.Sprintf("status %s: %q", res.Status, snippet)}
+		}
+		return nil, "", res.StatusCode, fmt.Errorf("status %s: %q", res.Status, snippet)
+	}
+
+	raw, err := ve.readManifest(res.Body)
 	if err != nil {
-		return nil, fmt.Errorf("read body: %w", err)
+		return nil, "", res.StatusCode, fmt.Errorf("read body: %w", err)
 	}
 
-	return playlist.Unmarshal(raw)
+	return raw, res.Request.URL.String(), res.StatusCode, nil
 }
 
-func (ve *DefaultVariantExtractor) extractM3U8Variant(ctx context.Context, url string, servers []string, v *playlist.MultivariantVariant) (*model.Variant, error) {
-	widthStr, heightStr, ok := strings.Cut(v.Resolution, "x")
-	if !ok {
-		return nil, fmt.Errorf("resolution: %s", v.Resolution)
+// readManifest reads the body of a manifest, failing rather than reading
+// beyond the maximum size, as servers may misbehave.
+func (ve *DefaultVariantExtractor) readManifest(r io.Reader) ([]byte, error) {
+	limit := ve.config.MaxManifestBytes
+	if limit <= 0 {
+		return io.ReadAll(r)
 	}
 
-	width, err := strconv.ParseUint(widthStr, 10, 32)
+	raw, err := io.ReadAll(io.LimitReader(r, limit+1))
 	if err != nil {
-		return nil, fmt.Errorf("width: %w", err)
+		return nil, err
+	}
+	if int64(len(raw)) > limit {
+		return nil, fmt.Errorf("manifest larger than %d bytes, see --max-manifest-size", limit)
 	}
 
-	height, err := strconv.ParseUint(heightStr, 10, 32)
-	if err != nil {
-		return nil, fmt.Errorf("height: %w", err)
+	return raw, nil
+}
+
+// parseM3U8StreamAttributes parses the attributes of the
+// EXT-X-STREAM-INF and EXT-X-I-FRAME-STREAM-INF tags of a multivariant
+// playlist, keyed by URI.
+func parseM3U8StreamAttributes(raw []byte) (map[string]primitives.Attributes, error) {
+	var (
+		attrsByURI = make(map[string]primitives.Attributes)
+		pending    primitives.Attributes
+	)
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			pending = primitives.Attributes{}
+			if err := pending.Unmarshal(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:")); err != nil {
+				return nil, fmt.Errorf("stream attributes: %w", err)
+			}
+		case strings.HasPrefix(line, "#EXT-X-I-FRAME-STREAM-INF:"):
+			var attrs primitives.Attributes
+			if err := attrs.Unmarshal(strings.TrimPrefix(line, "#EXT-X-I-FRAME-STREAM-INF:")); err != nil {
+				return nil, fmt.Errorf("i-frame stream attributes: %w", err)
+			}
+			attrsByURI[attrs["URI"]] = attrs
+		case strings.HasPrefix(line, "#"):
+		case pending != nil:
+			attrsByURI[line] = pending
+			pending = nil
+		}
+	}
+
+	return attrsByURI, nil
+}
+
+// parseM3U8IFrameStreams parses the EXT-X-I-FRAME-STREAM-INF tags of a
+// multivariant playlist, which the playlist package skips over.
+func parseM3U8IFrameStreams(raw []byte) ([]*playlist.MultivariantVariant, error) {
+	var streams []*playlist.MultivariantVariant
+	for _, line := range strings.Split(string(raw), "\n") {
+		line, ok := strings.CutPrefix(strings.TrimSpace(line), "#EXT-X-I-FRAME-STREAM-INF:")
+		if !ok {
+			continue
+		}
+
+		var attrs primitives.Attributes
+		if err := attrs.Unmarshal(line); err != nil {
+			return nil, fmt.Errorf("i-frame stream attributes: %w", err)
+		}
+
+		bandwidth, err := strconv.Atoi(attrs["BANDWIDTH"])
+		if err != nil {
+			return nil, fmt.Errorf("i-frame stream bandwidth: %w", err)
+		}
+
+		v := &playlist.MultivariantVariant{
+			Bandwidth:  bandwidth,
+			URI:        attrs["URI"],
+			Resolution: attrs["RESOLUTION"],
+		}
+		if c := attrs["CODECS"]; c != "" {
+			v.Codecs = strings.Split(c, ",")
+		}
+		streams = append(streams, v)
+	}
+
+	return streams, nil
+}
+
+// errIFramesOnly is returned for a variant whose media playlist turns out
+// to be I-frame only (EXT-X-I-FRAMES-ONLY), although not listed as such.
+var errIFramesOnly = errors.New("i-frame only playlist")
+
+// extractM3U8Variant extracts the variant of a multivariant playlist,
+// also given its raw attributes for those the playlist package skips
+// (VIDEO-RANGE and SCORE), and whether it's an I-frame stream.
+func (ve *DefaultVariantExtractor) extractM3U8Variant(ctx context.Context, url string, servers []string, v *playlist.MultivariantVariant, attrs primitives.Attributes, iFrame bool) (*model.Variant, error) {
+	var width, height uint64
+	if v.Resolution != "" {
+		widthStr, heightStr, ok := strings.Cut(v.Resolution, "x")
+		if !ok {
+			return nil, fmt.Errorf("resolution: %s", v.Resolution)
+		}
+
+		var err error
+		width, err = strconv.ParseUint(widthStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("width: %w", err)
+		}
+
+		height, err = strconv.ParseUint(heightStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("height: %w", err)
+		}
 	}
 
 	if v.Bandwidth > math.MaxUint32 {
@@ -363,80 +769,444 @@ func (ve *DefaultVariantExtractor) extractM3U8Variant(ctx context.Context, url s
 	}
 	bandwidth := uint32(v.Bandwidth)
 
-	if len(v.Codecs) == 0 {
+	// Codecs are left empty if missing, unless required.
+	if len(v.Codecs) == 0 && ve.config.CodecsRequired {
 		return nil, errors.New("no codecs")
 	}
-	codecs := v.Codecs[0]
+	codecs, audioCodecs := splitM3U8Codecs(v.Codecs)
 
-	u := resolveReference(url, v.URI)
-	p, err := ve.fetchM3U8(ctx, u)
+	raw, u, err := ve.fetchManifest(ctx, resolveReference(url, v.URI))
 	if err != nil {
 		return nil, fmt.Errorf("fetch m3u8: %w", err)
 	}
+	// The playlist package doesn't parse EXT-X-I-FRAMES-ONLY.
+	if !iFrame && bytes.Contains(raw, []byte("#EXT-X-I-FRAMES-ONLY")) {
+		return nil, errIFramesOnly
+	}
+	p, err := playlist.Unmarshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("read m3u8: %w", err)
+	}
 
 	variant := &model.Variant{
-		Codecs:    codecs,
-		Width:     uint32(width),
-		Height:    uint32(height),
-		Bandwidth: bandwidth,
+		Codecs:       codecs,
+		AudioCodecs:  audioCodecs,
+		Width:        uint32(width),
+		Height:       uint32(height),
+		Bandwidth:    bandwidth,
+		DynamicRange: attrs["VIDEO-RANGE"],
+	}
+	if v.FrameRate != nil {
+		variant.FrameRate = *v.FrameRate
+	}
+	if v.AverageBandwidth != nil {
+		if *v.AverageBandwidth > math.MaxUint32 {
+			return nil, errors.New("average bandwidth > uint32")
+		}
+		variant.AverageBandwidth = uint32(*v.AverageBandwidth)
+	}
+	if s := attrs["SCORE"]; s != "" {
+		score, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("score: %w", err)
+		}
+		variant.Score = score
 	}
 
-	var (
-		fp        model.Fingerprint
-		isIndexed bool
-	)
+	if p, ok := p.(*playlist.Media); ok {
+		p, err := ve.windowM3U8(ctx, u, p, variant)
+		if err != nil {
+			return nil, err
+		}
+		return parseM3U8MediaVariant(u, servers, p, ve.config.HLSParts, variant)
+	}
+
+	return nil, errors.New("media playlist not found")
+}
+
+// parseMPDFrameRate parses a frame rate, either integer or fraction
+// (e.g. "30000/1001"). Returns 0 if empty.
+func parseMPDFrameRate(frameRate mpd.FrameRateType) (float64, error) {
+	if frameRate == "" {
+		return 0, nil
+	}
+
+	numStr, denStr, isFraction := strings.Cut(string(frameRate), "/")
+	num, err := strconv.ParseUint(numStr, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if !isFraction {
+		return float64(num), nil
+	}
+	den, err := strconv.ParseUint(denStr, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if den == 0 {
+		return 0, errors.New("zero denominator")
+	}
+
+	return float64(num) / float64(den), nil
+}
+
+// mpdDynamicRange returns the dynamic range ("SDR", "PQ" or "HLG") signaled
+// by the transfer characteristics property of a representation or its
+// adaptation set. Returns empty string if not signaled.
+func mpdDynamicRange(r *mpd.RepresentationType) string {
+	props := slices.Concat(r.EssentialProperties, r.SupplementalProperties)
+	if a := r.Parent(); a != nil {
+		props = slices.Concat(props, a.EssentialProperties, a.SupplementalProperties)
+	}
+
+	for _, p := range props {
+		if p == nil || p.SchemeIdUri != "urn:mpeg:mpegB:cicp:TransferCharacteristics" {
+			continue
+		}
+		switch p.Value {
+		case "16":
+			return "PQ"
+		case "18":
+			return "HLG"
+		case "1", "6", "13", "14", "15":
+			return "SDR"
+		}
+	}
+
+	return ""
+}
+
+// windowM3U8 returns the media playlist p as is, unless live (or event),
+// which is rejected unless a live window is accepted. The variant is then
+// marked live, and the window extended by polling u (unless empty) until
+// it covers LiveDuration.
+func (ve *DefaultVariantExtractor) windowM3U8(ctx context.Context, u string, p *playlist.Media, variant *model.Variant) (*playlist.Media, error) {
+	if p.Endlist || (p.PlaylistType != nil && *p.PlaylistType == playlist.MediaPlaylistTypeVOD) {
+		return p, nil
+	}
+	if !ve.config.LiveWindow {
+		return nil, errors.New("live/event playlist (no EXT-X-ENDLIST), fingerprint its current window with --live-window")
+	}
+
+	now := time.Now().UTC()
+	variant.Live = true
+	variant.SnapshotTime = &now
+
+	for u != "" && !p.Endlist && m3u8Duration(p) < ve.config.LiveDuration {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(max(p.TargetDuration, 1)) * time.Second):
+		}
+
+		next, _, err := ve.fetchM3U8(ctx, u)
+		if err != nil {
+			return nil, fmt.Errorf("poll m3u8: %w", err)
+		}
+		n, ok := next.(*playlist.Media)
+		if !ok {
+			return nil, errors.New("poll m3u8: not a media playlist")
+		}
+
+		// Segments already in the window are skipped, a window that has
+		// moved past the end of ours has lost segments.
+		offset := p.MediaSequence + len(p.Segments) - n.MediaSequence
+		if offset < 0 {
+			return nil, fmt.Errorf("poll m3u8: missed %d segment(s)", -offset)
+		}
+		if offset < len(n.Segments) {
+			p.Segments = append(p.Segments, n.Segments[offset:]...)
+		}
+		p.Parts = n.Parts
+		p.Endlist = n.Endlist
+	}
+
+	variant.MediaSequenceStart = p.MediaSequence
+	variant.MediaSequenceEnd = p.MediaSequence + len(p.Segments) - 1
+
+	return p, nil
+}
+
+func m3u8Duration(p *playlist.Media) time.Duration {
+	var d time.Duration
+	for _, seg := range p.Segments {
+		d += seg.Duration
+	}
+	return d
+}
+
+// parseM3U8MediaVariant walks the segments of a media playlist, filling in
+// the addressing info (or fingerprint, if all segments are byte-ranged) of
+// variant. Sizes of byte-ranged segments in a playlist that also has URL
+// segments are kept in place, so that only the latter are fetched. If
+// parts is set, LL-HLS partial segments are walked instead where present.
+func parseM3U8MediaVariant(u string, servers []string, p *playlist.Media, parts bool, variant *model.Variant) (*model.Variant, error) {
 	info := &model.ExplicitAddressingInfo{
 		Servers:   servers,
 		Timescale: 1000,
 	}
 
-	if p, ok := p.(*playlist.Media); ok {
-		for _, seg := range p.Segments {
-			if variant.MimeType == "" {
-				switch filepath.Ext(seg.URI) {
-				case ".ts":
-					variant.MimeType = "video/mp2t"
-				case ".m4s", ".m4v", ".mp4":
-					variant.MimeType = "video/mp4"
-				}
+	// The init segment is sized here if byte-ranged,
+	// otherwise by its URL during fingerprinting.
+	if m := p.Map; m != nil {
+		if m.ByteRangeLength != nil {
+			if *m.ByteRangeLength > math.MaxUint32 {
+				return nil, errors.New("init segment size > uint32")
 			}
+			info.InitSize = uint32(*m.ByteRangeLength)
+		} else {
+			info.InitURL = resolveReference(u, m.URI)
+		}
+	}
 
-			dur := seg.Duration.Milliseconds()
+	// With parts, LL-HLS partial segments replace their parent
+	// segments. Trailing parts of an incomplete segment are
+	// included, preload hints are not.
+	type entry struct {
+		uri             string
+		duration        time.Duration
+		byteRangeLength *uint64
+		key             *playlist.MediaKey
+		gap             bool
+		discontinuity   bool
+	}
+	var (
+		entries []entry
+		lastKey *playlist.MediaKey
+	)
+	for _, seg := range p.Segments {
+		lastKey = seg.Key
+		if parts && len(seg.Parts) > 0 {
+			for i, pt := range seg.Parts {
+				entries = append(entries, entry{pt.URI, pt.Duration, pt.ByteRangeLength, seg.Key, seg.Gap || pt.Gap, seg.Discontinuity && i == 0})
+			}
+			info.Granularity = "part"
+			continue
+		}
+		entries = append(entries, entry{seg.URI, seg.Duration, seg.ByteRangeLength, seg.Key, seg.Gap, seg.Discontinuity})
+	}
+	if parts && len(p.Parts) > 0 {
+		for _, pt := range p.Parts {
+			entries = append(entries, entry{pt.URI, pt.Duration, pt.ByteRangeLength, lastKey, pt.Gap, false})
+		}
+		info.Granularity = "part"
+	}
+
+	// Gaps have no content to fingerprint, only their position and
+	// duration are recorded.
+	var (
+		gaps          []model.Gap
+		present       = entries[:0:0]
+		discontinuity bool
+	)
+	for _, e := range entries {
+		e.discontinuity = e.discontinuity || discontinuity
+		discontinuity = false
+		if e.gap {
+			discontinuity = e.discontinuity
+			dur := e.duration.Milliseconds()
 			if dur > math.MaxUint32 {
-				return nil, errors.New("segment duration > uint32")
+				return nil, errors.New("gap duration > uint32")
 			}
+			gaps = append(gaps, model.Gap{Index: len(present), Duration: uint32(dur)})
+			continue
+		}
+		present = append(present, e)
+	}
+	if len(present) == 0 {
+		return nil, errors.New("no segments")
+	}
+	entries = present
+	info.Gaps = gaps
 
-			if seg.ByteRangeLength != nil {
-				if !isIndexed {
-					variant.AddressingMode = "fingerprinted"
-					variant.Fingerprint = &fp
-					isIndexed = true
-					fp.Timescale = 1000
-				}
-				size := *seg.ByteRangeLength
-				if size > math.MaxUint32 {
-					return nil, errors.New("segment size > uint32")
-				}
-				fp.SegmentSizes = append(variant.Fingerprint.SegmentSizes, uint32(size))
-				fp.SegmentDurations = append(variant.Fingerprint.SegmentDurations, uint32(dur))
-				continue
+	var (
+		sizes     = make([]uint32, len(entries))
+		numRanged int
+	)
+	for i, e := range entries {
+		variant.Protection = appendM3U8Protection(variant.Protection, e.key, i)
+		if e.discontinuity {
+			info.Discontinuities = append(info.Discontinuities, i)
+		}
+
+		if variant.MimeType == "" {
+			switch filepath.Ext(e.uri) {
+			case ".ts":
+				variant.MimeType = "video/mp2t"
+			case ".m4s", ".m4v", ".mp4":
+				variant.MimeType = "video/mp4"
+			}
+		}
+
+		dur := e.duration.Milliseconds()
+		if dur > math.MaxUint32 {
+			return nil, errors.New("segment duration > uint32")
+		}
+		info.SegmentDurations = append(info.SegmentDurations, uint32(dur))
+
+		if e.byteRangeLength != nil {
+			size := *e.byteRangeLength
+			if size > math.MaxUint32 {
+				return nil, errors.New("segment size > uint32")
+			}
+			if size == 0 {
+				return nil, fmt.Errorf("segment %d: zero byte-range length", i)
+			}
+			sizes[i] = uint32(size)
+			info.URLs = append(info.URLs, "")
+			numRanged++
+			continue
+		}
+
+		info.URLs = append(info.URLs, resolveReference(u, e.uri))
+	}
+
+	// Unencrypted throughout.
+	if len(variant.Protection) == 1 && variant.Protection[0].Method == playlist.MediaKeyMethodNone {
+		variant.Protection = nil
+	}
+
+	variant.ID = computeID(variant.MimeType, variant.Codecs, variant.Width, variant.Height, variant.Bandwidth, variant.FrameRate)
+
+	switch {
+	case numRanged > 0 && numRanged == len(entries):
+		variant.AddressingMode = "fingerprinted"
+		variant.Fingerprint = &model.Fingerprint{
+			Granularity:      info.Granularity,
+			InitSegmentSize:  info.InitSize,
+			SegmentSizes:     sizes,
+			SegmentDurations: info.SegmentDurations,
+			Timescale:        info.Timescale,
+			Gaps:             info.Gaps,
+			Discontinuities:  info.Discontinuities,
+		}
+		if info.InitURL != "" {
+			variant.ExplicitAddressingInfo = &model.ExplicitAddressingInfo{
+				InitURL: info.InitURL,
+				Servers: servers,
 			}
+		}
+	case numRanged > 0:
+		info.SegmentSizes = sizes
+		fallthrough
+	default:
+		variant.AddressingMode = "explicit"
+		variant.ExplicitAddressingInfo = info
+	}
+
+	return variant, nil
+}
 
-			info.URLs = append(info.URLs, resolveReference(u, seg.URI))
-			info.SegmentDurations = append(info.SegmentDurations, uint32(dur))
+// appendM3U8Protection appends the protection of the i:th segment, encrypted
+// by key, unless unchanged since the previous segment.
+func appendM3U8Protection(protection []model.Protection, key *playlist.MediaKey, i int) []model.Protection {
+	pr := model.Protection{
+		Method:       playlist.MediaKeyMethodNone,
+		FirstSegment: i,
+	}
+	if key != nil {
+		pr.Method = string(key.Method)
+		pr.KeyFormat = key.KeyFormat
+		pr.IV = key.IV != ""
+	}
+
+	if l := len(protection); l > 0 {
+		last := protection[l-1]
+		if last.Method == pr.Method && last.KeyFormat == pr.KeyFormat && last.IV == pr.IV {
+			return protection
 		}
+	}
+
+	return append(protection, pr)
+}
 
-		variant.ID = computeID(variant.MimeType, variant.Codecs, variant.Width, variant.Height, variant.Bandwidth)
+// parseM3U8SessionKeys parses the EXT-X-SESSION-KEY tags of a
+// multivariant playlist, which the playlist package skips over.
+func parseM3U8SessionKeys(raw []byte) ([]model.Protection, error) {
+	var protection []model.Protection
+	for _, line := range strings.Split(string(raw), "\n") {
+		line, ok := strings.CutPrefix(strings.TrimSpace(line), "#EXT-X-SESSION-KEY:")
+		if !ok {
+			continue
+		}
 
-		if !isIndexed {
-			variant.AddressingMode = "explicit"
-			variant.ExplicitAddressingInfo = info
+		var attrs primitives.Attributes
+		if err := attrs.Unmarshal(line); err != nil {
+			return nil, fmt.Errorf("session key attributes: %w", err)
 		}
 
-		return variant, nil
+		protection = append(protection, model.Protection{
+			Method:    attrs["METHOD"],
+			KeyFormat: attrs["KEYFORMAT"],
+			IV:        attrs["IV"] != "",
+			Session:   true,
+		})
 	}
 
-	return nil, errors.New("media playlist not found")
+	return protection, nil
+}
+
+// SkippedVariantsError is returned along with the extracted variants when
+// some variants were skipped, deliberately or since their extraction
+// failed (counted by NumFailed). It's informational; the returned
+// variants are valid.
+type SkippedVariantsError struct {
+	Reasons   []string
+	NumFailed int
+}
+
+func (e *SkippedVariantsError) add(uri, reason string) {
+	e.Reasons = append(e.Reasons, fmt.Sprintf("%q: %s", uri, reason))
+}
+
+func (e *SkippedVariantsError) Error() string {
+	return fmt.Sprintf("skipped %d variant(s): %s", len(e.Reasons), strings.Join(e.Reasons, ", "))
+}
+
+// splitM3U8Codecs splits the CODECS list of a variant, listed in any
+// order, into its video codec and the rest (audio) joined. If no video
+// codec is recognized the whole list is joined as video.
+func splitM3U8Codecs(list []string) (string, string) {
+	var (
+		video string
+		audio []string
+	)
+	for _, c := range list {
+		c = strings.TrimSpace(c)
+		if video == "" && isVideoCodec(c) {
+			video = c
+			continue
+		}
+		audio = append(audio, c)
+	}
+	if video == "" {
+		return strings.Join(audio, ","), ""
+	}
+	return video, strings.Join(audio, ",")
+}
+
+var videoCodecPrefixes = []string{"avc1", "avc3", "hvc1", "hev1", "dvh1", "dvhe", "dvav", "dva1", "dav1", "av01", "vp09", "vp8", "mp4v"}
+
+var audioCodecPrefixes = []string{"mp4a", "ac-3", "ec-3", "ac-4", "opus", "Opus", "flac", "fLaC", "alac", "dtsc", "dtse", "dtsh", "dtsl", "dtsx", "mha1", "mhm1"}
+
+func isVideoCodec(codec string) bool {
+	codec = strings.TrimSpace(codec)
+	for _, p := range videoCodecPrefixes {
+		if strings.HasPrefix(codec, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func isAudioCodec(codec string) bool {
+	codec = strings.TrimSpace(codec)
+	for _, p := range audioCodecPrefixes {
+		if strings.HasPrefix(codec, p) {
+			return true
+		}
+	}
+	return false
 }
 
 type variantGroup struct {
@@ -496,7 +1266,7 @@ func (vg *variantGroup) merge() []model.Variant {
 
 		m.Bandwidth = uint32(sum / int64(len(vs)))
 		if m.Bandwidth != vs[0].Bandwidth {
-			m.ID = computeID(m.MimeType, m.Codecs, m.Width, m.Height, m.Bandwidth)
+			m.ID = computeID(m.MimeType, m.Codecs, m.Width, m.Height, m.Bandwidth, m.FrameRate)
 		}
 
 		merged = append(merged, m)
@@ -524,7 +1294,13 @@ func resolveReference(baseURL, u string) string {
 	return base.ResolveReference(ref).String()
 }
 
-func computeID(mimeType, codecs string, width, height, bandwidth uint32) string {
-	hash := md5.Sum([]byte(fmt.Sprintf("%s-%s-%d-%d-%d", mimeType, codecs, width, height, bandwidth)))
+// computeID hashes the properties of a variant. The frame rate is only
+// included if known, keeping the IDs of variants without it unchanged.
+func computeID(mimeType, codecs string, width, height, bandwidth uint32, frameRate float64) string {
+	s := fmt.Sprintf("%s-%s-%d-%d-%d", mimeType, codecs, width, height, bandwidth)
+	if frameRate > 0 {
+		s += fmt.Sprintf("-%g", frameRate)
+	}
+	hash := md5.Sum([]byte(s))
 	return hex.EncodeToString(hash[:])
 }
@@ -0,0 +1,554 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/dash-mpd/mpd"
+	"karl/pkg/config"
+	"karl/pkg/model"
+)
+
+func extractFileVariants(t *testing.T, path, format string) ([]model.Variant, error) {
+	t.Helper()
+	return extractFileVariantsConfig(t, &config.AppConfig{}, path, format)
+}
+
+func extractFileVariantsConfig(t *testing.T, config *config.AppConfig, path, format string) ([]model.Variant, error) {
+	t.Helper()
+	ve := NewDefaultVariantExtractor(config, nil, "")
+	return ve.ExtractVariants(context.Background(), model.Reference{URL: path, Format: format})
+}
+
+func TestExtractMPDVariantsStaticChunked(t *testing.T) {
+	vs, err := extractFileVariants(t, "../../testdata/dash/lowlatency/manifest.mpd", "dash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 {
+		t.Fatalf("variants = %d, want 2", len(vs))
+	}
+	for _, v := range vs {
+		info := v.ExplicitAddressingInfo
+		if info == nil {
+			t.Fatalf("variant %s: no explicit addressing", v.ID)
+		}
+		// 8 segment sequences of 4 segments each.
+		if n := len(info.URLs); n != 32 {
+			t.Fatalf("variant %s: urls = %d, want 32", v.ID, n)
+		}
+		if !strings.HasSuffix(info.URLs[0], "/1_1.m4s") || !strings.HasSuffix(info.URLs[5], "/2_2.m4s") || !strings.HasSuffix(info.URLs[31], "/8_4.m4s") {
+			t.Errorf("variant %s: urls %v", v.ID, info.URLs)
+		}
+		for i, d := range info.SegmentDurations {
+			if d != 500 {
+				t.Errorf("variant %s: duration %d = %d, want 500", v.ID, i, d)
+			}
+		}
+	}
+}
+
+func TestExtractMPDVariantsStaticServiceDescription(t *testing.T) {
+	vs, err := extractFileVariants(t, "../../testdata/dash/lowlatency/servicedescription.mpd", "dash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 1 || len(vs[0].ExplicitAddressingInfo.URLs) != 4 {
+		t.Fatalf("variants = %+v, want 1 of 4 segments", vs)
+	}
+}
+
+func TestExtractMPDVariantsDynamicLowLatency(t *testing.T) {
+	for _, name := range []string{"manifest.mpd", "servicedescription.mpd"} {
+		b, err := os.ReadFile(filepath.Join("../../testdata/dash/lowlatency", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(strings.Replace(string(b), `type="static"`, `type="dynamic"`, 1)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := extractFileVariants(t, path, "dash"); !errors.Is(err, errLowLatencyDASH) {
+			t.Errorf("%s: err = %v, want %v", name, err, errLowLatencyDASH)
+		}
+	}
+}
+
+func TestExtractMPDVariantsTimeline(t *testing.T) {
+	const manifest = "../../testdata/dash/timeline/manifest.mpd"
+	vs, err := extractFileVariants(t, manifest, "dash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 {
+		t.Fatalf("variants = %d, want 2", len(vs))
+	}
+	for _, v := range vs {
+		info := v.ExplicitAddressingInfo
+		if info == nil {
+			t.Fatalf("variant %s: no explicit addressing", v.ID)
+		}
+		id := path.Base(path.Dir(info.TemplateURL))
+		var want []string
+		for _, ts := range []int{0, 4000, 8000, 12000, 16000, 20000, 24000, 28000, 32000, 36000, 40000, 42000, 44000, 46000} {
+			want = append(want, fmt.Sprintf("https://example.com/timeline/%s/%d.m4s", id, ts))
+		}
+		if !slices.Equal(info.URLs, want) {
+			t.Errorf("variant %s: urls %v, want %v", id, info.URLs, want)
+		}
+	}
+
+	// The audio timeline has no time, starting at 0.
+	m, err := mpd.ReadFromFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := parseMPDExplicitAddressingInfo("https://example.com/timeline/", m.Periods[0].AdaptationSets[1].Representations[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := range 8 {
+		want = append(want, fmt.Sprintf("https://example.com/timeline/a1/%d.m4s", i*196608))
+	}
+	if !slices.Equal(info.URLs, want) {
+		t.Errorf("audio urls %v, want %v", info.URLs, want)
+	}
+}
+
+func TestExtractM3U8VariantsLocal(t *testing.T) {
+	vs, err := extractFileVariants(t, "../../testdata/hls/iframe/master.m3u8", "hls")
+	var se *SkippedVariantsError
+	if errors.As(err, &se) {
+		err = nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) == 0 {
+		t.Fatal("no variants")
+	}
+	for _, v := range vs {
+		info := v.ExplicitAddressingInfo
+		if info == nil || len(info.URLs) != 3 {
+			t.Fatalf("variant %s: %+v, want 3 segments", v.ID, info)
+		}
+		// Next to their media playlist.
+		if u := info.URLs[0]; !strings.HasPrefix(u, "file://") || !strings.HasSuffix(u, "/seg0.ts") {
+			t.Errorf("variant %s: segment %q, want a file next to its playlist", v.ID, u)
+		}
+	}
+}
+
+func TestExtractM3U8VariantsLocalEscaped(t *testing.T) {
+	// Of a path escaped in file URLs.
+	dir := filepath.Join(t.TempDir(), "my 100% playlists")
+	if err := os.CopyFS(dir, os.DirFS("../../testdata/hls/codecs")); err != nil {
+		t.Fatal(err)
+	}
+
+	vs, err := extractFileVariants(t, filepath.Join(dir, "master.m3u8"), "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 {
+		t.Fatalf("variants = %d, want 2", len(vs))
+	}
+	for _, v := range vs {
+		if info := v.ExplicitAddressingInfo; info == nil || len(info.URLs) == 0 {
+			t.Errorf("variant %s: %+v, want segments", v.ID, info)
+		}
+	}
+}
+
+func TestExtractM3U8VariantsMediaPlaylist(t *testing.T) {
+	vs, err := extractFileVariants(t, "../../testdata/hls/media/urls.m3u8", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 1 {
+		t.Fatalf("variants = %d, want 1", len(vs))
+	}
+	v := vs[0]
+	if v.AddressingMode != "explicit" || v.MimeType != "video/mp4" || v.Width != 0 || v.Bandwidth != 0 {
+		t.Fatalf("variant %+v, want explicit video/mp4 of unknown resolution and bandwidth", v)
+	}
+	info := v.ExplicitAddressingInfo
+	if !strings.HasSuffix(info.InitURL, "/media/init.mp4") {
+		t.Errorf("init %q, want media/init.mp4", info.InitURL)
+	}
+	if len(info.URLs) != 3 || !strings.HasSuffix(info.URLs[2], "/media/seg2.m4s") {
+		t.Errorf("urls %v, want 3 segments next to the playlist", info.URLs)
+	}
+	if want := []uint32{4000, 4000, 2000}; !slices.Equal(info.SegmentDurations, want) {
+		t.Errorf("durations %v, want %v", info.SegmentDurations, want)
+	}
+}
+
+func TestExtractM3U8VariantsMediaPlaylistByteRange(t *testing.T) {
+	vs, err := extractFileVariants(t, "../../testdata/hls/media/byterange.m3u8", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 1 {
+		t.Fatalf("variants = %d, want 1", len(vs))
+	}
+	// Sized by the playlist, without fetching.
+	fp := vs[0].Fingerprint
+	if vs[0].AddressingMode != "fingerprinted" || fp == nil {
+		t.Fatalf("variant %+v, want fingerprinted", vs[0])
+	}
+	if fp.InitSegmentSize != 800 {
+		t.Errorf("init size %d, want 800", fp.InitSegmentSize)
+	}
+	if want := []uint32{120000, 110000, 60000}; !slices.Equal(fp.SegmentSizes, want) {
+		t.Errorf("sizes %v, want %v", fp.SegmentSizes, want)
+	}
+	if want := []uint32{4000, 4000, 2000}; !slices.Equal(fp.SegmentDurations, want) {
+		t.Errorf("durations %v, want %v", fp.SegmentDurations, want)
+	}
+}
+
+func TestExtractM3U8VariantsMixedByteRange(t *testing.T) {
+	srv := httptest.NewServer(http.FileServer(http.Dir("../../testdata/hls/mixed")))
+	defer srv.Close()
+
+	ve := NewDefaultVariantExtractor(&config.AppConfig{}, srv.Client(), "")
+	vs, err := ve.ExtractVariants(context.Background(), model.Reference{URL: srv.URL + "/prog.m3u8", Format: "hls"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 1 || vs[0].AddressingMode != "explicit" {
+		t.Fatalf("variants %+v, want 1 explicit", vs)
+	}
+	info := vs[0].ExplicitAddressingInfo
+	if want := []string{"", "", srv.URL + "/seg2.ts", srv.URL + "/seg3.ts"}; !slices.Equal(info.URLs, want) {
+		t.Errorf("urls %v, want %v", info.URLs, want)
+	}
+	if want := []uint32{1000, 1200, 0, 0}; !slices.Equal(info.SegmentSizes, want) {
+		t.Errorf("sizes %v, want %v", info.SegmentSizes, want)
+	}
+
+	// The URL segments are sized in between the byte-ranged.
+	f := NewDefaultFingerprinter(&config.AppConfig{}, srv.Client(), "", nil)
+	fp, err := f.Fingerprint(context.Background(), vs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{1000, 1200, 1880, 940}; !slices.Equal(fp.SegmentSizes, want) {
+		t.Errorf("fingerprint sizes %v, want %v", fp.SegmentSizes, want)
+	}
+	if want := []uint32{4000, 4000, 4000, 2000}; !slices.Equal(fp.SegmentDurations, want) {
+		t.Errorf("fingerprint durations %v, want %v", fp.SegmentDurations, want)
+	}
+	if want := []int{2}; !slices.Equal(fp.Discontinuities, want) {
+		t.Errorf("discontinuities %v, want %v", fp.Discontinuities, want)
+	}
+}
+
+func TestExtractM3U8VariantsGaps(t *testing.T) {
+	for _, tt := range []struct {
+		name            string
+		segments        []string
+		gaps            []model.Gap
+		discontinuities []int
+	}{
+		{"start", []string{"seg1.ts", "seg2.ts", "seg3.ts"}, []model.Gap{{Index: 0, Duration: 4000}}, nil},
+		// The discontinuity before the gaps moves to the segment after.
+		{"middle", []string{"seg0.ts", "seg3.ts", "seg4.ts"}, []model.Gap{{Index: 1, Duration: 4000}, {Index: 1, Duration: 4000}}, []int{1, 2}},
+		{"end", []string{"seg0.ts", "seg1.ts"}, []model.Gap{{Index: 2, Duration: 2000}}, nil},
+	} {
+		vs, err := extractFileVariants(t, "../../testdata/hls/gaps/"+tt.name+".m3u8", "hls")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		info := vs[0].ExplicitAddressingInfo
+		var segments []string
+		for _, u := range info.URLs {
+			segments = append(segments, path.Base(u))
+		}
+		if !slices.Equal(segments, tt.segments) {
+			t.Errorf("%s: segments %v, want %v", tt.name, segments, tt.segments)
+		}
+		if !slices.Equal(info.Gaps, tt.gaps) {
+			t.Errorf("%s: gaps %v, want %v", tt.name, info.Gaps, tt.gaps)
+		}
+		if !slices.Equal(info.Discontinuities, tt.discontinuities) {
+			t.Errorf("%s: discontinuities %v, want %v", tt.name, info.Discontinuities, tt.discontinuities)
+		}
+	}
+}
+
+func TestExtractM3U8VariantsServerError(t *testing.T) {
+	const media = "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.000,\nseg0.ts\n#EXT-X-ENDLIST\n"
+	var (
+		mu       sync.Mutex
+		requests = make(map[string]int)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+
+		switch {
+		case r.URL.Path == "/master.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n")
+			for i := range 5 {
+				fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"avc1.64001f\",RESOLUTION=1280x720\nv%d/prog.m3u8\n", (i+1)*100000, i)
+			}
+		// Down for good.
+		case r.URL.Path == "/v3/prog.m3u8":
+			http.Error(w, "origin down", http.StatusInternalServerError)
+		// Flaky, up on retry.
+		case r.URL.Path == "/v1/prog.m3u8" && n == 1:
+			http.Error(w, "try again", http.StatusBadGateway)
+		default:
+			fmt.Fprint(w, media)
+		}
+	}))
+	defer srv.Close()
+
+	ve := NewDefaultVariantExtractor(&config.AppConfig{Retries: 2, RetryBackoff: time.Millisecond}, srv.Client(), "")
+	vs, err := ve.ExtractVariants(context.Background(), model.Reference{URL: srv.URL + "/master.m3u8", Format: "hls"})
+	var se *SkippedVariantsError
+	if !errors.As(err, &se) {
+		t.Fatalf("err = %v, want skipped variants", err)
+	}
+	if len(vs) != 4 {
+		t.Errorf("variants = %d, want 4, the failed one not cancelling the others", len(vs))
+	}
+	if se.NumFailed != 1 || len(se.Reasons) != 1 || !strings.Contains(se.Reasons[0], "v3/prog.m3u8") || !strings.Contains(se.Reasons[0], "origin down") {
+		t.Errorf("skipped %+v, want v3 failed with the body of its response", se)
+	}
+	if n := requests["/v3/prog.m3u8"]; n != 3 {
+		t.Errorf("v3 requested %d times, want 3 (2 retries)", n)
+	}
+	if n := requests["/v1/prog.m3u8"]; n != 2 {
+		t.Errorf("v1 requested %d times, want 2", n)
+	}
+}
+
+func TestExtractMPDVariantsServerError(t *testing.T) {
+	manifest, err := os.ReadFile("../../testdata/dash/timeline/manifest.mpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu       sync.Mutex
+		requests = make(map[string]int)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+
+		switch {
+		case r.URL.Path == "/flaky.mpd" && n == 1:
+			http.Error(w, "try again", http.StatusBadGateway)
+		case r.URL.Path == "/down.mpd":
+			http.Error(w, "origin down", http.StatusInternalServerError)
+		case r.URL.Path == "/geo.mpd":
+			http.Error(w, "The Amazon CloudFront distribution is configured to block access from your country.", http.StatusForbidden)
+		case r.URL.Path == "/denied.mpd":
+			http.Error(w, "Access Denied", http.StatusForbidden)
+		default:
+			w.Write(manifest)
+		}
+	}))
+	defer srv.Close()
+
+	ve := NewDefaultVariantExtractor(&config.AppConfig{Retries: 2, RetryBackoff: time.Millisecond, CountryCode: "SE"}, srv.Client(), "")
+	extract := func(name string) error {
+		_, err := ve.ExtractVariants(context.Background(), model.Reference{URL: srv.URL + "/" + name, Format: "dash"})
+		return err
+	}
+
+	if err := extract("flaky.mpd"); err != nil {
+		t.Errorf("flaky: %v", err)
+	}
+	// Told by status and body rather than failing to parse it.
+	if err := extract("down.mpd"); err == nil || !strings.Contains(err.Error(), "status 500") || !strings.Contains(err.Error(), "origin down") {
+		t.Errorf("down: error %v, want the status and body", err)
+	}
+	var ge *GeoBlockedError
+	if err := extract("geo.mpd"); !errors.As(err, &ge) || ge.Country != "SE" {
+		t.Errorf("geo: error %v, want geo-blocked", err)
+	}
+	if err := extract("denied.mpd"); err == nil || errors.As(err, &ge) || !strings.Contains(err.Error(), "status 403") {
+		t.Errorf("denied: error %v, want the status, not geo-blocked", err)
+	}
+
+	// Server errors retried, client errors not.
+	for name, want := range map[string]int{"/flaky.mpd": 2, "/down.mpd": 3, "/geo.mpd": 1, "/denied.mpd": 1} {
+		if n := requests[name]; n != want {
+			t.Errorf("%s requested %d times, want %d", name, n, want)
+		}
+	}
+}
+
+func TestExtractVariantsRedirected(t *testing.T) {
+	const mpdBody = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT4S" profiles="urn:mpeg:dash:profile:isoff-live:2011">
+  <Period id="1">
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="v1" bandwidth="3000000" width="1920" height="1080" codecs="avc1.640028">
+        <SegmentTemplate timescale="1000" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Time$.m4s">
+          <SegmentTimeline><S t="0" d="4000"/></SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	mux := http.NewServeMux()
+	redirect := func(to string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, to, http.StatusFound) }
+	}
+	mux.Handle("/master.m3u8", redirect("/cdn/token/master.m3u8"))
+	mux.HandleFunc("/cdn/token/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1200000,CODECS=\"avc1.64001f\",RESOLUTION=1280x720\nv1/prog.m3u8\n")
+	})
+	mux.Handle("/cdn/token/v1/prog.m3u8", redirect("/edge/v1/prog.m3u8"))
+	mux.HandleFunc("/edge/v1/prog.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.000,\nseg0.ts\n#EXT-X-ENDLIST\n")
+	})
+	mux.Handle("/manifest.mpd", redirect("/cdn/token/manifest.mpd"))
+	mux.HandleFunc("/cdn/token/manifest.mpd", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, mpdBody)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ve := NewDefaultVariantExtractor(&config.AppConfig{}, srv.Client(), "")
+	for _, tt := range []struct {
+		path, format, want string
+	}{
+		// Both the multivariant and the media playlist redirected.
+		{"/master.m3u8", "hls", "/edge/v1/seg0.ts"},
+		{"/manifest.mpd", "dash", "/cdn/token/v1/0.m4s"},
+	} {
+		vs, err := ve.ExtractVariants(context.Background(), model.Reference{URL: srv.URL + tt.path, Format: tt.format})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		if len(vs) != 1 {
+			t.Fatalf("%s: variants = %d, want 1", tt.format, len(vs))
+		}
+		if urls := vs[0].ExplicitAddressingInfo.URLs; len(urls) != 1 || urls[0] != srv.URL+tt.want {
+			t.Errorf("%s: urls %v, want %s", tt.format, urls, srv.URL+tt.want)
+		}
+	}
+}
+
+func TestSplitM3U8Codecs(t *testing.T) {
+	for _, tt := range []struct {
+		list         []string
+		video, audio string
+	}{
+		{[]string{"avc1.64001f", "mp4a.40.2"}, "avc1.64001f", "mp4a.40.2"},
+		{[]string{"mp4a.40.2", "avc1.64001f"}, "avc1.64001f", "mp4a.40.2"},
+		{[]string{"ec-3", " hvc1.2.4.L123.B0", "mp4a.40.2"}, "hvc1.2.4.L123.B0", "ec-3,mp4a.40.2"},
+		// Nothing recognized as video, joined.
+		{[]string{"xyz1", "mp4a.40.2"}, "xyz1,mp4a.40.2", ""},
+		{nil, "", ""},
+	} {
+		video, audio := splitM3U8Codecs(tt.list)
+		if video != tt.video || audio != tt.audio {
+			t.Errorf("%q: %q and %q, want %q and %q", tt.list, video, audio, tt.video, tt.audio)
+		}
+	}
+}
+
+func TestExtractM3U8VariantsCodecs(t *testing.T) {
+	vs, err := extractFileVariants(t, "../../testdata/hls/codecs/master.m3u8", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 {
+		t.Fatalf("variants = %d, want 2", len(vs))
+	}
+	for _, v := range vs {
+		var codecs, audioCodecs string
+		if v.Height == 720 {
+			codecs, audioCodecs = "avc1.64001f", "mp4a.40.2"
+		}
+		if v.Codecs != codecs || v.AudioCodecs != audioCodecs {
+			t.Errorf("variant %dp: codecs %q and %q, want %q and %q", v.Height, v.Codecs, v.AudioCodecs, codecs, audioCodecs)
+		}
+		if want := computeID(v.MimeType, codecs, v.Width, v.Height, v.Bandwidth, v.FrameRate); v.ID != want {
+			t.Errorf("variant %dp: id %s, want %s of its video codec", v.Height, v.ID, want)
+		}
+	}
+}
+
+func TestExtractM3U8VariantsIFrames(t *testing.T) {
+	for _, trickplay := range []bool{false, true} {
+		vs, err := extractFileVariantsConfig(t, &config.AppConfig{IncludeTrickplay: trickplay}, "../../testdata/hls/iframe/master.m3u8", "hls")
+		var se *SkippedVariantsError
+		if errors.As(err, &se) {
+			err = nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var regular, iFrame []model.Variant
+		for _, v := range vs {
+			if v.Type == "iframe" {
+				iFrame = append(iFrame, v)
+			} else {
+				regular = append(regular, v)
+			}
+		}
+		// The audio-only variant and the I-frame playlist listed as a
+		// variant are skipped, I-frame streams kept if asked for.
+		wantIFrame := 0
+		if trickplay {
+			wantIFrame = 2
+		}
+		if len(regular) != 2 || len(iFrame) != wantIFrame {
+			t.Fatalf("trickplay %t: variants = %d regular, %d I-frame, want 2 and %d", trickplay, len(regular), len(iFrame), wantIFrame)
+		}
+		for _, v := range regular {
+			if v.Height != 720 && v.Height != 360 {
+				t.Errorf("variant %+v, want of 720p or 360p", v)
+			}
+		}
+		// Fingerprinted by their byte-ranged segment lists.
+		for _, v := range iFrame {
+			fp := v.Fingerprint
+			if v.AddressingMode != "fingerprinted" || fp == nil {
+				t.Fatalf("I-frame variant %+v, want fingerprinted", v)
+			}
+			if want := []uint32{188, 188, 188}; !slices.Equal(fp.SegmentSizes, want) {
+				t.Errorf("I-frame variant %dp: sizes %v, want %v", v.Height, fp.SegmentSizes, want)
+			}
+		}
+	}
+}
+
+func TestExtractM3U8VariantsDolbyVision(t *testing.T) {
+	vs, err := extractFileVariants(t, "../../testdata/hls/dolbyvision/master.m3u8", "hls")
+	var se *SkippedVariantsError
+	if errors.As(err, &se) {
+		err = nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 1 || vs[0].Height != 1080 || !strings.HasPrefix(vs[0].Codecs, "dvav") {
+		t.Fatalf("variants = %+v, want the Dolby Vision one", vs)
+	}
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+	"karl/pkg/config"
+	"karl/pkg/model"
+)
+
+// VideoLimiter limits the requests for the videos (e.g. seasons, episodes
+// and bonus content) of a URL made concurrently, to not provoke throttling
+// of an API. One limiter is shared by nested fan-outs, bounding them as
+// one.
+type VideoLimiter struct {
+	sem *semaphore.Weighted
+	wg  sync.WaitGroup
+}
+
+// NewVideoLimiter returns a limiter of the videos of a URL extracted
+// concurrently.
+func NewVideoLimiter(config *config.AppConfig) *VideoLimiter {
+	n := int64(VideoConcurrency(config))
+	if n < 0 {
+		n = math.MaxInt64
+	}
+	return &VideoLimiter{sem: semaphore.NewWeighted(n)}
+}
+
+// Go runs f once a slot is free, holding it until f returns. f may add
+// nested work with Go, but not wait on it, not to deadlock. If ctx is done
+// before a slot is free, fail is run with its error instead, for no video
+// to be dropped without a result.
+func (l *VideoLimiter) Go(ctx context.Context, f func(), fail func(error)) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+
+		if err := l.sem.Acquire(ctx, 1); err != nil {
+			fail(err)
+			return
+		}
+		defer l.sem.Release(1)
+		f()
+	}()
+}
+
+// Wait waits for the work added, nested work included.
+func (l *VideoLimiter) Wait() {
+	l.wg.Wait()
+}
+
+// Series is of the seasons, S, of a series, and their episodes, E, sent
+// by SendSeries.
+type Series[S, E any] struct {
+	Seasons []S
+	// Number returns the number of a season, or 0 if unknown.
+	Number func(S) int32
+	// Episodes fetches the episodes of a season, its error telling which.
+	Episodes func(context.Context, S) ([]E, error)
+	// EpisodeNumber returns the season and episode numbers of an episode.
+	EpisodeNumber func(E) (season, episode int32)
+	// Send sends the results of an episode.
+	Send func(context.Context, E, chan<- model.VideoResult)
+}
+
+// SendSeries sends the results of the episodes of the seasons of s. The
+// seasons are told first, for those failing to be accounted for. Seasons,
+// and their episodes as soon as one is fetched, share one limiter.
+func SendSeries[S, E any](ctx context.Context, config *config.AppConfig, s Series[S, E], results chan<- model.VideoResult) {
+	var numbers []int32
+	for _, season := range s.Seasons {
+		if n := s.Number(season); n > 0 {
+			numbers = append(numbers, n)
+		}
+	}
+	if len(numbers) > 0 {
+		results <- model.VideoResult{Seasons: numbers}
+	}
+
+	l := NewVideoLimiter(config)
+	for _, season := range s.Seasons {
+		n := s.Number(season)
+		l.Go(ctx, func() {
+			episodes, err := s.Episodes(ctx, season)
+			if err != nil {
+				results <- model.VideoResult{Err: err, Season: n}
+				return
+			}
+
+			for _, e := range episodes {
+				l.Go(ctx, func() {
+					s.Send(ctx, e, results)
+				}, func(err error) {
+					sn, en := s.EpisodeNumber(e)
+					results <- model.VideoResult{
+						Err:     fmt.Errorf("season %d, episode %d: %w", sn, en, err),
+						Season:  sn,
+						Episode: en,
+					}
+				})
+			}
+		}, func(err error) {
+			results <- model.VideoResult{Err: fmt.Errorf("season %d: %w", n, err), Season: n}
+		})
+	}
+	l.Wait()
+}
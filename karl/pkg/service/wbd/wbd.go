@@ -0,0 +1,390 @@
+// Package wbd implements the content and playback APIs shared
+// by Warner Bros. Discovery services (Max, discovery+).
+package wbd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service"
+)
+
+type Client struct {
+	config     *config.AppConfig
+	httpClient *http.Client
+	origin     string
+	apiBase    string
+	tokens     TokenSource
+}
+
+// TokenSource provides the token authorizing API requests.
+type TokenSource interface {
+	// Token returns the token, obtaining one on first use.
+	Token(ctx context.Context) (string, error)
+	// Refresh returns a token replacing rejected, which the API
+	// responded unauthorized to.
+	Refresh(ctx context.Context, rejected string) (string, error)
+}
+
+// NewClient returns a client sending requests to the API at apiBase
+// (e.g. "https://default.any-any.prd.api.max.com") from origin,
+// authorized with tokens if not nil.
+func NewClient(config *config.AppConfig, httpClient *http.Client, origin, apiBase string, tokens TokenSource) *Client {
+	return &Client{
+		config:     config,
+		httpClient: httpClient,
+		origin:     origin,
+		apiBase:    apiBase,
+		tokens:     tokens,
+	}
+}
+
+// do sends the request returned by newReq, with the headers of the
+// origin and the token, if any. If unauthorized, it's sent again with a
+// refreshed token (e.g. expired mid-run). Transient failures, such as
+// throttling (429) when crawling many seasons, are retried with backoff
+// or as long as asked by Retry-After.
+func (c *Client) do(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	var token string
+	if c.tokens != nil {
+		t, err := c.tokens.Token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("token: %w", err)
+		}
+		token = t
+	}
+
+	refreshed := false
+	for try := 0; ; {
+		req, err := newReq()
+		if err != nil {
+			return nil, fmt.Errorf("new: %w", err)
+		}
+
+		req.Header.Set("Origin", c.origin)
+		req.Header.Set("Referer", c.origin+"/")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, err := c.httpClient.Do(req)
+		if err == nil && res.StatusCode == http.StatusUnauthorized && token != "" && !refreshed {
+			res.Body.Close()
+			if token, err = c.tokens.Refresh(ctx, token); err != nil {
+				return nil, fmt.Errorf("refresh token: %w", err)
+			}
+			refreshed = true
+			continue
+		}
+
+		d, retry := service.RetryDelay(c.config, try, res, err)
+		if !retry {
+			if err != nil {
+				return nil, fmt.Errorf("do: %w", err)
+			}
+			return res, nil
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(d):
+		}
+		try++
+	}
+}
+
+// FetchCollection fetches a resource of the CMS collections API.
+// The caller must close the returned body.
+func (c *Client) FetchCollection(ctx context.Context, resource, query string) (io.ReadCloser, error) {
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(
+			ctx,
+			http.MethodGet,
+			c.apiBase+"/cms/collections/"+resource+query,
+			nil,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("status %s", res.Status)
+	}
+
+	return res.Body, nil
+}
+
+// FetchRoute fetches a page of the CMS routes API, by its path (e.g.
+// "collection/..."). The caller must close the returned body.
+func (c *Client) FetchRoute(ctx context.Context, route, query string) (io.ReadCloser, error) {
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(
+			ctx,
+			http.MethodGet,
+			c.apiBase+"/cms/routes/"+route+query,
+			nil,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("status %s", res.Status)
+	}
+
+	return res.Body, nil
+}
+
+// FetchEditIDs fetches the IDs of the edits of a video (e.g. theatrical
+// and extended cuts, or of audio territories), each with a manifest of
+// its own, as of the edits relationship of the content API.
+func (c *Client) FetchEditIDs(ctx context.Context, videoID string) ([]string, error) {
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(
+			ctx,
+			http.MethodGet,
+			c.apiBase+"/content/videos/"+url.PathEscape(videoID)+"?include=edits",
+			nil,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", res.Status)
+	}
+
+	var r struct {
+		Data struct {
+			Relationships struct {
+				Edits struct {
+					Data []struct {
+						ID string `json:"id"`
+					} `json:"data"`
+				} `json:"edits"`
+			} `json:"relationships"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
+	}
+
+	var ids []string
+	for _, e := range r.Data.Relationships.Edits.Data {
+		if e.ID != "" && !slices.Contains(ids, e.ID) {
+			ids = append(ids, e.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no edits")
+	}
+
+	return ids, nil
+}
+
+// ExtractVideoReferences returns the manifest references and duration
+// of the main video of an edit, requesting manifests of formats ("dash"
+// and/or "hls"), or DASH if none. The manifest of each format offered
+// (e.g. also as fallback) is a reference.
+func (c *Client) ExtractVideoReferences(ctx context.Context, editID string, formats ...string) ([]model.Reference, int32, error) {
+	r, err := c.fetchPlaybackInfo(ctx, editID, formats)
+	if err != nil {
+		return nil, 0, fmt.Errorf("fetch playback info %q: %w", editID, err)
+	}
+
+	var (
+		id       string
+		duration int32
+	)
+
+	for _, v := range r.Videos {
+		if v.Type == "main" {
+			id = v.ManifestationID
+			duration = int32(v.Duration)
+			break
+		}
+	}
+
+	if len(formats) == 0 {
+		formats = []string{"dash"}
+	}
+
+	var refs []model.Reference
+	for i, m := range []manifest{r.Manifest, r.Fallback.Manifest} {
+		if m.URL == "" || slices.ContainsFunc(refs, func(ref model.Reference) bool { return ref.URL == m.URL }) {
+			continue
+		}
+		// The fallback is of the same content, only of use without
+		// primary or if of another format asked for (e.g. HLS of DASH).
+		if f := m.format(); i > 0 && len(refs) > 0 &&
+			(!slices.Contains(formats, f) || slices.ContainsFunc(refs, func(ref model.Reference) bool { return ref.Format == f })) {
+			continue
+		}
+		refs = append(refs, model.Reference{
+			ID:     id,
+			Format: m.format(),
+			URL:    m.URL,
+		})
+	}
+	if len(refs) == 0 {
+		return nil, 0, errors.New("no manifest")
+	}
+
+	return refs, duration, nil
+}
+
+type (
+	playbackInfoResponse struct {
+		Videos []struct {
+			ManifestationID string  `json:"manifestationId"`
+			Duration        float64 `json:"duration"`
+			Type            string  `json:"type"`
+		} `json:"videos"`
+
+		Manifest manifest `json:"manifest"`
+		Fallback struct {
+			Manifest manifest `json:"manifest"`
+		} `json:"fallback"`
+	}
+
+	manifest struct {
+		Format string `json:"format"`
+		URL    string `json:"url"`
+	}
+)
+
+// format returns the format of m ("dash" or "hls"), if not labeled by
+// the extension of its URL.
+func (m manifest) format() string {
+	if f := strings.ToLower(m.Format); f != "" {
+		return f
+	}
+	p := m.URL
+	if u, err := url.Parse(m.URL); err == nil {
+		p = u.Path
+	}
+	switch path.Ext(p) {
+	case ".mpd":
+		return "dash"
+	case ".m3u8":
+		return "hls"
+	}
+	return ""
+}
+
+func (c *Client) fetchPlaybackInfo(ctx context.Context, editID string, formats []string) (*playbackInfoResponse, error) {
+	const fmtQuery = `{"editId": "%s", "appBundle": "", "consumptionType": "streaming",
+		"deviceInfo": {"player": {"sdk": {"name": "", "version": ""}, "mediaEngine": {
+		"name": "", "version": ""}, "playerView": {"height": 2160, "width": 3840}}},
+		"capabilities": {"manifests": {"formats": {%s}}, "codecs": {"audio": {
+		"decoders": [{"codec": "avc", "profiles": ["lc", "hev", "hev2"]}]}, "video": {
+		"decoders": [{"codec": "h264", "profiles": ["high", "main", "baseline"],
+		"maxLevel": "5.2", "levelConstraints": {"width": {"min": 0, "max": 3840},
+		"height": {"min": 0, "max": 2160}, "framerate": {"min": 0, "max": 60}}}],
+		"hdrFormats": []}}}, "gdpr": false, "firstPlay": false, "playbackSessionId": "",
+		"applicationSessionId": "", "userPreferences": { "videoQuality": "best"}}`
+
+	body := fmt.Sprintf(fmtQuery, editID, manifestFormats(formats))
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(
+			ctx,
+			http.MethodPost,
+			c.apiBase+"/any/playback/v1/playbackInfo",
+			strings.NewReader(body),
+		)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, c.playbackError(res)
+	}
+
+	var r playbackInfoResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
+	}
+
+	return &r, nil
+}
+
+// playbackError returns the error of an unsuccessful playback response,
+// with the codes of its body, if any, as geo-blocked if one is (e.g.
+// access.denied.geoblocked), or as not entitled (e.g.
+// access.denied.missingpackage).
+func (c *Client) playbackError(res *http.Response) error {
+	var r struct {
+		Errors []struct {
+			Code   string `json:"code"`
+			Detail string `json:"detail"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<16)).Decode(&r); err != nil || len(r.Errors) == 0 {
+		return fmt.Errorf("status %s", res.Status)
+	}
+
+	codes := make([]string, len(r.Errors))
+	for i, e := range r.Errors {
+		code := strings.ToLower(e.Code)
+		if strings.Contains(code, "geo") {
+			return fmt.Errorf("status %s: %w", res.Status, &service.GeoBlockedError{Country: c.config.CountryCode, Reason: e.Code})
+		}
+		if isEntitlementCode(code) {
+			return fmt.Errorf("status %s: %w", res.Status, &service.NotEntitledError{Reason: e.Code})
+		}
+		codes[i] = e.Code
+	}
+	return fmt.Errorf("status %s: %s", res.Status, strings.Join(codes, ", "))
+}
+
+// isEntitlementCode returns whether the (lower case) error code of a
+// playback response refuses content not in the plan of the account, or
+// of no account.
+func isEntitlementCode(code string) bool {
+	for _, s := range []string{"missingpackage", "entitlement", "subscription"} {
+		if strings.Contains(code, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestFormats returns the manifest capabilities of formats, as the
+// members of a JSON object.
+func manifestFormats(formats []string) string {
+	if len(formats) == 0 {
+		formats = []string{"dash"}
+	}
+	members := make([]string, len(formats))
+	for i, f := range formats {
+		members[i] = fmt.Sprintf("%q: {}", f)
+	}
+	return strings.Join(members, ", ")
+}
@@ -0,0 +1,194 @@
+package wbd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"karl/pkg/config"
+	"karl/pkg/model"
+	"karl/pkg/service"
+	"karl/pkg/service/internal/servicetest"
+)
+
+// newTestClient returns a client responded to playback requests with the
+// fixture at path, keeping the capabilities requested in body.
+func newTestClient(t *testing.T, path string, body *string) *Client {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewClient(&config.AppConfig{}, &http.Client{Transport: servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		req, _ := io.ReadAll(r.Body)
+		*body = string(req)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(string(b))),
+		}, nil
+	})}, "https://play.max.com", "https://default.any-any.prd.api.max.com", nil)
+}
+
+func TestExtractVideoReferences(t *testing.T) {
+	const (
+		dash     = "https://akm.prd.media.h264.io/r/e48f3f6c/x/dash/manifest.mpd"
+		hls      = "https://akm.prd.media.h264.io/r/e48f3f6c/x/hls/manifest.m3u8"
+		fallback = "https://fly.prd.media.h264.io/r/e48f3f6c/x/dash/manifest.mpd"
+	)
+	for _, tt := range []struct {
+		name         string
+		fixture      string
+		formats      []string
+		capabilities string
+		want         []model.Reference
+	}{
+		{
+			name:         "dash only",
+			fixture:      "playbackinfo.json",
+			capabilities: `"formats": {"dash": {}}`,
+			want:         []model.Reference{{ID: "06a38397", Format: "dash", URL: dash}},
+		},
+		{
+			name:         "both",
+			fixture:      "playbackinfo.json",
+			formats:      []string{"dash", "hls"},
+			capabilities: `"formats": {"dash": {}, "hls": {}}`,
+			want: []model.Reference{
+				{ID: "06a38397", Format: "dash", URL: dash},
+				{ID: "06a38397", Format: "hls", URL: hls},
+			},
+		},
+		{
+			name:         "no primary",
+			fixture:      "playbackinfo_nomanifest.json",
+			capabilities: `"formats": {"dash": {}}`,
+			want:         []model.Reference{{ID: "06a38397", Format: "dash", URL: fallback}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var body string
+			c := newTestClient(t, "../../../testdata/wbd/"+tt.fixture, &body)
+
+			refs, duration, err := c.ExtractVideoReferences(context.Background(), "edit", tt.formats...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(body, tt.capabilities) {
+				t.Errorf("capabilities not %s: %s", tt.capabilities, body)
+			}
+			if duration != 2672 {
+				t.Errorf("duration = %d, want 2672", duration)
+			}
+			if len(refs) != len(tt.want) {
+				t.Fatalf("references = %+v, want %+v", refs, tt.want)
+			}
+			for i := range refs {
+				if refs[i].ID != tt.want[i].ID || refs[i].Format != tt.want[i].Format || refs[i].URL != tt.want[i].URL {
+					t.Errorf("reference %d = %+v, want %+v", i, refs[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestPlaybackInfoRequest pins the playback request to the one Max sent
+// before it was shared, byte for byte.
+func TestPlaybackInfoRequest(t *testing.T) {
+	want, err := os.ReadFile("../../../testdata/wbd/playbackrequest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	playback, err := os.ReadFile("../../../testdata/wbd/playbackinfo.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var req *http.Request
+	c := NewClient(&config.AppConfig{}, &http.Client{Transport: servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		req = r
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != string(want) {
+			t.Errorf("body:\n%s\nwant:\n%s", body, want)
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(string(playback))),
+		}, nil
+	})}, "https://play.max.com", "https://default.any-any.prd.api.max.com", nil)
+
+	if _, _, err := c.ExtractVideoReferences(context.Background(), "edit"); err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != http.MethodPost || req.URL.String() != "https://default.any-any.prd.api.max.com/any/playback/v1/playbackInfo" {
+		t.Errorf("request %s %s, want POST of the playback info", req.Method, req.URL)
+	}
+	for k, v := range map[string]string{
+		"Content-Type": "application/json",
+		"Origin":       "https://play.max.com",
+		"Referer":      "https://play.max.com/",
+	} {
+		if got := req.Header.Get(k); got != v {
+			t.Errorf("%s %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestFetchCollectionThrottled(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		retries  int
+		burst    int32
+		attempts int32
+		wantErr  string
+	}{
+		{"burst", 5, 3, 4, ""},
+		{"retries exhausted", 2, 10, 3, "429"},
+	} {
+		var attempts atomic.Int32
+		c := NewClient(&config.AppConfig{Retries: tt.retries}, &http.Client{Transport: servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+			if attempts.Add(1) <= tt.burst {
+				return &http.Response{
+					StatusCode: http.StatusTooManyRequests,
+					Status:     "429 Too Many Requests",
+					Header:     http.Header{"Retry-After": {"0"}},
+					Body:       http.NoBody,
+				}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+		})}, "https://play.max.com", "https://default.any-any.prd.api.max.com", nil)
+
+		body, err := c.FetchCollection(context.Background(), "generic-show-page-rail-episodes-tabbed-content", "")
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			body.Close()
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error %v, want %s", tt.name, err, tt.wantErr)
+		}
+		if n := attempts.Load(); n != tt.attempts {
+			t.Errorf("%s: %d attempts, want %d", tt.name, n, tt.attempts)
+		}
+	}
+}
+
+func TestPlaybackErrorNotEntitled(t *testing.T) {
+	c := NewClient(&config.AppConfig{}, &http.Client{Transport: servicetest.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			Status:     "403 Forbidden",
+			StatusCode: http.StatusForbidden,
+			Body:       io.NopCloser(strings.NewReader(`{"errors":[{"code":"access.denied.missingpackage","detail":"Missing package"}]}`)),
+		}, nil
+	})}, "https://play.max.com", "https://default.any-any.prd.api.max.com", nil)
+
+	_, _, err := c.ExtractVideoReferences(context.Background(), "edit")
+	var ne *service.NotEntitledError
+	if !errors.As(err, &ne) || ne.Reason != "access.denied.missingpackage" {
+		t.Errorf("err = %v, want not entitled", err)
+	}
+}
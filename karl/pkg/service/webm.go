@@ -0,0 +1,309 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// EBML (Matroska/WebM) element IDs, including their marker bits.
+const (
+	ebmlIDSegment            = 0x18538067
+	ebmlIDInfo               = 0x1549A966
+	ebmlIDTimecodeScale      = 0x2AD7B1
+	ebmlIDDuration           = 0x4489
+	ebmlIDCues               = 0x1C53BB6B
+	ebmlIDCuePoint           = 0xBB
+	ebmlIDCueTime            = 0xB3
+	ebmlIDCueTrackPositions  = 0xB7
+	ebmlIDCueClusterPosition = 0xF1
+	ebmlIDCluster            = 0x1F43B675
+)
+
+const ebmlUnknownSize = -1
+
+type webmCuePoint struct {
+	time     uint64
+	position uint64
+}
+
+// webmIndex is what's needed from a WebM file to size and time its
+// clusters: the Segment (its data offset within the file and size, if
+// known), Info and Cues elements.
+type webmIndex struct {
+	segmentOffset int64
+	segmentSize   int64
+	timecodeScale uint64
+	duration      float64
+	cuePoints     []webmCuePoint
+}
+
+func newWebMIndex() *webmIndex {
+	return &webmIndex{
+		segmentOffset: -1,
+		segmentSize:   ebmlUnknownSize,
+		timecodeScale: 1_000_000,
+	}
+}
+
+// parse walks the elements of raw, read from offset of the file, into
+// the Segment and through its children until the first Cluster. Both
+// the header (up to and including Info) and the Cues, wherever located,
+// are picked up.
+func (w *webmIndex) parse(raw []byte, offset int64) error {
+	for pos := 0; pos < len(raw); {
+		id, size, n, err := readEBMLElementHeader(raw[pos:])
+		if err != nil {
+			return err
+		}
+		pos += n
+
+		switch id {
+		case ebmlIDSegment:
+			// Descend into the children.
+			w.segmentOffset = offset + int64(pos)
+			w.segmentSize = size
+			continue
+		case ebmlIDCluster:
+			return nil
+		}
+
+		if size == ebmlUnknownSize || pos+int(size) > len(raw) {
+			// Only Info and Cues need to be complete.
+			if id == ebmlIDInfo || id == ebmlIDCues {
+				return fmt.Errorf("element %x truncated", id)
+			}
+			return nil
+		}
+		body := raw[pos : pos+int(size)]
+		pos += int(size)
+
+		switch id {
+		case ebmlIDInfo:
+			if err := w.parseInfo(body); err != nil {
+				return fmt.Errorf("info: %w", err)
+			}
+		case ebmlIDCues:
+			if err := w.parseCues(body); err != nil {
+				return fmt.Errorf("cues: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (w *webmIndex) parseInfo(raw []byte) error {
+	return walkEBMLElements(raw, func(id uint64, body []byte) error {
+		switch id {
+		case ebmlIDTimecodeScale:
+			w.timecodeScale = readEBMLUint(body)
+		case ebmlIDDuration:
+			d, err := readEBMLFloat(body)
+			if err != nil {
+				return fmt.Errorf("duration: %w", err)
+			}
+			w.duration = d
+		}
+		return nil
+	})
+}
+
+func (w *webmIndex) parseCues(raw []byte) error {
+	return walkEBMLElements(raw, func(id uint64, body []byte) error {
+		if id != ebmlIDCuePoint {
+			return nil
+		}
+
+		var (
+			cp          webmCuePoint
+			hasPosition bool
+		)
+		err := walkEBMLElements(body, func(id uint64, body []byte) error {
+			switch id {
+			case ebmlIDCueTime:
+				cp.time = readEBMLUint(body)
+			case ebmlIDCueTrackPositions:
+				// The first track's position is used, the cluster is
+				// shared between tracks.
+				if hasPosition {
+					return nil
+				}
+				return walkEBMLElements(body, func(id uint64, body []byte) error {
+					if id == ebmlIDCueClusterPosition {
+						cp.position = readEBMLUint(body)
+						hasPosition = true
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !hasPosition {
+			return errors.New("cue point without cluster position")
+		}
+
+		// Cue points of the same cluster are merged.
+		if l := len(w.cuePoints); l > 0 && w.cuePoints[l-1].position == cp.position {
+			return nil
+		}
+		w.cuePoints = append(w.cuePoints, cp)
+		return nil
+	})
+}
+
+// fingerprint converts the cue points into cluster sizes and durations.
+// The end of the last cluster is the end of the Segment, which if of
+// unknown size is given by fileSize (or else an error).
+func (w *webmIndex) fingerprint(fileSize func() (int64, error)) (timescale uint32, sizes []uint32, durations []uint32, err error) {
+	if w.segmentOffset < 0 {
+		return 0, nil, nil, errors.New("segment not found")
+	}
+	if len(w.cuePoints) == 0 {
+		return 0, nil, nil, errors.New("no cue points")
+	}
+	if w.timecodeScale == 0 || 1_000_000_000%w.timecodeScale != 0 {
+		return 0, nil, nil, fmt.Errorf("unsupported timecode scale %d", w.timecodeScale)
+	}
+	if w.duration == 0 {
+		return 0, nil, nil, errors.New("no duration")
+	}
+
+	end := w.segmentSize
+	if end == ebmlUnknownSize {
+		size, err := fileSize()
+		if err != nil {
+			return 0, nil, nil, fmt.Errorf("file size: %w", err)
+		}
+		end = size - w.segmentOffset
+	}
+
+	var (
+		n   = len(w.cuePoints)
+		cps = append(w.cuePoints, webmCuePoint{
+			time:     uint64(math.Round(w.duration)),
+			position: uint64(end),
+		})
+	)
+	sizes = make([]uint32, n)
+	durations = make([]uint32, n)
+	for i := range n {
+		cur, next := cps[i], cps[i+1]
+		if next.position <= cur.position || next.time < cur.time {
+			return 0, nil, nil, fmt.Errorf("cue point %d: not increasing", i)
+		}
+		if next.position-cur.position > math.MaxUint32 {
+			return 0, nil, nil, errors.New("cluster size > uint32")
+		}
+		if next.time-cur.time > math.MaxUint32 {
+			return 0, nil, nil, errors.New("cluster duration > uint32")
+		}
+		sizes[i] = uint32(next.position - cur.position)
+		durations[i] = uint32(next.time - cur.time)
+	}
+
+	return uint32(1_000_000_000 / w.timecodeScale), sizes, durations, nil
+}
+
+// offsets returns the offsets of the clusters of the cue points within
+// the file.
+func (w *webmIndex) offsets() []int64 {
+	offsets := make([]int64, len(w.cuePoints))
+	for i, cp := range w.cuePoints {
+		offsets[i] = w.segmentOffset + int64(cp.position)
+	}
+	return offsets
+}
+
+// walkEBMLElements calls fn for each (complete) element of raw.
+func walkEBMLElements(raw []byte, fn func(id uint64, body []byte) error) error {
+	for pos := 0; pos < len(raw); {
+		id, size, n, err := readEBMLElementHeader(raw[pos:])
+		if err != nil {
+			return err
+		}
+		pos += n
+		if size == ebmlUnknownSize || pos+int(size) > len(raw) {
+			return fmt.Errorf("element %x truncated", id)
+		}
+		if err := fn(id, raw[pos:pos+int(size)]); err != nil {
+			return err
+		}
+		pos += int(size)
+	}
+	return nil
+}
+
+// readEBMLElementHeader reads the ID (with marker bits) and data size of
+// an element, also returning the length of both.
+func readEBMLElementHeader(raw []byte) (id uint64, size int64, n int, err error) {
+	_, idLen, err := readEBMLVint(raw, 4)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("element id: %w", err)
+	}
+	id = readEBMLUint(raw[:idLen])
+
+	sizeVal, sizeLen, err := readEBMLVint(raw[idLen:], 8)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("element %x size: %w", id, err)
+	}
+	size = int64(sizeVal)
+	if sizeVal == 1<<(7*sizeLen)-1 {
+		size = ebmlUnknownSize
+	} else if sizeVal > math.MaxInt32 {
+		return 0, 0, 0, fmt.Errorf("element %x size too large", id)
+	}
+
+	return id, size, idLen + sizeLen, nil
+}
+
+// readEBMLVint reads a variable size integer of at most maxLen bytes,
+// returning its value without marker bit and its length.
+func readEBMLVint(raw []byte, maxLen int) (uint64, int, error) {
+	if len(raw) == 0 {
+		return 0, 0, errors.New("unexpected end")
+	}
+
+	n := 1
+	for mask := byte(0x80); n <= maxLen && raw[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > maxLen {
+		return 0, 0, errors.New("invalid length")
+	}
+	if len(raw) < n {
+		return 0, 0, errors.New("unexpected end")
+	}
+
+	v := uint64(raw[0] & (0xFF >> n))
+	for _, b := range raw[1:n] {
+		v = v<<8 | uint64(b)
+	}
+
+	return v, n, nil
+}
+
+func readEBMLUint(raw []byte) uint64 {
+	var v uint64
+	for _, b := range raw {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func readEBMLFloat(raw []byte) (float64, error) {
+	switch len(raw) {
+	case 0:
+		return 0, nil
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), nil
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), nil
+	default:
+		return 0, fmt.Errorf("invalid float length %d", len(raw))
+	}
+}